@@ -41,12 +41,18 @@ type CachePhase string
 type CacheSpec struct {
 	//BaseCacheName string `json:"baseCacheName,omitempty"`
 	ReadOnly bool `json:"readOnly,omitempty"`
+	// ResetGeneration requests the cache to be reset when changed.
+	// Local images on all nodes as well as the registry image are dropped.
+	ResetGeneration int64 `json:"resetGeneration,omitempty"`
 }
 
 // CacheStatus defines the observed state of Cache
 type CacheStatus struct {
-	Image           string       `json:"image,omitempty"`
-	CacheGeneration int64        `json:"cacheGeneration,omitempty"`
+	Image           string `json:"image,omitempty"`
+	CacheGeneration int64  `json:"cacheGeneration,omitempty"`
+	// ImageGeneration is the generation of the latest image that has been pushed to the registry.
+	// It is 0 if generations are not tagged.
+	ImageGeneration int64        `json:"imageGeneration,omitempty"`
 	LastImageID     *string      `json:"lastImageID,omitempty"`
 	LastUsed        *metav1.Time `json:"lastUsed,omitempty"`
 	LastWritten     *metav1.Time `json:"lastWritten,omitempty"`
@@ -62,8 +68,10 @@ type CacheStatus struct {
 
 // NodeStatus defines the observed state of a cache on a node
 type NodeStatus struct {
-	Name            string         `json:"name"`
-	CacheGeneration int64          `json:"cacheGeneration,omitempty"`
+	Name            string `json:"name"`
+	CacheGeneration int64  `json:"cacheGeneration,omitempty"`
+	// ResetGeneration is the reset generation the node's local images have been dropped for
+	ResetGeneration int64          `json:"resetGeneration,omitempty"`
 	LastUsed        metav1.Time    `json:"lastUsed"`
 	LastImageID     string         `json:"lastImageID,omitempty"`
 	Volumes         []VolumeStatus `json:"volumes,omitempty"`
@@ -87,6 +95,7 @@ type VolumeStatus struct {
 }
 
 type ResetStatus struct {
+	ResetGeneration int64       `json:"resetGeneration,omitempty"`
 	CacheGeneration int64       `json:"cacheGeneration"`
 	ResetTime       metav1.Time `json:"resetTime"`
 }
@@ -0,0 +1,76 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	ConditionSnapshotReady = "Ready"
+	// AnnotationSnapshot specifies the CacheSnapshot a PersistentVolumeClaim's volume should be restored from
+	AnnotationSnapshot = "k8storagex.mgoltzsche.github.com/snapshot"
+)
+
+// CacheSnapshotSpec defines the desired state of CacheSnapshot
+type CacheSnapshotSpec struct {
+	// PersistentVolumeClaimName is the name of the claim within the same namespace whose volume should be snapshotted
+	PersistentVolumeClaimName string `json:"persistentVolumeClaimName"`
+}
+
+// CacheSnapshotStatus defines the observed state of CacheSnapshot
+type CacheSnapshotStatus struct {
+	// ReadyToUse indicates whether the snapshot has been created and can be used to provision new volumes
+	ReadyToUse bool `json:"readyToUse,omitempty"`
+	// Provisioner is the name of the StorageProvisioner that created the snapshot
+	Provisioner string `json:"provisioner,omitempty"`
+	// NodeName is the name of the node the snapshot has been created on
+	NodeName string `json:"nodeName,omitempty"`
+	// PersistentVolumeName is the name of the snapshotted PersistentVolume
+	PersistentVolumeName string `json:"persistentVolumeName,omitempty"`
+	// CreationTime is the time the snapshot has been created
+	CreationTime *metav1.Time       `json:"creationTime,omitempty"`
+	Conditions   []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="PVC",type=string,JSONPath=`.spec.persistentVolumeClaimName`
+// +kubebuilder:printcolumn:name="Ready",type=boolean,JSONPath=`.status.readyToUse`
+// +kubebuilder:printcolumn:name="Node",type=string,JSONPath=`.status.nodeName`
+
+// CacheSnapshot is the Schema for the cachesnapshots API
+type CacheSnapshot struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   CacheSnapshotSpec   `json:"spec,omitempty"`
+	Status CacheSnapshotStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// CacheSnapshotList contains a list of CacheSnapshot
+type CacheSnapshotList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []CacheSnapshot `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&CacheSnapshot{}, &CacheSnapshotList{})
+}
@@ -22,11 +22,41 @@ import (
 )
 
 const (
-	ConditionConfigured                         = "Configured"
+	ConditionConfigured = "Configured"
+	Enabled             = "true"
+
+	// AnnotationPersistentVolumeClaimNoProtection marked a PersistentVolumeClaim whose Pods completed.
+	// Claims that carry it are treated as used by a Pod that completed and deleted once the volume has been unmounted.
+	//
+	// Deprecated: the manager marks claims that have been used by a Pod internally and does not set it anymore.
 	AnnotationPersistentVolumeClaimNoProtection = "k8storagex.mgoltzsche.github.com/no-pvc-protection"
-	Enabled                                     = "true"
+
+	// AnnotationProvisioningPhase exposes the provisioning phase of a PersistentVolumeClaim
+	AnnotationProvisioningPhase = "k8storagex.mgoltzsche.github.com/provisioning-phase"
+	// AnnotationProvisionerPod exposes the name of the provisioner Pod or Job within the manager namespace
+	AnnotationProvisionerPod = "k8storagex.mgoltzsche.github.com/provisioner-pod"
+	// AnnotationProvisionerNode exposes the node a PersistentVolumeClaim's volume is provisioned on
+	AnnotationProvisionerNode = "k8storagex.mgoltzsche.github.com/provisioner-node"
+	// AnnotationProvisionerNodes exposes the comma-separated nodes a ReadOnlyMany PersistentVolumeClaim's volume is provisioned on
+	AnnotationProvisionerNodes = "k8storagex.mgoltzsche.github.com/provisioner-nodes"
+	// AnnotationProvisionerPath exposes the host path of a PersistentVolumeClaim's volume
+	AnnotationProvisionerPath = "k8storagex.mgoltzsche.github.com/provisioner-path"
+	// AnnotationReclaim lets the manager delete and deprovision a released PersistentVolume with reclaim policy Retain when set to "true"
+	AnnotationReclaim = "k8storagex.mgoltzsche.github.com/reclaim"
+	// AnnotationProvisionerCache exposes the name of the Cache a PersistentVolumeClaim's volume has been initialized with
+	AnnotationProvisionerCache = "k8storagex.mgoltzsche.github.com/provisioner-cache"
+	// AnnotationCacheGeneration exposes the cache generation a PersistentVolumeClaim's volume has been initialized with
+	AnnotationCacheGeneration = "k8storagex.mgoltzsche.github.com/cache-generation"
+
+	ProvisioningPhaseWaitingForNode ProvisioningPhase = "waiting-for-node"
+	ProvisioningPhaseProvisioning   ProvisioningPhase = "provisioning"
+	ProvisioningPhaseProvisioned    ProvisioningPhase = "provisioned"
+	ProvisioningPhaseFailed         ProvisioningPhase = "failed"
 )
 
+// ProvisioningPhase is the value of a PersistentVolumeClaim's AnnotationProvisioningPhase
+type ProvisioningPhase string
+
 // EDIT THIS FILE!  THIS IS SCAFFOLDING FOR YOU TO OWN!
 // NOTE: json tags are required.  Any new fields you add must have json tags for the fields to be serialized.
 
@@ -39,8 +69,82 @@ type StorageProvisionerSpec struct {
 	Containers                 Containers                  `json:"containers"`
 	Env                        []EnvVar                    `json:"env,omitempty"`
 	Nodes                      []NodePath                  `json:"nodes,omitempty"`
+	Agent                      *AgentSpec                  `json:"agent,omitempty"`
+	// ReadOnlyMany enables provisioning ReadOnlyMany claims.
+	// Their volume is provisioned on every eligible node that maps the same storage root path
+	// with the env var STORAGE_READ_ONLY_MANY=true and the PersistentVolume's node affinity covers all of these nodes.
+	ReadOnlyMany bool `json:"readOnlyMany,omitempty"`
+	// Audit configures the periodic orphan detection on the nodes using the auditor container.
+	Audit *AuditSpec `json:"audit,omitempty"`
+	// JobPolicy specifies timeouts and retries of the Pods that are run for the provisioner's containers.
+	JobPolicy `json:",inline"`
+	// TemplateMode specifies how placeholders within the templates are substituted.
+	// envsubst (default) supports ${VAR} expressions only, gotemplate additionally renders each string as Go text/template.
+	// +kubebuilder:validation:Enum=envsubst;gotemplate
+	TemplateMode TemplateMode `json:"templateMode,omitempty"`
+	// ClaimPlaceholders lists the PersistentVolumeClaim labels and annotations that are provided to the templates.
+	// Since their values are written by the claim's author they must be used carefully.
+	ClaimPlaceholders *ClaimPlaceholders `json:"claimPlaceholders,omitempty"`
+}
+
+// ClaimPlaceholders specifies the PersistentVolumeClaim labels and annotations that are provided
+// as STORAGE_PVC_LABEL_<KEY> and STORAGE_PVC_ANNOTATION_<KEY> placeholders.
+type ClaimPlaceholders struct {
+	Labels      []string `json:"labels,omitempty"`
+	Annotations []string `json:"annotations,omitempty"`
+}
+
+// TemplateMode specifies the templating language used within the templates
+type TemplateMode string
+
+const (
+	TemplateModeEnvsubst   TemplateMode = "envsubst"
+	TemplateModeGoTemplate TemplateMode = "gotemplate"
+)
+
+// AgentSpec specifies a node-local agent that is called to provision and deprovision volumes instead of running a Pod per volume
+type AgentSpec struct {
+	// PodSelector selects the agent Pods within the manager namespace
+	PodSelector map[string]string `json:"podSelector"`
+	// Port is the agent's HTTP API port
+	Port int32 `json:"port"`
 }
 
+// AuditSpec configures the periodic audit of the volumes on the nodes
+type AuditSpec struct {
+	// Interval specifies how often a node is audited (defaults to 1h).
+	Interval *metav1.Duration `json:"interval,omitempty"`
+	// DeleteOrphansAfter enables the deletion of orphans that have been detected for longer than the given duration.
+	DeleteOrphansAfter *metav1.Duration `json:"deleteOrphansAfter,omitempty"`
+}
+
+// JobPolicy specifies how long a provisioner Pod may take and how often it is retried
+type JobPolicy struct {
+	// ActiveDeadlineSeconds is the duration in seconds a Pod may be pending or running before it is failed.
+	// +kubebuilder:validation:Minimum=1
+	ActiveDeadlineSeconds *int64 `json:"activeDeadlineSeconds,omitempty"`
+	// BackoffLimit is the number of times a failed Pod is recreated (defaults to 3).
+	// +kubebuilder:validation:Minimum=0
+	BackoffLimit *int32 `json:"backoffLimit,omitempty"`
+	// RetryBackoff is the delay before a failed Pod is recreated, doubled with every retry (defaults to 10s).
+	RetryBackoff *metav1.Duration `json:"retryBackoff,omitempty"`
+	// Workload specifies whether the containers are run as bare Pod (default) or as batch/v1 Job.
+	// A Job retries failed Pods itself and survives node drains.
+	// +kubebuilder:validation:Enum=Pod;Job
+	Workload Workload `json:"workload,omitempty"`
+	// TTLSecondsAfterFinished limits the lifetime of a finished Job.
+	// A failed Job that is removed by the TTL is created again.
+	TTLSecondsAfterFinished *int32 `json:"ttlSecondsAfterFinished,omitempty"`
+}
+
+// Workload specifies the kind of resource a provisioner container is run as
+type Workload string
+
+const (
+	WorkloadPod Workload = "Pod"
+	WorkloadJob Workload = "Job"
+)
+
 // EnvVar maps an annotation value to an env var that is provided to the de/provisioner Pod
 type EnvVar struct {
 	Name       string `json:"name"`
@@ -56,8 +160,31 @@ type NodePath struct {
 
 // Containers specifies the parameters used with the PodTemplate to create the Pods to handle the storage lifecycle
 type Containers struct {
-	Provisioner   ProvisionerContainer `json:"provisioner"`
+	Provisioner ProvisionerContainer `json:"provisioner"`
+	// Deprovisioner is run to delete a volume.
+	// It is also run when a claim is deleted before its provisioner completed,
+	// indicated by the env var STORAGE_PROVISIONING_INTERRUPTED=true.
 	Deprovisioner ProvisionerContainer `json:"deprovisioner"`
+	// Expander is run to expand a bound volume when its PersistentVolumeClaim requests more storage.
+	// ${STORAGE_CAPACITY} is substituted with the requested capacity, the env var STORAGE_PREVIOUS_CAPACITY holds the current one.
+	// Expansion is not supported if it is not specified.
+	Expander *ProvisionerContainer `json:"expander,omitempty"`
+	// Snapshotter is run to create a CacheSnapshot of a volume.
+	// The env vars STORAGE_SNAPSHOT_NAME and STORAGE_SNAPSHOT_NAMESPACE specify the snapshot.
+	// They are also provided to the provisioner when a volume is restored from a snapshot.
+	// Snapshots are not supported if it is not specified.
+	Snapshotter *ProvisionerContainer `json:"snapshotter,omitempty"`
+	// SnapshotDeleter is run to delete a CacheSnapshot's data.
+	SnapshotDeleter *ProvisionerContainer `json:"snapshotDeleter,omitempty"`
+	// Auditor is run periodically on every node to detect orphaned volumes.
+	// The env var STORAGE_VOLUMES holds the space-separated names of the volumes that are known on the node,
+	// STORAGE_DELETE_ORPHANS the names of the orphans that should be deleted.
+	// The auditor must write the names of the remaining orphans line by line to /dev/termination-log.
+	Auditor *ProvisionerContainer `json:"auditor,omitempty"`
+	// Releaser is run once when a PersistentVolume with reclaim policy Retain has been released by its claim.
+	// It must keep the volume's data since the volume may still be reclaimed later.
+	// The deprovisioner of a released volume is run with the env var STORAGE_VOLUME_RELEASED=true.
+	Releaser *ProvisionerContainer `json:"releaser,omitempty"`
 }
 
 // ProvisionerContainer specifies a container that is merged with a Pod template
@@ -69,6 +196,25 @@ type ProvisionerContainer struct {
 // StorageProvisionerStatus defines the observed state of StorageProvisioner
 type StorageProvisionerStatus struct {
 	Conditions []metav1.Condition `json:"conditions,omitempty"`
+	// Nodes holds the result of the last audit per node.
+	Nodes []NodeAudit `json:"nodes,omitempty"`
+}
+
+// NodeAudit is the result of a node's last audit
+type NodeAudit struct {
+	Name      string      `json:"name"`
+	LastAudit metav1.Time `json:"lastAudit"`
+	// Orphans are the volumes on the node without a matching PersistentVolume.
+	Orphans []Orphan `json:"orphans,omitempty"`
+	// LastError is the error the last audit failed with.
+	LastError string `json:"lastError,omitempty"`
+}
+
+// Orphan is a volume on a node without a matching PersistentVolume
+type Orphan struct {
+	Name string `json:"name"`
+	// Since is the time the orphan has been detected first.
+	Since metav1.Time `json:"since"`
 }
 
 // +kubebuilder:object:root=true
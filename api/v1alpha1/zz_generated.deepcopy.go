@@ -1,3 +1,4 @@
+//go:build !ignore_autogenerated
 // +build !ignore_autogenerated
 
 /*
@@ -26,6 +27,53 @@ import (
 	runtime "k8s.io/apimachinery/pkg/runtime"
 )
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *AgentSpec) DeepCopyInto(out *AgentSpec) {
+	*out = *in
+	if in.PodSelector != nil {
+		in, out := &in.PodSelector, &out.PodSelector
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AgentSpec.
+func (in *AgentSpec) DeepCopy() *AgentSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(AgentSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *AuditSpec) DeepCopyInto(out *AuditSpec) {
+	*out = *in
+	if in.Interval != nil {
+		in, out := &in.Interval, &out.Interval
+		*out = new(v1.Duration)
+		**out = **in
+	}
+	if in.DeleteOrphansAfter != nil {
+		in, out := &in.DeleteOrphansAfter, &out.DeleteOrphansAfter
+		*out = new(v1.Duration)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AuditSpec.
+func (in *AuditSpec) DeepCopy() *AuditSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(AuditSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *Cache) DeepCopyInto(out *Cache) {
 	*out = *in
@@ -85,6 +133,106 @@ func (in *CacheList) DeepCopyObject() runtime.Object {
 	return nil
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CacheSnapshot) DeepCopyInto(out *CacheSnapshot) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	out.Spec = in.Spec
+	in.Status.DeepCopyInto(&out.Status)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CacheSnapshot.
+func (in *CacheSnapshot) DeepCopy() *CacheSnapshot {
+	if in == nil {
+		return nil
+	}
+	out := new(CacheSnapshot)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *CacheSnapshot) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CacheSnapshotList) DeepCopyInto(out *CacheSnapshotList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]CacheSnapshot, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CacheSnapshotList.
+func (in *CacheSnapshotList) DeepCopy() *CacheSnapshotList {
+	if in == nil {
+		return nil
+	}
+	out := new(CacheSnapshotList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *CacheSnapshotList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CacheSnapshotSpec) DeepCopyInto(out *CacheSnapshotSpec) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CacheSnapshotSpec.
+func (in *CacheSnapshotSpec) DeepCopy() *CacheSnapshotSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(CacheSnapshotSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CacheSnapshotStatus) DeepCopyInto(out *CacheSnapshotStatus) {
+	*out = *in
+	if in.CreationTime != nil {
+		in, out := &in.CreationTime, &out.CreationTime
+		*out = (*in).DeepCopy()
+	}
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]v1.Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CacheSnapshotStatus.
+func (in *CacheSnapshotStatus) DeepCopy() *CacheSnapshotStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(CacheSnapshotStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *CacheSpec) DeepCopyInto(out *CacheSpec) {
 	*out = *in
@@ -147,11 +295,61 @@ func (in *CacheStatus) DeepCopy() *CacheStatus {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ClaimPlaceholders) DeepCopyInto(out *ClaimPlaceholders) {
+	*out = *in
+	if in.Labels != nil {
+		in, out := &in.Labels, &out.Labels
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Annotations != nil {
+		in, out := &in.Annotations, &out.Annotations
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ClaimPlaceholders.
+func (in *ClaimPlaceholders) DeepCopy() *ClaimPlaceholders {
+	if in == nil {
+		return nil
+	}
+	out := new(ClaimPlaceholders)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *Containers) DeepCopyInto(out *Containers) {
 	*out = *in
 	in.Provisioner.DeepCopyInto(&out.Provisioner)
 	in.Deprovisioner.DeepCopyInto(&out.Deprovisioner)
+	if in.Expander != nil {
+		in, out := &in.Expander, &out.Expander
+		*out = new(ProvisionerContainer)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Snapshotter != nil {
+		in, out := &in.Snapshotter, &out.Snapshotter
+		*out = new(ProvisionerContainer)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.SnapshotDeleter != nil {
+		in, out := &in.SnapshotDeleter, &out.SnapshotDeleter
+		*out = new(ProvisionerContainer)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Auditor != nil {
+		in, out := &in.Auditor, &out.Auditor
+		*out = new(ProvisionerContainer)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Releaser != nil {
+		in, out := &in.Releaser, &out.Releaser
+		*out = new(ProvisionerContainer)
+		(*in).DeepCopyInto(*out)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Containers.
@@ -184,6 +382,64 @@ func (in *EnvVar) DeepCopy() *EnvVar {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *JobPolicy) DeepCopyInto(out *JobPolicy) {
+	*out = *in
+	if in.ActiveDeadlineSeconds != nil {
+		in, out := &in.ActiveDeadlineSeconds, &out.ActiveDeadlineSeconds
+		*out = new(int64)
+		**out = **in
+	}
+	if in.BackoffLimit != nil {
+		in, out := &in.BackoffLimit, &out.BackoffLimit
+		*out = new(int32)
+		**out = **in
+	}
+	if in.RetryBackoff != nil {
+		in, out := &in.RetryBackoff, &out.RetryBackoff
+		*out = new(v1.Duration)
+		**out = **in
+	}
+	if in.TTLSecondsAfterFinished != nil {
+		in, out := &in.TTLSecondsAfterFinished, &out.TTLSecondsAfterFinished
+		*out = new(int32)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new JobPolicy.
+func (in *JobPolicy) DeepCopy() *JobPolicy {
+	if in == nil {
+		return nil
+	}
+	out := new(JobPolicy)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *NodeAudit) DeepCopyInto(out *NodeAudit) {
+	*out = *in
+	in.LastAudit.DeepCopyInto(&out.LastAudit)
+	if in.Orphans != nil {
+		in, out := &in.Orphans, &out.Orphans
+		*out = make([]Orphan, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new NodeAudit.
+func (in *NodeAudit) DeepCopy() *NodeAudit {
+	if in == nil {
+		return nil
+	}
+	out := new(NodeAudit)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *NodePath) DeepCopyInto(out *NodePath) {
 	*out = *in
@@ -227,6 +483,22 @@ func (in *NodeStatus) DeepCopy() *NodeStatus {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *Orphan) DeepCopyInto(out *Orphan) {
+	*out = *in
+	in.Since.DeepCopyInto(&out.Since)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Orphan.
+func (in *Orphan) DeepCopy() *Orphan {
+	if in == nil {
+		return nil
+	}
+	out := new(Orphan)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *ProvisionerContainer) DeepCopyInto(out *ProvisionerContainer) {
 	*out = *in
@@ -347,6 +619,22 @@ func (in *StorageProvisionerSpec) DeepCopyInto(out *StorageProvisionerSpec) {
 		*out = make([]NodePath, len(*in))
 		copy(*out, *in)
 	}
+	if in.Agent != nil {
+		in, out := &in.Agent, &out.Agent
+		*out = new(AgentSpec)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Audit != nil {
+		in, out := &in.Audit, &out.Audit
+		*out = new(AuditSpec)
+		(*in).DeepCopyInto(*out)
+	}
+	in.JobPolicy.DeepCopyInto(&out.JobPolicy)
+	if in.ClaimPlaceholders != nil {
+		in, out := &in.ClaimPlaceholders, &out.ClaimPlaceholders
+		*out = new(ClaimPlaceholders)
+		(*in).DeepCopyInto(*out)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new StorageProvisionerSpec.
@@ -369,6 +657,13 @@ func (in *StorageProvisionerStatus) DeepCopyInto(out *StorageProvisionerStatus)
 			(*in)[i].DeepCopyInto(&(*out)[i])
 		}
 	}
+	if in.Nodes != nil {
+		in, out := &in.Nodes, &out.Nodes
+		*out = make([]NodeAudit, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new StorageProvisionerStatus.
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+
+	storageapi "github.com/mgoltzsche/k8storagex/api/v1alpha1"
+	"github.com/spf13/cobra"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var cachesCmd = &cobra.Command{
+	Use:     "caches",
+	Aliases: []string{"cache", "ls"},
+	Short:   "list caches",
+	Args:    cobra.NoArgs,
+	RunE:    runCachesCmd,
+}
+
+func init() {
+	addAllNamespacesFlag(cachesCmd)
+	rootCmd.AddCommand(cachesCmd)
+}
+
+func runCachesCmd(cmd *cobra.Command, _ []string) error {
+	c, namespace, err := newClient()
+	if err != nil {
+		return err
+	}
+	caches := &storageapi.CacheList{}
+	if err = c.List(newContext(), caches, client.InNamespace(listNamespace(namespace))); err != nil {
+		return err
+	}
+	w := newTableWriter(cmd.OutOrStdout())
+	fmt.Fprintln(w, "NAMESPACE\tNAME\tPHASE\tGENERATION\tUSED\tNODES\tVOLUMES\tLAST WRITTEN\tAGE")
+	for _, cache := range caches.Items {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%d\t%d\t%s\t%s\n",
+			cache.Namespace, cache.Name, stringOrNone(string(cache.Status.Phase)),
+			cache.Status.CacheGeneration, cache.Status.Used, len(cache.Status.Nodes), len(cacheVolumes(&cache)),
+			age(cache.Status.LastWritten), age(&cache.CreationTimestamp))
+	}
+	return w.Flush()
+}
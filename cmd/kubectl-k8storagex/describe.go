@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	storageapi "github.com/mgoltzsche/k8storagex/api/v1alpha1"
+	"github.com/spf13/cobra"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+var describeCmd = &cobra.Command{
+	Use:   "describe CACHE",
+	Short: "show the details of a cache",
+	Long:  "Show a cache's nodes, generations, volumes and last errors",
+	Args:  cobra.ExactArgs(1),
+	RunE:  runDescribeCmd,
+}
+
+func init() {
+	rootCmd.AddCommand(describeCmd)
+}
+
+func runDescribeCmd(cmd *cobra.Command, args []string) error {
+	cache, err := getCache(args[0])
+	if err != nil {
+		return err
+	}
+	return describeCache(cmd.OutOrStdout(), cache)
+}
+
+func getCache(name string) (*storageapi.Cache, error) {
+	c, namespace, err := newClient()
+	if err != nil {
+		return nil, err
+	}
+	cache := &storageapi.Cache{}
+	err = c.Get(newContext(), types.NamespacedName{Name: name, Namespace: namespace}, cache)
+	return cache, err
+}
+
+func describeCache(out io.Writer, cache *storageapi.Cache) error {
+	s := &cache.Status
+	lastImageID := ""
+	if s.LastImageID != nil {
+		lastImageID = *s.LastImageID
+	}
+	w := newTableWriter(out)
+	fmt.Fprintf(w, "Name:\t%s\n", cache.Name)
+	fmt.Fprintf(w, "Namespace:\t%s\n", cache.Namespace)
+	fmt.Fprintf(w, "Phase:\t%s\n", stringOrNone(string(s.Phase)))
+	fmt.Fprintf(w, "Read only:\t%v\n", cache.Spec.ReadOnly)
+	fmt.Fprintf(w, "Image:\t%s\n", stringOrNone(s.Image))
+	fmt.Fprintf(w, "Generation:\t%d\n", s.CacheGeneration)
+	fmt.Fprintf(w, "Used:\t%d\n", s.Used)
+	fmt.Fprintf(w, "Last used:\t%s\n", age(s.LastUsed))
+	fmt.Fprintf(w, "Last written:\t%s\n", age(s.LastWritten))
+	fmt.Fprintf(w, "Last image ID:\t%s\n", stringOrNone(lastImageID))
+	if s.LastReset != nil {
+		fmt.Fprintf(w, "Last reset:\t%s (reset generation %d, cache generation %d)\n",
+			age(&s.LastReset.ResetTime), s.LastReset.ResetGeneration, s.LastReset.CacheGeneration)
+	} else {
+		fmt.Fprintf(w, "Last reset:\t<none>\n")
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(out, "Conditions:")
+	w = newTableWriter(out)
+	fmt.Fprintln(w, "  TYPE\tSTATUS\tREASON\tMESSAGE\tAGE")
+	for _, c := range s.Conditions {
+		fmt.Fprintf(w, "  %s\t%s\t%s\t%s\t%s\n", c.Type, c.Status, c.Reason, c.Message, age(&c.LastTransitionTime))
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(out, "Nodes:")
+	w = newTableWriter(out)
+	fmt.Fprintln(w, "  NAME\tGENERATION\tRESET GENERATION\tVOLUMES\tLAST IMAGE ID\tLAST USED")
+	for _, n := range s.Nodes {
+		fmt.Fprintf(w, "  %s\t%d\t%d\t%d\t%s\t%s\n",
+			n.Name, n.CacheGeneration, n.ResetGeneration, len(n.Volumes), stringOrNone(n.LastImageID), age(&n.LastUsed))
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(out, "Last errors:")
+	w = newTableWriter(out)
+	fmt.Fprintln(w, "  NODE\tVOLUME\tGENERATION\tERROR\tAGE")
+	for _, n := range s.Nodes {
+		if e := n.LastError; e != nil {
+			generation := "<none>"
+			if e.CacheGeneration != nil {
+				generation = fmt.Sprintf("%d", *e.CacheGeneration)
+			}
+			fmt.Fprintf(w, "  %s\t%s\t%s\t%s\t%s\n", n.Name, e.VolumeName, generation, e.Error, age(&e.Happened))
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(out, "Volumes:")
+	return printVolumes(out, "  ", cacheVolumes(cache))
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	storageapi "github.com/mgoltzsche/k8storagex/api/v1alpha1"
+	"github.com/spf13/cobra"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var (
+	gcCmd = &cobra.Command{
+		Use:   "gc",
+		Short: "delete unused caches",
+		Long:  "Delete the caches that are not mounted to any volume and have not been used within the specified duration",
+		Args:  cobra.NoArgs,
+		RunE:  runGCCmd,
+	}
+	dryRunFlag bool
+	maxAgeFlag = 7 * 24 * time.Hour
+)
+
+func init() {
+	gcCmd.Flags().BoolVar(&dryRunFlag, "dry-run", false, "only print the caches that would be deleted")
+	gcCmd.Flags().DurationVar(&maxAgeFlag, "max-age", maxAgeFlag, "the duration after which an unused cache is deleted")
+	addAllNamespacesFlag(gcCmd)
+	rootCmd.AddCommand(gcCmd)
+}
+
+func runGCCmd(cmd *cobra.Command, _ []string) error {
+	c, namespace, err := newClient()
+	if err != nil {
+		return err
+	}
+	ctx := newContext()
+	caches := &storageapi.CacheList{}
+	if err = c.List(ctx, caches, client.InNamespace(listNamespace(namespace))); err != nil {
+		return err
+	}
+	out := cmd.OutOrStdout()
+	for i := range caches.Items {
+		cache := &caches.Items[i]
+		lastUsed := cacheLastUsed(cache)
+		if len(cacheVolumes(cache)) > 0 || time.Since(lastUsed.Time) < maxAgeFlag {
+			continue
+		}
+		if dryRunFlag {
+			fmt.Fprintf(out, "cache/%s deleted (dry run, namespace %s, last used %s ago)\n", cache.Name, cache.Namespace, age(&lastUsed))
+			continue
+		}
+		if err = c.Delete(ctx, cache); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "cache/%s deleted (namespace %s, last used %s ago)\n", cache.Name, cache.Namespace, age(&lastUsed))
+	}
+	return nil
+}
+
+// cacheLastUsed returns the time the cache has been used last on any node
+func cacheLastUsed(cache *storageapi.Cache) metav1.Time {
+	lastUsed := cache.CreationTimestamp
+	if cache.Status.LastUsed != nil && cache.Status.LastUsed.After(lastUsed.Time) {
+		lastUsed = *cache.Status.LastUsed
+	}
+	for _, n := range cache.Status.Nodes {
+		if n.LastUsed.After(lastUsed.Time) {
+			lastUsed = n.LastUsed
+		}
+	}
+	return lastUsed
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+
+	storageapi "github.com/mgoltzsche/k8storagex/api/v1alpha1"
+	"github.com/spf13/cobra"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var provisionersCmd = &cobra.Command{
+	Use:     "provisioners",
+	Aliases: []string{"provisioner"},
+	Short:   "list storage provisioners",
+	Args:    cobra.NoArgs,
+	RunE:    runProvisionersCmd,
+}
+
+func init() {
+	addAllNamespacesFlag(provisionersCmd)
+	rootCmd.AddCommand(provisionersCmd)
+}
+
+func runProvisionersCmd(cmd *cobra.Command, _ []string) error {
+	c, namespace, err := newClient()
+	if err != nil {
+		return err
+	}
+	provisioners := &storageapi.StorageProvisionerList{}
+	if err = c.List(newContext(), provisioners, client.InNamespace(listNamespace(namespace))); err != nil {
+		return err
+	}
+	w := newTableWriter(cmd.OutOrStdout())
+	fmt.Fprintln(w, "NAMESPACE\tNAME\tPROVISIONER\tCONFIGURED\tAGE")
+	for _, p := range provisioners.Items {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n",
+			p.Namespace, p.Name, p.Spec.Name, conditionStatus(p.Status.Conditions, storageapi.ConditionConfigured), age(&p.CreationTimestamp))
+	}
+	return w.Flush()
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+
+	storageapi "github.com/mgoltzsche/k8storagex/api/v1alpha1"
+	"github.com/spf13/cobra"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var resetCmd = &cobra.Command{
+	Use:   "reset CACHE",
+	Short: "reset a cache",
+	Long:  "Request a cache to be reset by incrementing its resetGeneration. Its images are dropped on all nodes and within the registry.",
+	Args:  cobra.ExactArgs(1),
+	RunE:  runResetCmd,
+}
+
+func init() {
+	rootCmd.AddCommand(resetCmd)
+}
+
+func runResetCmd(cmd *cobra.Command, args []string) error {
+	c, namespace, err := newClient()
+	if err != nil {
+		return err
+	}
+	ctx := newContext()
+	cache := &storageapi.Cache{}
+	if err = c.Get(ctx, types.NamespacedName{Name: args[0], Namespace: namespace}, cache); err != nil {
+		return err
+	}
+	orig := cache.DeepCopy()
+	generation := cache.Spec.ResetGeneration
+	if r := cache.Status.LastReset; r != nil && r.ResetGeneration > generation {
+		generation = r.ResetGeneration
+	}
+	cache.Spec.ResetGeneration = generation + 1
+	if err = c.Patch(ctx, cache, client.MergeFrom(orig)); err != nil {
+		return err
+	}
+	fmt.Fprintf(cmd.OutOrStdout(), "cache/%s reset requested (reset generation %d)\n", cache.Name, cache.Spec.ResetGeneration)
+	return nil
+}
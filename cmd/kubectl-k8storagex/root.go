@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	storageapi "github.com/mgoltzsche/k8storagex/api/v1alpha1"
+	"github.com/spf13/cobra"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/duration"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/clientcmd"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var (
+	rootCmd = &cobra.Command{
+		Use:           "kubectl-k8storagex",
+		Short:         "Inspect and manage k8storagex caches and provisioners",
+		SilenceErrors: true,
+		SilenceUsage:  true,
+	}
+	scheme           = runtime.NewScheme()
+	configOverrides  = clientcmd.ConfigOverrides{}
+	kubeconfigFlag   string
+	allNamespaceFlag bool
+)
+
+func init() {
+	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
+	utilruntime.Must(storageapi.AddToScheme(scheme))
+}
+
+// Execute runs the CLI
+func Execute(out io.Writer) error {
+	rootCmd.SetOut(out)
+	f := rootCmd.PersistentFlags()
+	f.StringVar(&kubeconfigFlag, "kubeconfig", "", "path to the kubeconfig file")
+	f.StringVar(&configOverrides.CurrentContext, "context", "", "the kubeconfig context to use")
+	f.StringVarP(&configOverrides.Context.Namespace, "namespace", "n", "", "the namespace scope for this request")
+	return rootCmd.Execute()
+}
+
+func addAllNamespacesFlag(cmd *cobra.Command) {
+	cmd.Flags().BoolVarP(&allNamespaceFlag, "all-namespaces", "A", false, "list resources across all namespaces")
+}
+
+func newClient() (c client.Client, namespace string, err error) {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = kubeconfigFlag
+	clientConfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, &configOverrides)
+	cfg, err := clientConfig.ClientConfig()
+	if err != nil {
+		return nil, "", err
+	}
+	namespace, _, err = clientConfig.Namespace()
+	if err != nil {
+		return nil, "", err
+	}
+	c, err = client.New(cfg, client.Options{Scheme: scheme})
+	return c, namespace, err
+}
+
+// listNamespace returns the namespace resources should be listed in (empty for all namespaces)
+func listNamespace(namespace string) string {
+	if allNamespaceFlag {
+		return ""
+	}
+	return namespace
+}
+
+func newContext() context.Context {
+	return context.Background()
+}
+
+func newTableWriter(out io.Writer) *tabwriter.Writer {
+	return tabwriter.NewWriter(out, 0, 8, 3, ' ', 0)
+}
+
+func age(t *metav1.Time) string {
+	if t == nil || t.IsZero() {
+		return "<none>"
+	}
+	return duration.HumanDuration(time.Since(t.Time))
+}
+
+func conditionStatus(conditions []metav1.Condition, conditionType string) string {
+	for _, c := range conditions {
+		if c.Type == conditionType {
+			return string(c.Status)
+		}
+	}
+	return string(metav1.ConditionUnknown)
+}
+
+func stringOrNone(s string) string {
+	if s == "" {
+		return "<none>"
+	}
+	return s
+}
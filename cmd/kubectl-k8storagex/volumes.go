@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	storageapi "github.com/mgoltzsche/k8storagex/api/v1alpha1"
+	"github.com/spf13/cobra"
+)
+
+var volumesCmd = &cobra.Command{
+	Use:   "volumes CACHE",
+	Short: "list the volumes a cache is mounted to",
+	Args:  cobra.ExactArgs(1),
+	RunE:  runVolumesCmd,
+}
+
+func init() {
+	rootCmd.AddCommand(volumesCmd)
+}
+
+type nodeVolume struct {
+	Node string
+	storageapi.VolumeStatus
+}
+
+func runVolumesCmd(cmd *cobra.Command, args []string) error {
+	cache, err := getCache(args[0])
+	if err != nil {
+		return err
+	}
+	return printVolumes(cmd.OutOrStdout(), "", cacheVolumes(cache))
+}
+
+func cacheVolumes(cache *storageapi.Cache) []nodeVolume {
+	volumes := []nodeVolume{}
+	for _, n := range cache.Status.Nodes {
+		for _, v := range n.Volumes {
+			volumes = append(volumes, nodeVolume{Node: n.Name, VolumeStatus: v})
+		}
+	}
+	return volumes
+}
+
+func printVolumes(out io.Writer, indent string, volumes []nodeVolume) error {
+	w := newTableWriter(out)
+	fmt.Fprintf(w, "%sNODE\tVOLUME\tGENERATION\tCOMMITTABLE\tCOMMITTING SINCE\tAGE\n", indent)
+	for _, v := range volumes {
+		fmt.Fprintf(w, "%s%s\t%s\t%d\t%v\t%s\t%s\n",
+			indent, v.Node, v.Name, v.CacheGeneration, v.Committable, age(v.CommitStartTime), age(&v.Created))
+	}
+	return w.Flush()
+}
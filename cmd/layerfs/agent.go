@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	storageapi "github.com/mgoltzsche/k8storagex/api/v1alpha1"
+	"github.com/mgoltzsche/k8storagex/internal/layerfs"
+	"github.com/mgoltzsche/k8storagex/internal/utils"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var (
+	agentCmd = &cobra.Command{
+		Use:     "agent",
+		Short:   "push queued cache images and serve the agent API",
+		Long:    "Run continuously and push the cache images that have been committed using umount --async-push. Optionally serve an HTTP API that allows the controllers to un/mount volumes within the volume root on the node. Requests must be authenticated using a ServiceAccount token of an allowed user.",
+		Example: fmt.Sprintf("  %s agent --interval=10s --listen=:8080 --storage-provisioner=cache-provisioner --allowed-user=system:serviceaccount:k8storagex:k8storagex-manager", os.Args[0]),
+		Args:    cobra.ExactArgs(0),
+		RunE:    runAgentCmd,
+	}
+	agentIntervalFlag     = 15 * time.Second
+	agentListenFlag       string
+	agentVolumeRootFlag   string
+	agentAllowedUsersFlag []string
+	agentProvisionerFlag  string
+)
+
+func init() {
+	f := agentCmd.Flags()
+	f.DurationVar(&agentIntervalFlag, "interval", agentIntervalFlag, "interval in which the push queue is checked")
+	f.StringVar(&agentListenFlag, "listen", agentListenFlag, "address the agent API is served at (disabled if empty)")
+	f.StringVar(&agentVolumeRootFlag, "volume-root", agentVolumeRootFlag, "host directory that contains the volumes the agent API may un/mount")
+	f.StringVar(&agentProvisionerFlag, "storage-provisioner", agentProvisionerFlag, "StorageProvisioner ([<namespace>/]<name>) whose node path is used as volume root and, unless specified, to derive the storage root from")
+	f.StringSliceVar(&agentAllowedUsersFlag, "allowed-user", agentAllowedUsersFlag, "ServiceAccount (system:serviceaccount:<namespace>:<name>) that may call the agent API")
+	f.Uint32Var((*uint32)(&modeFlag), "mode", uint32(modeFlag), "set the access permissions of the directories mounted via the agent API")
+	rootCmd.AddCommand(agentCmd)
+}
+
+func runAgentCmd(cmd *cobra.Command, args []string) error {
+	ctx, cancel := context.WithCancel(newContext())
+	defer cancel()
+	if agentProvisionerFlag != "" {
+		if err := applyStorageProvisionerNodePath(ctx, agentProvisionerFlag); err != nil {
+			return err
+		}
+	}
+	store, err := newStore()
+	if err != nil {
+		return err
+	}
+	defer store.Free()
+	pushTrigger := make(chan struct{}, 1)
+	errCh := make(chan error, 1)
+	if agentListenFlag != "" {
+		go func() {
+			errCh <- serveAgentAPI(ctx, agentListenFlag, &volumeAgent{store: store, pushTrigger: pushTrigger})
+			cancel()
+		}()
+	}
+	logrus.Info("Starting agent")
+	for {
+		if err := pushQueuedImages(ctx, store); err != nil {
+			logrus.Error(err)
+		}
+		select {
+		case <-ctx.Done():
+			if agentListenFlag != "" {
+				return <-errCh
+			}
+			return nil
+		case <-pushTrigger:
+		case <-time.After(agentIntervalFlag):
+		}
+	}
+}
+
+func pushQueuedImages(ctx context.Context, store layerfs.Store) error {
+	reqs, err := store.QueuedPushes()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, req := range reqs {
+		if ctx.Err() != nil {
+			return nil
+		}
+		if !req.Due(now) {
+			continue
+		}
+		if err = store.Push(ctx, req); err != nil && !errors.Is(err, layerfs.ErrPushDiscarded) {
+			logrus.WithField("image", req.Image).
+				WithField("imageID", req.ImageID).
+				Error(err)
+		}
+	}
+	return nil
+}
+
+// applyStorageProvisionerNodePath sets the volume root to the StorageProvisioner's path for the node
+// and derives the storage root from it unless specified explicitly.
+func applyStorageProvisionerNodePath(ctx context.Context, provisioner string) error {
+	if nodeNameFlag == "" {
+		return fmt.Errorf("node name has not been specified")
+	}
+	key := types.NamespacedName{Name: provisioner}
+	if i := strings.Index(provisioner, "/"); i >= 0 {
+		key.Namespace, key.Name = provisioner[:i], provisioner[i+1:]
+	} else {
+		b, err := ioutil.ReadFile("/var/run/secrets/kubernetes.io/serviceaccount/namespace")
+		if err != nil {
+			return fmt.Errorf("detect storage provisioner namespace: %w", err)
+		}
+		key.Namespace = string(b)
+	}
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return fmt.Errorf("needs to be run within a k8s pod with an access token mounted: %w", err)
+	}
+	scheme := runtime.NewScheme()
+	storageapi.AddToScheme(scheme)
+	c, err := client.New(config, client.Options{Scheme: scheme})
+	if err != nil {
+		return err
+	}
+	p := &storageapi.StorageProvisioner{}
+	if err = c.Get(ctx, key, p); err != nil {
+		return fmt.Errorf("get storage provisioner: %w", err)
+	}
+	nodePath, err := utils.StorageRootPathForNode(nodeNameFlag, p.Spec.Nodes)
+	if err != nil {
+		return err
+	}
+	if _, err = os.Stat(nodePath); err != nil {
+		return fmt.Errorf("node path of storage provisioner %s is not mounted into the agent container: %w", key, err)
+	}
+	if agentVolumeRootFlag == "" {
+		agentVolumeRootFlag = nodePath
+	}
+	if storageRootFlag == "" {
+		storageRootFlag = filepath.Join(nodePath, ".cache")
+	}
+	logrus.WithField("volumeRoot", agentVolumeRootFlag).
+		WithField("storageRoot", storageRootFlag).
+		Infof("Using node path of storage provisioner %s", key)
+	return nil
+}
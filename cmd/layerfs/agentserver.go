@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/mgoltzsche/k8storagex/internal/agent"
+	"github.com/mgoltzsche/k8storagex/internal/layerfs"
+	"github.com/sirupsen/logrus"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// env vars the manager sets when it de/provisions a volume
+const (
+	envProvisioningInterrupted = "STORAGE_PROVISIONING_INTERRUPTED"
+	envVolumeReleased          = "STORAGE_VOLUME_RELEASED"
+	envReadOnlyMany            = "STORAGE_READ_ONLY_MANY"
+	envCacheGeneration         = "STORAGE_CACHE_GENERATION"
+)
+
+// volumeAgent un/mounts the volumes requested by the controllers via the agent API
+type volumeAgent struct {
+	store       layerfs.Store
+	pushTrigger chan<- struct{}
+}
+
+var _ agent.Agent = &volumeAgent{}
+
+func (a *volumeAgent) Mount(ctx context.Context, req agent.Request) error {
+	log := logrus.WithField("dir", req.Dir)
+	opts, err := mountOptionsFromEnv(ctx, req)
+	if err != nil {
+		return err
+	}
+	if _, err = os.Stat(req.Dir); err == nil {
+		mounted, err := layerfs.Mounted(req.Dir)
+		if err != nil {
+			return err
+		}
+		if mounted {
+			log.Info("Volume is already mounted")
+			return nil
+		}
+		// Clean up the directory and container a failed deprovisioner or a crash left behind
+		log.Warn("Removing stale unmounted volume directory")
+		if _, _, err = a.store.Unmount(opts); err != nil {
+			log.WithError(err).Warn("Failed to remove stale volume container")
+		}
+		if err = os.Remove(req.Dir); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	log.Info("Mounting volume")
+	dir, err := a.store.Mount(opts)
+	if err != nil {
+		log.WithError(err).Error("Failed to mount volume")
+		return err
+	}
+	if opts.ReadOnly {
+		return nil
+	}
+	return os.Chmod(dir, modeFlag)
+}
+
+func (a *volumeAgent) Unmount(ctx context.Context, req agent.Request) error {
+	opts, err := mountOptionsFromEnv(ctx, req)
+	if err != nil {
+		return err
+	}
+	log := logrus.WithField("dir", req.Dir)
+	// Clean up after an interrupted provisioner, a reclaimed or a read-only volume without committing
+	opts.Commit = req.Env[envProvisioningInterrupted] == "" && req.Env[envVolumeReleased] == "" && !opts.ReadOnly
+	opts.AsyncPush = opts.Commit
+	if !opts.Commit {
+		if _, err = os.Stat(req.Dir); os.IsNotExist(err) {
+			log.Info("Volume is not mounted")
+			return nil
+		}
+	}
+	log.WithField("commit", opts.Commit).Info("Unmounting volume")
+	if _, _, err = a.store.Unmount(opts); err != nil {
+		log.WithError(err).Error("Failed to unmount volume")
+		return err
+	}
+	if opts.Commit {
+		select {
+		case a.pushTrigger <- struct{}{}:
+		default: // push already scheduled
+		}
+	}
+	return nil
+}
+
+func (a *volumeAgent) Prune(ctx context.Context) error {
+	return a.store.Prune(ctx)
+}
+
+func mountOptionsFromEnv(ctx context.Context, req agent.Request) (opts layerfs.MountOptions, err error) {
+	opts = layerfs.MountOptions{
+		Context:        ctx,
+		ExtMountDir:    req.Dir,
+		CacheName:      req.Env[envCacheName],
+		CacheNamespace: req.Env[envCacheNamespace],
+		Image:          req.Env[envCacheImage],
+		ContainerName:  req.Env[envContainerName],
+		Snapshot:       req.Env[envStorageSnapshotName],
+		ReadOnly:       req.Env[envReadOnlyMany] != "",
+	}
+	if opts.ReadOnly {
+		if generation := req.Env[envCacheGeneration]; generation != "" {
+			if opts.Generation, err = strconv.ParseInt(generation, 10, 64); err != nil {
+				return opts, fmt.Errorf("invalid env var %s: %w", envCacheGeneration, err)
+			}
+		}
+	}
+	applyDefaults(&opts)
+	return opts, nil
+}
+
+func serveAgentAPI(ctx context.Context, addr string, a agent.Agent) error {
+	if agentVolumeRootFlag == "" {
+		return fmt.Errorf("no --volume-root specified")
+	}
+	if len(agentAllowedUsersFlag) == 0 {
+		return fmt.Errorf("no --allowed-user specified")
+	}
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return fmt.Errorf("the agent API needs to be run within a k8s pod with an access token mounted: %w", err)
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return err
+	}
+	handler, err := agent.NewHandler(ctx, a, agent.HandlerOptions{
+		Authenticator: agent.NewTokenReviewAuthenticator(clientset.AuthenticationV1().TokenReviews(), agentAllowedUsersFlag),
+		VolumeRoot:    agentVolumeRootFlag,
+	})
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{Addr: addr, Handler: handler}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(shutdownCtx)
+	}()
+	logrus.Infof("Serving agent API at %s", addr)
+	if err = srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
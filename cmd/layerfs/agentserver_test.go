@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mgoltzsche/k8storagex/internal/agent"
+	"github.com/mgoltzsche/k8storagex/internal/layerfs"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeStore records the options the agent un/mounts volumes with
+type fakeStore struct {
+	layerfs.Store
+	mounted   []layerfs.MountOptions
+	unmounted []layerfs.MountOptions
+}
+
+func (s *fakeStore) Mount(opts layerfs.MountOptions) (string, error) {
+	s.mounted = append(s.mounted, opts)
+	return opts.ExtMountDir, os.Mkdir(opts.ExtMountDir, 0000)
+}
+
+func (s *fakeStore) Unmount(opts layerfs.MountOptions) (string, bool, error) {
+	s.unmounted = append(s.unmounted, opts)
+	return "", false, os.RemoveAll(opts.ExtMountDir)
+}
+
+func newTestAgent(t *testing.T) (*volumeAgent, *fakeStore, string) {
+	dir, err := ioutil.TempDir("", "layerfs-agent-test-")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	store := &fakeStore{}
+	return &volumeAgent{store: store, pushTrigger: make(chan struct{}, 1)}, store, filepath.Join(dir, "pvc-1")
+}
+
+func TestAgentMountReadOnlyMany(t *testing.T) {
+	a, store, dir := newTestAgent(t)
+	err := a.Mount(context.Background(), agent.Request{Dir: dir, Env: map[string]string{
+		envCacheName:       "mycache",
+		envReadOnlyMany:    "true",
+		envCacheGeneration: "3",
+	}})
+	require.NoError(t, err)
+	require.Len(t, store.mounted, 1, "mounts")
+	require.True(t, store.mounted[0].ReadOnly, "read-only")
+	require.Equal(t, int64(3), store.mounted[0].Generation, "generation")
+}
+
+func TestAgentMountStaleDirectory(t *testing.T) {
+	a, store, dir := newTestAgent(t)
+	require.NoError(t, os.Mkdir(dir, 0755))
+	err := a.Mount(context.Background(), agent.Request{Dir: dir, Env: map[string]string{envCacheName: "mycache"}})
+	require.NoError(t, err)
+	require.Len(t, store.unmounted, 1, "stale volume should be removed")
+	require.False(t, store.unmounted[0].Commit, "stale volume should not be committed")
+	require.Len(t, store.mounted, 1, "volume should be mounted")
+}
+
+func TestAgentUnmount(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		env    map[string]string
+		commit bool
+	}{
+		{"commit", map[string]string{}, true},
+		{"interrupted provisioning", map[string]string{envProvisioningInterrupted: "true"}, false},
+		{"released volume", map[string]string{envVolumeReleased: "true"}, false},
+		{"read-only volume", map[string]string{envReadOnlyMany: "true", envCacheGeneration: "2"}, false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			a, store, dir := newTestAgent(t)
+			require.NoError(t, os.Mkdir(dir, 0755))
+			c.env[envCacheName] = "mycache"
+			err := a.Unmount(context.Background(), agent.Request{Dir: dir, Env: c.env})
+			require.NoError(t, err)
+			require.Len(t, store.unmounted, 1, "unmounts")
+			require.Equal(t, c.commit, store.unmounted[0].Commit, "commit")
+			require.Equal(t, c.commit, store.unmounted[0].AsyncPush, "async push")
+			require.Equal(t, c.commit, len(a.pushTrigger) == 1, "push triggered")
+		})
+	}
+}
@@ -13,6 +13,7 @@ import (
 	"github.com/containers/image/v5/types"
 	"github.com/containers/storage"
 	"github.com/containers/storage/pkg/unshare"
+	"github.com/docker/go-units"
 	cacheapi "github.com/mgoltzsche/k8storagex/api/v1alpha1"
 	"github.com/mgoltzsche/k8storagex/internal/ksync"
 	"github.com/mgoltzsche/k8storagex/internal/layerfs"
@@ -33,6 +34,7 @@ var (
 		CacheNamespace: os.Getenv(envCacheNamespace),
 		Image:          os.Getenv(envCacheImage),
 		ContainerName:  os.Getenv(envContainerName),
+		Snapshot:       os.Getenv(envSnapshot),
 	}
 )
 
@@ -48,6 +50,7 @@ func addContainerFlag(cmd *cobra.Command) {
 	f.StringVar(&mountOptions.ContainerName, "container-name", mountOptions.ContainerName, "sets the name of the cache container (otherwise derived from mount path arg)")
 	f.StringVar(&mountOptions.CacheName, "name", mountOptions.CacheName, "sets the cache's name")
 	f.StringVar(&mountOptions.CacheNamespace, "namespace", mountOptions.CacheNamespace, "sets the cache's namespace")
+	f.StringVar(&mountOptions.Snapshot, "snapshot", mountOptions.Snapshot, "sets the name of the snapshot (within the namespace) to mount or create")
 }
 
 func validateOptions(cmd *cobra.Command, _ []string) error {
@@ -61,9 +64,13 @@ func applyDefaults(o *layerfs.MountOptions) {
 	if o.CacheNamespace == "" {
 		o.CacheNamespace = "default"
 	}
+	o.KeepGenerations = keepGenerationsFlag
 	if o.Image == "" && registryFlag != "" {
 		o.Image = fmt.Sprintf("%s/cache/%s:%s", registryFlag, o.CacheNamespace, o.CacheName)
 	}
+	if o.SnapshotImage == "" && o.Snapshot != "" && registryFlag != "" {
+		o.SnapshotImage = fmt.Sprintf("%s/snapshot/%s/%s:latest", registryFlag, o.CacheNamespace, o.Snapshot)
+	}
 }
 
 func newContext() context.Context {
@@ -106,25 +113,67 @@ func newStore() (r layerfs.Store, err error) {
 		return nil, fmt.Errorf("init store at %s: %w", opts.GraphRoot, err)
 	}
 	imgstorage.Transport.SetStore(store)
-	systemContext := types.SystemContext{}
+	systemContext, cleanup, err := newSystemContext()
+	if err != nil {
+		store.Free()
+		return nil, err
+	}
+	if bandwidthLimitFlag != "" {
+		if transferOptions.BandwidthLimit, err = units.FromHumanSize(bandwidthLimitFlag); err != nil {
+			store.Free()
+			cleanup()
+			return nil, fmt.Errorf("invalid bandwidth limit: %w", err)
+		}
+	}
+	s := &storeWithCleanup{layerfs.New(store, systemContext, transferOptions, logrus.NewEntry(logrus.StandardLogger())), cleanup}
+	defer func() {
+		if err != nil {
+			s.Free()
+		}
+	}()
+	if enableK8sSyncFlag {
+		r, err = toClusterSyncedStore(s)
+		if err != nil {
+			return nil, fmt.Errorf("cannot enable k8s sync: %w", err)
+		}
+		return r, nil
+	}
+	return s, nil
+}
+
+// storeWithCleanup removes temporary files when the store is freed
+type storeWithCleanup struct {
+	layerfs.Store
+	cleanup func()
+}
+
+func (s *storeWithCleanup) Free() {
+	s.Store.Free()
+	s.cleanup()
+}
+
+func newSystemContext() (types.SystemContext, func(), error) {
+	certDir, cleanup, err := registryCertDir()
+	if err != nil {
+		return types.SystemContext{}, nil, err
+	}
+	systemContext := types.SystemContext{
+		AuthFilePath:             registryAuthFileFlag,
+		SystemRegistriesConfPath: registriesConfFlag,
+		DockerCertPath:           certDir,
+	}
 	if insecureFlag {
 		logrus.Warn("Registry TLS certificate validation is disabled")
 		systemContext.DockerInsecureSkipTLSVerify = types.OptionalBoolTrue
 	}
 	if registryUsernameFlag != "" && registryPasswordFlag != "" {
+		// Explicitly provided credentials take precedence over the auth file
 		systemContext.DockerAuthConfig = &types.DockerAuthConfig{
 			Username: registryUsernameFlag,
 			Password: registryPasswordFlag,
 		}
 	}
-	r = layerfs.New(store, systemContext, logrus.NewEntry(logrus.StandardLogger()))
-	if enableK8sSyncFlag {
-		r, err = toClusterSyncedStore(r)
-		if err != nil {
-			return nil, fmt.Errorf("cannot enable k8s sync: %w", err)
-		}
-	}
-	return r, nil
+	return systemContext, cleanup, nil
 }
 
 func toClusterSyncedStore(store layerfs.Store) (layerfs.Store, error) {
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containers/image/v5/pkg/docker/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSystemContextCredentialHelper(t *testing.T) {
+	dir, err := ioutil.TempDir("", "layerfs-auth-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	helper := "#!/bin/sh\nread SERVER\necho '{\"ServerURL\":\"'$SERVER'\",\"Username\":\"helperuser\",\"Secret\":\"helpersecret\"}'\n"
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "docker-credential-fake"), []byte(helper), 0755))
+	authFile := filepath.Join(dir, "auth.json")
+	require.NoError(t, ioutil.WriteFile(authFile, []byte(`{"credHelpers":{"registry.example.org":"fake"}}`), 0600))
+	origPath := os.Getenv("PATH")
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+origPath)
+	defer os.Setenv("PATH", origPath)
+	origAuthFile := registryAuthFileFlag
+	registryAuthFileFlag = authFile
+	defer func() { registryAuthFileFlag = origAuthFile }()
+
+	sysCtx, cleanup, err := newSystemContext()
+	require.NoError(t, err)
+	defer cleanup()
+	auth, err := config.GetCredentials(&sysCtx, "registry.example.org")
+	require.NoError(t, err)
+	require.Equal(t, "helperuser", auth.Username, "username")
+	require.Equal(t, "helpersecret", auth.Password, "password")
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/mgoltzsche/k8storagex/internal/csi"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	csiCmd = &cobra.Command{
+		Use:     "csi",
+		Short:   "run the CSI driver",
+		Long:    "Serve the CSI identity, controller and node services that provision cache volumes",
+		Example: fmt.Sprintf("  %s csi --endpoint=unix:///csi/csi.sock --node-id=$(hostname)", os.Args[0]),
+		Args:    cobra.ExactArgs(0),
+		RunE:    runCSICmd,
+	}
+	csiEndpointFlag   = "unix:///csi/csi.sock"
+	csiDriverNameFlag = "cache.k8storagex.mgoltzsche.github.com"
+	csiStateDirFlag   = "/var/lib/layerfs/csi"
+	csiModeFlag       = os.FileMode(0777)
+	version           = "dev"
+)
+
+func init() {
+	f := csiCmd.Flags()
+	f.StringVar(&csiEndpointFlag, "endpoint", csiEndpointFlag, "CSI endpoint")
+	f.StringVar(&csiDriverNameFlag, "driver-name", csiDriverNameFlag, "CSI driver name")
+	f.StringVar(&nodeNameFlag, "node-id", nodeNameFlag, fmt.Sprintf("name of the node the driver is running on (%s)", envNodeName))
+	f.StringVar(&csiStateDirFlag, "state-dir", csiStateDirFlag, "directory the published volumes are recorded in")
+	f.Uint32Var((*uint32)(&csiModeFlag), "mode", uint32(csiModeFlag), "set the access permissions of published volumes")
+	rootCmd.AddCommand(csiCmd)
+}
+
+func runCSICmd(cmd *cobra.Command, args []string) error {
+	if nodeNameFlag == "" {
+		return fmt.Errorf("no --node-id specified")
+	}
+	driver := &csi.Driver{
+		Name:          csiDriverNameFlag,
+		Version:       version,
+		NodeID:        nodeNameFlag,
+		StateDir:      csiStateDirFlag,
+		Mode:          csiModeFlag,
+		NewStore:      newStore,
+		ApplyDefaults: applyDefaults,
+		Log:           logrus.NewEntry(logrus.StandardLogger()),
+	}
+	return driver.Serve(newContext(), csiEndpointFlag)
+}
@@ -22,6 +22,8 @@ var (
 
 func init() {
 	mountCmd.Flags().Uint32Var((*uint32)(&modeFlag), "mode", uint32(modeFlag), "set mount directory access permissions")
+	mountCmd.Flags().BoolVar(&mountOptions.ReadOnly, "read-only", mountOptions.ReadOnly, "mounts the cache read-only and never commits it")
+	mountCmd.Flags().Int64Var(&mountOptions.Generation, "generation", mountOptions.Generation, "mounts the given cache generation instead of the latest one")
 	addContainerFlag(mountCmd)
 	rootCmd.AddCommand(mountCmd)
 }
@@ -40,9 +42,10 @@ func runMountCmd(cmd *cobra.Command, args []string) (err error) {
 	if err != nil {
 		return err
 	}
-	err = os.Chmod(dir, modeFlag)
-	if err != nil {
-		return err
+	if !mountOptions.ReadOnly {
+		if err = os.Chmod(dir, modeFlag); err != nil {
+			return err
+		}
 	}
 	fmt.Fprintln(cmd.OutOrStdout(), dir)
 	return err
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	resetCmd = &cobra.Command{
+		Use:     "reset",
+		Short:   "reset a cache",
+		Long:    "Drop a cache's local images including its generations as well as its registry image",
+		Example: fmt.Sprintf("  %s reset --name mycache", os.Args[0]),
+		Args:    cobra.NoArgs,
+		PreRunE: validateOptions,
+		RunE:    runResetCmd,
+	}
+)
+
+func init() {
+	addContainerFlag(resetCmd)
+	rootCmd.AddCommand(resetCmd)
+}
+
+func runResetCmd(cmd *cobra.Command, args []string) (err error) {
+	store, err := newStore()
+	if err != nil {
+		return err
+	}
+	defer store.Free()
+	applyDefaults(&mountOptions)
+	return store.Reset(mountOptions)
+}
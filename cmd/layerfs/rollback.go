@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	rollbackCmd = &cobra.Command{
+		Use:     "rollback",
+		Short:   "rollback a cache to a previous generation",
+		Long:    "Point a cache's latest image back to a previously committed generation, locally and within the registry",
+		Example: fmt.Sprintf("  %s rollback --name mycache --generation 3", os.Args[0]),
+		Args:    cobra.NoArgs,
+		PreRunE: validateRollbackOptions,
+		RunE:    runRollbackCmd,
+	}
+)
+
+func init() {
+	rollbackCmd.Flags().Int64Var(&mountOptions.Generation, "generation", 0, "sets the generation to roll back to")
+	addContainerFlag(rollbackCmd)
+	rootCmd.AddCommand(rollbackCmd)
+}
+
+func validateRollbackOptions(cmd *cobra.Command, args []string) error {
+	if mountOptions.Generation <= 0 {
+		return fmt.Errorf("no --generation specified")
+	}
+	return validateOptions(cmd, args)
+}
+
+func runRollbackCmd(cmd *cobra.Command, args []string) (err error) {
+	store, err := newStore()
+	if err != nil {
+		return err
+	}
+	defer store.Free()
+	applyDefaults(&mountOptions)
+	_, err = store.Rollback(mountOptions)
+	return err
+}
@@ -5,6 +5,9 @@ import (
 	"io"
 	"os"
 	"strconv"
+	"time"
+
+	"github.com/mgoltzsche/k8storagex/internal/layerfs"
 
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
@@ -24,31 +27,59 @@ var (
 			}
 		},
 	}
-	envStorageRoot       = "LAYERFS_STORAGE_ROOT"
-	envStorageRunRoot    = "LAYERFS_STORAGE_RUNROOT"
-	envRegistry          = "LAYERFS_REGISTRY"
-	envRegistryUsername  = "LAYERFS_REGISTRY_USERNAME"
-	envRegistryPassword  = "LAYERFS_REGISTRY_PASSWORD"
-	envInsecure          = "LAYERFS_INSECURE_SKIP_TLS_VERIFY"
-	envEnableK8sSync     = "LAYERFS_ENABLE_K8S_SYNC"
-	envNodeName          = "LAYERFS_NODE_NAME"
-	envCacheName         = "LAYERFS_NAME"
-	envCacheNamespace    = "LAYERFS_NAMESPACE"
-	envCacheImage        = "LAYERFS_IMAGE"
-	envContainerName     = "LAYERFS_CONTAINER_NAME"
-	debugFlag            bool
-	storageRootFlag      = os.Getenv(envStorageRoot)
-	storageRunRootFlag   = os.Getenv(envStorageRunRoot)
-	registryFlag         = os.Getenv(envRegistry)
-	registryUsernameFlag = os.Getenv(envRegistryUsername)
-	registryPasswordFlag = os.Getenv(envRegistryPassword)
-	insecureFlag, _      = strconv.ParseBool(os.Getenv(envInsecure))
-	enableK8sSyncFlag, _ = strconv.ParseBool(os.Getenv(envEnableK8sSync))
-	nodeNameFlag         = os.Getenv(envNodeName)
+	envStorageRoot         = "LAYERFS_STORAGE_ROOT"
+	envStorageRunRoot      = "LAYERFS_STORAGE_RUNROOT"
+	envRegistry            = "LAYERFS_REGISTRY"
+	envRegistryUsername    = "LAYERFS_REGISTRY_USERNAME"
+	envRegistryPassword    = "LAYERFS_REGISTRY_PASSWORD"
+	envRegistryAuthFile    = "LAYERFS_REGISTRY_AUTH_FILE"
+	envRegistriesConf      = "LAYERFS_REGISTRIES_CONF_PATH"
+	envRegistryCertDir     = "LAYERFS_REGISTRY_CERT_DIR"
+	envRegistryCAFile      = "LAYERFS_REGISTRY_CA_FILE"
+	envRegistryCert        = "LAYERFS_REGISTRY_CLIENT_CERT"
+	envRegistryKey         = "LAYERFS_REGISTRY_CLIENT_KEY"
+	envInsecure            = "LAYERFS_INSECURE_SKIP_TLS_VERIFY"
+	envRetries             = "LAYERFS_RETRIES"
+	envRetryDelay          = "LAYERFS_RETRY_DELAY"
+	envMaxRetryDelay       = "LAYERFS_MAX_RETRY_DELAY"
+	envBandwidthLimit      = "LAYERFS_BANDWIDTH_LIMIT"
+	envTimeout             = "LAYERFS_TIMEOUT"
+	envEnableK8sSync       = "LAYERFS_ENABLE_K8S_SYNC"
+	envNodeName            = "LAYERFS_NODE_NAME"
+	envCacheName           = "LAYERFS_NAME"
+	envCacheNamespace      = "LAYERFS_NAMESPACE"
+	envCacheImage          = "LAYERFS_IMAGE"
+	envContainerName       = "LAYERFS_CONTAINER_NAME"
+	envSnapshot            = "LAYERFS_SNAPSHOT"
+	envKeepGenerations     = "LAYERFS_KEEP_GENERATIONS"
+	envStorageSnapshotName = "STORAGE_SNAPSHOT_NAME" // provided by the manager when a volume is restored from a snapshot
+	debugFlag              bool
+	storageRootFlag        = os.Getenv(envStorageRoot)
+	storageRunRootFlag     = os.Getenv(envStorageRunRoot)
+	registryFlag           = os.Getenv(envRegistry)
+	registryUsernameFlag   = os.Getenv(envRegistryUsername)
+	registryPasswordFlag   = os.Getenv(envRegistryPassword)
+	registryAuthFileFlag   = os.Getenv(envRegistryAuthFile)
+	registriesConfFlag     = os.Getenv(envRegistriesConf)
+	registryCertDirFlag    = os.Getenv(envRegistryCertDir)
+	registryCAFileFlag     = os.Getenv(envRegistryCAFile)
+	registryClientCertFlag = os.Getenv(envRegistryCert)
+	registryClientKeyFlag  = os.Getenv(envRegistryKey)
+	insecureFlag           = boolFromEnv(envInsecure)
+	transferOptions        = transferOptionsFromEnv()
+	bandwidthLimitFlag     = os.Getenv(envBandwidthLimit)
+	enableK8sSyncFlag      = boolFromEnv(envEnableK8sSync)
+	nodeNameFlag           = os.Getenv(envNodeName)
+	keepGenerationsFlag    = keepGenerationsFromEnv()
+	// envErr is the first error that occurred while parsing the environment
+	envErr error
 )
 
 // Execute runs the CLI
 func Execute(out io.Writer) error {
+	if envErr != nil {
+		return envErr
+	}
 	rootCmd.SetFlagErrorFunc(handleFlagError)
 	rootCmd.SetOut(os.Stdout)
 	f := rootCmd.PersistentFlags()
@@ -58,11 +89,72 @@ func Execute(out io.Writer) error {
 	f.StringVar(&registryFlag, "registry", registryFlag, fmt.Sprintf("sets the registry (%s)", envRegistry))
 	f.StringVar(&registryUsernameFlag, "registry-username", registryUsernameFlag, fmt.Sprintf("cache image registry username (%s)", envRegistryUsername))
 	f.StringVar(&registryPasswordFlag, "registry-password", registryPasswordFlag, fmt.Sprintf("cache image registry password (%s)", envRegistryPassword))
+	f.StringVar(&registryAuthFileFlag, "authfile", registryAuthFileFlag, fmt.Sprintf("path to an auth.json or .dockerconfigjson file containing registry credentials (%s)", envRegistryAuthFile))
+	f.StringVar(&registriesConfFlag, "registries-conf", registriesConfFlag, fmt.Sprintf("path to a registries.conf file specifying registry mirrors (%s)", envRegistriesConf))
+	f.StringVar(&registryCertDirFlag, "cert-dir", registryCertDirFlag, fmt.Sprintf("directory containing CA certificates (*.crt) and client certificates (*.cert, *.key) used to connect to the registry (%s)", envRegistryCertDir))
+	f.StringVar(&registryCAFileFlag, "ca-file", registryCAFileFlag, fmt.Sprintf("CA bundle file used to verify the registry's TLS certificate (%s)", envRegistryCAFile))
+	f.StringVar(&registryClientCertFlag, "client-cert", registryClientCertFlag, fmt.Sprintf("client certificate file used to authenticate with the registry (%s)", envRegistryCert))
+	f.StringVar(&registryClientKeyFlag, "client-key", registryClientKeyFlag, fmt.Sprintf("client certificate key file used to authenticate with the registry (%s)", envRegistryKey))
 	f.BoolVar(&insecureFlag, "insecure-skip-tls-verify", insecureFlag, fmt.Sprintf("skips registry TLS certificate verification - do not enable in production (%s)", envInsecure))
+	f.IntVar(&transferOptions.MaxRetries, "retries", transferOptions.MaxRetries, fmt.Sprintf("max number of image transfer retries (%s)", envRetries))
+	f.DurationVar(&transferOptions.RetryDelay, "retry-delay", transferOptions.RetryDelay, fmt.Sprintf("initial delay between image transfer retries, doubled on every retry (%s)", envRetryDelay))
+	f.DurationVar(&transferOptions.MaxRetryDelay, "max-retry-delay", transferOptions.MaxRetryDelay, fmt.Sprintf("max delay between image transfer retries (%s)", envMaxRetryDelay))
+	f.StringVar(&bandwidthLimitFlag, "bandwidth-limit", bandwidthLimitFlag, fmt.Sprintf("limits the image transfer rate per second, e.g. 10MB (%s)", envBandwidthLimit))
+	f.DurationVar(&transferOptions.Timeout, "timeout", transferOptions.Timeout, fmt.Sprintf("image transfer timeout including retries (%s)", envTimeout))
+	f.IntVar(&keepGenerationsFlag, "keep-generations", keepGenerationsFlag, fmt.Sprintf("number of committed cache generations that are kept tagged as gen-<n>, 0 disables generation tags (%s)", envKeepGenerations))
 	f.BoolVar(&enableK8sSyncFlag, "enable-k8s-sync", enableK8sSyncFlag, "synchronizes cache operations with a Kubernetes Cache resource")
 	return rootCmd.Execute()
 }
 
+func transferOptionsFromEnv() layerfs.TransferOptions {
+	o := layerfs.DefaultTransferOptions()
+	o.MaxRetries = intFromEnv(envRetries, o.MaxRetries)
+	o.RetryDelay = durationFromEnv(envRetryDelay, o.RetryDelay)
+	o.MaxRetryDelay = durationFromEnv(envMaxRetryDelay, o.MaxRetryDelay)
+	o.Timeout = durationFromEnv(envTimeout, o.Timeout)
+	return o
+}
+
+func keepGenerationsFromEnv() int {
+	return intFromEnv(envKeepGenerations, 3)
+}
+
+func boolFromEnv(name string) bool {
+	v := os.Getenv(name)
+	if v == "" {
+		return false
+	}
+	b, err := strconv.ParseBool(v)
+	setEnvErr(name, err)
+	return b
+}
+
+func intFromEnv(name string, defaultValue int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return defaultValue
+	}
+	n, err := strconv.Atoi(v)
+	setEnvErr(name, err)
+	return n
+}
+
+func durationFromEnv(name string, defaultValue time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return defaultValue
+	}
+	d, err := time.ParseDuration(v)
+	setEnvErr(name, err)
+	return d
+}
+
+func setEnvErr(name string, err error) {
+	if err != nil && envErr == nil {
+		envErr = fmt.Errorf("invalid env var %s: %w", name, err)
+	}
+}
+
 func handleFlagError(cmd *cobra.Command, err error) error {
 	cmd.Help()
 	return err
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	snapshotCmd = &cobra.Command{
+		Use:     "snapshot",
+		Short:   "snapshot a mounted cache directory",
+		Long:    "Commit a mounted cache directory to an immutable snapshot image that can be mounted using the --snapshot option",
+		Example: fmt.Sprintf("  %s snapshot --name mycache --snapshot mysnapshot /data/myvolume", os.Args[0]),
+		Args:    cobra.RangeArgs(0, 1),
+		PreRunE: validateSnapshotOptions,
+		RunE:    runSnapshotCmd,
+	}
+	deleteSnapshotFlag bool
+)
+
+func init() {
+	snapshotCmd.Flags().BoolVar(&deleteSnapshotFlag, "delete", false, "deletes the snapshot")
+	addContainerFlag(snapshotCmd)
+	rootCmd.AddCommand(snapshotCmd)
+}
+
+func validateSnapshotOptions(cmd *cobra.Command, args []string) error {
+	if mountOptions.Snapshot == "" {
+		return fmt.Errorf("no --snapshot specified")
+	}
+	return nil
+}
+
+func runSnapshotCmd(cmd *cobra.Command, args []string) (err error) {
+	if len(args) > 0 {
+		mountOptions.ExtMountDir = args[0]
+	}
+	store, err := newStore()
+	if err != nil {
+		return err
+	}
+	defer store.Free()
+	applyDefaults(&mountOptions)
+	if deleteSnapshotFlag {
+		return store.DeleteSnapshot(mountOptions)
+	}
+	imageID, err := store.Snapshot(mountOptions)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(cmd.OutOrStdout(), imageID)
+	return nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// registryCertDir returns a directory in the format that is expected by
+// types.SystemContext.DockerCertPath: CA certificates end with .crt,
+// client certificates with .cert and their keys with .key.
+// When only a cert dir is specified it is returned as is.
+// When a CA file or client certificate is specified a temporary directory
+// that links all files is created and must be removed by calling the returned
+// cleanup function.
+func registryCertDir() (dir string, cleanup func(), err error) {
+	cleanup = func() {}
+	if registryCAFileFlag == "" && registryClientCertFlag == "" && registryClientKeyFlag == "" {
+		return registryCertDirFlag, cleanup, nil
+	}
+	if (registryClientCertFlag == "") != (registryClientKeyFlag == "") {
+		return "", cleanup, errors.Errorf("client certificate and key must be specified together")
+	}
+	dir, err = ioutil.TempDir("", "layerfs-certs-")
+	if err != nil {
+		return "", cleanup, errors.Wrap(err, "create registry cert dir")
+	}
+	cleanup = func() {
+		_ = os.RemoveAll(dir)
+	}
+	defer func() {
+		if err != nil {
+			cleanup()
+		}
+	}()
+	if registryCertDirFlag != "" {
+		files, err := ioutil.ReadDir(registryCertDirFlag)
+		if err != nil && !os.IsNotExist(err) {
+			return "", cleanup, errors.Wrap(err, "read registry cert dir")
+		}
+		for _, f := range files {
+			name := f.Name()
+			if strings.HasSuffix(name, ".crt") || strings.HasSuffix(name, ".cert") || strings.HasSuffix(name, ".key") {
+				if err = linkFile(filepath.Join(registryCertDirFlag, name), filepath.Join(dir, name)); err != nil {
+					return "", cleanup, err
+				}
+			}
+		}
+	}
+	links := map[string]string{
+		registryCAFileFlag:     "layerfs-ca.crt",
+		registryClientCertFlag: "layerfs-client.cert",
+		registryClientKeyFlag:  "layerfs-client.key",
+	}
+	for src, name := range links {
+		if src == "" {
+			continue
+		}
+		if _, err = os.Stat(src); err != nil {
+			return "", cleanup, errors.Wrap(err, "registry tls")
+		}
+		if err = linkFile(src, filepath.Join(dir, name)); err != nil {
+			return "", cleanup, err
+		}
+	}
+	return dir, cleanup, nil
+}
+
+func linkFile(src, dest string) error {
+	src, err := filepath.Abs(src)
+	if err != nil {
+		return err
+	}
+	err = os.Symlink(src, dest)
+	return errors.Wrapf(err, "link %s into registry cert dir", src)
+}
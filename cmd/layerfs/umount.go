@@ -19,6 +19,8 @@ var (
 )
 
 func init() {
+	umountCmd.Flags().BoolVar(&mountOptions.Keep, "keep", mountOptions.Keep, "commits the container without unmounting and deleting it")
+	umountCmd.Flags().BoolVar(&mountOptions.AsyncPush, "async-push", mountOptions.AsyncPush, "queues the committed image to be pushed by the agent instead of pushing it directly")
 	addContainerFlag(umountCmd)
 	rootCmd.AddCommand(umountCmd)
 }
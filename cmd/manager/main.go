@@ -22,15 +22,19 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"time"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 
+	"github.com/containers/image/v5/types"
 	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/meta"
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/kubernetes"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	"k8s.io/client-go/rest"
 	ctrl "sigs.k8s.io/controller-runtime"
@@ -39,15 +43,23 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 
 	storageapi "github.com/mgoltzsche/k8storagex/api/v1alpha1"
+	"github.com/mgoltzsche/k8storagex/internal/agent"
 	"github.com/mgoltzsche/k8storagex/internal/controllers"
+	"github.com/mgoltzsche/k8storagex/internal/registry"
 	// +kubebuilder:scaffold:imports
 )
 
 const (
 	envManagerNamespace          = "MANAGER_NAMESPACE"
+	envManagerServiceAccount     = "MANAGER_SERVICE_ACCOUNT"
 	envProvisioner               = "PROVISIONER"
 	envProvisionerImage          = "PROVISIONER_IMAGE"
 	envProvisionerServiceAccount = "PROVISIONER_SERVICE_ACCOUNT"
+	envRegistryAuthFile          = "REGISTRY_AUTH_FILE"
+	envRegistryUsername          = "REGISTRY_USERNAME"
+	envRegistryPassword          = "REGISTRY_PASSWORD"
+	envRegistryCertDir           = "REGISTRY_CERT_DIR"
+	envRegistryInsecure          = "REGISTRY_INSECURE_SKIP_TLS_VERIFY"
 )
 
 var (
@@ -68,10 +80,20 @@ func main() {
 		enableLeaderElection bool
 		probeAddr            string
 		managerNamespace     = os.Getenv(envManagerNamespace)
+		serviceAccount       = os.Getenv(envManagerServiceAccount)
+		lostNodeGracePeriod  time.Duration
+		registryAuthFile     = os.Getenv(envRegistryAuthFile)
+		registryCertDir      = os.Getenv(envRegistryCertDir)
+		registryInsecure     = os.Getenv(envRegistryInsecure) == "true"
 	)
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
 	flag.StringVar(&managerNamespace, "manager-namespace", managerNamespace, "The namespace provisioner Pods are run in")
+	flag.StringVar(&serviceAccount, "service-account", serviceAccount, "The manager's ServiceAccount that is used to authenticate with the provisioner agents")
+	flag.DurationVar(&lostNodeGracePeriod, "lost-node-grace-period", controllers.DefaultLostNodeGracePeriod, "The duration a node may be NotReady before its volumes are finalized without deprovisioning")
+	flag.StringVar(&registryAuthFile, "registry-auth-file", registryAuthFile, "Path to a .dockerconfigjson file containing the credentials used to delete the images of a Cache that is reset")
+	flag.StringVar(&registryCertDir, "registry-cert-dir", registryCertDir, "Directory containing the CA certificates (*.crt) used to verify the registry's TLS certificate")
+	flag.BoolVar(&registryInsecure, "registry-insecure-skip-tls-verify", registryInsecure, "Skips the registry's TLS certificate verification - do not enable in production")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
@@ -96,6 +118,8 @@ func main() {
 		HealthProbeBindAddress: probeAddr,
 		LeaderElection:         enableLeaderElection,
 		LeaderElectionID:       "146685bb.cache-manager",
+		// Agent requests resolve env var references in the manager namespace only
+		ClientDisableCacheFor: []client.Object{&corev1.Secret{}, &corev1.ConfigMap{}},
 	})
 	if err != nil {
 		setupLog.Error(err, "unable to start manager")
@@ -110,23 +134,34 @@ func main() {
 		os.Exit(1)
 	}
 
-	// TODO: implement Cache reconciler properly
-	/*if err = (&controllers.CacheReconciler{
-		Client:             mgr.GetClient(),
-		Log:                ctrl.Log.WithName("controllers").WithName("Cache"),
-		Scheme:             mgr.GetScheme(),
-		ManagerNamespace:   managerNamespace,
-		ServiceAccountName: provisionerServiceAccount,
+	var agentTokens agent.TokenSource
+	if serviceAccount != "" {
+		clientset, err := kubernetes.NewForConfig(config)
+		if err != nil {
+			setupLog.Error(err, "unable to create clientset")
+			os.Exit(1)
+		}
+		agentTokens = agent.NewServiceAccountTokenSource(clientset.CoreV1().ServiceAccounts(managerNamespace), serviceAccount)
+	} else {
+		setupLog.Info("No --service-account specified, provisioner agents cannot be used")
+	}
+
+	if err = (&controllers.CacheReconciler{
+		Client:   mgr.GetClient(),
+		Log:      ctrl.Log.WithName("controllers").WithName("Cache"),
+		Scheme:   mgr.GetScheme(),
+		Registry: newRegistry(registryAuthFile, registryCertDir, registryInsecure),
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "Cache")
 		os.Exit(1)
-	}*/
+	}
 	if err = (&controllers.PersistentVolumeClaimReconciler{
 		Client:           mgr.GetClient(),
 		Log:              ctrl.Log.WithName("controllers").WithName("PersistentVolumeClaim"),
 		Scheme:           mgr.GetScheme(),
 		ManagerNamespace: managerNamespace,
 		Provisioners:     provisioners,
+		AgentTokens:      agentTokens,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "PersistentVolumeClaim")
 		os.Exit(1)
@@ -137,10 +172,21 @@ func main() {
 		Scheme:           mgr.GetScheme(),
 		ManagerNamespace: managerNamespace,
 		Provisioners:     provisioners,
+		AgentTokens:      agentTokens,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "PersistentVolume")
 		os.Exit(1)
 	}
+	if err = (&controllers.CacheSnapshotReconciler{
+		Client:           mgr.GetClient(),
+		Log:              ctrl.Log.WithName("controllers").WithName("CacheSnapshot"),
+		Scheme:           mgr.GetScheme(),
+		ManagerNamespace: managerNamespace,
+		Provisioners:     provisioners,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "CacheSnapshot")
+		os.Exit(1)
+	}
 	if err = (&controllers.StorageProvisionerReconciler{
 		Client:       mgr.GetClient(),
 		Log:          ctrl.Log.WithName("controllers").WithName("StorageProvisioner"),
@@ -151,6 +197,16 @@ func main() {
 		setupLog.Error(err, "unable to create controller", "controller", "StorageProvisioner")
 		os.Exit(1)
 	}
+	if err = (&controllers.NodeReconciler{
+		Client:              mgr.GetClient(),
+		Log:                 ctrl.Log.WithName("controllers").WithName("Node"),
+		Scheme:              mgr.GetScheme(),
+		ManagerNamespace:    managerNamespace,
+		LostNodeGracePeriod: lostNodeGracePeriod,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "Node")
+		os.Exit(1)
+	}
 	err = (&controllers.PodReconciler{
 		Client:       mgr.GetClient(),
 		Log:          ctrl.Log.WithName("controllers").WithName("Pod"),
@@ -175,6 +231,26 @@ func main() {
 	}
 }
 
+func newRegistry(authFile, certDir string, insecure bool) *registry.Registry {
+	systemContext := types.SystemContext{
+		AuthFilePath:   authFile,
+		DockerCertPath: certDir,
+	}
+	if insecure {
+		setupLog.Info("Registry TLS certificate validation is disabled")
+		systemContext.DockerInsecureSkipTLSVerify = types.OptionalBoolTrue
+	}
+	username, password := os.Getenv(envRegistryUsername), os.Getenv(envRegistryPassword)
+	if username != "" && password != "" {
+		// Explicitly provided credentials take precedence over the auth file
+		systemContext.DockerAuthConfig = &types.DockerAuthConfig{
+			Username: username,
+			Password: password,
+		}
+	}
+	return registry.New(systemContext)
+}
+
 func loadProvisioners(ctx context.Context, cfg *rest.Config, mapper meta.RESTMapper, namespace string, log logr.Logger) (*controllers.ProvisionerRegistry, error) {
 	client, err := client.New(cfg, client.Options{Scheme: scheme, Mapper: mapper})
 	if err != nil {
@@ -13,6 +13,13 @@ setup() {
 	fi
 }
 
+deleteLocalStorage() {
+	docker run --rm --privileged --mount "type=bind,src=`pwd`,dst=/data" \
+		alpine:3.12 /bin/sh -c '
+			umount /data/testmount/.cache/overlay;
+			rm -rf /data/testmount'
+}
+
 # ARGS: COMMAND
 runContainer() {
 	mkdir -p testmount
@@ -21,14 +28,13 @@ runContainer() {
 		-e LAYERFS_NAMESPACE=test-namespace \
 		-e LAYERFS_CONTAINER_NAME=$VOLDIR \
 		-e LAYERFS_STORAGE_ROOT=/data/.cache \
-		-e LAYERFS_REGISTRY=$TEST_REGISTRY \
-		-e LAYERFS_REGISTRY_USERNAME=testuser \
-		-e LAYERFS_REGISTRY_PASSWORD=testpass \
-		-e LAYERFS_REGISTRIES_CONF_PATH=/registries-config.json \
+		-e LAYERFS_REGISTRY=${REGISTRY:-$TEST_REGISTRY} \
+		-e LAYERFS_REGISTRY_AUTH_FILE=/auth.json \
 		-e LAYERFS_INSECURE_SKIP_TLS_VERIFY=true \
-		--mount "type=bind,source=`pwd`/registries-config.json,target=/registries-config.json" \
+		--mount "type=bind,source=`pwd`/auth.json,target=/auth.json" \
 		--mount "type=bind,source=`pwd`/script,target=/script" \
 		--mount "type=bind,source=`pwd`/testmount,target=/data,bind-propagation=rshared" \
+		$CONTAINER_OPTS \
 		"$IMAGE" \
 		"$@"
 }
@@ -47,10 +53,7 @@ runContainer() {
 @test "mount should restore previous volume contents [$TEST_REGISTRY]" {
 	if [ "$TEST_REGISTRY" ]; then
 		# Delete local storage when testing against a registry
-		docker run --rm --privileged --mount "type=bind,src=`pwd`,dst=/data" \
-			alpine:3.12 /bin/sh -c '
-				umount /data/testmount/.cache/overlay;
-				rm -rf /data/testmount' || exit 1
+		deleteLocalStorage || exit 1
 	fi
 
 	VOLDIR=pv-xyz2_test-namespace_pvc-xyz
@@ -62,3 +65,19 @@ runContainer() {
 
 	runContainer layerfs umount /data/$VOLDIR --commit
 }
+
+@test "mount should pull the cache from a registries.conf mirror [$TEST_REGISTRY]" {
+	[ "$TEST_REGISTRY" ] || skip "requires a registry"
+	deleteLocalStorage || exit 1
+
+	VOLDIR=pv-xyz3_test-namespace_pvc-xyz
+	REGISTRY=docker://mirrored.registry.invalid
+	CONTAINER_OPTS="-e LAYERFS_REGISTRIES_CONF_PATH=/registries.conf --mount type=bind,source=`pwd`/registries.conf,target=/registries.conf"
+
+	runContainer layerfs mount /data/$VOLDIR --mode=0777
+
+	CONTENT="$(cat testmount/$VOLDIR/testfile)"
+	[ "$CONTENT" = "$EXPECTED_CONTENT" ] || (echo fail: volume should be restored from the mirror >&2; false)
+
+	runContainer layerfs umount /data/$VOLDIR
+}
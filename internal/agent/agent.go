@@ -0,0 +1,45 @@
+// Package agent provides the HTTP API of the node-local volume agent
+// that provisions and deprovisions volumes on behalf of the controllers.
+package agent
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	PathMount   = "/mount"
+	PathUnmount = "/unmount"
+	PathPrune   = "/prune"
+	PathHealthz = "/healthz"
+
+	// Audience is the audience of the ServiceAccount tokens the controllers authenticate with
+	Audience = "k8storagex-agent"
+)
+
+// ErrPending is returned when the agent is still processing a request.
+// The caller should repeat the request later in order to obtain the result.
+var ErrPending = errors.New("agent: operation pending")
+
+// Agent un/mounts volumes on the node it is running on
+type Agent interface {
+	Mount(context.Context, Request) error
+	Unmount(context.Context, Request) error
+	Prune(context.Context) error
+}
+
+// Request specifies the volume that should be un/mounted
+type Request struct {
+	// Dir is the volume's host directory
+	Dir string `json:"dir"`
+	// Env contains the env vars the de/provisioner container would have been run with
+	Env map[string]string `json:"env,omitempty"`
+}
+
+// Response is returned by the agent
+type Response struct {
+	Error string `json:"error,omitempty"`
+	// Pending indicates that the operation has not completed yet
+	Pending bool `json:"pending,omitempty"`
+}
@@ -0,0 +1,114 @@
+package agent
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	authv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	authclient "k8s.io/client-go/kubernetes/typed/authentication/v1"
+	coreclient "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+const tokenExpirationSeconds = 600
+
+// Authenticator verifies the bearer token of an agent request
+type Authenticator interface {
+	Authenticate(ctx context.Context, token string) error
+}
+
+// TokenSource provides the bearer token a client authenticates with
+type TokenSource interface {
+	Token(ctx context.Context) (string, error)
+}
+
+// StaticToken is a TokenSource that always returns the same token
+type StaticToken string
+
+func (t StaticToken) Token(_ context.Context) (string, error) {
+	return string(t), nil
+}
+
+type tokenReviewAuthenticator struct {
+	reviews authclient.TokenReviewInterface
+	users   map[string]struct{}
+}
+
+// NewTokenReviewAuthenticator accepts ServiceAccount tokens issued for the agent's Audience to one of the given users.
+// The users are specified as system:serviceaccount:<namespace>:<name>.
+func NewTokenReviewAuthenticator(reviews authclient.TokenReviewInterface, users []string) Authenticator {
+	m := make(map[string]struct{}, len(users))
+	for _, u := range users {
+		m[u] = struct{}{}
+	}
+	return &tokenReviewAuthenticator{reviews: reviews, users: m}
+}
+
+func (a *tokenReviewAuthenticator) Authenticate(ctx context.Context, token string) error {
+	review, err := a.reviews.Create(ctx, &authv1.TokenReview{
+		Spec: authv1.TokenReviewSpec{
+			Token:     token,
+			Audiences: []string{Audience},
+		},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return errors.Wrap(err, "token review")
+	}
+	if !review.Status.Authenticated {
+		return errors.Errorf("unauthenticated: %s", review.Status.Error)
+	}
+	if !hasString(review.Status.Audiences, Audience) {
+		return errors.Errorf("token is not issued for audience %s", Audience)
+	}
+	if _, ok := a.users[review.Status.User.Username]; !ok {
+		return errors.Errorf("user %s is not allowed to call the agent", review.Status.User.Username)
+	}
+	return nil
+}
+
+type serviceAccountTokenSource struct {
+	serviceAccounts coreclient.ServiceAccountInterface
+	name            string
+	token           string
+	expiry          time.Time
+	mutex           sync.Mutex
+}
+
+// NewServiceAccountTokenSource requests short-lived tokens for the agent's Audience on behalf of the given ServiceAccount.
+// Since the tokens are bound to the agent audience they cannot be used to access the Kubernetes API.
+func NewServiceAccountTokenSource(serviceAccounts coreclient.ServiceAccountInterface, name string) TokenSource {
+	return &serviceAccountTokenSource{serviceAccounts: serviceAccounts, name: name}
+}
+
+func (s *serviceAccountTokenSource) Token(ctx context.Context) (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.token != "" && time.Now().Before(s.expiry) {
+		return s.token, nil
+	}
+	expirationSeconds := int64(tokenExpirationSeconds)
+	req, err := s.serviceAccounts.CreateToken(ctx, s.name, &authv1.TokenRequest{
+		Spec: authv1.TokenRequestSpec{
+			Audiences:         []string{Audience},
+			ExpirationSeconds: &expirationSeconds,
+		},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return "", errors.Wrapf(err, "request token for serviceaccount %s", s.name)
+	}
+	s.token = req.Status.Token
+	// Renew the token well before it expires
+	s.expiry = time.Now().Add(tokenExpirationSeconds * time.Second / 2)
+	return s.token, nil
+}
+
+func hasString(l []string, s string) bool {
+	for _, e := range l {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,83 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultTimeout is the max duration of an agent call.
+// It must be higher than the duration the agent waits for an operation before it responds with pending.
+const DefaultTimeout = DefaultWait + 20*time.Second
+
+var _ Agent = &Client{}
+
+// Client calls an agent's HTTP API.
+// A call returns ErrPending when the agent's operation did not complete in time.
+type Client struct {
+	URL        string
+	HTTPClient *http.Client
+	Tokens     TokenSource
+}
+
+// NewClient creates a client for the agent listening at the given address
+func NewClient(addr string, tokens TokenSource) *Client {
+	return &Client{
+		URL:        fmt.Sprintf("http://%s", addr),
+		HTTPClient: &http.Client{Timeout: DefaultTimeout},
+		Tokens:     tokens,
+	}
+}
+
+func (c *Client) Mount(ctx context.Context, req Request) error {
+	return errors.Wrap(c.call(ctx, PathMount, &req), "agent: mount")
+}
+
+func (c *Client) Unmount(ctx context.Context, req Request) error {
+	return errors.Wrap(c.call(ctx, PathUnmount, &req), "agent: unmount")
+}
+
+func (c *Client) Prune(ctx context.Context) error {
+	return errors.Wrap(c.call(ctx, PathPrune, &Request{}), "agent: prune")
+}
+
+func (c *Client) call(ctx context.Context, path string, req *Request) error {
+	b, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	token, err := c.Tokens.Token(ctx)
+	if err != nil {
+		return err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, c.URL+path, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("Authorization", "Bearer "+token)
+	res, err := c.HTTPClient.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	resp := Response{}
+	if err = json.NewDecoder(res.Body).Decode(&resp); err != nil {
+		return errors.Wrapf(err, "decode response (status %d)", res.StatusCode)
+	}
+	if resp.Error != "" {
+		return errors.New(resp.Error)
+	}
+	if resp.Pending {
+		return ErrPending
+	}
+	if res.StatusCode != http.StatusOK {
+		return errors.Errorf("unexpected status %d", res.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultWait is the max duration a request waits for its operation to complete before the agent responds with pending
+const DefaultWait = 10 * time.Second
+
+// HandlerOptions configures the agent's HTTP API
+type HandlerOptions struct {
+	// Authenticator verifies each request's bearer token
+	Authenticator Authenticator
+	// VolumeRoot is the host directory that contains the volumes.
+	// Requests for a Dir that is not a direct child of it are rejected.
+	VolumeRoot string
+	// Wait is the max duration a request waits for its operation to complete (defaults to DefaultWait)
+	Wait time.Duration
+}
+
+// operation is an un/mount or prune call that runs in the background
+type operation struct {
+	path string
+	done chan struct{}
+	err  error
+}
+
+// NewHandler exposes the given Agent as HTTP API.
+// Requests must be authenticated and refer to a volume within the VolumeRoot.
+// Operations run in the background and are processed sequentially.
+// When an operation does not complete within the wait duration the agent responds with pending
+// and the client is expected to repeat the request in order to obtain the operation's result.
+// The operations are bound to the given context.
+func NewHandler(ctx context.Context, a Agent, opts HandlerOptions) (http.Handler, error) {
+	if opts.Authenticator == nil {
+		return nil, errors.New("agent handler: no authenticator specified")
+	}
+	if !filepath.IsAbs(opts.VolumeRoot) {
+		return nil, errors.Errorf("agent handler: volume root %q is not an absolute path", opts.VolumeRoot)
+	}
+	if opts.Wait == 0 {
+		opts.Wait = DefaultWait
+	}
+	root := filepath.Clean(opts.VolumeRoot)
+	lock := make(chan struct{}, 1)
+	ops := map[string]*operation{}
+	var mutex sync.Mutex
+	start := func(key, path string, fn func(context.Context) error) (*operation, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if op := ops[key]; op != nil {
+			select {
+			case <-op.done:
+				if op.path == path {
+					return op, nil
+				}
+				// Discard the unconsumed result of a different operation
+			default:
+				if op.path == path {
+					return op, nil
+				}
+				return nil, errors.Errorf("another operation (%s) is in progress for %q", op.path, key)
+			}
+		}
+		op := &operation{path: path, done: make(chan struct{})}
+		ops[key] = op
+		go func() {
+			defer close(op.done)
+			select {
+			case lock <- struct{}{}:
+				defer func() { <-lock }()
+			case <-ctx.Done():
+				op.err = ctx.Err()
+				return
+			}
+			op.err = fn(ctx)
+		}()
+		return op, nil
+	}
+	consume := func(key string, op *operation) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if ops[key] == op {
+			delete(ops, key)
+		}
+	}
+	call := func(fn func(context.Context, Request) error) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				writeResponse(w, http.StatusMethodNotAllowed, "method not allowed")
+				return
+			}
+			token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if token == "" || token == r.Header.Get("Authorization") {
+				writeResponse(w, http.StatusUnauthorized, "no bearer token provided")
+				return
+			}
+			if err := opts.Authenticator.Authenticate(r.Context(), token); err != nil {
+				writeResponse(w, http.StatusUnauthorized, err.Error())
+				return
+			}
+			req := Request{}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeResponse(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			if r.URL.Path != PathPrune {
+				dir, err := volumeDir(root, req.Dir)
+				if err != nil {
+					writeResponse(w, http.StatusBadRequest, err.Error())
+					return
+				}
+				req.Dir = dir
+			}
+			op, err := start(req.Dir, r.URL.Path, func(ctx context.Context) error {
+				return fn(ctx, req)
+			})
+			if err != nil {
+				writeResponse(w, http.StatusConflict, err.Error())
+				return
+			}
+			select {
+			case <-op.done:
+				consume(req.Dir, op)
+				if op.err != nil {
+					writeResponse(w, http.StatusInternalServerError, op.err.Error())
+					return
+				}
+				writeResponse(w, http.StatusOK, "")
+			case <-time.After(opts.Wait):
+				writePendingResponse(w)
+			case <-r.Context().Done():
+				writePendingResponse(w)
+			}
+		}
+	}
+	mux := http.NewServeMux()
+	mux.Handle(PathMount, call(a.Mount))
+	mux.Handle(PathUnmount, call(a.Unmount))
+	mux.Handle(PathPrune, call(func(ctx context.Context, _ Request) error {
+		return a.Prune(ctx)
+	}))
+	mux.HandleFunc(PathHealthz, func(w http.ResponseWriter, _ *http.Request) {
+		writeResponse(w, http.StatusOK, "")
+	})
+	return mux, nil
+}
+
+// volumeDir returns the cleaned volume directory or an error if it is not a direct child of the root directory.
+// Hidden directories are rejected since they may contain the node's image store.
+func volumeDir(root, dir string) (string, error) {
+	if !filepath.IsAbs(dir) {
+		return "", errors.Errorf("volume dir %q is not an absolute path", dir)
+	}
+	dir = filepath.Clean(dir)
+	if filepath.Dir(dir) != root || strings.HasPrefix(filepath.Base(dir), ".") {
+		return "", errors.Errorf("volume dir %q is not located within %s", dir, root)
+	}
+	return dir, nil
+}
+
+func writePendingResponse(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	_ = json.NewEncoder(w).Encode(&Response{Pending: true})
+}
+
+func writeResponse(w http.ResponseWriter, status int, errMsg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(&Response{Error: errMsg})
+}
@@ -0,0 +1,100 @@
+package agent
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeAuthenticator string
+
+func (a fakeAuthenticator) Authenticate(_ context.Context, token string) error {
+	if token != string(a) {
+		return errors.New("invalid token")
+	}
+	return nil
+}
+
+type fakeAgent struct {
+	mounted chan Request
+	release chan struct{}
+}
+
+func (a *fakeAgent) Mount(ctx context.Context, req Request) error {
+	a.mounted <- req
+	<-a.release
+	return nil
+}
+
+func (a *fakeAgent) Unmount(ctx context.Context, req Request) error {
+	return errors.Errorf("unmount %s failed", req.Dir)
+}
+
+func (a *fakeAgent) Prune(ctx context.Context) error {
+	return nil
+}
+
+func newTestServer(t *testing.T, a Agent) *httptest.Server {
+	h, err := NewHandler(context.Background(), a, HandlerOptions{
+		Authenticator: fakeAuthenticator("valid-token"),
+		VolumeRoot:    "/volumes",
+		Wait:          100 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func newTestClient(srv *httptest.Server, token string) *Client {
+	return NewClient(strings.TrimPrefix(srv.URL, "http://"), StaticToken(token))
+}
+
+func TestHandlerRejectsUnauthenticatedRequests(t *testing.T) {
+	a := &fakeAgent{mounted: make(chan Request, 1), release: make(chan struct{})}
+	srv := newTestServer(t, a)
+	err := newTestClient(srv, "invalid-token").Mount(context.Background(), Request{Dir: "/volumes/pvc-a"})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "invalid token")
+	require.Len(t, a.mounted, 0, "mounted")
+}
+
+func TestHandlerRejectsDirOutsideVolumeRoot(t *testing.T) {
+	a := &fakeAgent{mounted: make(chan Request, 1), release: make(chan struct{})}
+	srv := newTestServer(t, a)
+	c := newTestClient(srv, "valid-token")
+	for _, dir := range []string{"/etc", "/volumes", "/volumes/../etc", "/volumes/pvc-a/nested", "/volumes/.cache", "relative/pvc-a"} {
+		err := c.Mount(context.Background(), Request{Dir: dir})
+		require.Error(t, err, dir)
+		require.Len(t, a.mounted, 0, "mounted %s", dir)
+	}
+}
+
+func TestHandlerPendingOperation(t *testing.T) {
+	a := &fakeAgent{mounted: make(chan Request, 1), release: make(chan struct{})}
+	srv := newTestServer(t, a)
+	c := newTestClient(srv, "valid-token")
+	req := Request{Dir: "/volumes/pvc-a/", Env: map[string]string{"K": "V"}}
+	err := c.Mount(context.Background(), req)
+	require.True(t, errors.Is(err, ErrPending), "should return ErrPending but returned %v", err)
+	require.Equal(t, Request{Dir: "/volumes/pvc-a", Env: req.Env}, <-a.mounted, "mount request")
+
+	err = c.Unmount(context.Background(), req)
+	require.Error(t, err, "conflicting unmount")
+	require.False(t, errors.Is(err, ErrPending), "conflicting unmount should not be pending")
+
+	err = c.Mount(context.Background(), req)
+	require.True(t, errors.Is(err, ErrPending), "repeated mount should return ErrPending but returned %v", err)
+	close(a.release)
+	require.NoError(t, c.Mount(context.Background(), req), "mount result")
+	require.Len(t, a.mounted, 0, "repeated mount should not start another operation")
+
+	err = c.Unmount(context.Background(), req)
+	require.Error(t, err, "unmount")
+	require.Contains(t, err.Error(), "unmount /volumes/pvc-a failed")
+}
@@ -0,0 +1,78 @@
+package controllers
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"time"
+
+	storageapi "github.com/mgoltzsche/k8storagex/api/v1alpha1"
+	"github.com/mgoltzsche/k8storagex/internal/agent"
+	"github.com/mgoltzsche/k8storagex/internal/utils"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// +kubebuilder:rbac:groups=core,namespace=k8storagex,resources=secrets;configmaps,verbs=get
+// +kubebuilder:rbac:groups=core,namespace=k8storagex,resources=serviceaccounts/token,verbs=create
+// +kubebuilder:rbac:groups=authentication.k8s.io,resources=tokenreviews,verbs=create
+
+// agentPollInterval is the interval in which a pending agent operation is polled
+const agentPollInterval = 5 * time.Second
+
+// agentForNode returns a client for the provisioner's agent Pod on the given node
+func agentForNode(ctx context.Context, c client.Client, namespace string, spec *storageapi.AgentSpec, nodeName string, tokens agent.TokenSource) (agent.Agent, error) {
+	if tokens == nil {
+		return nil, errors.New("no agent token source configured")
+	}
+	pods := &corev1.PodList{}
+	err := c.List(ctx, pods, client.InNamespace(namespace), client.MatchingLabels(spec.PodSelector))
+	if err != nil {
+		return nil, errors.Wrap(err, "list agent pods")
+	}
+	for _, pod := range pods.Items {
+		if pod.Spec.NodeName == nodeName && pod.DeletionTimestamp == nil && pod.Status.PodIP != "" && isPodReady(&pod) {
+			addr := net.JoinHostPort(pod.Status.PodIP, strconv.Itoa(int(spec.Port)))
+			return agent.NewClient(addr, tokens), nil
+		}
+	}
+	return nil, errors.Errorf("no ready agent pod found on node %s", nodeName)
+}
+
+// agentRequest derives an agent request from the (substituted) provisioner.
+// The env var references are resolved within the namespace the provisioner Pods are run in.
+func agentRequest(ctx context.Context, c client.Client, namespace string, provisioner *storageapi.StorageProvisioner, container *storageapi.ProvisionerContainer, env []corev1.EnvVar, dir string) (agent.Request, error) {
+	if dir == "" {
+		return agent.Request{}, errors.New("agent request: no hostPath volume specified")
+	}
+	vars, err := utils.ProvisionerEnv(ctx, c, utils.PodSource{
+		PodName:                types.NamespacedName{Namespace: namespace},
+		SubstitutedProvisioner: provisioner,
+		Container:              container,
+		Env:                    env,
+	})
+	if err != nil {
+		return agent.Request{}, err
+	}
+	return agent.Request{Dir: dir, Env: vars}, nil
+}
+
+// requeueIfPending requeues the reconciliation when an agent operation is still pending
+func requeueIfPending(result ctrl.Result, err error) (ctrl.Result, error) {
+	if errors.Is(err, agent.ErrPending) {
+		return ctrl.Result{RequeueAfter: agentPollInterval}, nil
+	}
+	return result, err
+}
+
+func isPodReady(pod *corev1.Pod) bool {
+	for _, c := range pod.Status.Conditions {
+		if c.Type == corev1.PodReady {
+			return c.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
@@ -0,0 +1,145 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"strconv"
+	"time"
+
+	storageapi "github.com/mgoltzsche/k8storagex/api/v1alpha1"
+	"github.com/mgoltzsche/k8storagex/internal/agent"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const testAgentToken = "fake-agent-token"
+
+var _ = Describe("Agent", func() {
+	Describe("provisioner with agent", func() {
+		It("should provision the volume using an authenticated agent request", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			fake := &fakeAgent{mounted: make(chan agent.Request, 1), release: make(chan struct{})}
+			port := startFakeAgent(ctx, fake, "/fake/agent/path")
+			p := fakeProvisioner("agent")
+			p.Spec.Nodes = []storageapi.NodePath{{Name: "*", Path: "/fake/agent/path"}}
+			p.Spec.Agent = &storageapi.AgentSpec{
+				PodSelector: map[string]string{"app": "fake-agent"},
+				Port:        port,
+			}
+			p.Spec.PodTemplate.Containers[0].Env = []corev1.EnvVar{{
+				Name: "FAKE_SECRET",
+				ValueFrom: &corev1.EnvVarSource{SecretKeyRef: &corev1.SecretKeySelector{
+					LocalObjectReference: corev1.LocalObjectReference{Name: "fake-agent-secret"},
+					Key:                  "key",
+				}},
+			}}
+			Expect(testProvisioners.Put(p)).To(Succeed())
+			secret := &corev1.Secret{}
+			secret.Name = "fake-agent-secret"
+			secret.Namespace = testNamespace
+			secret.StringData = map[string]string{"key": "secret-value"}
+			Expect(k8sClient.Create(context.TODO(), secret)).To(Succeed())
+			createReadyNode("agent-node")
+			createAgentPod("fake-agent", "agent-node")
+			createStorageClass("agent", p.Spec.Name, storagev1.VolumeBindingWaitForFirstConsumer)
+			pvc := newClaim("agent-pvc", p.Spec.Name, "agent")
+			pvc.Annotations[annSelectedNode] = "agent-node"
+			Expect(k8sClient.Create(context.TODO(), pvc)).To(Succeed())
+
+			var req agent.Request
+			Eventually(fake.mounted, "10s").Should(Receive(&req))
+			Expect(req.Dir).To(Equal("/fake/agent/path/" + pvNameForPVC(pvc)))
+			Expect(req.Env["FAKE_SECRET"]).To(Equal("secret-value"), "resolved secret env var")
+
+			By("waiting for the pending agent operation")
+			pv := &corev1.PersistentVolume{}
+			pv.Name = pvNameForPVC(pvc)
+			verify(pv, notAfter(2*time.Second, func(err error) error { return err }))
+			close(fake.release)
+			verify(pv, func(err error) error {
+				if err != nil {
+					return err
+				}
+				if path := pv.Spec.HostPath.Path; path != req.Dir {
+					return fmt.Errorf("unexpected host path %q", path)
+				}
+				return nil
+			})
+			Consistently(fake.mounted, "2s").ShouldNot(Receive(), "should not mount the volume twice")
+		})
+	})
+})
+
+type fakeAgent struct {
+	mounted chan agent.Request
+	release chan struct{}
+}
+
+func (a *fakeAgent) Mount(ctx context.Context, req agent.Request) error {
+	a.mounted <- req
+	<-a.release
+	return nil
+}
+
+func (a *fakeAgent) Unmount(ctx context.Context, req agent.Request) error {
+	return nil
+}
+
+func (a *fakeAgent) Prune(ctx context.Context) error {
+	return nil
+}
+
+type fakeAgentAuthenticator struct{}
+
+func (fakeAgentAuthenticator) Authenticate(_ context.Context, token string) error {
+	if token != testAgentToken {
+		return errors.New("invalid token")
+	}
+	return nil
+}
+
+// startFakeAgent serves the given agent at 127.0.0.1 and returns the port
+func startFakeAgent(ctx context.Context, a agent.Agent, volumeRoot string) int32 {
+	h, err := agent.NewHandler(ctx, a, agent.HandlerOptions{
+		Authenticator: fakeAgentAuthenticator{},
+		VolumeRoot:    volumeRoot,
+	})
+	Expect(err).ShouldNot(HaveOccurred())
+	srv := httptest.NewServer(h)
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	_, port, err := net.SplitHostPort(srv.Listener.Addr().String())
+	Expect(err).ShouldNot(HaveOccurred())
+	p, err := strconv.Atoi(port)
+	Expect(err).ShouldNot(HaveOccurred())
+	return int32(p)
+}
+
+// createAgentPod creates a ready agent Pod on the given node that is reachable at 127.0.0.1
+func createAgentPod(name, nodeName string) *corev1.Pod {
+	pod := &corev1.Pod{}
+	pod.Name = name
+	pod.Namespace = testNamespace
+	pod.Labels = map[string]string{"app": "fake-agent"}
+	pod.Spec.NodeName = nodeName
+	pod.Spec.Containers = []corev1.Container{{Name: "agent", Image: "fake-agent-image"}}
+	Expect(k8sClient.Create(context.TODO(), pod)).To(Succeed())
+	pod.Status.PodIP = "127.0.0.1"
+	pod.Status.Phase = corev1.PodRunning
+	pod.Status.Conditions = []corev1.PodCondition{{
+		Type:               corev1.PodReady,
+		Status:             corev1.ConditionTrue,
+		LastTransitionTime: metav1.Now(),
+	}}
+	Expect(k8sClient.Status().Update(context.TODO(), pod)).To(Succeed())
+	return pod
+}
@@ -0,0 +1,249 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	storageapi "github.com/mgoltzsche/k8storagex/api/v1alpha1"
+	"github.com/mgoltzsche/k8storagex/internal/utils"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+const (
+	auditor                        = "auditor"
+	annStorageProvisionerName      = "k8storagex.mgoltzsche.github.com/storageprovisioner-name"
+	annStorageProvisionerNamespace = "k8storagex.mgoltzsche.github.com/storageprovisioner-namespace"
+	envVolumes                     = "STORAGE_VOLUMES"
+	envDeleteOrphans               = "STORAGE_DELETE_ORPHANS"
+	defaultAuditInterval           = time.Hour
+)
+
+// audit runs the auditor Pod on every node that is due and records the orphans it reports within the status.
+func (r *StorageProvisionerReconciler) audit(ctx context.Context, config *storageapi.StorageProvisioner, log logr.Logger) (ctrl.Result, error) {
+	if config.Spec.Containers.Auditor == nil {
+		if len(config.Status.Nodes) > 0 {
+			config.Status.Nodes = nil
+			return ctrl.Result{}, r.Client.Status().Update(ctx, config)
+		}
+		return ctrl.Result{}, nil
+	}
+	nodes := &corev1.NodeList{}
+	if err := r.Client.List(ctx, nodes); err != nil {
+		return ctrl.Result{}, err
+	}
+	interval := defaultAuditInterval
+	if a := config.Spec.Audit; a != nil && a.Interval != nil && a.Interval.Duration > 0 {
+		interval = a.Interval.Duration
+	}
+	now := time.Now()
+	statusChanged := false
+	requeueAfter := interval
+	audited := make([]storageapi.NodeAudit, 0, len(nodes.Items))
+	for _, node := range nodes.Items {
+		if _, err := utils.StorageRootPathForNode(node.Name, config.Spec.Nodes); err != nil {
+			continue
+		}
+		nodeStatus := storageapi.NodeAudit{Name: node.Name}
+		for _, s := range config.Status.Nodes {
+			if s.Name == node.Name {
+				nodeStatus = s
+				break
+			}
+		}
+		nodeLog := log.WithValues("node", node.Name)
+		due := nodeStatus.LastAudit.Add(interval)
+		shouldRun := !due.After(now)
+		if !shouldRun {
+			if d := due.Sub(now); d < requeueAfter {
+				requeueAfter = d
+			}
+		}
+		changed, err := r.auditNode(ctx, config, &nodeStatus, shouldRun, nodeLog)
+		if err != nil {
+			nodeLog.Error(err, "Failed to audit node")
+		}
+		statusChanged = statusChanged || changed
+		audited = append(audited, nodeStatus)
+	}
+	if len(audited) != len(config.Status.Nodes) {
+		statusChanged = true
+	}
+	if statusChanged {
+		config.Status.Nodes = audited
+		if err := r.Client.Status().Update(ctx, config); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+	return ctrl.Result{RequeueAfter: requeueAfter}, nil
+}
+
+// auditNode reconciles the auditor Pod for the given node and updates the node's audit status when it terminated.
+func (r *StorageProvisionerReconciler) auditNode(ctx context.Context, config *storageapi.StorageProvisioner, status *storageapi.NodeAudit, shouldRun bool, log logr.Logger) (changed bool, err error) {
+	podName := types.NamespacedName{
+		Name:      utils.ResourceName(fmt.Sprintf("%s-%s", config.Name, status.Name), auditor),
+		Namespace: r.Namespace,
+	}
+	volumes := []string{}
+	deleteOrphans := []string{}
+	if shouldRun {
+		volumes, err = r.knownVolumes(ctx, config, status.Name)
+		if err != nil {
+			return false, err
+		}
+		deleteOrphans = orphansToDelete(config, status, volumes)
+	}
+	done, err := r.jobReconciler.ReconcileJob(utils.JobRequest{
+		Context:   ctx,
+		Name:      auditor,
+		PodName:   podName,
+		Owner:     config,
+		ShouldRun: shouldRun,
+		Create: func() (*corev1.Pod, error) {
+			p := config.DeepCopy()
+			nodePath, err := utils.StorageRootPathForNode(status.Name, p.Spec.Nodes)
+			if err != nil {
+				return nil, err
+			}
+			err = utils.SubstituteProvisionerPlaceholders(p, utils.ProvisionerParams{
+				NodeName:              status.Name,
+				NodePath:              nodePath,
+				PersistentVolumeName:  auditor,
+				PersistentVolumeClaim: types.NamespacedName{Name: config.Name, Namespace: config.Namespace},
+			})
+			if err != nil {
+				return nil, err
+			}
+			return utils.NewProvisionerPod(utils.PodSource{
+				ContainerName:          auditor,
+				PodName:                podName,
+				SubstitutedProvisioner: p,
+				Container:              p.Spec.Containers.Auditor,
+				Env: []corev1.EnvVar{
+					{Name: envVolumes, Value: strings.Join(volumes, " ")},
+					{Name: envDeleteOrphans, Value: strings.Join(deleteOrphans, " ")},
+				},
+			})
+		},
+		OnCompleted: func(pod *corev1.Pod) (bool, error) {
+			orphans := parseOrphans(pod, volumes)
+			deleted := make([]string, 0, len(deleteOrphans))
+			for _, name := range deleteOrphans {
+				if !utils.HasString(orphans, name) {
+					deleted = append(deleted, name)
+				}
+			}
+			recordOrphans(status, orphans)
+			if len(deleted) > 0 {
+				msg := fmt.Sprintf("Deleted %d orphans on node %s: %s", len(deleted), status.Name, strings.Join(deleted, ", "))
+				r.recorder.Event(config, corev1.EventTypeNormal, "OrphansDeleted", msg)
+			}
+			if len(orphans) > 0 {
+				msg := fmt.Sprintf("Detected %d orphans on node %s: %s", len(orphans), status.Name, strings.Join(orphans, ", "))
+				r.recorder.Event(config, corev1.EventTypeWarning, "OrphansDetected", msg)
+			}
+			changed = true
+			return true, nil
+		},
+		Policy: config.Spec.JobPolicy,
+		Log:    log,
+	})
+	if done && err != nil {
+		// Record the failure and remove the Pod to retry within the next interval
+		status.LastAudit = metav1.Now()
+		status.LastError = err.Error()
+		changed = true
+		if _, e := utils.DeleteJob(ctx, r.Client, podName, log); e != nil {
+			return changed, e
+		}
+	}
+	return changed, err
+}
+
+// knownVolumes returns the names of the volumes that are expected on the node:
+// the provisioner's PersistentVolumes and the volumes that are currently being provisioned.
+func (r *StorageProvisionerReconciler) knownVolumes(ctx context.Context, config *storageapi.StorageProvisioner, nodeName string) ([]string, error) {
+	pvs := &corev1.PersistentVolumeList{}
+	if err := r.Client.List(ctx, pvs); err != nil {
+		return nil, err
+	}
+	claims := &corev1.PersistentVolumeClaimList{}
+	if err := r.Client.List(ctx, claims); err != nil {
+		return nil, err
+	}
+	volumes := []string{}
+	for _, pv := range pvs.Items {
+		if pv.Annotations[annStorageProvisioner] != config.Spec.Name {
+			continue
+		}
+		if utils.HasString(volumeNodes(&pv), nodeName) {
+			volumes = append(volumes, pv.Name)
+		}
+	}
+	for _, claim := range claims.Items {
+		onNode := claim.Annotations[annProvisionerNode] == nodeName || utils.HasString(provisionerNodes(&claim), nodeName)
+		if onNode && claim.Annotations[annStorageProvisioner] == config.Spec.Name {
+			utils.AddString(&volumes, pvNameForPVC(&claim))
+		}
+	}
+	sort.Strings(volumes)
+	return volumes, nil
+}
+
+// orphansToDelete returns the previously detected orphans that exceeded the grace period and are still unknown.
+func orphansToDelete(config *storageapi.StorageProvisioner, status *storageapi.NodeAudit, volumes []string) []string {
+	a := config.Spec.Audit
+	if a == nil || a.DeleteOrphansAfter == nil {
+		return []string{}
+	}
+	threshold := time.Now().Add(-a.DeleteOrphansAfter.Duration)
+	names := []string{}
+	for _, o := range status.Orphans {
+		if !o.Since.Time.After(threshold) && !utils.HasString(volumes, o.Name) {
+			names = append(names, o.Name)
+		}
+	}
+	return names
+}
+
+// parseOrphans reads the orphans from the auditor container's termination message.
+func parseOrphans(pod *corev1.Pod, volumes []string) []string {
+	orphans := []string{}
+	for _, s := range pod.Status.ContainerStatuses {
+		if s.Name != "main" || s.State.Terminated == nil {
+			continue
+		}
+		for _, line := range strings.Split(s.State.Terminated.Message, "\n") {
+			name := strings.TrimSpace(line)
+			if name != "" && !strings.ContainsAny(name, "/ ") && !utils.HasString(volumes, name) {
+				utils.AddString(&orphans, name)
+			}
+		}
+	}
+	sort.Strings(orphans)
+	return orphans
+}
+
+// recordOrphans replaces the node's orphans while preserving the time they were detected first.
+func recordOrphans(status *storageapi.NodeAudit, orphans []string) {
+	now := metav1.Now()
+	recorded := make([]storageapi.Orphan, len(orphans))
+	for i, name := range orphans {
+		recorded[i] = storageapi.Orphan{Name: name, Since: now}
+		for _, o := range status.Orphans {
+			if o.Name == name {
+				recorded[i].Since = o.Since
+				break
+			}
+		}
+	}
+	status.Orphans = recorded
+	status.LastAudit = now
+	status.LastError = ""
+}
@@ -18,20 +18,18 @@ package controllers
 
 import (
 	"context"
+	"fmt"
+	"strings"
 	"time"
 
 	"github.com/go-logr/logr"
 	cacheapi "github.com/mgoltzsche/k8storagex/api/v1alpha1"
 	"github.com/mgoltzsche/k8storagex/internal/utils"
-	"github.com/pkg/errors"
-	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
-	"k8s.io/apimachinery/pkg/types"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
-	"sigs.k8s.io/controller-runtime/pkg/source"
 )
 
 const (
@@ -39,40 +37,40 @@ const (
 	annCacheNamespace = "k8storagex.mgoltzsche.github.com/cache-namespace"
 )
 
+// resetPollInterval is the interval in which a pending reset checks for volumes that are still in use
+var resetPollInterval = 15 * time.Second
+
+// ImageDeleter deletes a cache's images from the registry
+type ImageDeleter interface {
+	DeleteImage(ctx context.Context, image string) error
+}
+
 // CacheReconciler reconciles a Cache object
 type CacheReconciler struct {
 	client.Client
-	Log                logr.Logger
-	Scheme             *runtime.Scheme
-	ManagerNamespace   string
-	ServiceAccountName string
+	Log    logr.Logger
+	Scheme *runtime.Scheme
+	// Registry deletes the registry images of a Cache that is reset.
+	// When nil the registry images are kept.
+	Registry ImageDeleter
 }
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *CacheReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&cacheapi.Cache{}).
-		Watches(&source.Kind{Type: &corev1.Pod{}}, utils.PodToRequestMapper(r.ManagerNamespace, annCacheName, annCacheNamespace)).
 		Complete(r)
 }
 
-// TODO: implement proper Cache resource clean up and garbage collection
-
-// +kubebuilder:rbac:groups=core,resources=persistentvolumeclaims,verbs=get;list;create;watch
-// +kubebuilder:rbac:groups=core,resources=pods,verbs=get;list;create;watch
 // +kubebuilder:rbac:groups=k8storagex.mgoltzsche.github.com,resources=caches,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=k8storagex.mgoltzsche.github.com,resources=caches/status,verbs=get;update;patch
 // +kubebuilder:rbac:groups=k8storagex.mgoltzsche.github.com,resources=caches/finalizers,verbs=update
 
-// Reconcile is part of the main kubernetes reconciliation loop which aims to
-// move the current state of the cluster closer to the desired state.
-// TODO(user): Modify the Reconcile function to compare the state specified by
-// the Cache object against the actual cluster state, and then
-// perform operations to make the cluster state reflect the state specified by
-// the user.
-//
-// For more details, check Reconcile and its Result here:
-// - https://pkg.go.dev/sigs.k8s.io/controller-runtime@v0.7.0/pkg/reconcile
+// Reconcile resets a Cache when its spec.resetGeneration changed.
+// While a reset is pending the Cache rejects commits until the volumes that have been mounted before are unmounted.
+// Afterwards the registry images are deleted, the reset is recorded within the Cache's status
+// and the nodes drop their local images before they mount the Cache next.
+// The StorageReset condition becomes true once every node acknowledged the reset.
 func (r *CacheReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
 	log := r.Log.WithValues("cache", req.NamespacedName.String())
 
@@ -88,9 +86,8 @@ func (r *CacheReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl
 		return ctrl.Result{}, err
 	}
 
-	// Clean up the file systems on the nodes
 	if !cache.ObjectMeta.DeletionTimestamp.IsZero() {
-		return ctrl.Result{}, r.finalize(ctx, cache, log)
+		return ctrl.Result{}, r.finalize(ctx, cache)
 	}
 
 	// Add finalizer to prevent deletion before its associated resources have been cleaned up.
@@ -98,155 +95,116 @@ func (r *CacheReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl
 		return ctrl.Result{}, r.Client.Update(ctx, cache)
 	}
 
+	if cache.Spec.ResetGeneration != lastResetGeneration(cache) {
+		return r.reset(ctx, cache, log)
+	}
+
+	if cache.Status.LastReset != nil && setResetAppliedCondition(cache) {
+		return ctrl.Result{}, r.Client.Status().Update(ctx, cache)
+	}
+
 	return ctrl.Result{}, nil
 }
 
-func (r *CacheReconciler) finalize(ctx context.Context, cache *cacheapi.Cache, log logr.Logger) error {
-	err := r.freeStorage(ctx, cache, log)
-	if err != nil {
-		return err
-	}
+func (r *CacheReconciler) finalize(ctx context.Context, cache *cacheapi.Cache) error {
 	// TODO: Run Pods to clean up cache resources on the nodes (untag images, eventually find and delete old containers).
 	if utils.RemoveString(&cache.Finalizers, cacheapi.CacheFinalizer) {
-		return r.Client.Status().Update(ctx, cache)
+		return r.Client.Update(ctx, cache)
 	}
 	return nil
 }
 
-func (r *CacheReconciler) freeStorage(ctx context.Context, cache *cacheapi.Cache, log logr.Logger) error {
-	podName := r.imageUntagPodName(cache)
-	if cache.Status.LastReset != nil && cache.Status.LastReset.CacheGeneration == cache.Status.CacheGeneration {
-		return r.deletePods(ctx, cache, podName)
-	}
-	podNamespacedName := types.NamespacedName{Name: podName, Namespace: r.ManagerNamespace}
-	done, _, err := utils.ReconcilePod(ctx, r.Client, podNamespacedName, func() (*corev1.Pod, error) {
-		// Configure Pod
-		pod := &corev1.Pod{}
-		pod.Annotations = map[string]string{
-			annCacheName:      cache.Name,
-			annCacheNamespace: cache.Namespace,
-		}
-		pod.Spec.ServiceAccountName = r.ServiceAccountName
-		pod.Spec.RestartPolicy = corev1.RestartPolicyNever
-		pod.Spec.Containers = []corev1.Container{{
-			Name:  "image-untagger",
-			Image: "TODO",
-			Args:  []string{"untag image within registry"},
-		}}
-
-		// Lock cache
-		changed := setPodsClearedCondition(cache, metav1.ConditionFalse, "PodDeletionPending", "new reset pod will be removed on success")
-		if cache.Status.Phase != cacheapi.CachePhaseReject || changed {
-			cache.Status.CacheGeneration++
-			cache.Status.Phase = cacheapi.CachePhaseReject
-			err := r.Client.Status().Update(ctx, cache)
-			if err != nil {
-				return nil, err
+func (r *CacheReconciler) reset(ctx context.Context, cache *cacheapi.Cache, log logr.Logger) (ctrl.Result, error) {
+	// Reject commits
+	if cache.Status.Phase != cacheapi.CachePhaseReject {
+		log.Info("Resetting cache", "resetGeneration", cache.Spec.ResetGeneration)
+		cache.Status.Phase = cacheapi.CachePhaseReject
+		setStorageResetCondition(cache, metav1.ConditionFalse, "ResetPending", "rejecting commits")
+		return ctrl.Result{}, r.Client.Status().Update(ctx, cache)
+	}
+
+	// Wait for the volumes that may still be committed
+	if n := committableVolumes(cache); n > 0 {
+		msg := fmt.Sprintf("waiting for %d committable volume(s) to be unmounted", n)
+		if setStorageResetCondition(cache, metav1.ConditionFalse, "VolumesInUse", msg) {
+			if err := r.Client.Status().Update(ctx, cache); err != nil {
+				return ctrl.Result{}, err
 			}
-			// TODO: don't return reconcile when cache doesn't exist (anymore)
-			return pod, r.Client.Get(ctx, types.NamespacedName{Name: cache.Name, Namespace: cache.Namespace}, cache)
 		}
+		return ctrl.Result{RequeueAfter: resetPollInterval}, nil
+	}
 
-		return pod, nil
-	})
-	if err != nil {
-		changed := utils.SetCondition(&cache.Status.Conditions, metav1.Condition{
-			Type:               cacheapi.ConditionStorageReset,
-			Status:             metav1.ConditionFalse,
-			Reason:             "PendingImageDeletion",
-			Message:            err.Error(),
-			ObservedGeneration: cache.Generation,
-		})
-		if changed {
-			e := r.Client.Status().Update(ctx, cache)
-			if e != nil {
-				return e
+	// Delete the registry images
+	if r.Registry != nil && cache.Status.Image != "" {
+		if err := r.Registry.DeleteImage(ctx, cache.Status.Image); err != nil {
+			if setStorageResetCondition(cache, metav1.ConditionFalse, "RegistryDeletionFailed", err.Error()) {
+				if e := r.Client.Status().Update(ctx, cache); e != nil {
+					log.Error(e, "failed to update cache status")
+				}
 			}
+			return ctrl.Result{}, err
 		}
-		if done {
-			return nil
-		}
-		return err
 	}
 
-	// On success update status, unlock cache
-	utils.SetCondition(&cache.Status.Conditions, metav1.Condition{
-		Type:               cacheapi.ConditionStorageReset,
-		Status:             metav1.ConditionTrue,
-		Reason:             "Success",
-		Message:            "Cache image has been untagged",
-		ObservedGeneration: cache.Generation,
-	})
-	cache.Status.Phase = cacheapi.CachePhaseReady
+	// Record the reset and accept commits again.
+	// Volumes that are mounted afterwards are not affected by the old images since the nodes drop them before mounting a volume.
 	cache.Status.LastReset = &cacheapi.ResetStatus{
-		CacheGeneration: cache.Generation,
+		ResetGeneration: cache.Spec.ResetGeneration,
+		CacheGeneration: cache.Status.CacheGeneration,
 		ResetTime:       metav1.Time{Time: time.Now()},
 	}
-	err = r.Client.Status().Update(ctx, cache)
-	if err != nil {
-		return err
-	}
+	cache.Status.LastImageID = nil
+	cache.Status.ImageGeneration = 0
+	cache.Status.Phase = cacheapi.CachePhaseReady
+	setResetAppliedCondition(cache)
+	log.Info("Cache reset", "resetGeneration", cache.Spec.ResetGeneration)
+	return ctrl.Result{}, r.Client.Status().Update(ctx, cache)
+}
 
-	err = r.deletePods(ctx, cache, podName)
-	if err != nil {
-		return err
+// setResetAppliedCondition reports the last reset as successful once every node dropped its images.
+func setResetAppliedCondition(cache *cacheapi.Cache) bool {
+	pending := nodesPendingReset(cache)
+	if len(pending) > 0 {
+		msg := fmt.Sprintf("waiting for %d node(s) to drop the cache images when using the cache next: %s", len(pending), strings.Join(pending, ", "))
+		return setStorageResetCondition(cache, metav1.ConditionFalse, "NodesPending", msg)
 	}
-
-	return nil
+	return setStorageResetCondition(cache, metav1.ConditionTrue, "Success", "all nodes dropped the cache images")
 }
 
-func (r *CacheReconciler) deletePods(ctx context.Context, cache *cacheapi.Cache, podNames ...string) (err error) {
-	if c := utils.GetCondition(cache.Status.Conditions, cacheapi.ConditionPodsCleared); c != nil && c.Status == metav1.ConditionTrue {
-		// skip Pod deletion when already happened
-		return nil
-	}
-	for _, pod := range podNames {
-		if e := r.deletePod(ctx, pod); e != nil && err == nil {
-			err = e
-		}
-	}
-	var changed bool
-	if err != nil {
-		changed = setPodsClearedCondition(cache, metav1.ConditionFalse, "PodDeletionFailed", err.Error())
-	} else {
-		changed = setPodsClearedCondition(cache, metav1.ConditionTrue, "Completed", "all pods removed")
-	}
-	if changed {
-		if e := r.Status().Update(ctx, cache); e != nil && err == nil {
-			err = e
+func nodesPendingReset(cache *cacheapi.Cache) []string {
+	pending := []string{}
+	for _, node := range cache.Status.Nodes {
+		if node.ResetGeneration != cache.Status.LastReset.ResetGeneration {
+			pending = append(pending, node.Name)
 		}
 	}
-	return err
+	return pending
 }
 
-func (r *CacheReconciler) deletePod(ctx context.Context, name string) error {
-	pod := &corev1.Pod{}
-	podName := types.NamespacedName{Name: name, Namespace: r.ManagerNamespace}
-	err := r.Client.Get(ctx, podName, pod)
-	if apierrors.IsNotFound(err) {
-		return nil
-	}
-	if err != nil {
-		return err
+func lastResetGeneration(cache *cacheapi.Cache) int64 {
+	if cache.Status.LastReset == nil {
+		return 0
 	}
-	err = r.Client.Delete(ctx, pod)
-	if err == nil {
-		err = errors.Errorf("pod deletion pending")
+	return cache.Status.LastReset.ResetGeneration
+}
+
+func committableVolumes(cache *cacheapi.Cache) (n int) {
+	for _, node := range cache.Status.Nodes {
+		for _, v := range node.Volumes {
+			if v.Committable {
+				n++
+			}
+		}
 	}
-	return err
+	return n
 }
 
-func setPodsClearedCondition(cache *cacheapi.Cache, status metav1.ConditionStatus, reason, message string) bool {
+func setStorageResetCondition(cache *cacheapi.Cache, status metav1.ConditionStatus, reason, message string) bool {
 	return utils.SetCondition(&cache.Status.Conditions, metav1.Condition{
-		Type:               cacheapi.ConditionPodsCleared,
+		Type:               cacheapi.ConditionStorageReset,
 		Status:             status,
 		Reason:             reason,
 		Message:            message,
 		ObservedGeneration: cache.Generation,
 	})
 }
-
-func (r *CacheReconciler) imageUntagPodName(cache *cacheapi.Cache) string {
-	// TODO: build name
-	return cache.Name
-}
@@ -0,0 +1,112 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	storageapi "github.com/mgoltzsche/k8storagex/api/v1alpha1"
+	"github.com/mgoltzsche/k8storagex/internal/utils"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+var _ = Describe("Cache", func() {
+	Describe("reset", func() {
+		It("should delete the registry image and succeed once all nodes dropped their images", func() {
+			image := "docker://registry.example.org/cache/" + testNamespace + ":reset"
+			cache := &storageapi.Cache{}
+			cache.Name = "reset"
+			cache.Namespace = testNamespace
+			Expect(k8sClient.Create(context.TODO(), cache)).To(Succeed())
+			updateCacheStatus(cache, func() {
+				cache.Status.Image = image
+				cache.Status.Nodes = []storageapi.NodeStatus{
+					{Name: "reset-node-a", LastUsed: metav1.Now(), Volumes: []storageapi.VolumeStatus{{Name: "pvc-a", Created: metav1.Now(), Committable: true}}},
+					{Name: "reset-node-b", LastUsed: metav1.Now()},
+				}
+			})
+
+			updateCache(cache, func() { cache.Spec.ResetGeneration = 1 })
+
+			verify(cache, hasResetCondition(cache, metav1.ConditionFalse, "VolumesInUse"))
+			Expect(cache.Status.Phase).To(Equal(storageapi.CachePhaseReject), "phase while volumes are in use")
+			Expect(testRegistry.Deleted()).ToNot(ContainElement(image), "deleted registry images while volumes are in use")
+
+			By("unmounting the volume")
+			updateCacheStatus(cache, func() { cache.Status.Nodes[0].Volumes = nil })
+			verify(cache, hasResetCondition(cache, metav1.ConditionFalse, "NodesPending"))
+			Expect(testRegistry.Deleted()).To(ContainElement(image), "deleted registry images")
+			Expect(cache.Status.Phase).To(Equal(storageapi.CachePhaseReady), "phase")
+			Expect(cache.Status.LastReset).ToNot(BeNil(), "lastReset")
+			Expect(cache.Status.LastReset.ResetGeneration).To(Equal(int64(1)), "lastReset.resetGeneration")
+
+			By("acknowledging the reset on one node")
+			updateCacheStatus(cache, func() { cache.Status.Nodes[0].ResetGeneration = 1 })
+			verify(cache, notAfter(2*time.Second, hasResetCondition(cache, metav1.ConditionTrue, "Success")))
+
+			By("acknowledging the reset on all nodes")
+			updateCacheStatus(cache, func() { cache.Status.Nodes[1].ResetGeneration = 1 })
+			verify(cache, hasResetCondition(cache, metav1.ConditionTrue, "Success"))
+		})
+	})
+})
+
+type fakeRegistry struct {
+	deleted []string
+	mutex   sync.Mutex
+}
+
+func (r *fakeRegistry) DeleteImage(_ context.Context, image string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.deleted = append(r.deleted, image)
+	return nil
+}
+
+func (r *fakeRegistry) Deleted() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]string{}, r.deleted...)
+}
+
+func updateCache(cache *storageapi.Cache, modify func()) {
+	key := types.NamespacedName{Name: cache.Name, Namespace: cache.Namespace}
+	Eventually(func() error {
+		if err := k8sClient.Get(context.TODO(), key, cache); err != nil {
+			return err
+		}
+		modify()
+		return k8sClient.Update(context.TODO(), cache)
+	}, "10s", "1s").ShouldNot(HaveOccurred())
+}
+
+func updateCacheStatus(cache *storageapi.Cache, modify func()) {
+	key := types.NamespacedName{Name: cache.Name, Namespace: cache.Namespace}
+	Eventually(func() error {
+		if err := k8sClient.Get(context.TODO(), key, cache); err != nil {
+			return err
+		}
+		modify()
+		return k8sClient.Status().Update(context.TODO(), cache)
+	}, "10s", "1s").ShouldNot(HaveOccurred())
+}
+
+func hasResetCondition(cache *storageapi.Cache, status metav1.ConditionStatus, reason string) func(error) error {
+	return func(err error) error {
+		if err != nil {
+			return err
+		}
+		c := utils.GetCondition(cache.Status.Conditions, storageapi.ConditionStorageReset)
+		if c == nil {
+			return fmt.Errorf("cache has no %s condition", storageapi.ConditionStorageReset)
+		}
+		if c.Status != status || c.Reason != reason {
+			return fmt.Errorf("expected %s condition %s/%s but was %s/%s: %s", c.Type, status, reason, c.Status, c.Reason, c.Message)
+		}
+		return nil
+	}
+}
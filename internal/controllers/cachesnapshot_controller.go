@@ -0,0 +1,339 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-logr/logr"
+	storageapi "github.com/mgoltzsche/k8storagex/api/v1alpha1"
+	"github.com/mgoltzsche/k8storagex/internal/utils"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	snapshotter          = "snapshotter"
+	snapshotDeleter      = "snapshotdeleter"
+	annSnapshotName      = "k8storagex.mgoltzsche.github.com/snapshot-name"
+	annSnapshotNamespace = "k8storagex.mgoltzsche.github.com/snapshot-namespace"
+	envSnapshotName      = "STORAGE_SNAPSHOT_NAME"
+	envSnapshotNamespace = "STORAGE_SNAPSHOT_NAMESPACE"
+)
+
+// CacheSnapshotReconciler reconciles a CacheSnapshot object
+type CacheSnapshotReconciler struct {
+	client.Client
+	Log              logr.Logger
+	Scheme           *runtime.Scheme
+	ManagerNamespace string
+	Provisioners     Provisioners
+	jobReconciler    *utils.JobReconciler
+	recorder         record.EventRecorder
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *CacheSnapshotReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	r.recorder = mgr.GetEventRecorderFor("CacheSnapshot")
+	r.jobReconciler = &utils.JobReconciler{
+		Client:                   r.Client,
+		Recorder:                 r.recorder,
+		AnnotationOwnerName:      annSnapshotName,
+		AnnotationOwnerNamespace: annSnapshotNamespace,
+	}
+	b := ctrl.NewControllerManagedBy(mgr).
+		For(&storageapi.CacheSnapshot{})
+	return r.jobReconciler.Watch(b, r.ManagerNamespace).Complete(r)
+}
+
+// +kubebuilder:rbac:groups=k8storagex.mgoltzsche.github.com,resources=cachesnapshots,verbs=get;list;watch;update;patch
+// +kubebuilder:rbac:groups=k8storagex.mgoltzsche.github.com,resources=cachesnapshots/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=k8storagex.mgoltzsche.github.com,resources=cachesnapshots/finalizers,verbs=update
+// +kubebuilder:rbac:groups=core,resources=persistentvolumeclaims,verbs=get;list;watch
+// +kubebuilder:rbac:groups=core,resources=persistentvolumes,verbs=get;list
+// +kubebuilder:rbac:groups=core,resources=pods,verbs=get;list;create;delete;patch;watch
+// +kubebuilder:rbac:groups=batch,resources=jobs,verbs=get;list;create;delete;watch
+// +kubebuilder:rbac:groups="",resources=events,verbs=create;patch
+
+// Reconcile runs the provisioner's snapshotter Pod for a CacheSnapshot's PersistentVolume
+// and the snapshot deleter Pod when the CacheSnapshot is deleted.
+func (r *CacheSnapshotReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	log := r.Log.WithValues("cachesnapshot", req.NamespacedName.String())
+
+	log.V(1).Info("Reconciling CacheSnapshot")
+
+	snapshot := &storageapi.CacheSnapshot{}
+	err := r.Client.Get(ctx, req.NamespacedName, snapshot)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return ctrl.Result{}, nil
+		}
+		return ctrl.Result{}, err
+	}
+
+	if snapshot.DeletionTimestamp != nil {
+		if !utils.HasString(snapshot.Finalizers, finalizer) {
+			return ctrl.Result{}, nil
+		}
+		done, err := r.deleteSnapshot(ctx, snapshot, log)
+		if err != nil || !done {
+			return ctrl.Result{}, err
+		}
+		utils.RemoveString(&snapshot.Finalizers, finalizer)
+		return ctrl.Result{}, r.Client.Update(ctx, snapshot)
+	}
+
+	if utils.AddString(&snapshot.Finalizers, finalizer) {
+		return ctrl.Result{}, r.Client.Update(ctx, snapshot)
+	}
+
+	if snapshot.Status.ReadyToUse {
+		return ctrl.Result{}, nil // snapshots are immutable
+	}
+
+	return ctrl.Result{}, r.createSnapshot(ctx, snapshot, log)
+}
+
+func (r *CacheSnapshotReconciler) createSnapshot(ctx context.Context, snapshot *storageapi.CacheSnapshot, log logr.Logger) error {
+	// Record the snapshot's volume, node and provisioner in order to be able to delete it later
+	if snapshot.Status.PersistentVolumeName == "" {
+		reason, err := r.prepareSnapshot(ctx, snapshot)
+		if err != nil {
+			if reason == "" {
+				return err
+			}
+			// Retry since the claim may get bound or the provisioner may get updated
+			r.recorder.Event(snapshot, corev1.EventTypeWarning, reason, err.Error())
+			if e := r.setReadyCondition(ctx, snapshot, metav1.ConditionFalse, reason, err.Error()); e != nil {
+				return e
+			}
+			return err
+		}
+		return r.Client.Status().Update(ctx, snapshot)
+	}
+	provisionerSpec, err := r.snapshotProvisioner(ctx, snapshot)
+	if err != nil {
+		return err
+	}
+	log = log.WithValues("provisioner", provisionerSpec.GetProvisionerName(), "persistentvolume", snapshot.Status.PersistentVolumeName)
+	podName := snapshotPodName(snapshot, snapshotter, r.ManagerNamespace)
+	done, err := r.jobReconciler.ReconcileJob(utils.JobRequest{
+		Context:   ctx,
+		Name:      snapshotter,
+		PodName:   podName,
+		Owner:     snapshot,
+		ShouldRun: true,
+		Create: func() (*corev1.Pod, error) {
+			pv := &corev1.PersistentVolume{}
+			err := r.Client.Get(ctx, types.NamespacedName{Name: snapshot.Status.PersistentVolumeName}, pv)
+			if err != nil {
+				return nil, errors.Wrap(err, "get snapshot source")
+			}
+			env, err := utils.AnnotationsToEnv(pv, provisionerSpec.Spec.Env)
+			if err != nil {
+				return nil, errors.Wrap(err, "persistentvolume does not specify annotation")
+			}
+			pod, err := utils.NewProvisionerPod(utils.PodSource{
+				ContainerName:          snapshotter,
+				PodName:                podName,
+				SubstitutedProvisioner: provisionerSpec,
+				Container:              provisionerSpec.Spec.Containers.Snapshotter,
+				Env:                    append(env, snapshotEnv(snapshot)...),
+			})
+			if err != nil {
+				return nil, err
+			}
+			r.recorder.Event(snapshot, corev1.EventTypeNormal, "Snapshotting", "Creating snapshot")
+			return pod, nil
+		},
+		OnCompleted: func(_ *corev1.Pod) (done bool, err error) {
+			snapshot.Status.ReadyToUse = true
+			snapshot.Status.CreationTime = &metav1.Time{Time: time.Now()}
+			err = r.setReadyCondition(ctx, snapshot, metav1.ConditionTrue, "Created", "Snapshot has been created")
+			if err != nil {
+				return false, err
+			}
+			log.Info("Created snapshot")
+			r.recorder.Event(snapshot, corev1.EventTypeNormal, "Created", "Created snapshot")
+			return true, nil
+		},
+		Policy: provisionerSpec.Spec.JobPolicy,
+		Log:    log,
+	})
+	if done && err != nil {
+		log.Error(err, "Failed to create snapshot")
+		return r.setReadyCondition(ctx, snapshot, metav1.ConditionFalse, "SnapshotterFailed", err.Error())
+	}
+	return err
+}
+
+// prepareSnapshot resolves the snapshot's PersistentVolume and records its node and provisioner within the status.
+// When the snapshot cannot be created a reason is returned with the error.
+func (r *CacheSnapshotReconciler) prepareSnapshot(ctx context.Context, snapshot *storageapi.CacheSnapshot) (reason string, err error) {
+	claim := &corev1.PersistentVolumeClaim{}
+	claimName := types.NamespacedName{Name: snapshot.Spec.PersistentVolumeClaimName, Namespace: snapshot.Namespace}
+	err = r.Client.Get(ctx, claimName, claim)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return "PersistentVolumeClaimNotFound", err
+		}
+		return "", err
+	}
+	if claim.Spec.VolumeName == "" {
+		return "PersistentVolumeClaimNotBound", errors.Errorf("persistentvolumeclaim %s is not bound", claim.Name)
+	}
+	pv := &corev1.PersistentVolume{}
+	err = r.Client.Get(ctx, types.NamespacedName{Name: claim.Spec.VolumeName}, pv)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return "PersistentVolumeNotFound", err
+		}
+		return "", err
+	}
+	provisionerSpec := resolveProvisioner(pv, r.Provisioners)
+	if provisionerSpec == nil {
+		return "UnsupportedProvisioner", errors.Errorf("persistentvolume %s is not managed by a known StorageProvisioner", pv.Name)
+	}
+	if provisionerSpec.Spec.Containers.Snapshotter == nil {
+		return "SnapshotNotSupported", errors.Errorf("StorageProvisioner %s does not support snapshots", provisionerSpec.Name)
+	}
+	if len(provisionerNodes(pv)) > 0 {
+		return "SnapshotNotSupported", errors.Errorf("persistentvolume %s is ReadOnlyMany and cannot be snapshotted", pv.Name)
+	}
+	nodeName, err := nodeNameFromPV(pv)
+	if err != nil {
+		return "NodeUnknown", errors.Wrapf(err, "persistentvolume %s", pv.Name)
+	}
+	snapshot.Status.Provisioner = provisionerSpec.Spec.Name
+	snapshot.Status.NodeName = nodeName
+	snapshot.Status.PersistentVolumeName = pv.Name
+	return "", nil
+}
+
+// deleteSnapshot runs the snapshot deleter Pod if the snapshot may have been created
+func (r *CacheSnapshotReconciler) deleteSnapshot(ctx context.Context, snapshot *storageapi.CacheSnapshot, log logr.Logger) (done bool, err error) {
+	done, err = utils.DeleteJob(ctx, r.Client, snapshotPodName(snapshot, snapshotter, r.ManagerNamespace), log)
+	if err != nil || !done || snapshot.Status.PersistentVolumeName == "" {
+		return done, err
+	}
+	if r.Provisioners.Get(snapshot.Status.Provisioner) == nil {
+		msg := fmt.Sprintf("Cannot delete snapshot since StorageProvisioner %s does not exist anymore", snapshot.Status.Provisioner)
+		r.recorder.Event(snapshot, corev1.EventTypeWarning, "SnapshotDeleterFailed", msg)
+		return true, nil
+	}
+	provisionerSpec, err := r.snapshotProvisioner(ctx, snapshot)
+	if err != nil {
+		return false, err
+	}
+	if provisionerSpec.Spec.Containers.SnapshotDeleter == nil {
+		return true, nil
+	}
+	podName := snapshotPodName(snapshot, snapshotDeleter, r.ManagerNamespace)
+	done, err = r.jobReconciler.ReconcileJob(utils.JobRequest{
+		Context:   ctx,
+		Name:      snapshotDeleter,
+		PodName:   podName,
+		Owner:     snapshot,
+		ShouldRun: true,
+		Create: func() (*corev1.Pod, error) {
+			pod, err := utils.NewProvisionerPod(utils.PodSource{
+				ContainerName:          snapshotDeleter,
+				PodName:                podName,
+				SubstitutedProvisioner: provisionerSpec,
+				Container:              provisionerSpec.Spec.Containers.SnapshotDeleter,
+				Env:                    snapshotEnv(snapshot),
+			})
+			if err != nil {
+				return nil, err
+			}
+			r.recorder.Event(snapshot, corev1.EventTypeNormal, "Deleting", "Deleting snapshot")
+			return pod, nil
+		},
+		OnCompleted: func(_ *corev1.Pod) (done bool, err error) {
+			log.Info("Deleted snapshot")
+			return true, nil
+		},
+		Policy: provisionerSpec.Spec.JobPolicy,
+		Log:    log,
+	})
+	if done && err != nil {
+		log.Error(err, "Failed to delete snapshot")
+		r.recorder.Event(snapshot, corev1.EventTypeWarning, "SnapshotDeleterFailed", fmt.Sprintf("Failed to delete snapshot: %v", err))
+	}
+	return done && err == nil, err
+}
+
+// snapshotProvisioner returns the snapshot's provisioner substituted for the snapshot's node.
+// The claim's placeholder values are used as long as the claim refers to the snapshotted volume.
+func (r *CacheSnapshotReconciler) snapshotProvisioner(ctx context.Context, snapshot *storageapi.CacheSnapshot) (*storageapi.StorageProvisioner, error) {
+	provisionerSpec := r.Provisioners.Get(snapshot.Status.Provisioner)
+	if provisionerSpec == nil {
+		return nil, errors.Errorf("storageprovisioner %s of snapshot not found", snapshot.Status.Provisioner)
+	}
+	params := utils.ProvisionerParams{
+		PersistentVolumeName:  snapshot.Status.PersistentVolumeName,
+		PersistentVolumeClaim: types.NamespacedName{Name: snapshot.Spec.PersistentVolumeClaimName, Namespace: snapshot.Namespace},
+	}
+	claim := &corev1.PersistentVolumeClaim{}
+	err := r.Client.Get(ctx, params.PersistentVolumeClaim, claim)
+	if err == nil && claim.Spec.VolumeName == snapshot.Status.PersistentVolumeName {
+		if params, err = provisionerParams(ctx, r.Client, claim); err != nil {
+			return nil, err
+		}
+	} else if err != nil && !apierrors.IsNotFound(err) {
+		return nil, err
+	}
+	if err = substituteProvisionerForNode(provisionerSpec, params, snapshot.Status.NodeName); err != nil {
+		return nil, err
+	}
+	return provisionerSpec, nil
+}
+
+func (r *CacheSnapshotReconciler) setReadyCondition(ctx context.Context, snapshot *storageapi.CacheSnapshot, status metav1.ConditionStatus, reason, msg string) error {
+	utils.SetCondition(&snapshot.Status.Conditions, metav1.Condition{
+		Type:               storageapi.ConditionSnapshotReady,
+		Status:             status,
+		Reason:             reason,
+		Message:            msg,
+		ObservedGeneration: snapshot.Generation,
+	})
+	return r.Client.Status().Update(ctx, snapshot)
+}
+
+func snapshotPodName(snapshot *storageapi.CacheSnapshot, suffix, namespace string) types.NamespacedName {
+	return types.NamespacedName{
+		Name:      utils.ResourceName(fmt.Sprintf("snapshot-%s", snapshot.UID), suffix),
+		Namespace: namespace,
+	}
+}
+
+// snapshotEnv returns the env vars that specify the snapshot to a de/provisioner container
+func snapshotEnv(snapshot *storageapi.CacheSnapshot) []corev1.EnvVar {
+	return []corev1.EnvVar{
+		{Name: envSnapshotName, Value: snapshot.Name},
+		{Name: envSnapshotNamespace, Value: snapshot.Namespace},
+	}
+}
@@ -0,0 +1,70 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	storageapi "github.com/mgoltzsche/k8storagex/api/v1alpha1"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+)
+
+var _ = Describe("CacheSnapshot", func() {
+	Describe("snapshot of a bound claim", func() {
+		It("should run the snapshotter and the snapshot deleter", func() {
+			p := fakeProvisioner("snapshot")
+			p.Spec.Containers.Snapshotter = &storageapi.ProvisionerContainer{Command: []string{"snapshot"}}
+			p.Spec.Containers.SnapshotDeleter = &storageapi.ProvisionerContainer{Command: []string{"delete-snapshot"}}
+			Expect(testProvisioners.Put(p)).To(Succeed())
+			pvc, pv := provisionBoundClaim("snapshot", p)
+
+			snapshot := &storageapi.CacheSnapshot{}
+			snapshot.Name = "snapshot-a"
+			snapshot.Namespace = testNamespace
+			snapshot.Spec.PersistentVolumeClaimName = pvc.Name
+			Expect(k8sClient.Create(context.TODO(), snapshot)).To(Succeed())
+
+			pod := &corev1.Pod{}
+			pod.Name = snapshotPodName(snapshot, snapshotter, testNamespace).Name
+			pod.Namespace = testNamespace
+			verify(pod, hasSnapshotEnv(pod, snapshot.Name))
+			setPodPhase(pod, corev1.PodSucceeded)
+			verify(snapshot, func(err error) error {
+				if err != nil {
+					return err
+				}
+				if !snapshot.Status.ReadyToUse {
+					return fmt.Errorf("snapshot is not ready to use")
+				}
+				return nil
+			})
+			Expect(snapshot.Status.Provisioner).To(Equal(p.Spec.Name), "status.provisioner")
+			Expect(snapshot.Status.NodeName).To(Equal("snapshot-node"), "status.nodeName")
+			Expect(snapshot.Status.PersistentVolumeName).To(Equal(pv.Name), "status.persistentVolumeName")
+
+			By("deleting the snapshot")
+			Expect(k8sClient.Delete(context.TODO(), snapshot)).To(Succeed())
+			deleter := &corev1.Pod{}
+			deleter.Name = snapshotPodName(snapshot, snapshotDeleter, testNamespace).Name
+			deleter.Namespace = testNamespace
+			verify(deleter, hasSnapshotEnv(deleter, snapshot.Name))
+			verify(snapshot, notAfter(2*time.Second, isNotFound))
+			setPodPhase(deleter, corev1.PodSucceeded)
+			verify(snapshot, isNotFound)
+		})
+	})
+})
+
+func hasSnapshotEnv(pod *corev1.Pod, snapshotName string) func(error) error {
+	return func(err error) error {
+		if err != nil {
+			return err
+		}
+		if !hasEnv(pod, envSnapshotName, snapshotName) {
+			return fmt.Errorf("pod %s does not specify the snapshot name", pod.Name)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,189 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/go-logr/logr"
+	storageapi "github.com/mgoltzsche/k8storagex/api/v1alpha1"
+	"github.com/mgoltzsche/k8storagex/internal/utils"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	expander             = "expander"
+	annRequestedCapacity = "k8storagex.mgoltzsche.github.com/requested-capacity"
+)
+
+// expand runs the provisioner's expander Pod when a bound claim requests more storage than its PersistentVolume provides.
+// Since the volumes are not resized by the kubelet the claim's status is updated directly after the PersistentVolume has been expanded.
+func (r *PersistentVolumeClaimReconciler) expand(ctx context.Context, claim *corev1.PersistentVolumeClaim, provisionerSpec *storageapi.StorageProvisioner, log logr.Logger) error {
+	pv := &corev1.PersistentVolume{}
+	err := r.Client.Get(ctx, types.NamespacedName{Name: claim.Spec.VolumeName}, pv)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	if resolveProvisioner(pv, r.Provisioners) == nil || pv.DeletionTimestamp != nil {
+		return nil // not managed by a known StorageProvisioner
+	}
+	log = log.WithValues("persistentvolume", pv.Name)
+	requested := claim.Spec.Resources.Requests[corev1.ResourceStorage]
+	current := pv.Spec.Capacity[corev1.ResourceStorage]
+	shouldRun := requested.Cmp(current) > 0
+	podName := types.NamespacedName{
+		Name:      utils.ResourceName(pv.Name, expander),
+		Namespace: r.ManagerNamespace,
+	}
+	if !shouldRun {
+		done, err := utils.DeleteJob(ctx, r.Client, podName, log)
+		if err != nil || !done {
+			return err
+		}
+		return r.updateClaimCapacity(ctx, claim, pv)
+	}
+	if len(provisionerNodes(pv)) > 0 {
+		r.recorder.Event(claim, corev1.EventTypeWarning, "ExpansionNotSupported", "ReadOnlyMany volumes cannot be expanded")
+		return nil
+	}
+	if provisionerSpec.Spec.Containers.Expander == nil {
+		msg := fmt.Sprintf("StorageProvisioner %s does not support volume expansion", provisionerSpec.Name)
+		r.recorder.Event(claim, corev1.EventTypeWarning, "ExpansionNotSupported", msg)
+		return nil
+	}
+	if setClaimCondition(claim, corev1.PersistentVolumeClaimResizing, "Expanding PersistentVolume") {
+		return r.Client.Status().Update(ctx, claim)
+	}
+	nodeName, err := nodeNameFromPV(pv)
+	if err != nil {
+		nodeName = claim.Annotations[annSelectedNode]
+	}
+	done, err := r.jobReconciler.ReconcileJob(utils.JobRequest{
+		Context:   ctx,
+		Name:      expander,
+		PodName:   podName,
+		Owner:     claim,
+		ShouldRun: true,
+		Create: func() (*corev1.Pod, error) {
+			env, err := utils.AnnotationsToEnv(pv, provisionerSpec.Spec.Env)
+			if err != nil {
+				return nil, errors.Wrap(err, "persistentvolume does not specify annotation")
+			}
+			if err = substituteProvisioner(ctx, r.Client, claim, provisionerSpec, nodeName); err != nil {
+				return nil, err
+			}
+			env = append(env, corev1.EnvVar{Name: "STORAGE_PREVIOUS_CAPACITY", Value: current.String()})
+			pod, err := utils.NewProvisionerPod(utils.PodSource{
+				ContainerName:          expander,
+				PodName:                podName,
+				SubstitutedProvisioner: provisionerSpec,
+				Container:              provisionerSpec.Spec.Containers.Expander,
+				Env:                    env,
+			})
+			if err != nil {
+				return nil, err
+			}
+			pod.Annotations[annRequestedCapacity] = requested.String()
+			msg := fmt.Sprintf("Expanding PersistentVolume from %s to %s", current.String(), requested.String())
+			r.recorder.Event(claim, corev1.EventTypeNormal, "Expanding", msg)
+			return pod, nil
+		},
+		OnCompleted: func(pod *corev1.Pod) (done bool, err error) {
+			// Update PersistentVolume capacity to the one the Pod has been run with
+			capacity, err := resource.ParseQuantity(pod.Annotations[annRequestedCapacity])
+			if err != nil {
+				return true, fmt.Errorf("invalid/missing expander pod annotation %s: %w", annRequestedCapacity, err)
+			}
+			if pv.Spec.Capacity == nil {
+				pv.Spec.Capacity = corev1.ResourceList{}
+			}
+			pv.Spec.Capacity[corev1.ResourceStorage] = capacity
+			if err = r.Client.Update(ctx, pv); err != nil {
+				return false, err
+			}
+			log.Info("Expanded PersistentVolume", "capacity", capacity.String())
+			r.recorder.Eventf(claim, corev1.EventTypeNormal, "Expanded", "Expanded PersistentVolume %s to %s", pv.Name, capacity.String())
+			return true, r.updateClaimCapacity(ctx, claim, pv)
+		},
+		Policy: provisionerSpec.Spec.JobPolicy,
+		Log:    log,
+	})
+	if done && err != nil {
+		log.Error(err, "Failed to expand PersistentVolume")
+		msg := fmt.Sprintf("Failed to expand PersistentVolume %s: %v", pv.Name, err)
+		r.recorder.Eventf(claim, corev1.EventTypeWarning, "VolumeResizeFailed", msg)
+	}
+	return err
+}
+
+// updateClaimCapacity sets the claim's status capacity to the PersistentVolume's and removes the resize conditions
+func (r *PersistentVolumeClaimReconciler) updateClaimCapacity(ctx context.Context, claim *corev1.PersistentVolumeClaim, pv *corev1.PersistentVolume) error {
+	capacity, ok := pv.Spec.Capacity[corev1.ResourceStorage]
+	if !ok || claim.Status.Phase != corev1.ClaimBound {
+		return nil
+	}
+	statusCapacity := claim.Status.Capacity[corev1.ResourceStorage]
+	changed := statusCapacity.Cmp(capacity) != 0
+	conditions := make([]corev1.PersistentVolumeClaimCondition, 0, len(claim.Status.Conditions))
+	for _, c := range claim.Status.Conditions {
+		if c.Type == corev1.PersistentVolumeClaimResizing || c.Type == corev1.PersistentVolumeClaimFileSystemResizePending {
+			changed = true
+			continue
+		}
+		conditions = append(conditions, c)
+	}
+	if !changed {
+		return nil
+	}
+	if claim.Status.Capacity == nil {
+		claim.Status.Capacity = corev1.ResourceList{}
+	}
+	claim.Status.Capacity[corev1.ResourceStorage] = capacity
+	claim.Status.Conditions = conditions
+	return r.Client.Status().Update(ctx, claim)
+}
+
+// setClaimCondition adds the given condition to the claim or updates its message
+func setClaimCondition(claim *corev1.PersistentVolumeClaim, condType corev1.PersistentVolumeClaimConditionType, msg string) bool {
+	now := metav1.Now()
+	for i, c := range claim.Status.Conditions {
+		if c.Type == condType {
+			if c.Message == msg {
+				return false
+			}
+			claim.Status.Conditions[i].Message = msg
+			claim.Status.Conditions[i].LastProbeTime = now
+			return true
+		}
+	}
+	claim.Status.Conditions = append(claim.Status.Conditions, corev1.PersistentVolumeClaimCondition{
+		Type:               condType,
+		Status:             corev1.ConditionTrue,
+		LastProbeTime:      now,
+		LastTransitionTime: now,
+		Message:            msg,
+	})
+	return true
+}
+
+// removeClaimCondition removes the given condition from the claim
+func removeClaimCondition(claim *corev1.PersistentVolumeClaim, condType corev1.PersistentVolumeClaimConditionType) bool {
+	conditions := make([]corev1.PersistentVolumeClaimCondition, 0, len(claim.Status.Conditions))
+	for _, c := range claim.Status.Conditions {
+		if c.Type != condType {
+			conditions = append(conditions, c)
+		}
+	}
+	if len(conditions) == len(claim.Status.Conditions) {
+		return false
+	}
+	claim.Status.Conditions = conditions
+	return true
+}
@@ -0,0 +1,160 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	storageapi "github.com/mgoltzsche/k8storagex/api/v1alpha1"
+	"github.com/mgoltzsche/k8storagex/internal/utils"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+var _ = Describe("Expander", func() {
+	Describe("bound claim", func() {
+		It("should delete a lingering provisioner Pod", func() {
+			p := fakeProvisioner("lingering")
+			Expect(testProvisioners.Put(p)).To(Succeed())
+			pvc := createClaimForNode("lingering", p)
+			pod := &corev1.Pod{}
+			pod.Name = utils.ResourceName(pvNameForPVC(pvc), provisioner)
+			pod.Namespace = testNamespace
+			verify(pod, func(err error) error { return err })
+
+			pv := &corev1.PersistentVolume{}
+			pv.Name = pvNameForPVC(pvc)
+			bindClaim(pvc, pv.Name, resource.MustParse("1G"))
+			verify(pod, isNotFound)
+		})
+	})
+	Describe("growing a bound claim", func() {
+		It("should run the expander and update the capacity", func() {
+			p := fakeProvisioner("expand")
+			p.Spec.Containers.Expander = &storageapi.ProvisionerContainer{Command: []string{"expand"}}
+			Expect(testProvisioners.Put(p)).To(Succeed())
+			pvc, pv := provisionBoundClaim("expand", p)
+
+			requestCapacity(pvc, resource.MustParse("2G"))
+
+			pod := &corev1.Pod{}
+			pod.Name = utils.ResourceName(pv.Name, expander)
+			pod.Namespace = testNamespace
+			verify(pod, func(err error) error {
+				if err != nil {
+					return err
+				}
+				if !hasEnv(pod, "STORAGE_PREVIOUS_CAPACITY", "1G") {
+					return fmt.Errorf("expander Pod does not specify the previous capacity")
+				}
+				return nil
+			})
+			setPodPhase(pod, corev1.PodSucceeded)
+			verify(pv, hasCapacity(func() corev1.ResourceList { return pv.Spec.Capacity }, "2G"))
+			verify(pvc, func(err error) error {
+				if err != nil {
+					return err
+				}
+				if err = hasCapacity(func() corev1.ResourceList { return pvc.Status.Capacity }, "2G")(nil); err != nil {
+					return err
+				}
+				for _, c := range pvc.Status.Conditions {
+					if c.Type == corev1.PersistentVolumeClaimResizing {
+						return fmt.Errorf("claim still has condition %s", c.Type)
+					}
+				}
+				return nil
+			})
+			verify(pod, isNotFound)
+		})
+		It("should report a provisioner that cannot expand volumes", func() {
+			p := fakeProvisioner("noexpand")
+			Expect(testProvisioners.Put(p)).To(Succeed())
+			pvc, pv := provisionBoundClaim("noexpand", p)
+
+			requestCapacity(pvc, resource.MustParse("2G"))
+
+			Eventually(func() error {
+				return hasEvent(pvc, "ExpansionNotSupported")
+			}, "10s", "1s").ShouldNot(HaveOccurred())
+			pod := &corev1.Pod{}
+			pod.Name = utils.ResourceName(pv.Name, expander)
+			pod.Namespace = testNamespace
+			verify(pod, notAfter(2*time.Second, func(err error) error { return err }))
+			verify(pv, hasCapacity(func() corev1.ResourceList { return pv.Spec.Capacity }, "1G"))
+		})
+	})
+})
+
+// createClaimForNode creates a claim for the given provisioner that is assigned to a new ready node
+func createClaimForNode(name string, p *storageapi.StorageProvisioner) *corev1.PersistentVolumeClaim {
+	createStorageClass(name, p.Spec.Name, storagev1.VolumeBindingWaitForFirstConsumer)
+	createReadyNode(name + "-node")
+	pvc := newClaim(name+"-pvc", p.Spec.Name, name)
+	pvc.Annotations[annSelectedNode] = name + "-node"
+	Expect(k8sClient.Create(context.TODO(), pvc)).To(Succeed())
+	return pvc
+}
+
+// provisionBoundClaim provisions a claim of 1G and binds it to its PersistentVolume
+func provisionBoundClaim(name string, p *storageapi.StorageProvisioner) (*corev1.PersistentVolumeClaim, *corev1.PersistentVolume) {
+	pvc := createClaimForNode(name, p)
+	pod := &corev1.Pod{}
+	pod.Name = utils.ResourceName(pvNameForPVC(pvc), provisioner)
+	pod.Namespace = testNamespace
+	verify(pod, func(err error) error { return err })
+	setPodPhase(pod, corev1.PodSucceeded)
+	pv := &corev1.PersistentVolume{}
+	pv.Name = pvNameForPVC(pvc)
+	verify(pv, func(err error) error { return err })
+	bindClaim(pvc, pv.Name, pv.Spec.Capacity[corev1.ResourceStorage])
+	return pvc, pv
+}
+
+// bindClaim binds the claim to the given volume since envtest does not run the PersistentVolume binder
+func bindClaim(pvc *corev1.PersistentVolumeClaim, pvName string, capacity resource.Quantity) {
+	key := types.NamespacedName{Name: pvc.Name, Namespace: pvc.Namespace}
+	Eventually(func() error {
+		if err := k8sClient.Get(context.TODO(), key, pvc); err != nil {
+			return err
+		}
+		pvc.Spec.VolumeName = pvName
+		return k8sClient.Update(context.TODO(), pvc)
+	}, "10s", "1s").ShouldNot(HaveOccurred())
+	Eventually(func() error {
+		if err := k8sClient.Get(context.TODO(), key, pvc); err != nil {
+			return err
+		}
+		pvc.Status.Phase = corev1.ClaimBound
+		pvc.Status.Capacity = corev1.ResourceList{corev1.ResourceStorage: capacity}
+		return k8sClient.Status().Update(context.TODO(), pvc)
+	}, "10s", "1s").ShouldNot(HaveOccurred())
+}
+
+func requestCapacity(pvc *corev1.PersistentVolumeClaim, capacity resource.Quantity) {
+	key := types.NamespacedName{Name: pvc.Name, Namespace: pvc.Namespace}
+	Eventually(func() error {
+		if err := k8sClient.Get(context.TODO(), key, pvc); err != nil {
+			return err
+		}
+		pvc.Spec.Resources.Requests[corev1.ResourceStorage] = capacity
+		return k8sClient.Update(context.TODO(), pvc)
+	}, "10s", "1s").ShouldNot(HaveOccurred())
+}
+
+func hasCapacity(capacity func() corev1.ResourceList, expected string) func(error) error {
+	return func(err error) error {
+		if err != nil {
+			return err
+		}
+		actual := capacity()[corev1.ResourceStorage]
+		if actual.Cmp(resource.MustParse(expected)) != 0 {
+			return fmt.Errorf("expected capacity %s but was %s", expected, actual.String())
+		}
+		return nil
+	}
+}
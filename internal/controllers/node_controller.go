@@ -0,0 +1,321 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-logr/logr"
+	storageapi "github.com/mgoltzsche/k8storagex/api/v1alpha1"
+	"github.com/mgoltzsche/k8storagex/internal/utils"
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+// DefaultLostNodeGracePeriod is the duration a node may be NotReady before its volumes are considered lost
+const DefaultLostNodeGracePeriod = time.Hour
+
+var lostNodeResources = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "k8storagex_lost_node_resources_total",
+	Help: "Number of resources that have been cleaned up because their node has been lost",
+}, []string{"resource"})
+
+func init() {
+	metrics.Registry.MustRegister(lostNodeResources)
+}
+
+// NodeReconciler cleans up after nodes that have been deleted or are NotReady longer than the grace period.
+// The PersistentVolumes of such a node cannot be deprovisioned anymore and are finalized without running the deprovisioner.
+type NodeReconciler struct {
+	client.Client
+	Log                 logr.Logger
+	Scheme              *runtime.Scheme
+	ManagerNamespace    string
+	LostNodeGracePeriod time.Duration
+	recorder            record.EventRecorder
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *NodeReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	r.recorder = mgr.GetEventRecorderFor("Node")
+	if r.LostNodeGracePeriod == 0 {
+		r.LostNodeGracePeriod = DefaultLostNodeGracePeriod
+	}
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&corev1.Node{}).
+		Watches(&source.Kind{Type: &corev1.PersistentVolume{}}, handler.EnqueueRequestsFromMapFunc(deletedPersistentVolumeToNodeRequest)).
+		Watches(&source.Kind{Type: &corev1.PersistentVolumeClaim{}}, handler.EnqueueRequestsFromMapFunc(deletedClaimToNodeRequest)).
+		Complete(r)
+}
+
+// deletedPersistentVolumeToNodeRequest maps a PersistentVolume that is being deleted to its node
+// in order to finalize it when the node is lost already.
+func deletedPersistentVolumeToNodeRequest(o client.Object) []reconcile.Request {
+	pv, ok := o.(*corev1.PersistentVolume)
+	if !ok || pv.DeletionTimestamp == nil || !utils.HasString(pv.Finalizers, finalizer) {
+		return nil
+	}
+	return nodeRequests(volumeNodes(pv))
+}
+
+// deletedClaimToNodeRequest maps a PersistentVolumeClaim that is being deleted to the node it was being provisioned on.
+func deletedClaimToNodeRequest(o client.Object) []reconcile.Request {
+	if o.GetDeletionTimestamp() == nil {
+		return nil
+	}
+	nodes := provisionerNodes(o)
+	if nodeName := o.GetAnnotations()[annProvisionerNode]; nodeName != "" {
+		nodes = append(nodes, nodeName)
+	}
+	return nodeRequests(nodes)
+}
+
+func nodeRequests(nodes []string) []reconcile.Request {
+	requests := make([]reconcile.Request, len(nodes))
+	for i, nodeName := range nodes {
+		requests[i] = reconcile.Request{NamespacedName: types.NamespacedName{Name: nodeName}}
+	}
+	return requests
+}
+
+// +kubebuilder:rbac:groups=core,resources=nodes,verbs=get;list;watch
+// +kubebuilder:rbac:groups=core,resources=persistentvolumes,verbs=get;list;update;watch
+// +kubebuilder:rbac:groups=core,resources=persistentvolumeclaims,verbs=get;list;update;watch
+// +kubebuilder:rbac:groups=core,resources=pods,verbs=get;list;delete;watch
+// +kubebuilder:rbac:groups=k8storagex.mgoltzsche.github.com,resources=caches,verbs=get;list;watch
+// +kubebuilder:rbac:groups=k8storagex.mgoltzsche.github.com,resources=caches/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups="",resources=events,verbs=create;patch
+
+// Reconcile finalizes the volumes of a lost node.
+func (r *NodeReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	log := r.Log.WithValues("node", req.Name)
+
+	node, err := r.getNode(ctx, req.Name)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if node == nil {
+		log.Info("Node has been deleted")
+	} else {
+		notReadySince := nodeNotReadySince(node)
+		if notReadySince == nil {
+			return ctrl.Result{}, nil
+		}
+		if d := time.Until(notReadySince.Add(r.LostNodeGracePeriod)); d > 0 {
+			return ctrl.Result{RequeueAfter: d}, nil
+		}
+		log.Info(fmt.Sprintf("Node is NotReady for longer than %s", r.LostNodeGracePeriod))
+	}
+
+	err = r.deleteProvisionerPods(ctx, req.Name, log)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	err = r.finalizePersistentVolumes(ctx, req.Name, log)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	err = r.finalizePersistentVolumeClaims(ctx, req.Name, log)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{}, r.removeCacheNodes(ctx, req.Name, log)
+}
+
+// getNode returns the node with the given name or hostname label or nil if it does not exist.
+func (r *NodeReconciler) getNode(ctx context.Context, name string) (*corev1.Node, error) {
+	node := &corev1.Node{}
+	err := r.Client.Get(ctx, types.NamespacedName{Name: name}, node)
+	if err == nil {
+		return node, nil
+	}
+	if !apierrors.IsNotFound(err) {
+		return nil, err
+	}
+	// PersistentVolumes refer to the node by its hostname label which may differ from its name
+	nodes := &corev1.NodeList{}
+	err = r.Client.List(ctx, nodes, client.MatchingLabels{KeyNode: name})
+	if err != nil || len(nodes.Items) == 0 {
+		return nil, err
+	}
+	return &nodes.Items[0], nil
+}
+
+// nodeNotReadySince returns the time the node became NotReady or nil if it is ready.
+func nodeNotReadySince(node *corev1.Node) *time.Time {
+	for _, c := range node.Status.Conditions {
+		if c.Type == corev1.NodeReady {
+			if c.Status == corev1.ConditionTrue {
+				return nil
+			}
+			return &c.LastTransitionTime.Time
+		}
+	}
+	return nil
+}
+
+// deleteProvisionerPods force-deletes the provisioner Pods that are pinned to the lost node.
+func (r *NodeReconciler) deleteProvisionerPods(ctx context.Context, nodeName string, log logr.Logger) error {
+	pods := &corev1.PodList{}
+	err := r.Client.List(ctx, pods, client.InNamespace(r.ManagerNamespace))
+	if err != nil {
+		return err
+	}
+	for i, pod := range pods.Items {
+		if pod.Spec.NodeName != nodeName || !isProvisionerPod(&pod) {
+			continue
+		}
+		err = r.Client.Delete(ctx, &pods.Items[i], client.GracePeriodSeconds(0))
+		if err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+		log.Info("Deleted provisioner Pod of lost node", "pod", fmt.Sprintf("%s/%s", pod.Namespace, pod.Name))
+	}
+	return nil
+}
+
+func isProvisionerPod(pod *corev1.Pod) bool {
+	for _, ann := range []string{annPVName, annPVCName, annSnapshotName, annStorageProvisionerName} {
+		if pod.Annotations[ann] != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// finalizePersistentVolumes removes the finalizer from the lost node's PersistentVolumes that are being deleted
+// since their deprovisioner cannot run anymore.
+func (r *NodeReconciler) finalizePersistentVolumes(ctx context.Context, nodeName string, log logr.Logger) error {
+	pvs := &corev1.PersistentVolumeList{}
+	err := r.Client.List(ctx, pvs)
+	if err != nil {
+		return err
+	}
+	for i, pv := range pvs.Items {
+		if pv.DeletionTimestamp == nil || !utils.HasString(pv.Finalizers, finalizer) {
+			continue
+		}
+		if utils.HasString(provisionerNodes(&pv), nodeName) {
+			// Skip the deprovisioner on the lost node only since the ReadOnlyMany volume exists on other nodes as well
+			if _, err = removeProvisionerNode(ctx, r.Client, &pvs.Items[i], nodeName); err != nil {
+				return err
+			}
+			log.Info("Skipping deprovisioner of ReadOnlyMany PersistentVolume on lost node", "persistentvolume", pv.Name)
+			lostNodeResources.WithLabelValues("persistentvolume").Inc()
+			r.recorder.Event(&pvs.Items[i], corev1.EventTypeWarning, "NodeLost", fmt.Sprintf("Skipping deprovisioner since node %s is lost", nodeName))
+			continue
+		}
+		if pvNode, err := nodeNameFromPV(&pv); err != nil || pvNode != nodeName {
+			continue
+		}
+		pv := &pvs.Items[i]
+		utils.RemoveString(&pv.Finalizers, finalizer)
+		if err = r.Client.Update(ctx, pv); err != nil {
+			return err
+		}
+		log.Info("Finalized PersistentVolume of lost node", "persistentvolume", pv.Name)
+		lostNodeResources.WithLabelValues("persistentvolume").Inc()
+		msg := fmt.Sprintf("Finalized PersistentVolume without deprovisioning it since node %s is lost", nodeName)
+		r.recorder.Event(pv, corev1.EventTypeWarning, "NodeLost", msg)
+		if ref := pv.Spec.ClaimRef; ref != nil {
+			r.recorder.Event(ref, corev1.EventTypeWarning, "NodeLost", msg)
+		}
+	}
+	return nil
+}
+
+// finalizePersistentVolumeClaims drops the provisioner record from deleted claims that were being provisioned on the lost node
+// in order to skip the deprovisioner that would otherwise clean up after the interrupted provisioner.
+func (r *NodeReconciler) finalizePersistentVolumeClaims(ctx context.Context, nodeName string, log logr.Logger) error {
+	claims := &corev1.PersistentVolumeClaimList{}
+	err := r.Client.List(ctx, claims)
+	if err != nil {
+		return err
+	}
+	for i, claim := range claims.Items {
+		if claim.DeletionTimestamp == nil || !utils.HasString(claim.Finalizers, finalizer) {
+			continue
+		}
+		if utils.HasString(provisionerNodes(&claim), nodeName) {
+			if _, err = removeProvisionerNode(ctx, r.Client, &claims.Items[i], nodeName); err != nil {
+				return err
+			}
+			log.Info("Skipping deprovisioner of deleted ReadOnlyMany PersistentVolumeClaim on lost node", "persistentvolumeclaim", fmt.Sprintf("%s/%s", claim.Namespace, claim.Name))
+			lostNodeResources.WithLabelValues("persistentvolumeclaim").Inc()
+			r.recorder.Event(&claims.Items[i], corev1.EventTypeWarning, "NodeLost", fmt.Sprintf("Skipping deprovisioner since node %s is lost", nodeName))
+			continue
+		}
+		if claim.Annotations[annProvisionerNode] != nodeName {
+			continue
+		}
+		claim := &claims.Items[i]
+		delete(claim.Annotations, annStorageProvisionerSpec)
+		delete(claim.Annotations, annProvisionerNode)
+		delete(claim.Annotations, annProvisionerPath)
+		if err = r.Client.Update(ctx, claim); err != nil {
+			return err
+		}
+		log.Info("Skipping deprovisioner of deleted PersistentVolumeClaim on lost node", "persistentvolumeclaim", fmt.Sprintf("%s/%s", claim.Namespace, claim.Name))
+		lostNodeResources.WithLabelValues("persistentvolumeclaim").Inc()
+		msg := fmt.Sprintf("Skipping deprovisioner since node %s is lost", nodeName)
+		r.recorder.Event(claim, corev1.EventTypeWarning, "NodeLost", msg)
+	}
+	return nil
+}
+
+// removeCacheNodes removes the lost node from the Caches' status
+// in order to not treat the node's volumes as in use or committing.
+func (r *NodeReconciler) removeCacheNodes(ctx context.Context, nodeName string, log logr.Logger) error {
+	caches := &storageapi.CacheList{}
+	err := r.Client.List(ctx, caches)
+	if err != nil {
+		return err
+	}
+	for i := range caches.Items {
+		cache := &caches.Items[i]
+		nodes := make([]storageapi.NodeStatus, 0, len(cache.Status.Nodes))
+		for _, n := range cache.Status.Nodes {
+			if n.Name != nodeName {
+				nodes = append(nodes, n)
+			}
+		}
+		if len(nodes) == len(cache.Status.Nodes) {
+			continue
+		}
+		cache.Status.Nodes = nodes
+		if err = r.Client.Status().Update(ctx, cache); err != nil {
+			return err
+		}
+		log.Info("Removed lost node from Cache", "cache", fmt.Sprintf("%s/%s", cache.Namespace, cache.Name))
+		lostNodeResources.WithLabelValues("cache").Inc()
+		msg := fmt.Sprintf("Removed node %s from status since it is lost", nodeName)
+		r.recorder.Event(cache, corev1.EventTypeWarning, "NodeLost", msg)
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	storageapi "github.com/mgoltzsche/k8storagex/api/v1alpha1"
+	"github.com/mgoltzsche/k8storagex/internal/utils"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+var _ = Describe("NodeController", func() {
+	Describe("lost node", func() {
+		It("should finalize the node's volumes once the grace period elapsed", func() {
+			p := fakeProvisioner("lostnode")
+			Expect(testProvisioners.Put(p)).To(Succeed())
+			pvc, pv := provisionBoundClaim("lostnode", p)
+			cache := &storageapi.Cache{}
+			cache.Name = "lostnode"
+			cache.Namespace = testNamespace
+			Expect(k8sClient.Create(context.TODO(), cache)).To(Succeed())
+			updateCacheStatus(cache, func() {
+				cache.Status.Nodes = []storageapi.NodeStatus{{
+					Name:     "lostnode-node",
+					LastUsed: metav1.Now(),
+					Volumes:  []storageapi.VolumeStatus{{Name: pv.Name, Created: metav1.Now()}},
+				}}
+			})
+
+			By("deleting the claim")
+			Expect(k8sClient.Delete(context.TODO(), pvc)).To(Succeed())
+			verify(pvc, isNotFound)
+			pod := &corev1.Pod{}
+			pod.Name = utils.ResourceName(pv.Name, deprovisioner)
+			pod.Namespace = testNamespace
+			verify(pod, func(err error) error { return err })
+
+			By("making the node NotReady")
+			setNodeReady("lostnode-node", corev1.ConditionFalse)
+			verify(pv, notAfter(2*time.Second, isNotFound))
+
+			By("waiting for the grace period")
+			verify(pv, isNotFound)
+			verify(cache, func(err error) error {
+				if err != nil {
+					return err
+				}
+				if len(cache.Status.Nodes) > 0 {
+					return fmt.Errorf("Cache status still lists node %s", cache.Status.Nodes[0].Name)
+				}
+				return nil
+			})
+		})
+		It("should not finalize the volumes of a ready node", func() {
+			p := fakeProvisioner("readynode")
+			Expect(testProvisioners.Put(p)).To(Succeed())
+			pvc, pv := provisionBoundClaim("readynode", p)
+			Expect(k8sClient.Delete(context.TODO(), pvc)).To(Succeed())
+			verify(pvc, isNotFound)
+			verify(pv, notAfter(testLostNodeGracePeriod+2*time.Second, isNotFound))
+		})
+	})
+})
+
+func setNodeReady(nodeName string, status corev1.ConditionStatus) {
+	node := &corev1.Node{}
+	Eventually(func() error {
+		if err := k8sClient.Get(context.TODO(), types.NamespacedName{Name: nodeName}, node); err != nil {
+			return err
+		}
+		node.Status.Conditions = []corev1.NodeCondition{{
+			Type:               corev1.NodeReady,
+			Status:             status,
+			LastTransitionTime: metav1.Now(),
+		}}
+		return k8sClient.Status().Update(context.TODO(), node)
+	}, "10s", "1s").ShouldNot(HaveOccurred())
+}
@@ -0,0 +1,133 @@
+package controllers
+
+import (
+	"context"
+	"sort"
+
+	storageapi "github.com/mgoltzsche/k8storagex/api/v1alpha1"
+	"github.com/mgoltzsche/k8storagex/internal/utils"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// nodeCandidate is a node a volume can be provisioned on
+type nodeCandidate struct {
+	Name            string
+	HasLatestImage  bool
+	CacheGeneration int64
+	// AllocatableStorage is the node's allocatable ephemeral storage.
+	// It is used as approximation since the free space within the provisioner's node path is unknown.
+	AllocatableStorage int64
+}
+
+// selectNode selects a node for a PersistentVolumeClaim in Immediate binding mode.
+// Only ready, schedulable nodes that are mapped by the provisioner and whose taints are tolerated by its podTemplate are considered.
+// Nodes holding the latest cache generation are preferred, otherwise the node with the most allocatable ephemeral storage is chosen.
+func selectNode(ctx context.Context, c client.Client, claim *corev1.PersistentVolumeClaim, provisioner *storageapi.StorageProvisioner) (string, error) {
+	nodes := &corev1.NodeList{}
+	if err := c.List(ctx, nodes); err != nil {
+		return "", errors.Wrap(err, "select node")
+	}
+	cache, err := cacheForClaim(ctx, c, claim)
+	if err != nil {
+		return "", errors.Wrap(err, "select node")
+	}
+	candidates := nodeCandidates(nodes.Items, &provisioner.Spec, cache)
+	if len(candidates) == 0 {
+		return "", errors.New("select node: no ready node matches the provisioner's node list")
+	}
+	return candidates[0].Name, nil
+}
+
+// nodeCandidates returns the eligible nodes, best candidate first
+func nodeCandidates(nodes []corev1.Node, spec *storageapi.StorageProvisionerSpec, cache *storageapi.Cache) []nodeCandidate {
+	cacheNodes := map[string]*storageapi.NodeStatus{}
+	var latestImageID string
+	if cache != nil {
+		for i, n := range cache.Status.Nodes {
+			cacheNodes[n.Name] = &cache.Status.Nodes[i]
+		}
+		if cache.Status.LastImageID != nil {
+			latestImageID = *cache.Status.LastImageID
+		}
+	}
+	candidates := make([]nodeCandidate, 0, len(nodes))
+	for _, node := range nodes {
+		if !isNodeEligible(&node, spec.Nodes, spec.PodTemplate.Tolerations) {
+			continue
+		}
+		candidate := nodeCandidate{Name: node.Name}
+		if storage, ok := node.Status.Allocatable[corev1.ResourceEphemeralStorage]; ok {
+			candidate.AllocatableStorage = storage.Value()
+		}
+		if n := cacheNodes[node.Name]; n != nil {
+			candidate.HasLatestImage = latestImageID != "" && n.LastImageID == latestImageID
+			candidate.CacheGeneration = n.CacheGeneration
+		}
+		candidates = append(candidates, candidate)
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if a.HasLatestImage != b.HasLatestImage {
+			return a.HasLatestImage
+		}
+		if a.CacheGeneration != b.CacheGeneration {
+			return a.CacheGeneration > b.CacheGeneration
+		}
+		if a.AllocatableStorage != b.AllocatableStorage {
+			return a.AllocatableStorage > b.AllocatableStorage
+		}
+		return a.Name < b.Name
+	})
+	return candidates
+}
+
+func isNodeEligible(node *corev1.Node, mapping []storageapi.NodePath, tolerations []corev1.Toleration) bool {
+	if node.DeletionTimestamp != nil || node.Spec.Unschedulable {
+		return false
+	}
+	if _, err := utils.StorageRootPathForNode(node.Name, mapping); err != nil {
+		return false
+	}
+	for i := range node.Spec.Taints {
+		t := &node.Spec.Taints[i]
+		if (t.Effect == corev1.TaintEffectNoSchedule || t.Effect == corev1.TaintEffectNoExecute) && !toleratesTaint(tolerations, t) {
+			return false
+		}
+	}
+	for _, c := range node.Status.Conditions {
+		if c.Type == corev1.NodeReady {
+			return c.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+func toleratesTaint(tolerations []corev1.Toleration, taint *corev1.Taint) bool {
+	for i := range tolerations {
+		if tolerations[i].ToleratesTaint(taint) {
+			return true
+		}
+	}
+	return false
+}
+
+// cacheForClaim returns the Cache the claim refers to or nil if there is none
+func cacheForClaim(ctx context.Context, c client.Client, claim *corev1.PersistentVolumeClaim) (*storageapi.Cache, error) {
+	name := claim.Annotations[annCacheName]
+	if name == "" {
+		return nil, nil
+	}
+	cache := &storageapi.Cache{}
+	err := c.Get(ctx, types.NamespacedName{Name: name, Namespace: claim.Namespace}, cache)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return cache, nil
+}
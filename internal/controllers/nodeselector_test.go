@@ -0,0 +1,89 @@
+package controllers
+
+import (
+	storageapi "github.com/mgoltzsche/k8storagex/api/v1alpha1"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+var _ = DescribeTable("nodeCandidates",
+	func(nodes []corev1.Node, tolerations []corev1.Toleration, cache *storageapi.Cache, expected []string) {
+		spec := &storageapi.StorageProvisionerSpec{
+			Nodes: []storageapi.NodePath{{Name: "node-*", Path: "/data"}},
+		}
+		spec.PodTemplate.Tolerations = tolerations
+		names := []string{}
+		for _, c := range nodeCandidates(nodes, spec, cache) {
+			names = append(names, c.Name)
+		}
+		Expect(names).To(Equal(expected))
+	},
+	Entry("ready node", []corev1.Node{candidateNode("node-a", "1G")}, nil, nil, []string{"node-a"}),
+	Entry("unschedulable node", []corev1.Node{unschedulable(candidateNode("node-a", "1G"))}, nil, nil, []string{}),
+	Entry("NotReady node", []corev1.Node{notReady(candidateNode("node-a", "1G"))}, nil, nil, []string{}),
+	Entry("node without mapping", []corev1.Node{candidateNode("other", "1G")}, nil, nil, []string{}),
+	Entry("tainted node",
+		[]corev1.Node{tainted(candidateNode("node-a", "1G"), corev1.TaintEffectNoSchedule)},
+		nil, nil, []string{}),
+	Entry("tainted node with toleration",
+		[]corev1.Node{tainted(candidateNode("node-a", "1G"), corev1.TaintEffectNoExecute)},
+		[]corev1.Toleration{{Key: "dedicated", Operator: corev1.TolerationOpEqual, Value: "storage"}},
+		nil, []string{"node-a"}),
+	Entry("tainted node with other toleration",
+		[]corev1.Node{tainted(candidateNode("node-a", "1G"), corev1.TaintEffectNoSchedule)},
+		[]corev1.Toleration{{Key: "dedicated", Operator: corev1.TolerationOpEqual, Value: "other"}},
+		nil, []string{}),
+	Entry("node with PreferNoSchedule taint",
+		[]corev1.Node{tainted(candidateNode("node-a", "1G"), corev1.TaintEffectPreferNoSchedule)},
+		nil, nil, []string{"node-a"}),
+	Entry("larger allocatable storage first",
+		[]corev1.Node{candidateNode("node-a", "1G"), candidateNode("node-b", "2G")},
+		nil, nil, []string{"node-b", "node-a"}),
+	Entry("name as tiebreak",
+		[]corev1.Node{candidateNode("node-b", "1G"), candidateNode("node-a", "1G")},
+		nil, nil, []string{"node-a", "node-b"}),
+	Entry("higher cache generation first",
+		[]corev1.Node{candidateNode("node-a", "1G"), candidateNode("node-b", "2G"), candidateNode("node-c", "1G")},
+		nil, candidateCache("", storageapi.NodeStatus{Name: "node-a", CacheGeneration: 3}, storageapi.NodeStatus{Name: "node-c", CacheGeneration: 2}),
+		[]string{"node-a", "node-c", "node-b"}),
+	Entry("latest image first",
+		[]corev1.Node{candidateNode("node-a", "1G"), candidateNode("node-b", "1G")},
+		nil, candidateCache("sha256:latest",
+			storageapi.NodeStatus{Name: "node-a", CacheGeneration: 3, LastImageID: "sha256:previous"},
+			storageapi.NodeStatus{Name: "node-b", CacheGeneration: 2, LastImageID: "sha256:latest"}),
+		[]string{"node-b", "node-a"}),
+)
+
+func candidateNode(name, allocatable string) corev1.Node {
+	node := corev1.Node{}
+	node.Name = name
+	node.Status.Allocatable = corev1.ResourceList{corev1.ResourceEphemeralStorage: resource.MustParse(allocatable)}
+	node.Status.Conditions = []corev1.NodeCondition{{Type: corev1.NodeReady, Status: corev1.ConditionTrue}}
+	return node
+}
+
+func unschedulable(node corev1.Node) corev1.Node {
+	node.Spec.Unschedulable = true
+	return node
+}
+
+func notReady(node corev1.Node) corev1.Node {
+	node.Status.Conditions[0].Status = corev1.ConditionFalse
+	return node
+}
+
+func tainted(node corev1.Node, effect corev1.TaintEffect) corev1.Node {
+	node.Spec.Taints = append(node.Spec.Taints, corev1.Taint{Key: "dedicated", Value: "storage", Effect: effect})
+	return node
+}
+
+func candidateCache(latestImageID string, nodes ...storageapi.NodeStatus) *storageapi.Cache {
+	cache := &storageapi.Cache{}
+	if latestImageID != "" {
+		cache.Status.LastImageID = &latestImageID
+	}
+	cache.Status.Nodes = nodes
+	return cache
+}
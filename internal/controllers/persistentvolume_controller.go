@@ -22,6 +22,8 @@ import (
 	"fmt"
 
 	"github.com/go-logr/logr"
+	storageapi "github.com/mgoltzsche/k8storagex/api/v1alpha1"
+	"github.com/mgoltzsche/k8storagex/internal/agent"
 	"github.com/mgoltzsche/k8storagex/internal/utils"
 	"github.com/pkg/errors"
 	corev1 "k8s.io/api/core/v1"
@@ -32,10 +34,7 @@ import (
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
-	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/predicate"
-	"sigs.k8s.io/controller-runtime/pkg/reconcile"
-	"sigs.k8s.io/controller-runtime/pkg/source"
 )
 
 const (
@@ -43,6 +42,9 @@ const (
 	annPVName                 = "k8storagex.mgoltzsche.github.com/pv-name"
 	annPVDisableDeprovisioner = "k8storagex.mgoltzsche.github.com/pv-deprovisioner-disabled"
 	annPVClaimRef             = "k8storagex.mgoltzsche.github.com/pvc"
+	annPVReleased             = "k8storagex.mgoltzsche.github.com/pv-released"
+	releaser                  = "releaser"
+	envVolumeReleased         = "STORAGE_VOLUME_RELEASED"
 )
 
 // PersistentVolumeReconciler reconciles a Cache object
@@ -52,6 +54,7 @@ type PersistentVolumeReconciler struct {
 	Scheme           *runtime.Scheme
 	ManagerNamespace string
 	Provisioners     Provisioners
+	AgentTokens      agent.TokenSource
 	jobReconciler    *utils.JobReconciler
 	recorder         record.EventRecorder
 }
@@ -64,20 +67,19 @@ func (r *PersistentVolumeReconciler) SetupWithManager(mgr ctrl.Manager) error {
 		Recorder:            r.recorder,
 		AnnotationOwnerName: annPVName,
 	}
-	return ctrl.NewControllerManagedBy(mgr).
+	b := ctrl.NewControllerManagedBy(mgr).
 		For(&corev1.PersistentVolume{}, builder.WithPredicates(predicate.And(
-			hasDeletionTimestamp(),
+			predicate.Or(hasDeletionTimestamp(), isRetainedAndReleased()),
 			hasSupportedProvisionerOrFinalizer(r.Provisioners),
-		))).
-		Watches(&source.Kind{Type: &corev1.Pod{}}, utils.PodToRequestMapper(r.ManagerNamespace, annPVName, "")).
-		//Watches(&source.Kind{Type: &corev1.PersistentVolumeClaim{}}, pvcToRequestMapper()).
-		Complete(r)
+		)))
+	return r.jobReconciler.Watch(b, r.ManagerNamespace).Complete(r)
 }
 
-// +kubebuilder:rbac:groups=core,resources=persistentvolumes,verbs=get;list;update;delete;watch
+// +kubebuilder:rbac:groups=core,resources=persistentvolumes,verbs=get;list;update;patch;delete;watch
 // +kubebuilder:rbac:groups=core,resources=persistentvolumes/finalizers,verbs=update
 // +kubebuilder:rbac:groups=core,resources=persistentvolumes/status,verbs=get;update;patch
-// +kubebuilder:rbac:groups=core,resources=pods,verbs=get;list;create;delete;watch
+// +kubebuilder:rbac:groups=core,resources=pods,verbs=get;list;create;delete;patch;watch
+// +kubebuilder:rbac:groups=batch,resources=jobs,verbs=get;list;create;delete;watch
 // +kubebuilder:rbac:groups="",resources=events,verbs=create;patch
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
@@ -85,6 +87,10 @@ func (r *PersistentVolumeReconciler) SetupWithManager(mgr ctrl.Manager) error {
 // For more details, check Reconcile and its Result here:
 // - https://pkg.go.dev/sigs.k8s.io/controller-runtime@v0.7.0/pkg/reconcile
 func (r *PersistentVolumeReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	return requeueIfPending(r.reconcile(ctx, req))
+}
+
+func (r *PersistentVolumeReconciler) reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
 	log := r.Log.WithValues("persistentvolume", req.NamespacedName.Name)
 
 	log.V(1).Info("Reconciling PersistentVolume")
@@ -110,8 +116,15 @@ func (r *PersistentVolumeReconciler) Reconcile(ctx context.Context, req ctrl.Req
 			return ctrl.Result{}, err
 		}
 
+		// Clean up the releaser Pod of a reclaimed PersistentVolume
+		releaserPodName := types.NamespacedName{Name: utils.ResourceName(pv.Name, releaser), Namespace: r.ManagerNamespace}
+		done, err := utils.DeleteJob(ctx, r.Client, releaserPodName, log)
+		if err != nil || !done {
+			return ctrl.Result{}, err
+		}
+
 		// Run deprovisioner Pod
-		done, err := r.deprovisionVolume(ctx, pv, log)
+		done, err = r.deprovisionVolume(ctx, pv, log)
 		if err != nil || !done {
 			return ctrl.Result{}, err
 		}
@@ -127,7 +140,94 @@ func (r *PersistentVolumeReconciler) Reconcile(ctx context.Context, req ctrl.Req
 		return ctrl.Result{}, nil
 	}
 
-	return ctrl.Result{}, nil
+	if pv.Status.Phase != corev1.VolumeReleased || pv.Spec.PersistentVolumeReclaimPolicy != corev1.PersistentVolumeReclaimRetain {
+		return ctrl.Result{}, nil
+	}
+
+	// Delete a released PersistentVolume when requested in order to run the deprovisioner
+	if pv.Annotations[storageapi.AnnotationReclaim] == storageapi.Enabled {
+		if resolveProvisioner(pv, r.Provisioners) == nil {
+			return ctrl.Result{}, nil // not managed by known StorageProvisioner
+		}
+		log.Info("Reclaiming PersistentVolume")
+		r.event(pv, corev1.EventTypeNormal, "Reclaiming", "Reclaiming retained PersistentVolume")
+		return ctrl.Result{}, client.IgnoreNotFound(r.Client.Delete(ctx, pv))
+	}
+
+	// Run the releaser once the claim of a retained PersistentVolume has been deleted
+	_, err = r.releaseVolume(ctx, pv, log)
+	return ctrl.Result{}, err
+}
+
+// releaseVolume runs the provisioner's releaser, if any, for a retained PersistentVolume whose claim has been deleted.
+func (r *PersistentVolumeReconciler) releaseVolume(ctx context.Context, pv *corev1.PersistentVolume, log logr.Logger) (done bool, err error) {
+	provisionerJSON := pv.Annotations[annStorageProvisionerSpec]
+	if provisionerJSON == "" {
+		return false, nil
+	}
+	provisioner, err := utils.StorageProvisionerFromJSON(provisionerJSON)
+	if err != nil {
+		err = errors.Wrapf(err, "invalid provisioner annotation %s on PersistentVolume", annStorageProvisionerSpec)
+		log.Error(err, "Cannot derive releaser from PersistentVolume")
+		r.event(pv, corev1.EventTypeWarning, "ReleaserSpecAnnotationInvalid", err.Error())
+		return false, nil
+	}
+	if provisioner.Spec.Containers.Releaser == nil || len(provisionerNodes(pv)) > 0 {
+		return true, nil // ReadOnlyMany volumes are never committed
+	}
+
+	log = log.WithValues("provisioner", provisioner.GetProvisionerName())
+
+	podName := types.NamespacedName{
+		Name:      utils.ResourceName(pv.Name, releaser),
+		Namespace: r.ManagerNamespace,
+	}
+	done, err = r.jobReconciler.ReconcileJob(utils.JobRequest{
+		Context:   ctx,
+		Name:      releaser,
+		PodName:   podName,
+		Owner:     pv,
+		ShouldRun: pv.Annotations[annPVReleased] != "true",
+		Create: func() (*corev1.Pod, error) {
+			env, err := utils.AnnotationsToEnv(pv, provisioner.Spec.Env)
+			if err != nil {
+				return nil, errors.Wrap(err, "persistentvolume does not specify annotation")
+			}
+
+			pod, err := utils.NewProvisionerPod(utils.PodSource{
+				ContainerName:          releaser,
+				PodName:                podName,
+				SubstitutedProvisioner: provisioner,
+				Container:              provisioner.Spec.Containers.Releaser,
+				Env:                    env,
+			})
+			if err != nil {
+				return nil, err
+			}
+
+			r.event(pv, corev1.EventTypeNormal, "Releasing", "Releasing retained PersistentVolume")
+
+			return pod, nil
+		},
+		OnCompleted: func(_ *corev1.Pod) (done bool, err error) {
+			pv.Annotations[annPVReleased] = "true"
+			if err = r.Client.Update(ctx, pv); err != nil {
+				return false, err
+			}
+			log.Info("Released PersistentVolume")
+			r.event(pv, corev1.EventTypeNormal, "Released", "Released retained PersistentVolume")
+			return true, nil
+		},
+		Policy: provisioner.Spec.JobPolicy,
+		Log:    log,
+	})
+	if done && err != nil {
+		log = log.WithValues("pod", podName.String())
+		log.Error(err, "Failed to release PersistentVolume")
+		msg := fmt.Sprintf("Failed to release PersistentVolume: %v", err)
+		r.event(pv, corev1.EventTypeWarning, "ReleaserFailed", msg)
+	}
+	return done, err
 }
 
 func (r *PersistentVolumeReconciler) canDeprovision(ctx context.Context, pv *corev1.PersistentVolume, log logr.Logger) (done bool, err error) {
@@ -207,6 +307,22 @@ func (r *PersistentVolumeReconciler) deprovisionVolume(ctx context.Context, pv *
 		Namespace: r.ManagerNamespace,
 	}
 	needsDeprovisioning := pv.Annotations != nil && pv.Annotations[annPVDisableDeprovisioner] != "true"
+	if needsDeprovisioning && len(provisionerNodes(pv)) > 0 {
+		return r.deprovisionReadOnlyMany(ctx, pv, provisioner, log)
+	}
+	if provisioner.Spec.Agent != nil && needsDeprovisioning {
+		if err = r.deprovisionWithAgent(ctx, pv, provisioner, log); err != nil {
+			if errors.Is(err, agent.ErrPending) {
+				return false, err
+			}
+			log.Error(err, "Failed to deprovision PersistentVolume")
+			msg := fmt.Sprintf("Failed to deprovision PersistentVolume: %v", err)
+			r.event(pv, corev1.EventTypeWarning, "DeprovisionerFailed", msg)
+			return false, err
+		}
+		pv.Annotations[annPVDisableDeprovisioner] = "true"
+		return false, r.Client.Update(ctx, pv)
+	}
 	done, err = r.jobReconciler.ReconcileJob(utils.JobRequest{
 		Context:   ctx,
 		Name:      deprovisioner,
@@ -214,9 +330,9 @@ func (r *PersistentVolumeReconciler) deprovisionVolume(ctx context.Context, pv *
 		Owner:     pv,
 		ShouldRun: needsDeprovisioning,
 		Create: func() (*corev1.Pod, error) {
-			env, err := utils.AnnotationsToEnv(pv, provisioner.Spec.Env)
+			env, err := deprovisionerEnv(pv, provisioner)
 			if err != nil {
-				return nil, errors.Wrap(err, "persistentvolume does not specify annotation")
+				return nil, err
 			}
 
 			pod, err := utils.NewProvisionerPod(utils.PodSource{
@@ -238,7 +354,8 @@ func (r *PersistentVolumeReconciler) deprovisionVolume(ctx context.Context, pv *
 			pv.Annotations[annPVDisableDeprovisioner] = "true"
 			return false, r.Client.Update(ctx, pv)
 		},
-		Log: log,
+		Policy: provisioner.Spec.JobPolicy,
+		Log:    log,
 	})
 	if done && err != nil {
 		log = log.WithValues("pod", podName.String())
@@ -249,6 +366,41 @@ func (r *PersistentVolumeReconciler) deprovisionVolume(ctx context.Context, pv *
 	return done, err
 }
 
+// deprovisionWithAgent lets the provisioner's node agent clean up the volume instead of running a deprovisioner Pod
+func (r *PersistentVolumeReconciler) deprovisionWithAgent(ctx context.Context, pv *corev1.PersistentVolume, provisioner *storageapi.StorageProvisioner, log logr.Logger) error {
+	nodeName, err := nodeNameFromPV(pv)
+	if err != nil {
+		return err
+	}
+	env, err := deprovisionerEnv(pv, provisioner)
+	if err != nil {
+		return err
+	}
+	req, err := agentRequest(ctx, r.Client, r.ManagerNamespace, provisioner, &provisioner.Spec.Containers.Deprovisioner, env, hostPathFromPV(pv))
+	if err != nil {
+		return err
+	}
+	a, err := agentForNode(ctx, r.Client, r.ManagerNamespace, provisioner.Spec.Agent, nodeName, r.AgentTokens)
+	if err != nil {
+		return err
+	}
+	log.WithValues("node", nodeName).Info("Deprovisioning PersistentVolume using agent")
+	r.event(pv, corev1.EventTypeNormal, "Deprovisioning", "Deprovisioning PersistentVolume")
+	return a.Unmount(ctx, req)
+}
+
+// deprovisionerEnv maps the PersistentVolume's annotations to env vars and indicates whether the volume has been released before
+func deprovisionerEnv(pv *corev1.PersistentVolume, provisioner *storageapi.StorageProvisioner) ([]corev1.EnvVar, error) {
+	env, err := utils.AnnotationsToEnv(pv, provisioner.Spec.Env)
+	if err != nil {
+		return nil, errors.Wrap(err, "persistentvolume does not specify annotation")
+	}
+	if pv.Annotations[annPVReleased] == "true" {
+		env = append(env, corev1.EnvVar{Name: envVolumeReleased, Value: "true"})
+	}
+	return env, nil
+}
+
 func (r *PersistentVolumeReconciler) event(pv *corev1.PersistentVolume, evtType, reason, message string) {
 	r.recorder.Eventf(pv, evtType, reason, message)
 	if claimRef := r.getClaimRef(pv); claimRef != nil {
@@ -336,18 +488,15 @@ func hasSupportedProvisionerOrFinalizer(provisioners Provisioners) predicate.Pre
 	})
 }
 
-func hasDeletionTimestamp() predicate.Predicate {
+func isRetainedAndReleased() predicate.Predicate {
 	return predicate.NewPredicateFuncs(func(o client.Object) bool {
-		return o.GetDeletionTimestamp() != nil
+		pv, ok := o.(*corev1.PersistentVolume)
+		return ok && pv.Spec.PersistentVolumeReclaimPolicy == corev1.PersistentVolumeReclaimRetain && pv.Status.Phase == corev1.VolumeReleased
 	})
 }
 
-func pvcToRequestMapper() handler.EventHandler {
-	return handler.EnqueueRequestsFromMapFunc(func(o client.Object) []reconcile.Request {
-		pvc, ok := o.(*corev1.PersistentVolumeClaim)
-		if !ok || pvc.Spec.VolumeName == "" {
-			return nil
-		}
-		return []reconcile.Request{{NamespacedName: types.NamespacedName{Name: pvc.Spec.VolumeName}}}
+func hasDeletionTimestamp() predicate.Predicate {
+	return predicate.NewPredicateFuncs(func(o client.Object) bool {
+		return o.GetDeletionTimestamp() != nil
 	})
 }
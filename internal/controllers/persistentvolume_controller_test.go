@@ -0,0 +1,99 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	storageapi "github.com/mgoltzsche/k8storagex/api/v1alpha1"
+	"github.com/mgoltzsche/k8storagex/internal/utils"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var _ = Describe("PersistentVolumeController", func() {
+	Describe("retained volume", func() {
+		It("should be released and reclaimed only after its claim has been deleted", func() {
+			p := fakeProvisioner("reclaim")
+			p.Spec.PersistentVolumeTemplate.PersistentVolumeReclaimPolicy = corev1.PersistentVolumeReclaimRetain
+			p.Spec.Containers.Releaser = &storageapi.ProvisionerContainer{Command: []string{"release"}}
+			Expect(testProvisioners.Put(p)).To(Succeed())
+			pvc, pv := provisionBoundClaim("reclaim", p)
+
+			By("annotating an available volume")
+			setVolumePhase(pv, corev1.VolumeAvailable)
+			annotateVolume(pv, storageapi.AnnotationReclaim, storageapi.Enabled)
+			verify(pv, notAfter(2*time.Second, isDeleting(pv)))
+
+			By("deleting the claim")
+			Expect(k8sClient.Delete(context.TODO(), pvc)).To(Succeed())
+			verify(pvc, isNotFound)
+			annotateVolume(pv, storageapi.AnnotationReclaim, "")
+			setVolumePhase(pv, corev1.VolumeReleased)
+			releaserPod := &corev1.Pod{}
+			releaserPod.Name = utils.ResourceName(pv.Name, releaser)
+			releaserPod.Namespace = testNamespace
+			verify(releaserPod, func(err error) error { return err })
+			setPodPhase(releaserPod, corev1.PodSucceeded)
+			verify(pv, func(err error) error {
+				if err != nil {
+					return err
+				}
+				if pv.Annotations[annPVReleased] != "true" {
+					return fmt.Errorf("PersistentVolume has not been released")
+				}
+				return nil
+			})
+
+			By("reclaiming the released volume")
+			annotateVolume(pv, storageapi.AnnotationReclaim, storageapi.Enabled)
+			deprovisionerPod := &corev1.Pod{}
+			deprovisionerPod.Name = utils.ResourceName(pv.Name, deprovisioner)
+			deprovisionerPod.Namespace = testNamespace
+			verify(deprovisionerPod, func(err error) error { return err })
+			setPodPhase(deprovisionerPod, corev1.PodSucceeded)
+			verify(pv, isNotFound)
+		})
+	})
+})
+
+func setVolumePhase(pv *corev1.PersistentVolume, phase corev1.PersistentVolumePhase) {
+	key := types.NamespacedName{Name: pv.Name}
+	Eventually(func() error {
+		if err := k8sClient.Get(context.TODO(), key, pv); err != nil {
+			return err
+		}
+		pv.Status.Phase = phase
+		return k8sClient.Status().Update(context.TODO(), pv)
+	}, "10s", "1s").ShouldNot(HaveOccurred())
+}
+
+func annotateVolume(pv *corev1.PersistentVolume, key, value string) {
+	name := types.NamespacedName{Name: pv.Name}
+	Eventually(func() error {
+		if err := k8sClient.Get(context.TODO(), name, pv); err != nil {
+			return err
+		}
+		if value == "" {
+			delete(pv.Annotations, key)
+		} else {
+			pv.Annotations[key] = value
+		}
+		return k8sClient.Update(context.TODO(), pv)
+	}, "10s", "1s").ShouldNot(HaveOccurred())
+}
+
+func isDeleting(o client.Object) func(error) error {
+	return func(err error) error {
+		if err != nil {
+			return err
+		}
+		if o.GetDeletionTimestamp() == nil {
+			return fmt.Errorf("%s has not been deleted", o.GetName())
+		}
+		return nil
+	}
+}
@@ -19,10 +19,13 @@ package controllers
 import (
 	"context"
 	"fmt"
+	"strconv"
 
 	"github.com/go-logr/logr"
 	storageapi "github.com/mgoltzsche/k8storagex/api/v1alpha1"
+	"github.com/mgoltzsche/k8storagex/internal/agent"
 	"github.com/mgoltzsche/k8storagex/internal/utils"
+	"github.com/pkg/errors"
 	corev1 "k8s.io/api/core/v1"
 	storage "k8s.io/api/storage/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
@@ -32,6 +35,8 @@ import (
 	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 	"sigs.k8s.io/controller-runtime/pkg/source"
 )
 
@@ -47,6 +52,11 @@ const (
 	finalizerPVProtection     = "kubernetes.io/pv-protection"
 	KeyNode                   = "kubernetes.io/hostname"
 	finalizerPVCProtection    = "kubernetes.io/pvc-protection"
+	annProvisionerNode        = storageapi.AnnotationProvisionerNode
+	annProvisionerPath        = storageapi.AnnotationProvisionerPath
+	// claimConditionProvisionerFailed is set on a claim with the reason its provisioner failed
+	claimConditionProvisionerFailed corev1.PersistentVolumeClaimConditionType = "ProvisionerFailed"
+	envInterrupted                                                            = "STORAGE_PROVISIONING_INTERRUPTED"
 )
 
 // PersistentVolumeClaimReconciler reconciles a Cache object
@@ -56,6 +66,7 @@ type PersistentVolumeClaimReconciler struct {
 	Scheme           *runtime.Scheme
 	ManagerNamespace string
 	Provisioners     Provisioners
+	AgentTokens      agent.TokenSource
 	jobReconciler    *utils.JobReconciler
 	recorder         record.EventRecorder
 }
@@ -69,19 +80,23 @@ func (r *PersistentVolumeClaimReconciler) SetupWithManager(mgr ctrl.Manager) err
 		AnnotationOwnerName:      annPVCName,
 		AnnotationOwnerNamespace: annPVCNamespace,
 	}
-	return ctrl.NewControllerManagedBy(mgr).
+	b := ctrl.NewControllerManagedBy(mgr).
 		For(&corev1.PersistentVolumeClaim{}).
-		Watches(&source.Kind{Type: &corev1.Pod{}}, utils.PodToRequestMapper(r.ManagerNamespace, annPVCName, annPVCNamespace)).
-		Complete(r)
+		Watches(&source.Kind{Type: &storageapi.Cache{}}, handler.EnqueueRequestsFromMapFunc(r.cacheToClaimRequests))
+	return r.jobReconciler.Watch(b, r.ManagerNamespace).Complete(r)
 }
 
 // +kubebuilder:rbac:groups=core,resources=persistentvolumeclaims,verbs=get;list;create;update;patch;watch
 // +kubebuilder:rbac:groups=core,resources=persistentvolumeclaims/finalizers,verbs=update
 // +kubebuilder:rbac:groups=core,resources=persistentvolumeclaims/status,verbs=get;update;patch
-// +kubebuilder:rbac:groups=core,resources=persistentvolumes,verbs=get;list;create;delete
+// +kubebuilder:rbac:groups=core,resources=persistentvolumes,verbs=get;list;create;update;delete
 // +kubebuilder:rbac:groups=core,resources=persistentvolumes/finalizers,verbs=update
 // +kubebuilder:rbac:groups=storage.k8s.io,resources=storageclasses,verbs=get;list;watch
-// +kubebuilder:rbac:groups=core,resources=pods,verbs=get;list;create;delete;watch
+// +kubebuilder:rbac:groups=core,resources=nodes,verbs=get;list;watch
+// +kubebuilder:rbac:groups=k8storagex.mgoltzsche.github.com,resources=cachesnapshots,verbs=get;list;watch
+// +kubebuilder:rbac:groups=k8storagex.mgoltzsche.github.com,resources=caches,verbs=get;list;watch
+// +kubebuilder:rbac:groups=core,resources=pods,verbs=get;list;create;delete;patch;watch
+// +kubebuilder:rbac:groups=batch,resources=jobs,verbs=get;list;create;delete;watch
 // +kubebuilder:rbac:groups="",resources=events,verbs=create;patch
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
@@ -89,6 +104,10 @@ func (r *PersistentVolumeClaimReconciler) SetupWithManager(mgr ctrl.Manager) err
 // For more details, check Reconcile and its Result here:
 // - https://pkg.go.dev/sigs.k8s.io/controller-runtime@v0.7.0/pkg/reconcile
 func (r *PersistentVolumeClaimReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	return requeueIfPending(r.reconcile(ctx, req))
+}
+
+func (r *PersistentVolumeClaimReconciler) reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
 	log := r.Log.WithValues("persistentvolumeclaim", req.NamespacedName.String())
 
 	// Get PVC
@@ -103,11 +122,7 @@ func (r *PersistentVolumeClaimReconciler) Reconcile(ctx context.Context, req ctr
 
 	if claim.DeletionTimestamp != nil {
 		if utils.HasString(claim.Finalizers, finalizerPVCProtection) {
-			if claim.Annotations[storageapi.AnnotationPersistentVolumeClaimNoProtection] == storageapi.Enabled {
-				// Remove pvc-protection finalizers
-				utils.RemoveString(&claim.Finalizers, finalizerPVCProtection)
-				return ctrl.Result{}, r.Client.Status().Update(ctx, claim)
-			}
+			// Wait for the claim to be released by its Pods
 			return ctrl.Result{}, nil
 		}
 		// Clean up pending/failed provisioner Pods and their (partially created) volumes
@@ -141,6 +156,18 @@ func (r *PersistentVolumeClaimReconciler) Reconcile(ctx context.Context, req ctr
 	log = log.WithValues("provisioner", provisionerSpec.GetProvisionerName())
 	log.V(1).Info("Reconciling PersistentVolumeClaim")
 
+	// Clean up after the provisioner and expand the bound PersistentVolume when the claim requests more storage
+	if claim.Spec.VolumeName != "" {
+		done, err := r.deleteProvisionerPods(ctx, claim, log)
+		if err != nil || !done {
+			return ctrl.Result{}, err
+		}
+		if err = r.recordProvisioned(ctx, claim, log); err != nil {
+			return ctrl.Result{}, err
+		}
+		return ctrl.Result{}, r.expand(ctx, claim, provisionerSpec, log)
+	}
+
 	// Ignore PVC when provisioner or StorageClass does not match
 	should, err := r.shouldProvision(ctx, claim, provisionerSpec, log)
 	if err != nil || !should {
@@ -176,8 +203,11 @@ func (r *PersistentVolumeClaimReconciler) deprovision(ctx context.Context, claim
 	err = r.Client.Get(ctx, pvName, pv)
 	if err != nil {
 		if apierrors.IsNotFound(err) {
-			// TODO: run volume deprovisioner pod to clean up what the interrupted provisioner may have left behind
-			return true, nil // PersistentVolume doesn't exist anymore
+			// Clean up what an interrupted provisioner may have left behind
+			if len(provisionerNodes(claim)) > 0 && claim.Spec.VolumeName == "" {
+				return r.deprovisionInterruptedReadOnlyMany(ctx, claim, log)
+			}
+			return r.deprovisionInterrupted(ctx, claim, log)
 		}
 		return false, err
 	}
@@ -194,7 +224,148 @@ func (r *PersistentVolumeClaimReconciler) deprovision(ctx context.Context, claim
 	return true, nil // marked PersistentVolume as deleted, not waiting for it to be actually deleted
 }
 
+// deprovisionInterrupted runs the deprovisioner for a claim that is deleted before its PersistentVolume has been created.
+// It runs on the node that has been recorded on the claim when the provisioner was started (see recordProvisioner).
+// The deprovisioner is derived from the registered StorageProvisioner since users can modify the claim's annotations.
+func (r *PersistentVolumeClaimReconciler) deprovisionInterrupted(ctx context.Context, claim *corev1.PersistentVolumeClaim, log logr.Logger) (done bool, err error) {
+	nodeName := claim.Annotations[annProvisionerNode]
+	// The PersistentVolume has been deprovisioned already when the claim was bound
+	shouldRun := nodeName != "" && claim.Spec.VolumeName == ""
+	var provisionerSpec *storageapi.StorageProvisioner
+	var policy storageapi.JobPolicy
+	if shouldRun {
+		log = log.WithValues("node", nodeName)
+		provisionerSpec, err = r.interruptedProvisioner(ctx, claim, nodeName)
+		if err != nil {
+			log.Error(err, "Cannot derive deprovisioner for PersistentVolumeClaim")
+			r.recorder.Eventf(claim, corev1.EventTypeWarning, "DeprovisionerUnavailable", err.Error())
+			return false, nil
+		}
+		log = log.WithValues("provisioner", provisionerSpec.GetProvisionerName())
+		policy = provisionerSpec.Spec.JobPolicy
+	}
+	if shouldRun && provisionerSpec.Spec.Agent != nil {
+		if err = r.deprovisionInterruptedWithAgent(ctx, claim, provisionerSpec, nodeName, log); err != nil {
+			if errors.Is(err, agent.ErrPending) {
+				return false, err
+			}
+			log.Error(err, "Failed to clean up interrupted provisioner")
+			r.recorder.Eventf(claim, corev1.EventTypeWarning, "DeprovisionerFailed", "Failed to clean up interrupted provisioner: %v", err)
+			return false, err
+		}
+		return false, r.clearProvisionerRecord(ctx, claim)
+	}
+	podName := types.NamespacedName{
+		Name:      utils.ResourceName(pvNameForPVC(claim), deprovisioner),
+		Namespace: r.ManagerNamespace,
+	}
+	done, err = r.jobReconciler.ReconcileJob(utils.JobRequest{
+		Context:   ctx,
+		Name:      deprovisioner,
+		PodName:   podName,
+		Owner:     claim,
+		ShouldRun: shouldRun,
+		Create: func() (*corev1.Pod, error) {
+			env, err := utils.AnnotationsToEnv(claim, provisionerSpec.Spec.Env)
+			if err != nil {
+				return nil, errors.Wrap(err, "persistentvolumeclaim does not specify annotation")
+			}
+			env = append(env, corev1.EnvVar{Name: envInterrupted, Value: "true"})
+			pod, err := utils.NewProvisionerPod(utils.PodSource{
+				ContainerName:          deprovisioner,
+				PodName:                podName,
+				SubstitutedProvisioner: provisionerSpec,
+				Container:              &provisionerSpec.Spec.Containers.Deprovisioner,
+				Env:                    env,
+			})
+			if err != nil {
+				return nil, err
+			}
+
+			log.Info("Cleaning up interrupted provisioner")
+			r.recorder.Event(claim, corev1.EventTypeNormal, "Deprovisioning", "Cleaning up interrupted provisioner")
+
+			return pod, nil
+		},
+		OnCompleted: func(_ *corev1.Pod) (done bool, err error) {
+			return false, r.clearProvisionerRecord(ctx, claim)
+		},
+		Policy: policy,
+		Log:    log,
+	})
+	if done && err != nil {
+		log.Error(err, "Failed to clean up interrupted provisioner")
+		r.recorder.Eventf(claim, corev1.EventTypeWarning, "DeprovisionerFailed", "Failed to clean up interrupted provisioner: %v", err)
+	}
+	return done, err
+}
+
+// interruptedProvisioner returns the registered StorageProvisioner of a claim substituted for the given node
+func (r *PersistentVolumeClaimReconciler) interruptedProvisioner(ctx context.Context, claim *corev1.PersistentVolumeClaim, nodeName string) (*storageapi.StorageProvisioner, error) {
+	provisionerSpec := resolveProvisioner(claim, r.Provisioners)
+	if provisionerSpec == nil {
+		return nil, errors.Errorf("StorageProvisioner %q is not registered", claim.Annotations[annStorageProvisioner])
+	}
+	if err := substituteProvisioner(ctx, r.Client, claim, provisionerSpec, nodeName); err != nil {
+		return nil, err
+	}
+	return provisionerSpec, nil
+}
+
+// deprovisionInterruptedWithAgent lets the provisioner's node agent clean up what an interrupted provisioner left behind
+func (r *PersistentVolumeClaimReconciler) deprovisionInterruptedWithAgent(ctx context.Context, claim *corev1.PersistentVolumeClaim, provisionerSpec *storageapi.StorageProvisioner, nodeName string, log logr.Logger) error {
+	if nodeName == "" {
+		return errors.Errorf("missing annotation %s", annProvisionerNode)
+	}
+	env, err := utils.AnnotationsToEnv(claim, provisionerSpec.Spec.Env)
+	if err != nil {
+		return errors.Wrap(err, "persistentvolumeclaim does not specify annotation")
+	}
+	env = append(env, corev1.EnvVar{Name: envInterrupted, Value: "true"})
+	req, err := agentRequest(ctx, r.Client, r.ManagerNamespace, provisionerSpec, &provisionerSpec.Spec.Containers.Deprovisioner, env, claim.Annotations[annProvisionerPath])
+	if err != nil {
+		return err
+	}
+	a, err := agentForNode(ctx, r.Client, r.ManagerNamespace, provisionerSpec.Spec.Agent, nodeName, r.AgentTokens)
+	if err != nil {
+		return err
+	}
+	log.Info("Cleaning up interrupted provisioner using agent")
+	r.recorder.Event(claim, corev1.EventTypeNormal, "Deprovisioning", "Cleaning up interrupted provisioner")
+	return a.Unmount(ctx, req)
+}
+
+// recordProvisioner records the node and path of a provisioner on the claim before the provisioner is started.
+// This allows to clean up after the provisioner when the claim is deleted before the PersistentVolume has been created.
+// It also exposes the provisioning phase, the provisioner Pod (unless an agent is used), node and path to the claim's users.
+func (r *PersistentVolumeClaimReconciler) recordProvisioner(ctx context.Context, claim *corev1.PersistentVolumeClaim, provisionerSpec *storageapi.StorageProvisioner, nodeName, podName string) error {
+	if claim.Annotations == nil {
+		claim.Annotations = map[string]string{}
+	}
+	claim.Annotations[storageapi.AnnotationProvisioningPhase] = string(storageapi.ProvisioningPhaseProvisioning)
+	claim.Annotations[annProvisionerNode] = nodeName
+	if podName != "" {
+		claim.Annotations[storageapi.AnnotationProvisionerPod] = podName
+	}
+	if hostPath := provisionerSpec.Spec.PersistentVolumeTemplate.HostPath; hostPath != nil {
+		claim.Annotations[annProvisionerPath] = hostPath.Path
+	}
+	return errors.Wrap(r.Client.Update(ctx, claim), "record provisioner")
+}
+
+func (r *PersistentVolumeClaimReconciler) clearProvisionerRecord(ctx context.Context, claim *corev1.PersistentVolumeClaim) error {
+	delete(claim.Annotations, annStorageProvisionerSpec) // recorded by previous versions
+	delete(claim.Annotations, annProvisionerNode)
+	delete(claim.Annotations, annProvisionerPath)
+	delete(claim.Annotations, storageapi.AnnotationProvisionerNodes)
+	delete(claim.Annotations, annProvisionerParams) // recorded by previous versions
+	return r.Client.Update(ctx, claim)
+}
+
 func (r *PersistentVolumeClaimReconciler) provision(ctx context.Context, claim *corev1.PersistentVolumeClaim, provisionerSpec *storageapi.StorageProvisioner, log logr.Logger) (done bool, err error) {
+	if hasAccessMode(claim, corev1.ReadOnlyMany) {
+		return r.provisionReadOnlyMany(ctx, claim, provisionerSpec, log)
+	}
 	pv := &corev1.PersistentVolume{}
 	pvName := types.NamespacedName{Name: pvNameForPVC(claim)}
 	err = r.Client.Get(ctx, pvName, pv)
@@ -205,12 +376,28 @@ func (r *PersistentVolumeClaimReconciler) provision(ctx context.Context, claim *
 
 	env, errAnn := utils.AnnotationsToEnv(claim, provisionerSpec.Spec.Env)
 	if errAnn != nil {
-		r.recorder.Eventf(claim, corev1.EventTypeWarning, "AnnotationMissing", err.Error())
+		r.recorder.Eventf(claim, corev1.EventTypeWarning, "AnnotationMissing", errAnn.Error())
+	}
+
+	var snapshot *storageapi.CacheSnapshot
+	if !pvExists {
+		snapshot, err = r.snapshotForClaim(ctx, claim, provisionerSpec)
+		if err != nil {
+			r.recorder.Eventf(claim, corev1.EventTypeWarning, "SnapshotInvalid", err.Error())
+			return false, err
+		}
+		if snapshot != nil {
+			env = append(env, snapshotEnv(snapshot)...)
+		}
 	}
 
 	nodeName := claim.Annotations[annSelectedNode]
 	log = log.WithValues("persistentvolume", pvName.Name)
 	if nodeName == "" {
+		if !pvExists {
+			// Immediate binding mode: no consumer selected a node
+			return false, r.assignNode(ctx, claim, provisionerSpec, snapshot, log)
+		}
 		log.Info("PersistentVolumeClaim is not assigned to a node")
 	} else {
 		log = log.WithValues("node", nodeName)
@@ -220,23 +407,30 @@ func (r *PersistentVolumeClaimReconciler) provision(ctx context.Context, claim *
 		Name:      utils.ResourceName(pvNameForPVC(claim), provisioner),
 		Namespace: r.ManagerNamespace,
 	}
+	shouldRun := !pvExists && nodeName != "" && errAnn == nil
+	if provisionerSpec.Spec.Agent != nil && shouldRun {
+		if err = r.provisionWithAgent(ctx, claim, provisionerSpec, nodeName, env, log); err != nil {
+			if errors.Is(err, agent.ErrPending) {
+				return false, err
+			}
+			log.Error(err, "Failed to provision PersistentVolume")
+			msg := fmt.Sprintf("Failed to provision PersistentVolume %s: %v", pvName.Name, err)
+			r.recorder.Eventf(claim, corev1.EventTypeWarning, "ProvisionerFailed", msg)
+			if e := r.setProvisionerFailedCondition(ctx, claim, msg); e != nil {
+				log.Error(e, "Failed to set PersistentVolumeClaim condition")
+			}
+			return false, err
+		}
+		return true, nil
+	}
 	done, err = r.jobReconciler.ReconcileJob(utils.JobRequest{
 		Context:   ctx,
 		Name:      provisioner,
 		PodName:   podName,
 		Owner:     claim,
-		ShouldRun: !pvExists && nodeName != "" && errAnn == nil,
+		ShouldRun: shouldRun,
 		Create: func() (*corev1.Pod, error) {
-			nodePath, err := utils.StorageRootPathForNode(nodeName, provisionerSpec.Spec.Nodes)
-			if err != nil {
-				return nil, fmt.Errorf("invalid storageprovisioner: %w", err)
-			}
-			err = utils.SubstituteProvisionerPlaceholders(provisionerSpec, utils.ProvisionerParams{
-				NodeName:              nodeName,
-				NodePath:              nodePath,
-				PersistentVolumeName:  pvName.Name,
-				PersistentVolumeClaim: types.NamespacedName{Name: claim.Name, Namespace: claim.Namespace},
-			})
+			err := substituteProvisioner(ctx, r.Client, claim, provisionerSpec, nodeName)
 			if err != nil {
 				return nil, err
 			}
@@ -254,7 +448,14 @@ func (r *PersistentVolumeClaimReconciler) provision(ctx context.Context, claim *
 				return nil, err
 			}
 			utils.CopyAnnotations(claim, pod, provisionerSpec.Spec.Env)
-			pod.Annotations[annStorageProvisionerSpec], err = utils.StorageProvisionerToJSON(provisionerSpec)
+			provisionerJSON, err := utils.StorageProvisionerToJSON(provisionerSpec)
+			if err != nil {
+				return nil, err
+			}
+			pod.Annotations[annStorageProvisionerSpec] = provisionerJSON
+			if err = r.recordProvisioner(ctx, claim, provisionerSpec, nodeName, podName.Name); err != nil {
+				return nil, err
+			}
 
 			r.recorder.Event(claim, corev1.EventTypeNormal, "Provisioning", "Provisioning PersistentVolume")
 
@@ -267,30 +468,249 @@ func (r *PersistentVolumeClaimReconciler) provision(ctx context.Context, claim *
 			if err != nil {
 				return true, fmt.Errorf("invalid/missing provisioner pod annotation %s: %w", annStorageProvisionerSpec, err)
 			}
-			pv = r.persistentVolumeForClaim(claim, provisionerSpec, provisionerJSON)
-			utils.CopyAnnotations(pod, pv, provisionerSpec.Spec.Env)
-			if hostPath := pv.Spec.HostPath; hostPath != nil {
-				log = log.WithValues("path", hostPath.Path)
-			}
-			err = r.Client.Create(ctx, pv)
-			if err != nil {
-				return false, err
-			}
-			log.Info("Successfully provisioned PersistentVolume")
-			msg := fmt.Sprintf("Provisioned PersistentVolume %s", pvName.Name)
-			r.recorder.Eventf(claim, corev1.EventTypeNormal, "Provisioned", msg)
-			return true, nil
+			err = r.createPersistentVolume(ctx, claim, provisionerSpec, provisionerJSON, pod, log)
+			return err == nil, err
 		},
-		Log: log,
+		Policy: provisionerSpec.Spec.JobPolicy,
+		Log:    log,
 	})
 	if done && err != nil {
 		log.Error(err, "Failed to provision PersistentVolume")
 		msg := fmt.Sprintf("Failed to provision PersistentVolume %s: %v", pvName.Name, err)
 		r.recorder.Eventf(claim, corev1.EventTypeWarning, "ProvisionerFailed", msg)
+		if e := r.setProvisionerFailedCondition(ctx, claim, msg); e != nil {
+			log.Error(e, "Failed to set PersistentVolumeClaim condition")
+		}
 	}
 	return done, err
 }
 
+// substituteProvisioner replaces the placeholders within the provisioner template with the claim's values
+func substituteProvisioner(ctx context.Context, c client.Client, claim *corev1.PersistentVolumeClaim, provisionerSpec *storageapi.StorageProvisioner, nodeName string) error {
+	params, err := provisionerParams(ctx, c, claim)
+	if err != nil {
+		return err
+	}
+	return substituteProvisionerForNode(provisionerSpec, params, nodeName)
+}
+
+// provisionerParams returns the node-independent placeholder values of a claim
+func provisionerParams(ctx context.Context, c client.Client, claim *corev1.PersistentVolumeClaim) (utils.ProvisionerParams, error) {
+	class := &storage.StorageClass{}
+	err := c.Get(ctx, types.NamespacedName{Name: persistentVolumeClaimClass(claim)}, class)
+	if err != nil {
+		return utils.ProvisionerParams{}, fmt.Errorf("get storageclass: %w", err)
+	}
+	params := utils.ProvisionerParams{
+		PersistentVolumeName:  pvNameForPVC(claim),
+		PersistentVolumeClaim: types.NamespacedName{Name: claim.Name, Namespace: claim.Namespace},
+		AccessModes:           claim.Spec.AccessModes,
+		Parameters:            class.Parameters,
+		Labels:                claim.Labels,
+		Annotations:           claim.Annotations,
+	}
+	if capacity, ok := claim.Spec.Resources.Requests[corev1.ResourceStorage]; ok {
+		params.Capacity = capacity.String()
+	}
+	return params, nil
+}
+
+// substituteProvisionerForNode replaces the placeholders within the provisioner template with the given values and node
+func substituteProvisionerForNode(provisionerSpec *storageapi.StorageProvisioner, params utils.ProvisionerParams, nodeName string) error {
+	nodePath, err := utils.StorageRootPathForNode(nodeName, provisionerSpec.Spec.Nodes)
+	if err != nil {
+		return fmt.Errorf("invalid storageprovisioner: %w", err)
+	}
+	params.NodeName = nodeName
+	params.NodePath = nodePath
+	return utils.SubstituteProvisionerPlaceholders(provisionerSpec, params)
+}
+
+// assignNode selects a node for the claim and records it as annotation.
+// A claim that is restored from a snapshot is assigned to the node the snapshot has been created on
+// since the snapshot is available there without pulling it from the registry.
+func (r *PersistentVolumeClaimReconciler) assignNode(ctx context.Context, claim *corev1.PersistentVolumeClaim, provisionerSpec *storageapi.StorageProvisioner, snapshot *storageapi.CacheSnapshot, log logr.Logger) error {
+	var nodeName string
+	if snapshot != nil {
+		nodeName = snapshot.Status.NodeName
+	} else {
+		var err error
+		nodeName, err = selectNode(ctx, r.Client, claim, provisionerSpec)
+		if err != nil {
+			r.recorder.Eventf(claim, corev1.EventTypeWarning, "NodeSelectionFailed", err.Error())
+			return err
+		}
+	}
+	log.Info("Selected node for PersistentVolumeClaim", "node", nodeName)
+	if claim.Annotations == nil {
+		claim.Annotations = map[string]string{}
+	}
+	claim.Annotations[annSelectedNode] = nodeName
+	return r.Client.Update(ctx, claim)
+}
+
+// provisionWithAgent lets the provisioner's node agent prepare the volume instead of running a provisioner Pod
+func (r *PersistentVolumeClaimReconciler) provisionWithAgent(ctx context.Context, claim *corev1.PersistentVolumeClaim, provisionerSpec *storageapi.StorageProvisioner, nodeName string, env []corev1.EnvVar, log logr.Logger) error {
+	err := substituteProvisioner(ctx, r.Client, claim, provisionerSpec, nodeName)
+	if err != nil {
+		return err
+	}
+	provisionerJSON, err := utils.StorageProvisionerToJSON(provisionerSpec)
+	if err != nil {
+		return err
+	}
+	req, err := agentRequest(ctx, r.Client, r.ManagerNamespace, provisionerSpec, &provisionerSpec.Spec.Containers.Provisioner, env, provisionerSpec.Spec.PersistentVolumeTemplate.HostPath.Path)
+	if err != nil {
+		return err
+	}
+	a, err := agentForNode(ctx, r.Client, r.ManagerNamespace, provisionerSpec.Spec.Agent, nodeName, r.AgentTokens)
+	if err != nil {
+		return err
+	}
+	if err = r.recordProvisioner(ctx, claim, provisionerSpec, nodeName, ""); err != nil {
+		return err
+	}
+	log.Info("Provisioning PersistentVolume using agent")
+	r.recorder.Event(claim, corev1.EventTypeNormal, "Provisioning", "Provisioning PersistentVolume")
+	if err = a.Mount(ctx, req); err != nil {
+		return err
+	}
+	return r.createPersistentVolume(ctx, claim, provisionerSpec, provisionerJSON, claim, log)
+}
+
+// snapshotForClaim returns the ready CacheSnapshot the claim should be restored from or nil if none is specified
+func (r *PersistentVolumeClaimReconciler) snapshotForClaim(ctx context.Context, claim *corev1.PersistentVolumeClaim, provisionerSpec *storageapi.StorageProvisioner) (*storageapi.CacheSnapshot, error) {
+	name := claim.Annotations[storageapi.AnnotationSnapshot]
+	if name == "" {
+		return nil, nil
+	}
+	snapshot := &storageapi.CacheSnapshot{}
+	err := r.Client.Get(ctx, types.NamespacedName{Name: name, Namespace: claim.Namespace}, snapshot)
+	if err != nil {
+		return nil, errors.Wrap(err, "get snapshot")
+	}
+	if !snapshot.Status.ReadyToUse || snapshot.DeletionTimestamp != nil {
+		return nil, errors.Errorf("snapshot %s is not ready to use", name)
+	}
+	if snapshot.Status.Provisioner != provisionerSpec.Spec.Name {
+		return nil, errors.Errorf("snapshot %s has been created by provisioner %s", name, snapshot.Status.Provisioner)
+	}
+	return snapshot, nil
+}
+
+// createPersistentVolume creates the PersistentVolume for a claim after the provisioner succeeded
+func (r *PersistentVolumeClaimReconciler) createPersistentVolume(ctx context.Context, claim *corev1.PersistentVolumeClaim, provisionerSpec *storageapi.StorageProvisioner, provisionerJSON string, annotationSrc metav1.Object, log logr.Logger) error {
+	pv := r.persistentVolumeForClaim(claim, provisionerSpec, provisionerJSON)
+	utils.CopyAnnotations(annotationSrc, pv, provisionerSpec.Spec.Env)
+	return r.createVolume(ctx, claim, pv, log)
+}
+
+// createVolume creates the given PersistentVolume for a claim
+func (r *PersistentVolumeClaimReconciler) createVolume(ctx context.Context, claim *corev1.PersistentVolumeClaim, pv *corev1.PersistentVolume, log logr.Logger) error {
+	if hostPath := pv.Spec.HostPath; hostPath != nil {
+		log = log.WithValues("path", hostPath.Path)
+	}
+	err := r.Client.Create(ctx, pv)
+	if err != nil {
+		return err
+	}
+	log.Info("Successfully provisioned PersistentVolume")
+	msg := fmt.Sprintf("Provisioned PersistentVolume %s", pv.Name)
+	r.recorder.Eventf(claim, corev1.EventTypeNormal, "Provisioned", msg)
+	if removeClaimCondition(claim, claimConditionProvisionerFailed) {
+		return r.Client.Status().Update(ctx, claim)
+	}
+	return nil
+}
+
+// setProvisionerFailedCondition exposes the provisioner's failure on the claim
+// for users that cannot access the manager namespace.
+func (r *PersistentVolumeClaimReconciler) setProvisionerFailedCondition(ctx context.Context, claim *corev1.PersistentVolumeClaim, msg string) error {
+	if err := r.setProvisioningPhase(ctx, claim, storageapi.ProvisioningPhaseFailed); err != nil {
+		return err
+	}
+	if setClaimCondition(claim, claimConditionProvisionerFailed, msg) {
+		return r.Client.Status().Update(ctx, claim)
+	}
+	return nil
+}
+
+// recordProvisioned exposes the phase of a bound claim that has been provisioned by this controller
+// as well as the Cache and cache generation its volume has been initialized with.
+// A cache volume's claim remains in phase provisioning until its Cache lists the volume's generation.
+func (r *PersistentVolumeClaimReconciler) recordProvisioned(ctx context.Context, claim *corev1.PersistentVolumeClaim, log logr.Logger) error {
+	phase := storageapi.ProvisioningPhase(claim.Annotations[storageapi.AnnotationProvisioningPhase])
+	if phase == "" || phase == storageapi.ProvisioningPhaseProvisioned {
+		return nil
+	}
+	cacheName := claim.Annotations[annCacheName]
+	if cacheName != "" && claim.Annotations[storageapi.AnnotationCacheGeneration] == "" && claim.Annotations[storageapi.AnnotationProvisionerNodes] == "" {
+		cache, err := cacheForClaim(ctx, r.Client, claim)
+		if err != nil {
+			return errors.Wrap(err, "record provisioned claim")
+		}
+		generation, ok := cacheVolumeGeneration(cache, claim.Annotations[annProvisionerNode], claim.Spec.VolumeName)
+		if !ok {
+			// Reconciled again when the Cache changes
+			log.V(1).Info("Waiting for the Cache to register the volume", "cache", cacheName)
+			return nil
+		}
+		claim.Annotations[storageapi.AnnotationCacheGeneration] = strconv.FormatInt(generation, 10)
+	}
+	if cacheName != "" {
+		claim.Annotations[storageapi.AnnotationProvisionerCache] = cacheName
+	}
+	log.V(1).Info("Recording provisioned PersistentVolumeClaim")
+	return r.setProvisioningPhase(ctx, claim, storageapi.ProvisioningPhaseProvisioned)
+}
+
+// cacheToClaimRequests maps a Cache to the bound claims that wait for it to list their volume's generation
+func (r *PersistentVolumeClaimReconciler) cacheToClaimRequests(o client.Object) []reconcile.Request {
+	claims := &corev1.PersistentVolumeClaimList{}
+	if err := r.Client.List(context.TODO(), claims, client.InNamespace(o.GetNamespace())); err != nil {
+		r.Log.Error(err, "Cannot map Cache to PersistentVolumeClaims", "cache", o.GetName())
+		return nil
+	}
+	requests := []reconcile.Request{}
+	for _, claim := range claims.Items {
+		phase := storageapi.ProvisioningPhase(claim.Annotations[storageapi.AnnotationProvisioningPhase])
+		if claim.Annotations[annCacheName] == o.GetName() && claim.Spec.VolumeName != "" && phase == storageapi.ProvisioningPhaseProvisioning {
+			requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Name: claim.Name, Namespace: claim.Namespace}})
+		}
+	}
+	return requests
+}
+
+// cacheVolumeGeneration returns the cache generation of the given volume on the given node
+func cacheVolumeGeneration(cache *storageapi.Cache, nodeName, volumeName string) (int64, bool) {
+	if cache == nil {
+		return 0, false
+	}
+	for _, n := range cache.Status.Nodes {
+		if n.Name != nodeName {
+			continue
+		}
+		for _, v := range n.Volumes {
+			if v.Name == volumeName {
+				return v.CacheGeneration, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// setProvisioningPhase exposes the claim's provisioning phase as annotation
+func (r *PersistentVolumeClaimReconciler) setProvisioningPhase(ctx context.Context, claim *corev1.PersistentVolumeClaim, phase storageapi.ProvisioningPhase) error {
+	if claim.Annotations[storageapi.AnnotationProvisioningPhase] == string(phase) {
+		return nil
+	}
+	if claim.Annotations == nil {
+		claim.Annotations = map[string]string{}
+	}
+	claim.Annotations[storageapi.AnnotationProvisioningPhase] = string(phase)
+	return errors.Wrap(r.Client.Update(ctx, claim), "set provisioning phase")
+}
+
 func (r *PersistentVolumeClaimReconciler) persistentVolumeForClaim(claim *corev1.PersistentVolumeClaim, provisioner *storageapi.StorageProvisioner, provisionerJSON string) *corev1.PersistentVolume {
 	pv := &corev1.PersistentVolume{Spec: provisioner.Spec.PersistentVolumeTemplate}
 	pv.Name = pvNameForPVC(claim)
@@ -306,6 +726,12 @@ func (r *PersistentVolumeClaimReconciler) persistentVolumeForClaim(claim *corev1
 	if claim.Spec.StorageClassName != nil {
 		pv.Spec.StorageClassName = *claim.Spec.StorageClassName
 	}
+	if nodes := provisionerNodes(claim); len(nodes) > 0 {
+		// ReadOnlyMany volume that is available on all of its nodes
+		pv.Spec.AccessModes = claim.Spec.AccessModes
+		pv.Spec.NodeAffinity = nodeAffinity(nodes)
+		pv.Annotations[storageapi.AnnotationProvisionerNodes] = claim.Annotations[storageapi.AnnotationProvisionerNodes]
+	}
 	pv.Spec.ClaimRef = &corev1.ObjectReference{
 		APIVersion:      "v1",
 		Kind:            "PersistentVolumeClaim",
@@ -321,9 +747,26 @@ func pvNameForPVC(claim *corev1.PersistentVolumeClaim) string {
 	return fmt.Sprintf("pvc-%s", string(claim.UID))
 }
 
+// deleteProvisionerPods removes the provisioner Pods a bound claim's provisioning may have left behind,
+// e.g. when the claim was bound before the provisioner's result was processed.
+func (r *PersistentVolumeClaimReconciler) deleteProvisionerPods(ctx context.Context, claim *corev1.PersistentVolumeClaim, log logr.Logger) (done bool, err error) {
+	pvName := pvNameForPVC(claim)
+	done, err = r.deletePod(ctx, utils.ResourceName(pvName, provisioner), log)
+	if err != nil || !done {
+		return done, err
+	}
+	for _, nodeName := range provisionerNodes(claim) {
+		done, err = utils.DeleteJob(ctx, r.Client, nodePodName(pvName, nodeName, provisioner, r.ManagerNamespace), log)
+		if err != nil || !done {
+			return done, err
+		}
+	}
+	return true, nil
+}
+
 func (r *PersistentVolumeClaimReconciler) deletePod(ctx context.Context, name string, log logr.Logger) (done bool, err error) {
 	podName := types.NamespacedName{Name: name, Namespace: r.ManagerNamespace}
-	return utils.DeletePod(ctx, r.Client, podName, log)
+	return utils.DeleteJob(ctx, r.Client, podName, log)
 }
 
 // shouldProvision returns whether a claim should have a volume provisioned for
@@ -356,6 +799,15 @@ func (r *PersistentVolumeClaimReconciler) shouldProvision(ctx context.Context, c
 		return false, nil
 	}
 
+	// Check accessModes
+	if hasAccessMode(claim, corev1.ReadOnlyMany) {
+		if !provisioner.Spec.ReadOnlyMany {
+			r.recorder.Eventf(claim, corev1.EventTypeWarning, "AccessModeNotSupported", "StorageProvisioner %s does not support access mode %s", provisioner.Name, corev1.ReadOnlyMany)
+			return false, nil
+		}
+		return true, nil // provisioned on all eligible nodes regardless of the binding mode
+	}
+
 	// Check volumeBindingMode and wait for first consumer eventually
 	if class.VolumeBindingMode != nil && *class.VolumeBindingMode == storage.VolumeBindingWaitForFirstConsumer {
 		// When claim is in delay binding mode, annSelectedNode is
@@ -367,9 +819,9 @@ func (r *PersistentVolumeClaimReconciler) shouldProvision(ctx context.Context, c
 			return true, nil // Claim has node assigned
 		}
 		log.Info("Waiting for first consumer to bind to a node")
-		return false, nil
+		return false, r.setProvisioningPhase(ctx, claim, storageapi.ProvisioningPhaseWaitingForNode)
 	}
-	return true, nil // no delay binding, this controller has to select a node
+	return true, nil // no delay binding, this controller has to select a node (see assignNode)
 }
 
 func (r *PersistentVolumeClaimReconciler) getStorageClass(ctx context.Context, name string) (*storage.StorageClass, error) {
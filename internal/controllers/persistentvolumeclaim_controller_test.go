@@ -0,0 +1,389 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	storageapi "github.com/mgoltzsche/k8storagex/api/v1alpha1"
+	"github.com/mgoltzsche/k8storagex/internal/utils"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var _ = Describe("PersistentVolumeClaimController", func() {
+	Describe("claim deleted during provisioning", func() {
+		It("should run the registered deprovisioner instead of the one the claim specifies", func() {
+			p := fakeProvisioner("interrupted")
+			Expect(testProvisioners.Put(p)).To(Succeed())
+			createStorageClass("interrupted", p.Spec.Name, storagev1.VolumeBindingWaitForFirstConsumer)
+			pvc := newClaim("interrupted-pvc", p.Spec.Name, "interrupted")
+			pvc.Finalizers = []string{finalizer}
+			pvc.Annotations[annProvisionerNode] = "fake-node"
+			forged := fakeProvisioner("forged")
+			forged.Spec.PodTemplate.Containers[0].Image = "forged-image"
+			forgedJSON, err := utils.StorageProvisionerToJSON(forged)
+			Expect(err).ShouldNot(HaveOccurred())
+			pvc.Annotations[annStorageProvisionerSpec] = forgedJSON
+			Expect(k8sClient.Create(context.TODO(), pvc)).To(Succeed())
+			Expect(k8sClient.Delete(context.TODO(), pvc)).To(Succeed())
+
+			pod := &corev1.Pod{}
+			pod.Name = utils.ResourceName(pvNameForPVC(pvc), deprovisioner)
+			pod.Namespace = testNamespace
+			verify(pod, func(err error) error {
+				if err != nil {
+					return err
+				}
+				if image := pod.Spec.Containers[0].Image; image != "fake-image" {
+					return fmt.Errorf("unexpected deprovisioner image %q", image)
+				}
+				if !hasEnv(pod, envInterrupted, "true") {
+					return fmt.Errorf("deprovisioner Pod does not specify %s", envInterrupted)
+				}
+				return nil
+			})
+			setPodPhase(pod, corev1.PodSucceeded)
+			verify(pvc, isNotFound)
+		})
+	})
+	Describe("failed provisioner Pod", func() {
+		It("should be retried with the retry count recorded on the Pod", func() {
+			p := fakeProvisioner("retry")
+			backoffLimit := int32(1)
+			p.Spec.BackoffLimit = &backoffLimit
+			p.Spec.RetryBackoff = &metav1.Duration{Duration: time.Second}
+			Expect(testProvisioners.Put(p)).To(Succeed())
+			createStorageClass("retry", p.Spec.Name, storagev1.VolumeBindingWaitForFirstConsumer)
+			createReadyNode("retry-node")
+			pvc := newClaim("retry-pvc", p.Spec.Name, "retry")
+			pvc.Annotations[annSelectedNode] = "retry-node"
+			Expect(k8sClient.Create(context.TODO(), pvc)).To(Succeed())
+
+			pod := &corev1.Pod{}
+			pod.Name = utils.ResourceName(pvNameForPVC(pvc), provisioner)
+			pod.Namespace = testNamespace
+			verify(pod, func(err error) error { return err })
+			uid := pod.UID
+			setPodPhase(pod, corev1.PodFailed)
+			verify(pod, func(err error) error {
+				if err != nil {
+					return err
+				}
+				if pod.UID == uid {
+					return fmt.Errorf("provisioner Pod has not been recreated")
+				}
+				if n := pod.Annotations["k8storagex.mgoltzsche.github.com/job-retries"]; n != "1" {
+					return fmt.Errorf("unexpected job-retries annotation %q", n)
+				}
+				return nil
+			})
+			verify(pvc, func(err error) error {
+				if err != nil {
+					return err
+				}
+				for k := range pvc.Annotations {
+					if strings.HasPrefix(k, "k8storagex.mgoltzsche.github.com/job-") {
+						return fmt.Errorf("claim has been annotated with %s", k)
+					}
+				}
+				return nil
+			})
+		})
+	})
+	Describe("cache claim", func() {
+		It("should be recorded as provisioned once the Cache lists the volume's generation", func() {
+			p := fakeProvisioner("phase")
+			Expect(testProvisioners.Put(p)).To(Succeed())
+			createStorageClass("phase", p.Spec.Name, storagev1.VolumeBindingWaitForFirstConsumer)
+			createReadyNode("phase-node")
+			pvc := newClaim("phase-pvc", p.Spec.Name, "phase")
+			pvc.Annotations[annSelectedNode] = "phase-node"
+			pvc.Annotations[annCacheName] = "phase-cache"
+			Expect(k8sClient.Create(context.TODO(), pvc)).To(Succeed())
+			pod := &corev1.Pod{}
+			pod.Name = utils.ResourceName(pvNameForPVC(pvc), provisioner)
+			pod.Namespace = testNamespace
+			verify(pod, func(err error) error { return err })
+			setPodPhase(pod, corev1.PodSucceeded)
+			pv := &corev1.PersistentVolume{}
+			pv.Name = pvNameForPVC(pvc)
+			verify(pv, func(err error) error { return err })
+			bindClaim(pvc, pv.Name, pv.Spec.Capacity[corev1.ResourceStorage])
+
+			verify(pvc, notAfter(2*time.Second, hasProvisioningPhase(pvc, storageapi.ProvisioningPhaseProvisioned)))
+			Expect(pvc.Annotations[storageapi.AnnotationProvisioningPhase]).To(Equal(string(storageapi.ProvisioningPhaseProvisioning)), "phase before the Cache lists the volume")
+
+			By("registering the volume within the Cache")
+			cache := &storageapi.Cache{}
+			cache.Name = "phase-cache"
+			cache.Namespace = testNamespace
+			Expect(k8sClient.Create(context.TODO(), cache)).To(Succeed())
+			updateCacheStatus(cache, func() {
+				cache.Status.Nodes = []storageapi.NodeStatus{{
+					Name:     "phase-node",
+					LastUsed: metav1.Now(),
+					Volumes:  []storageapi.VolumeStatus{{Name: pv.Name, Created: metav1.Now(), CacheGeneration: 3}},
+				}}
+			})
+			verify(pvc, hasProvisioningPhase(pvc, storageapi.ProvisioningPhaseProvisioned))
+			Expect(pvc.Annotations[storageapi.AnnotationCacheGeneration]).To(Equal("3"), "cache generation")
+			Expect(pvc.Annotations[storageapi.AnnotationProvisionerCache]).To(Equal("phase-cache"), "cache name")
+		})
+	})
+	Describe("claim of a StorageClass with Immediate binding mode", func() {
+		It("should be assigned to an eligible node", func() {
+			p := fakeProvisioner("immediate")
+			p.Spec.Nodes = []storageapi.NodePath{{Name: "immediate-node-*", Path: "/fake/immediate/path"}}
+			Expect(testProvisioners.Put(p)).To(Succeed())
+			createStorageClass("immediate", p.Spec.Name, storagev1.VolumeBindingImmediate)
+			tainted := createReadyNode("immediate-node-a")
+			tainted.Spec.Taints = []corev1.Taint{{Key: "dedicated", Value: "other", Effect: corev1.TaintEffectNoSchedule}}
+			Expect(k8sClient.Update(context.TODO(), tainted)).To(Succeed())
+			createReadyNode("immediate-node-b")
+			createReadyNode("other-immediate-node")
+			pvc := newClaim("immediate-pvc", p.Spec.Name, "immediate")
+			Expect(k8sClient.Create(context.TODO(), pvc)).To(Succeed())
+
+			verify(pvc, func(err error) error {
+				if err != nil {
+					return err
+				}
+				if nodeName := pvc.Annotations[annSelectedNode]; nodeName != "immediate-node-b" {
+					return fmt.Errorf("expected claim to be assigned to node immediate-node-b but was %q", nodeName)
+				}
+				return nil
+			})
+			pod := &corev1.Pod{}
+			pod.Name = utils.ResourceName(pvNameForPVC(pvc), provisioner)
+			pod.Namespace = testNamespace
+			verify(pod, func(err error) error { return err })
+		})
+	})
+	Describe("generic ephemeral volume claim", func() {
+		It("should be provisioned using the annotations of the volumeClaimTemplate only", func() {
+			p := fakeProvisioner("ephemeral")
+			p.Spec.Env = []storageapi.EnvVar{{Name: "LAYERFS_NAME", Annotation: annCacheName}}
+			Expect(testProvisioners.Put(p)).To(Succeed())
+			createStorageClass("ephemeral", p.Spec.Name, storagev1.VolumeBindingWaitForFirstConsumer)
+			createReadyNode("ephemeral-node")
+			pod := &corev1.Pod{}
+			pod.Name = "ephemeral"
+			pod.Namespace = testNamespace
+			pod.Annotations = map[string]string{annCacheName: "pod-cache"}
+			pod.Spec.RestartPolicy = corev1.RestartPolicyNever
+			pod.Spec.Containers = []corev1.Container{{Name: "main", Image: "alpine:3.12"}}
+			Expect(k8sClient.Create(context.TODO(), pod)).To(Succeed())
+
+			// The ephemeral volume controller copies the volumeClaimTemplate's annotations to the claim
+			templated := newEphemeralClaim(pod, "templated", p.Spec.Name, "ephemeral")
+			templated.Annotations[annCacheName] = "template-cache"
+			Expect(k8sClient.Create(context.TODO(), templated)).To(Succeed())
+			provisionerPod := &corev1.Pod{}
+			provisionerPod.Name = utils.ResourceName(pvNameForPVC(templated), provisioner)
+			provisionerPod.Namespace = testNamespace
+			verify(provisionerPod, func(err error) error {
+				if err != nil {
+					return err
+				}
+				if !hasEnv(provisionerPod, "LAYERFS_NAME", "template-cache") {
+					return fmt.Errorf("provisioner Pod does not specify the cache name of the claim")
+				}
+				return nil
+			})
+			setPodPhase(provisionerPod, corev1.PodSucceeded)
+			pv := &corev1.PersistentVolume{}
+			pv.Name = pvNameForPVC(templated)
+			verify(pv, func(err error) error {
+				if err != nil {
+					return err
+				}
+				if name := pv.Annotations[annCacheName]; name != "template-cache" {
+					return fmt.Errorf("unexpected PersistentVolume cache name %q", name)
+				}
+				return nil
+			})
+
+			By("creating a claim without annotations")
+			untemplated := newEphemeralClaim(pod, "untemplated", p.Spec.Name, "ephemeral")
+			Expect(k8sClient.Create(context.TODO(), untemplated)).To(Succeed())
+			Eventually(func() error {
+				return hasEvent(untemplated, "AnnotationMissing")
+			}, "10s", "1s").ShouldNot(HaveOccurred())
+			provisionerPod = &corev1.Pod{}
+			provisionerPod.Name = utils.ResourceName(pvNameForPVC(untemplated), provisioner)
+			provisionerPod.Namespace = testNamespace
+			verify(provisionerPod, notAfter(2*time.Second, func(err error) error { return err }))
+		})
+	})
+	Describe("ReadOnlyMany claim", func() {
+		It("should provision the volume on all eligible nodes using the registered provisioner", func() {
+			p := fakeProvisioner("rox")
+			p.Spec.ReadOnlyMany = true
+			p.Spec.Nodes = []storageapi.NodePath{{Name: "rox-node-*", Path: "/fake/rox/path"}}
+			Expect(testProvisioners.Put(p)).To(Succeed())
+			createStorageClass("rox", p.Spec.Name, storagev1.VolumeBindingImmediate)
+			nodes := []string{"rox-node-a", "rox-node-b"}
+			for _, nodeName := range nodes {
+				createReadyNode(nodeName)
+			}
+			pvc := newClaim("rox-pvc", p.Spec.Name, "rox")
+			pvc.Spec.AccessModes = []corev1.PersistentVolumeAccessMode{corev1.ReadOnlyMany}
+			forged := fakeProvisioner("forged")
+			forged.Spec.PodTemplate.Containers[0].Image = "forged-image"
+			forgedJSON, err := utils.StorageProvisionerToJSON(forged)
+			Expect(err).ShouldNot(HaveOccurred())
+			pvc.Annotations[annStorageProvisionerSpec] = forgedJSON
+			pvc.Annotations[annProvisionerParams] = `{"PersistentVolumeName":"pvc-victim"}`
+			Expect(k8sClient.Create(context.TODO(), pvc)).To(Succeed())
+
+			for _, nodeName := range nodes {
+				pod := &corev1.Pod{}
+				pod.Name = nodePodName(pvNameForPVC(pvc), nodeName, provisioner, testNamespace).Name
+				pod.Namespace = testNamespace
+				verify(pod, func(err error) error {
+					if err != nil {
+						return err
+					}
+					if image := pod.Spec.Containers[0].Image; image != "fake-image" {
+						return fmt.Errorf("unexpected provisioner image %q", image)
+					}
+					if pod.Spec.NodeName != "" && pod.Spec.NodeName != nodeName {
+						return fmt.Errorf("provisioner Pod is assigned to node %q", pod.Spec.NodeName)
+					}
+					return nil
+				})
+				setPodPhase(pod, corev1.PodSucceeded)
+			}
+
+			pv := &corev1.PersistentVolume{}
+			pv.Name = pvNameForPVC(pvc)
+			verify(pv, func(err error) error {
+				if err != nil {
+					return err
+				}
+				if path := pv.Spec.HostPath.Path; path != "/fake/rox/path/"+pv.Name {
+					return fmt.Errorf("unexpected host path %q", path)
+				}
+				if nodes := provisionerNodes(pv); len(nodes) != 2 {
+					return fmt.Errorf("unexpected PersistentVolume nodes %v", nodes)
+				}
+				if strings.Contains(pv.Annotations[annStorageProvisionerSpec], "forged-image") {
+					return fmt.Errorf("PersistentVolume refers to the claim's provisioner annotation")
+				}
+				return nil
+			})
+		})
+	})
+})
+
+func createReadyNode(name string) *corev1.Node {
+	node := &corev1.Node{}
+	node.Name = name
+	node.Labels = map[string]string{KeyNode: name}
+	Expect(k8sClient.Create(context.TODO(), node)).To(Succeed())
+	node.Status.Conditions = []corev1.NodeCondition{{
+		Type:               corev1.NodeReady,
+		Status:             corev1.ConditionTrue,
+		LastTransitionTime: metav1.Now(),
+	}}
+	Expect(k8sClient.Status().Update(context.TODO(), node)).To(Succeed())
+	return node
+}
+
+// fakeProvisioner returns a valid StorageProvisioner with the given name
+func fakeProvisioner(name string) *storageapi.StorageProvisioner {
+	p := &storageapi.StorageProvisioner{}
+	p.Name = name
+	p.Spec.Name = name + ".fake.provisioner"
+	p.Spec.PodTemplate.Containers = []corev1.Container{{
+		Name:    "main",
+		Image:   "fake-image",
+		Command: []string{"true"},
+	}}
+	volMode := corev1.PersistentVolumeFilesystem
+	p.Spec.PersistentVolumeTemplate.VolumeMode = &volMode
+	p.Spec.PersistentVolumeTemplate.AccessModes = []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce}
+	p.Spec.PersistentVolumeTemplate.PersistentVolumeReclaimPolicy = corev1.PersistentVolumeReclaimDelete
+	p.Spec.PersistentVolumeTemplate.HostPath = &corev1.HostPathVolumeSource{Path: "${STORAGE_NODE_PATH}/${STORAGE_PV_NAME}"}
+	p.Spec.PersistentVolumeTemplate.NodeAffinity = nodeAffinity([]string{"${STORAGE_NODE_NAME}"})
+	p.Spec.Nodes = []storageapi.NodePath{{Name: "*", Path: "/fake/test/path"}}
+	return p
+}
+
+func createStorageClass(name, provisionerName string, bindingMode storagev1.VolumeBindingMode) *storagev1.StorageClass {
+	class := &storagev1.StorageClass{}
+	class.Name = name
+	class.Provisioner = provisionerName
+	class.VolumeBindingMode = &bindingMode
+	err := k8sClient.Create(context.TODO(), class)
+	Expect(err).ShouldNot(HaveOccurred())
+	return class
+}
+
+// newEphemeralClaim returns a claim as the ephemeral volume controller creates it for the given Pod's volume
+func newEphemeralClaim(pod *corev1.Pod, volumeName, provisionerName, className string) *corev1.PersistentVolumeClaim {
+	pvc := newClaim(pod.Name+"-"+volumeName, provisionerName, className)
+	pvc.Annotations[annSelectedNode] = className + "-node"
+	pvc.OwnerReferences = []metav1.OwnerReference{*metav1.NewControllerRef(pod, corev1.SchemeGroupVersion.WithKind("Pod"))}
+	return pvc
+}
+
+// newClaim returns a claim of the given StorageClass that has not been created yet
+func newClaim(name, provisionerName, className string) *corev1.PersistentVolumeClaim {
+	volMode := corev1.PersistentVolumeFilesystem
+	pvc := newPVC(name, provisionerName)
+	pvc.Finalizers = nil
+	pvc.Spec.StorageClassName = &className
+	pvc.Spec.VolumeMode = &volMode
+	return pvc
+}
+
+func hasEnv(pod *corev1.Pod, name, value string) bool {
+	for _, c := range pod.Spec.Containers {
+		for _, e := range c.Env {
+			if e.Name == name && e.Value == value {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func hasEvent(o client.Object, reason string) error {
+	events := &corev1.EventList{}
+	err := k8sClient.List(context.TODO(), events, client.InNamespace(o.GetNamespace()))
+	if err != nil {
+		return err
+	}
+	for _, e := range events.Items {
+		if e.InvolvedObject.UID == o.GetUID() && e.Reason == reason {
+			return nil
+		}
+	}
+	return fmt.Errorf("no %s event found for %s", reason, o.GetName())
+}
+
+func hasProvisioningPhase(pvc *corev1.PersistentVolumeClaim, phase storageapi.ProvisioningPhase) func(error) error {
+	return func(err error) error {
+		if err != nil {
+			return err
+		}
+		if actual := pvc.Annotations[storageapi.AnnotationProvisioningPhase]; actual != string(phase) {
+			return fmt.Errorf("expected provisioning phase %q but was %q", phase, actual)
+		}
+		return nil
+	}
+}
+
+func isNotFound(err error) error {
+	if err == nil {
+		return fmt.Errorf("object still exists")
+	}
+	return client.IgnoreNotFound(err)
+}
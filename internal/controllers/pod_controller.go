@@ -18,105 +18,326 @@ package controllers
 
 import (
 	"context"
-	"errors"
+	"fmt"
+	"strings"
+	"time"
 
 	"github.com/go-logr/logr"
 	storageapi "github.com/mgoltzsche/k8storagex/api/v1alpha1"
+	"github.com/mgoltzsche/k8storagex/internal/utils"
+	"github.com/pkg/errors"
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 )
 
-var errPVCDelete = errors.New("pvc deletion failed")
+const (
+	// annPVCUsed marks a PersistentVolumeClaim that has been used by a Pod.
+	// It allows to delete the claim when its Pods have been deleted instead of completed.
+	annPVCUsed = "k8storagex.mgoltzsche.github.com/used"
 
-// PodReconciler reconciles a Pod object
+	unmountPollInterval = 5 * time.Second
+)
+
+// PodReconciler deletes the writeable PersistentVolumeClaims of completed or deleted Pods
+// for StorageProvisioners that deprovision volumes on Pod completion.
+// It reconciles PersistentVolumeClaims since Pods may be deleted and several Pods may share a claim.
 type PodReconciler struct {
 	client.Client
 	Log          logr.Logger
 	Scheme       *runtime.Scheme
 	Provisioners Provisioners
+	recorder     record.EventRecorder
 }
 
 func (r *PodReconciler) SetupWithManager(mgr ctrl.Manager) error {
-	podCompleted := predicate.NewPredicateFuncs(func(o client.Object) bool {
-		pod := o.(*corev1.Pod)
-		podFailed := pod.Status.Phase == corev1.PodFailed
-		podSucceeded := pod.Status.Phase == corev1.PodSucceeded
-		finished := pod.Spec.RestartPolicy == corev1.RestartPolicyNever && (podSucceeded || podFailed) ||
-			pod.Spec.RestartPolicy == corev1.RestartPolicyOnFailure && podSucceeded
-		return finished && len(writeablePVCs(pod)) > 0
+	r.recorder = mgr.GetEventRecorderFor("Pod")
+	deprovisionOnPodCompletion := predicate.NewPredicateFuncs(func(o client.Object) bool {
+		return r.shouldDelete(o.(*corev1.PersistentVolumeClaim))
+	})
+	// Pods and Jobs are mapped to their claims on every change including their deletion
+	podChanged := predicate.NewPredicateFuncs(func(o client.Object) bool {
+		return len(writeablePVCs(o.(*corev1.Pod))) > 0
 	})
 	return ctrl.NewControllerManagedBy(mgr).
-		For(&corev1.Pod{}, builder.WithPredicates(podCompleted)).
+		Named("pod").
+		For(&corev1.PersistentVolumeClaim{}, builder.WithPredicates(deprovisionOnPodCompletion)).
+		Watches(&source.Kind{Type: &corev1.Pod{}}, handler.EnqueueRequestsFromMapFunc(podToClaimRequests), builder.WithPredicates(podChanged)).
+		Watches(&source.Kind{Type: &batchv1.Job{}}, handler.EnqueueRequestsFromMapFunc(jobToClaimRequests)).
 		Complete(r)
 }
 
+func podToClaimRequests(o client.Object) []reconcile.Request {
+	return claimRequests(writeablePVCs(o.(*corev1.Pod)))
+}
+
+func jobToClaimRequests(o client.Object) []reconcile.Request {
+	return claimRequests(jobPVCs(o.(*batchv1.Job)))
+}
+
+func claimRequests(claims []types.NamespacedName) []reconcile.Request {
+	requests := make([]reconcile.Request, len(claims))
+	for i, claim := range claims {
+		requests[i] = reconcile.Request{NamespacedName: claim}
+	}
+	return requests
+}
+
 // +kubebuilder:rbac:groups=core,resources=pods,verbs=get;list;watch
 // +kubebuilder:rbac:groups=core,resources=pods/status,verbs=get
 // +kubebuilder:rbac:groups=core,resources=persistentvolumeclaims,verbs=get;list;watch;update;delete
+// +kubebuilder:rbac:groups=core,resources=persistentvolumes,verbs=get;list;watch
+// +kubebuilder:rbac:groups=core,resources=nodes,verbs=get;list;watch
+// +kubebuilder:rbac:groups=batch,resources=jobs,verbs=get;list;watch
+// +kubebuilder:rbac:groups=storage.k8s.io,resources=volumeattachments,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=events,verbs=create;patch
 
+// Reconcile deletes a PersistentVolumeClaim once all Pods and Jobs that use it have completed or have been deleted.
+// The claim's pvc-protection finalizer is removed when the volume has been unmounted from the Pods' nodes.
 func (r *PodReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
-	log := r.Log.WithValues("pod", req.NamespacedName)
-
-	log.Info("Reconciling Pod")
+	log := r.Log.WithValues("pvc", req.NamespacedName)
 
-	// Get Pod
-	pod := &corev1.Pod{}
-	err := r.Client.Get(ctx, req.NamespacedName, pod)
+	// Get PVC
+	pvc := &corev1.PersistentVolumeClaim{}
+	err := r.Client.Get(ctx, req.NamespacedName, pvc)
 	if err != nil {
 		if apierrors.IsNotFound(err) {
 			return ctrl.Result{}, nil
 		}
 		return ctrl.Result{}, err
 	}
+	if !r.shouldDelete(pvc) {
+		// Do not touch PVCs of provisioners that don't have deletion
+		// on termination enabled or PVCs with other accessModes
+		return ctrl.Result{}, nil
+	}
 
-	// Delete matching referenced PersistentVolumeClaims
-	for _, pvcName := range writeablePVCs(pod) {
-		pvcLog := log.WithValues("pvc", pvcName)
-		pvc := &corev1.PersistentVolumeClaim{}
-		e := r.Get(ctx, pvcName, pvc)
-		if e != nil {
-			if !apierrors.IsNotFound(e) {
-				pvcLog.Error(e, "failed to get PVC")
-				err = errPVCDelete
-			}
-			continue
-		}
-		if !r.shouldDelete(pvc) {
-			// Do not touch PVCs of provisioners that don't have deletion
-			// on termination enabled or PVCs with other accessModes
-			continue
-		}
-		if setAnnotation(pvc, storageapi.AnnotationPersistentVolumeClaimNoProtection, storageapi.Enabled) {
-			e = r.Update(ctx, pvc)
-			if e != nil {
-				if !apierrors.IsNotFound(e) {
-					pvcLog.Error(e, "Failed to set PVC annotation")
-					err = errPVCDelete
-				}
+	log.V(1).Info("Reconciling PVC")
+
+	// Find the Pods and Jobs that use the PVC
+	pods, err := r.podsUsingClaim(ctx, pvc)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	jobs, err := r.jobsUsingClaim(ctx, pvc)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if hasCompletingPod(pods) || len(jobs) > 0 {
+		if setAnnotation(pvc, annPVCUsed, storageapi.Enabled) {
+			return ctrl.Result{}, r.Update(ctx, pvc)
+		}
+	}
+	// Pods that are restarted forever keep the PVC as well
+	for _, pod := range pods {
+		if !isPodFinished(&pod) {
+			log.V(1).Info("PVC is still used by Pod", "usedBy", pod.Name)
+			return ctrl.Result{}, nil
+		}
+	}
+	for _, job := range jobs {
+		if !isJobFinished(&job) {
+			// The Job may still create Pods that use the PVC
+			log.V(1).Info("PVC is still used by Job", "usedBy", job.Name)
+			return ctrl.Result{}, nil
+		}
+	}
+	if !isClaimUsed(pvc) {
+		// The PVC has not been used by a Pod or Job that completes yet
+		return ctrl.Result{}, nil
+	}
+
+	// Delete the PVC
+	if pvc.DeletionTimestamp == nil {
+		log.Info("Deleting PVC")
+		r.recorder.Event(pvc, corev1.EventTypeNormal, "Deleting", "Deleting PersistentVolumeClaim since the Pods using it completed")
+		err = r.Delete(ctx, pvc)
+		if apierrors.IsNotFound(err) {
+			err = nil
+		}
+		return ctrl.Result{}, err
+	}
+
+	// Remove the pvc-protection finalizer once the volume has been unmounted.
+	// Kubernetes removes it only when no Pod refers to the PVC anymore which is not the case for completed Pods.
+	if !utils.HasString(pvc.Finalizers, finalizerPVCProtection) {
+		return ctrl.Result{}, nil
+	}
+	inUse, err := r.volumeInUse(ctx, pvc, pods)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if inUse != "" {
+		log.V(1).Info("Waiting for volume to be unmounted", "usedBy", inUse)
+		return ctrl.Result{RequeueAfter: unmountPollInterval}, nil
+	}
+	log.V(1).Info("Removing pvc-protection finalizer")
+	utils.RemoveString(&pvc.Finalizers, finalizerPVCProtection)
+	err = r.Update(ctx, pvc)
+	if apierrors.IsNotFound(err) {
+		err = nil
+	}
+	return ctrl.Result{}, err
+}
+
+func (r *PodReconciler) podsUsingClaim(ctx context.Context, pvc *corev1.PersistentVolumeClaim) ([]corev1.Pod, error) {
+	pods := &corev1.PodList{}
+	if err := r.List(ctx, pods, client.InNamespace(pvc.Namespace)); err != nil {
+		return nil, errors.Wrap(err, "list pods")
+	}
+	claimName := types.NamespacedName{Name: pvc.Name, Namespace: pvc.Namespace}
+	matching := make([]corev1.Pod, 0, 1)
+	for _, pod := range pods.Items {
+		if hasClaim(writeablePVCs(&pod), claimName) {
+			matching = append(matching, pod)
+		}
+	}
+	return matching, nil
+}
+
+func (r *PodReconciler) jobsUsingClaim(ctx context.Context, pvc *corev1.PersistentVolumeClaim) ([]batchv1.Job, error) {
+	jobs := &batchv1.JobList{}
+	if err := r.List(ctx, jobs, client.InNamespace(pvc.Namespace)); err != nil {
+		return nil, errors.Wrap(err, "list jobs")
+	}
+	claimName := types.NamespacedName{Name: pvc.Name, Namespace: pvc.Namespace}
+	matching := make([]batchv1.Job, 0, 1)
+	for _, job := range jobs.Items {
+		if hasClaim(jobPVCs(&job), claimName) {
+			matching = append(matching, job)
+		}
+	}
+	return matching, nil
+}
+
+// volumeInUse returns the Pod, VolumeAttachment or node that still uses the PVC's volume or an empty string.
+// Kubelet reports only attachable volumes within the node's volumesInUse.
+// Other volumes such as hostPath volumes are not mounted by kubelet and are released when the Pod's containers terminated.
+// Deleted Pods are removed from the API only after kubelet terminated their containers.
+func (r *PodReconciler) volumeInUse(ctx context.Context, pvc *corev1.PersistentVolumeClaim, pods []corev1.Pod) (string, error) {
+	for _, pod := range pods {
+		if !containersTerminated(&pod) {
+			return fmt.Sprintf("pod/%s", pod.Name), nil
+		}
+	}
+	if pvc.Spec.VolumeName == "" {
+		return "", nil
+	}
+	pv := &corev1.PersistentVolume{}
+	err := r.Get(ctx, types.NamespacedName{Name: pvc.Spec.VolumeName}, pv)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	attachments := &storagev1.VolumeAttachmentList{}
+	if err = r.List(ctx, attachments); err != nil {
+		return "", errors.Wrap(err, "list volumeattachments")
+	}
+	for _, a := range attachments.Items {
+		if pvName := a.Spec.Source.PersistentVolumeName; pvName != nil && *pvName == pv.Name && a.Status.Attached {
+			return fmt.Sprintf("volumeattachment/%s", a.Name), nil
+		}
+	}
+	nodeNames := volumeNodes(pv)
+	for _, pod := range pods {
+		if pod.Spec.NodeName != "" {
+			utils.AddString(&nodeNames, pod.Spec.NodeName)
+		}
+	}
+	for _, nodeName := range nodeNames {
+		node := &corev1.Node{}
+		err = r.Get(ctx, types.NamespacedName{Name: nodeName}, node)
+		if err != nil {
+			if apierrors.IsNotFound(err) {
 				continue
 			}
+			return "", err
 		}
-		if pvc.GetDeletionTimestamp() == nil {
-			pvcLog.Info("Deleting PVC")
-			e = r.Delete(ctx, pvc)
-			if e != nil {
-				if !apierrors.IsNotFound(e) {
-					pvcLog.Error(e, "Failed to delete PVC")
-					err = errPVCDelete
-				}
-				continue
+		for _, v := range node.Status.VolumesInUse {
+			if isUniqueVolumeName(string(v), pv) {
+				return fmt.Sprintf("node/%s", nodeName), nil
 			}
 		}
 	}
+	return "", nil
+}
 
-	return ctrl.Result{}, err
+// isUniqueVolumeName returns true if the given name kubelet reports within a node's volumesInUse refers to the PersistentVolume
+func isUniqueVolumeName(name string, pv *corev1.PersistentVolume) bool {
+	if csi := pv.Spec.CSI; csi != nil && name == fmt.Sprintf("kubernetes.io/csi/%s^%s", csi.Driver, csi.VolumeHandle) {
+		return true
+	}
+	return strings.HasSuffix(name, "/"+pv.Name)
+}
+
+// isPodFinished returns true if the Pod terminated and is not restarted anymore.
+// Pods that are restarted forever only terminate when they are evicted.
+func isPodFinished(pod *corev1.Pod) bool {
+	podFailed := pod.Status.Phase == corev1.PodFailed
+	podSucceeded := pod.Status.Phase == corev1.PodSucceeded
+	return pod.Spec.RestartPolicy == corev1.RestartPolicyOnFailure && podSucceeded ||
+		pod.Spec.RestartPolicy != corev1.RestartPolicyOnFailure && (podSucceeded || podFailed)
+}
+
+// containersTerminated returns true if kubelet reported all of the Pod's containers as terminated
+func containersTerminated(pod *corev1.Pod) bool {
+	for _, statuses := range [][]corev1.ContainerStatus{pod.Status.InitContainerStatuses, pod.Status.ContainerStatuses} {
+		for _, c := range statuses {
+			if c.State.Running != nil || c.State.Waiting != nil {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// hasCompletingPod returns true if any of the given Pods is not restarted forever
+func hasCompletingPod(pods []corev1.Pod) bool {
+	for _, pod := range pods {
+		if pod.Spec.RestartPolicy != corev1.RestartPolicyAlways {
+			return true
+		}
+	}
+	return false
+}
+
+// isClaimUsed returns true if a Pod or Job that completes has used the PersistentVolumeClaim.
+// Claims annotated by previous versions of the PodReconciler are considered used as well.
+func isClaimUsed(pvc *corev1.PersistentVolumeClaim) bool {
+	return pvc.Annotations[annPVCUsed] == storageapi.Enabled ||
+		pvc.Annotations[storageapi.AnnotationPersistentVolumeClaimNoProtection] == storageapi.Enabled
+}
+
+func isJobFinished(job *batchv1.Job) bool {
+	for _, c := range job.Status.Conditions {
+		if (c.Type == batchv1.JobComplete || c.Type == batchv1.JobFailed) && c.Status == corev1.ConditionTrue {
+			return true
+		}
+	}
+	return false
+}
+
+func hasClaim(claims []types.NamespacedName, claim types.NamespacedName) bool {
+	for _, c := range claims {
+		if c == claim {
+			return true
+		}
+	}
+	return false
 }
 
 func hasAccessMode(pvc *corev1.PersistentVolumeClaim, mode corev1.PersistentVolumeAccessMode) bool {
@@ -130,6 +351,10 @@ func (r *PodReconciler) shouldDelete(pvc *corev1.PersistentVolumeClaim) bool {
 	if !hasAccessMode(pvc, corev1.ReadWriteOnce) || pvc.Annotations == nil {
 		return false
 	}
+	if pvc.Annotations[storageapi.AnnotationPersistentVolumeClaimNoProtection] == storageapi.Enabled {
+		// The claim has been deleted by a previous version and still needs its pvc-protection finalizer to be removed
+		return true
+	}
 	provisioner := r.Provisioners.Get(pvc.Annotations[annStorageProvisioner])
 	if provisioner == nil {
 		return false
@@ -137,15 +362,33 @@ func (r *PodReconciler) shouldDelete(pvc *corev1.PersistentVolumeClaim) bool {
 	return provisioner.Spec.DeprovisionOnPodCompletion
 }
 
+// jobPVCs returns the writeable PersistentVolumeClaims the Job's Pods share
+func jobPVCs(job *batchv1.Job) (pvcs []types.NamespacedName) {
+	for _, v := range job.Spec.Template.Spec.Volumes {
+		if pvc := v.PersistentVolumeClaim; pvc != nil && !pvc.ReadOnly {
+			pvcs = append(pvcs, types.NamespacedName{Name: pvc.ClaimName, Namespace: job.Namespace})
+		}
+	}
+	return
+}
+
 func writeablePVCs(pod *corev1.Pod) (pvcs []types.NamespacedName) {
 	for _, v := range pod.Spec.Volumes {
 		if pvc := v.PersistentVolumeClaim; pvc != nil && !pvc.ReadOnly {
 			pvcs = append(pvcs, types.NamespacedName{Name: pvc.ClaimName, Namespace: pod.Namespace})
 		}
+		if e := v.Ephemeral; e != nil && !e.ReadOnly {
+			pvcs = append(pvcs, types.NamespacedName{Name: ephemeralPVCName(pod, &v), Namespace: pod.Namespace})
+		}
 	}
 	return
 }
 
+// ephemeralPVCName returns the name of the PersistentVolumeClaim Kubernetes creates for a generic ephemeral volume
+func ephemeralPVCName(pod *corev1.Pod, v *corev1.Volume) string {
+	return pod.Name + "-" + v.Name
+}
+
 func setAnnotation(meta metav1.Object, key, value string) bool {
 	a := meta.GetAnnotations()
 	if a == nil {
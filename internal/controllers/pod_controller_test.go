@@ -2,12 +2,15 @@ package controllers
 
 import (
 	"context"
+	"fmt"
 	"time"
 
 	storageapi "github.com/mgoltzsche/k8storagex/api/v1alpha1"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
 var (
@@ -33,8 +36,8 @@ var _ = Describe("PodController", func() {
 		pDeleteOnPodTermination.Name += "2"
 		pDeleteOnPodTermination.Spec.Name = fakeProvisionerDeleteOnPodTermination
 		pDeleteOnPodTermination.Spec.DeprovisionOnPodCompletion = true
-		testProvisioners.Put(p)
-		testProvisioners.Put(&pDeleteOnPodTermination)
+		testPodProvisioners.Put(p)
+		testPodProvisioners.Put(&pDeleteOnPodTermination)
 	})
 	Describe("completed pod", func() {
 		It("should annotate and delete PVC of matching provisioner when auto deletion is enabled", func() {
@@ -68,6 +71,65 @@ var _ = Describe("PodController", func() {
 			verify(pvcMatchingActive, notAfter(5*time.Second, hasBeenDeleted(pvcMatchingActive)))
 		})
 	})
+	Describe("deleted pod", func() {
+		It("should delete PVC of deleted Pod", func() {
+			pvcDeleted := createPVC("deleted-pod-pvc", fakeProvisionerDeleteOnPodTermination)
+			podDeleted := createPod("deleted", []string{"/bin/sleep", "10000"}, corev1.RestartPolicyNever, pvcDeleted)
+			setPodPhase(podDeleted, corev1.PodRunning)
+			verify(pvcDeleted, hasBeenMarkedUsed(pvcDeleted))
+			Expect(k8sClient.Delete(context.TODO(), podDeleted, client.GracePeriodSeconds(0))).ShouldNot(HaveOccurred())
+			verify(pvcDeleted, hasBeenDeleted(pvcDeleted))
+		})
+	})
+	Describe("job", func() {
+		It("should delete PVC shared by the Pods of a Job once the Job completed", func() {
+			pvcShared := createPVC("job-shared-pvc", fakeProvisionerDeleteOnPodTermination)
+			job := createJob("shared-pvc", pvcShared)
+			pod1 := createPod("job-pod-1", []string{"true"}, corev1.RestartPolicyNever, pvcShared)
+			pod2 := createPod("job-pod-2", []string{"true"}, corev1.RestartPolicyNever, pvcShared)
+			setPodPhase(pod1, corev1.PodSucceeded)
+			setPodPhase(pod2, corev1.PodRunning)
+			verify(pvcShared, notAfter(5*time.Second, hasBeenDeleted(pvcShared)))
+			setPodPhase(pod2, corev1.PodFailed)
+			verify(pvcShared, notAfter(5*time.Second, hasBeenDeleted(pvcShared)))
+			setJobCompleted(job)
+			verify(pvcShared, hasBeenDeleted(pvcShared))
+		})
+	})
+	Describe("pod with running containers", func() {
+		It("should keep the pvc-protection finalizer until the Pod's containers terminated", func() {
+			pvcTerminating := createPVC("terminating-pvc", fakeProvisionerDeleteOnPodTermination)
+			podTerminating := createPod("terminating", []string{"true"}, corev1.RestartPolicyNever, pvcTerminating)
+			setContainerState(podTerminating, corev1.ContainerState{Running: &corev1.ContainerStateRunning{}})
+			setPodPhase(podTerminating, corev1.PodSucceeded)
+			verify(pvcTerminating, notAfter(5*time.Second, isNotFound))
+			Expect(pvcTerminating.DeletionTimestamp).ToNot(BeNil(), "deletionTimestamp")
+			setContainerState(podTerminating, corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{}})
+			verify(pvcTerminating, isNotFound)
+		})
+	})
+	Describe("pods sharing a claim", func() {
+		It("should not delete PVC shared by a completed Job Pod and a restartable Pod", func() {
+			pvcShared := createPVC("job-and-deployment-pvc", fakeProvisionerDeleteOnPodTermination)
+			podRestarting := createPod("shared-restarting", []string{"/bin/sleep", "10000"}, corev1.RestartPolicyAlways, pvcShared)
+			podCompleted := createPod("shared-completed", []string{"true"}, corev1.RestartPolicyNever, pvcShared)
+			setPodPhase(podRestarting, corev1.PodRunning)
+			setPodPhase(podCompleted, corev1.PodSucceeded)
+			verify(pvcShared, hasBeenMarkedUsed(pvcShared))
+			verify(pvcShared, notAfter(5*time.Second, hasBeenDeleted(pvcShared)))
+			Expect(k8sClient.Delete(context.TODO(), podRestarting, client.GracePeriodSeconds(0))).ShouldNot(HaveOccurred())
+			verify(pvcShared, hasBeenDeleted(pvcShared))
+		})
+	})
+	Describe("claim deleted by a previous version", func() {
+		It("should remove the pvc-protection finalizer of a PVC annotated with no-pvc-protection", func() {
+			pvcDeprecated := newPVC("deprecated-annotation-pvc", "other."+fakeProvisionerDeleteOnPodTermination)
+			pvcDeprecated.Annotations[storageapi.AnnotationPersistentVolumeClaimNoProtection] = storageapi.Enabled
+			Expect(k8sClient.Create(context.TODO(), pvcDeprecated)).ShouldNot(HaveOccurred())
+			Expect(k8sClient.Delete(context.TODO(), pvcDeprecated)).ShouldNot(HaveOccurred())
+			verify(pvcDeprecated, isNotFound)
+		})
+	})
 	Describe("restartable pod", func() {
 		It("should not annotate or delete PVC of restartable Pod", func() {
 			pvcRestarting := createPVC("restarting-pvc", fakeProvisionerDeleteOnPodTermination)
@@ -120,3 +182,50 @@ func setPodPhase(pod *corev1.Pod, phase corev1.PodPhase) {
 		return err
 	}, "15s", "1s").ShouldNot(HaveOccurred())
 }
+
+func setContainerState(pod *corev1.Pod, state corev1.ContainerState) {
+	Eventually(func() (err error) {
+		defer GinkgoRecover()
+		pod.Status.ContainerStatuses = []corev1.ContainerStatus{{Name: "fakecontainer", Image: "alpine:3.12", State: state}}
+		return k8sClient.Status().Update(context.TODO(), pod)
+	}, "15s", "1s").ShouldNot(HaveOccurred())
+}
+
+func createJob(name string, pvc *corev1.PersistentVolumeClaim) *batchv1.Job {
+	job := &batchv1.Job{}
+	job.Name = name
+	job.Namespace = testNamespace
+	job.Spec.Template.Spec.RestartPolicy = corev1.RestartPolicyNever
+	job.Spec.Template.Spec.Containers = []corev1.Container{{
+		Name:         "fakecontainer",
+		Image:        "alpine:3.12",
+		Args:         []string{"true"},
+		VolumeMounts: []corev1.VolumeMount{{Name: pvc.Name, MountPath: "/" + pvc.Name}},
+	}}
+	job.Spec.Template.Spec.Volumes = []corev1.Volume{{
+		Name: pvc.Name,
+		VolumeSource: corev1.VolumeSource{
+			PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: pvc.Name},
+		},
+	}}
+	err := k8sClient.Create(context.TODO(), job)
+	Expect(err).ShouldNot(HaveOccurred())
+	return job
+}
+
+func setJobCompleted(job *batchv1.Job) {
+	Eventually(func() (err error) {
+		defer GinkgoRecover()
+		job.Status.Conditions = []batchv1.JobCondition{{Type: batchv1.JobComplete, Status: corev1.ConditionTrue}}
+		return k8sClient.Status().Update(context.TODO(), job)
+	}, "15s", "1s").ShouldNot(HaveOccurred())
+}
+
+func hasBeenMarkedUsed(pvc *corev1.PersistentVolumeClaim) func(error) error {
+	return func(err error) error {
+		if err == nil && pvc.Annotations[annPVCUsed] != storageapi.Enabled {
+			err = fmt.Errorf("PVC has not been marked as used")
+		}
+		return err
+	}
+}
@@ -0,0 +1,419 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-logr/logr"
+	storageapi "github.com/mgoltzsche/k8storagex/api/v1alpha1"
+	"github.com/mgoltzsche/k8storagex/internal/utils"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	annProvisionerParams = "k8storagex.mgoltzsche.github.com/provisioner-params"
+	annProvisionedNodes  = "k8storagex.mgoltzsche.github.com/provisioned-nodes"
+	envReadOnlyMany      = "STORAGE_READ_ONLY_MANY"
+	envCacheGeneration   = "STORAGE_CACHE_GENERATION"
+)
+
+// provisionReadOnlyMany runs the provisioner on every eligible node and creates a PersistentVolume that is available on all of them.
+// The nodes and the cache generation are recorded on the claim first
+// so that every node's volume is provisioned the same way and can be deprovisioned later.
+// The provisioner is always derived from the registered StorageProvisioner since users can modify the claim's annotations.
+func (r *PersistentVolumeClaimReconciler) provisionReadOnlyMany(ctx context.Context, claim *corev1.PersistentVolumeClaim, provisionerSpec *storageapi.StorageProvisioner, log logr.Logger) (done bool, err error) {
+	pvName := pvNameForPVC(claim)
+	log = log.WithValues("persistentvolume", pvName)
+	err = r.Client.Get(ctx, types.NamespacedName{Name: pvName}, &corev1.PersistentVolume{})
+	if err == nil {
+		return true, nil
+	}
+	if !apierrors.IsNotFound(err) {
+		return false, err
+	}
+
+	env, err := utils.AnnotationsToEnv(claim, provisionerSpec.Spec.Env)
+	if err != nil {
+		r.recorder.Eventf(claim, corev1.EventTypeWarning, "AnnotationMissing", err.Error())
+		return false, nil
+	}
+
+	nodes := provisionerNodes(claim)
+	if len(nodes) == 0 {
+		return false, r.recordReadOnlyManyProvisioner(ctx, claim, provisionerSpec, log)
+	}
+	params, err := provisionerParams(ctx, r.Client, claim)
+	if err != nil {
+		return false, err
+	}
+	env = append(env, readOnlyManyEnv(claim)...)
+
+	provisioned := splitNodes(claim.Annotations[annProvisionedNodes])
+	pending := false
+	for _, nodeName := range nodes {
+		if utils.HasString(provisioned, nodeName) {
+			continue
+		}
+		pending = true
+		nodeName := nodeName
+		podName := nodePodName(pvName, nodeName, provisioner, r.ManagerNamespace)
+		done, err := r.jobReconciler.ReconcileJob(utils.JobRequest{
+			Context:   ctx,
+			Name:      provisioner,
+			PodName:   podName,
+			Owner:     claim,
+			ShouldRun: true,
+			Create: func() (*corev1.Pod, error) {
+				p := provisionerSpec.DeepCopy()
+				if err := substituteProvisionerForNode(p, params, nodeName); err != nil {
+					return nil, err
+				}
+				pod, err := utils.NewProvisionerPod(utils.PodSource{
+					ContainerName:          provisioner,
+					PodName:                podName,
+					SubstitutedProvisioner: p,
+					Container:              &p.Spec.Containers.Provisioner,
+					Env:                    env,
+				})
+				if err != nil {
+					return nil, err
+				}
+				utils.CopyAnnotations(claim, pod, p.Spec.Env)
+
+				r.recorder.Eventf(claim, corev1.EventTypeNormal, "Provisioning", "Provisioning PersistentVolume on node %s", nodeName)
+
+				return pod, nil
+			},
+			OnCompleted: func(_ *corev1.Pod) (done bool, err error) {
+				nodes := splitNodes(claim.Annotations[annProvisionedNodes])
+				utils.AddString(&nodes, nodeName)
+				claim.Annotations[annProvisionedNodes] = strings.Join(nodes, ",")
+				err = r.Client.Update(ctx, claim)
+				return err == nil, err
+			},
+			Policy: provisionerSpec.Spec.JobPolicy,
+			Log:    log.WithValues("node", nodeName),
+		})
+		if done && err != nil {
+			log.Error(err, "Failed to provision PersistentVolume", "node", nodeName)
+			msg := fmt.Sprintf("Failed to provision PersistentVolume %s on node %s: %v", pvName, nodeName, err)
+			r.recorder.Eventf(claim, corev1.EventTypeWarning, "ProvisionerFailed", msg)
+			if e := r.setProvisionerFailedCondition(ctx, claim, msg); e != nil {
+				log.Error(e, "Failed to set PersistentVolumeClaim condition")
+			}
+			return true, err
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+	if pending {
+		return false, nil
+	}
+
+	// Create the PersistentVolume after the volume has been provisioned on all nodes.
+	// It records the unsubstituted provisioner and its values to deprovision every node later.
+	provisionerJSON, err := utils.StorageProvisionerToJSON(provisionerSpec)
+	if err != nil {
+		return false, err
+	}
+	paramsJSON, err := json.Marshal(params)
+	if err != nil {
+		return false, errors.Wrap(err, "marshal provisioner params")
+	}
+	p := provisionerSpec.DeepCopy()
+	if err = substituteProvisionerForNode(p, params, nodes[0]); err != nil {
+		return false, err
+	}
+	pv := r.persistentVolumeForClaim(claim, p, provisionerJSON)
+	utils.CopyAnnotations(claim, pv, p.Spec.Env)
+	pv.Annotations[annProvisionerParams] = string(paramsJSON)
+	err = r.createVolume(ctx, claim, pv, log)
+	return err == nil, err
+}
+
+// recordReadOnlyManyProvisioner selects the nodes for a ReadOnlyMany claim and records them on the claim
+// together with the cache generation.
+func (r *PersistentVolumeClaimReconciler) recordReadOnlyManyProvisioner(ctx context.Context, claim *corev1.PersistentVolumeClaim, provisionerSpec *storageapi.StorageProvisioner, log logr.Logger) error {
+	nodes, err := selectReadOnlyManyNodes(ctx, r.Client, claim, provisionerSpec)
+	if err != nil {
+		r.recorder.Eventf(claim, corev1.EventTypeWarning, "NodeSelectionFailed", err.Error())
+		return err
+	}
+	params, err := provisionerParams(ctx, r.Client, claim)
+	if err != nil {
+		return err
+	}
+	p := provisionerSpec.DeepCopy()
+	if err = substituteProvisionerForNode(p, params, nodes[0]); err != nil {
+		return err
+	}
+	cache, err := cacheForClaim(ctx, r.Client, claim)
+	if err != nil {
+		return errors.Wrap(err, "record provisioner")
+	}
+	if claim.Annotations == nil {
+		claim.Annotations = map[string]string{}
+	}
+	if cache != nil && cache.Status.ImageGeneration > 0 {
+		// Mount the same cache generation on all nodes
+		claim.Annotations[storageapi.AnnotationCacheGeneration] = strconv.FormatInt(cache.Status.ImageGeneration, 10)
+	}
+	claim.Annotations[storageapi.AnnotationProvisioningPhase] = string(storageapi.ProvisioningPhaseProvisioning)
+	claim.Annotations[storageapi.AnnotationProvisionerNodes] = strings.Join(nodes, ",")
+	if hostPath := p.Spec.PersistentVolumeTemplate.HostPath; hostPath != nil {
+		claim.Annotations[annProvisionerPath] = hostPath.Path
+	}
+	log.Info("Selected nodes for ReadOnlyMany PersistentVolumeClaim", "nodes", nodes)
+	return errors.Wrap(r.Client.Update(ctx, claim), "record provisioner")
+}
+
+// deprovisionInterruptedReadOnlyMany runs the deprovisioner on every node of a ReadOnlyMany claim
+// that is deleted before its PersistentVolume has been created.
+func (r *PersistentVolumeClaimReconciler) deprovisionInterruptedReadOnlyMany(ctx context.Context, claim *corev1.PersistentVolumeClaim, log logr.Logger) (done bool, err error) {
+	provisionerSpec := resolveProvisioner(claim, r.Provisioners)
+	if provisionerSpec == nil {
+		err = errors.Errorf("StorageProvisioner %q is not registered", claim.Annotations[annStorageProvisioner])
+		log.Error(err, "Cannot derive deprovisioner for PersistentVolumeClaim")
+		r.recorder.Eventf(claim, corev1.EventTypeWarning, "DeprovisionerUnavailable", err.Error())
+		return false, nil
+	}
+	params, err := provisionerParams(ctx, r.Client, claim)
+	if err != nil {
+		return false, err
+	}
+	pvName := pvNameForPVC(claim)
+	nodes := provisionerNodes(claim)
+	for _, nodeName := range nodes {
+		done, err := utils.DeleteJob(ctx, r.Client, nodePodName(pvName, nodeName, provisioner, r.ManagerNamespace), log)
+		if err != nil || !done {
+			return false, err
+		}
+	}
+	for _, nodeName := range nodes {
+		nodeName := nodeName
+		podName := nodePodName(pvName, nodeName, deprovisioner, r.ManagerNamespace)
+		done, err := r.jobReconciler.ReconcileJob(utils.JobRequest{
+			Context:   ctx,
+			Name:      deprovisioner,
+			PodName:   podName,
+			Owner:     claim,
+			ShouldRun: true,
+			Create: func() (*corev1.Pod, error) {
+				env, err := utils.AnnotationsToEnv(claim, provisionerSpec.Spec.Env)
+				if err != nil {
+					return nil, errors.Wrap(err, "persistentvolumeclaim does not specify annotation")
+				}
+				env = append(env, corev1.EnvVar{Name: envInterrupted, Value: "true"})
+				env = append(env, readOnlyManyEnv(claim)...)
+				p := provisionerSpec.DeepCopy()
+				if err = substituteProvisionerForNode(p, params, nodeName); err != nil {
+					return nil, err
+				}
+				pod, err := utils.NewProvisionerPod(utils.PodSource{
+					ContainerName:          deprovisioner,
+					PodName:                podName,
+					SubstitutedProvisioner: p,
+					Container:              &p.Spec.Containers.Deprovisioner,
+					Env:                    env,
+				})
+				if err != nil {
+					return nil, err
+				}
+
+				log.Info("Cleaning up interrupted provisioner", "node", nodeName)
+				r.recorder.Eventf(claim, corev1.EventTypeNormal, "Deprovisioning", "Cleaning up interrupted provisioner on node %s", nodeName)
+
+				return pod, nil
+			},
+			OnCompleted: func(_ *corev1.Pod) (done bool, err error) {
+				return removeProvisionerNode(ctx, r.Client, claim, nodeName)
+			},
+			Policy: provisionerSpec.Spec.JobPolicy,
+			Log:    log.WithValues("node", nodeName),
+		})
+		if done && err != nil {
+			log.Error(err, "Failed to clean up interrupted provisioner", "node", nodeName)
+			r.recorder.Eventf(claim, corev1.EventTypeWarning, "DeprovisionerFailed", "Failed to clean up interrupted provisioner on node %s: %v", nodeName, err)
+			return false, err
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+	if len(provisionerNodes(claim)) > 0 {
+		return false, nil
+	}
+	return false, r.clearProvisionerRecord(ctx, claim)
+}
+
+// deprovisionReadOnlyMany runs the deprovisioner on every node of a ReadOnlyMany PersistentVolume.
+// Each node is removed from the PersistentVolume's nodes when its deprovisioner succeeded.
+func (r *PersistentVolumeReconciler) deprovisionReadOnlyMany(ctx context.Context, pv *corev1.PersistentVolume, provisionerSpec *storageapi.StorageProvisioner, log logr.Logger) (done bool, err error) {
+	params := utils.ProvisionerParams{}
+	if err = json.Unmarshal([]byte(pv.Annotations[annProvisionerParams]), &params); err != nil {
+		err = errors.Wrapf(err, "invalid annotation %s on PersistentVolume", annProvisionerParams)
+		log.Error(err, "Cannot derive deprovisioner from PersistentVolume")
+		r.event(pv, corev1.EventTypeWarning, "DeprovisionerSpecAnnotationInvalid", err.Error())
+		return false, nil
+	}
+	for _, nodeName := range provisionerNodes(pv) {
+		nodeName := nodeName
+		podName := nodePodName(pv.Name, nodeName, deprovisioner, r.ManagerNamespace)
+		done, err := r.jobReconciler.ReconcileJob(utils.JobRequest{
+			Context:   ctx,
+			Name:      deprovisioner,
+			PodName:   podName,
+			Owner:     pv,
+			ShouldRun: true,
+			Create: func() (*corev1.Pod, error) {
+				env, err := deprovisionerEnv(pv, provisionerSpec)
+				if err != nil {
+					return nil, err
+				}
+				env = append(env, readOnlyManyEnv(pv)...)
+				p := provisionerSpec.DeepCopy()
+				if err = substituteProvisionerForNode(p, params, nodeName); err != nil {
+					return nil, err
+				}
+				pod, err := utils.NewProvisionerPod(utils.PodSource{
+					ContainerName:          deprovisioner,
+					PodName:                podName,
+					SubstitutedProvisioner: p,
+					Container:              &p.Spec.Containers.Deprovisioner,
+					Env:                    env,
+				})
+				if err != nil {
+					return nil, err
+				}
+
+				r.event(pv, corev1.EventTypeNormal, "Deprovisioning", fmt.Sprintf("Deprovisioning PersistentVolume on node %s", nodeName))
+
+				return pod, nil
+			},
+			OnCompleted: func(_ *corev1.Pod) (done bool, err error) {
+				return removeProvisionerNode(ctx, r.Client, pv, nodeName)
+			},
+			Policy: provisionerSpec.Spec.JobPolicy,
+			Log:    log.WithValues("node", nodeName),
+		})
+		if done && err != nil {
+			log.Error(err, "Failed to deprovision PersistentVolume", "node", nodeName)
+			msg := fmt.Sprintf("Failed to deprovision PersistentVolume on node %s: %v", nodeName, err)
+			r.event(pv, corev1.EventTypeWarning, "DeprovisionerFailed", msg)
+			return done, err
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+// removeProvisionerNode removes a node whose volume has been deprovisioned from the object's nodes.
+// When no node is left the deprovisioner is disabled.
+func removeProvisionerNode(ctx context.Context, c client.Client, o client.Object, nodeName string) (bool, error) {
+	nodes := provisionerNodes(o)
+	utils.RemoveString(&nodes, nodeName)
+	a := o.GetAnnotations()
+	if len(nodes) == 0 {
+		delete(a, storageapi.AnnotationProvisionerNodes)
+		if _, ok := o.(*corev1.PersistentVolume); ok {
+			a[annPVDisableDeprovisioner] = "true"
+		}
+	} else {
+		a[storageapi.AnnotationProvisionerNodes] = strings.Join(nodes, ",")
+	}
+	o.SetAnnotations(a)
+	err := c.Update(ctx, o)
+	return err == nil, err
+}
+
+// selectReadOnlyManyNodes returns the eligible nodes that map the same storage root path as the best candidate
+// since the PersistentVolume's host path must be the same on all of its nodes.
+func selectReadOnlyManyNodes(ctx context.Context, c client.Client, claim *corev1.PersistentVolumeClaim, provisionerSpec *storageapi.StorageProvisioner) ([]string, error) {
+	nodes := &corev1.NodeList{}
+	if err := c.List(ctx, nodes); err != nil {
+		return nil, errors.Wrap(err, "select nodes")
+	}
+	cache, err := cacheForClaim(ctx, c, claim)
+	if err != nil {
+		return nil, errors.Wrap(err, "select nodes")
+	}
+	candidates := nodeCandidates(nodes.Items, &provisionerSpec.Spec, cache)
+	if len(candidates) == 0 {
+		return nil, errors.New("select nodes: no ready node matches the provisioner's node list")
+	}
+	rootPath, _ := utils.StorageRootPathForNode(candidates[0].Name, provisionerSpec.Spec.Nodes)
+	names := make([]string, 0, len(candidates))
+	for _, n := range candidates {
+		if p, _ := utils.StorageRootPathForNode(n.Name, provisionerSpec.Spec.Nodes); p == rootPath {
+			names = append(names, n.Name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// readOnlyManyEnv returns the env vars that indicate a ReadOnlyMany volume and its cache generation
+func readOnlyManyEnv(o metav1.Object) []corev1.EnvVar {
+	env := []corev1.EnvVar{{Name: envReadOnlyMany, Value: "true"}}
+	if generation := o.GetAnnotations()[storageapi.AnnotationCacheGeneration]; generation != "" {
+		env = append(env, corev1.EnvVar{Name: envCacheGeneration, Value: generation})
+	}
+	return env
+}
+
+// provisionerNodes returns the nodes a ReadOnlyMany volume is provisioned on
+func provisionerNodes(o metav1.Object) []string {
+	return splitNodes(o.GetAnnotations()[storageapi.AnnotationProvisionerNodes])
+}
+
+// volumeNodes returns the nodes a PersistentVolume is available on
+func volumeNodes(pv *corev1.PersistentVolume) []string {
+	if nodes := provisionerNodes(pv); len(nodes) > 0 {
+		return nodes
+	}
+	if nodeName, err := nodeNameFromPV(pv); err == nil {
+		return []string{nodeName}
+	}
+	return nil
+}
+
+func splitNodes(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+func nodePodName(volumeName, nodeName, suffix, namespace string) types.NamespacedName {
+	return types.NamespacedName{
+		Name:      utils.ResourceName(fmt.Sprintf("%s-%s", volumeName, nodeName), suffix),
+		Namespace: namespace,
+	}
+}
+
+// nodeAffinity returns a node affinity that matches the given nodes
+func nodeAffinity(nodes []string) *corev1.VolumeNodeAffinity {
+	return &corev1.VolumeNodeAffinity{
+		Required: &corev1.NodeSelector{
+			NodeSelectorTerms: []corev1.NodeSelectorTerm{{
+				MatchExpressions: []corev1.NodeSelectorRequirement{{
+					Key:      KeyNode,
+					Operator: corev1.NodeSelectorOpIn,
+					Values:   nodes,
+				}},
+			}},
+		},
+	}
+}
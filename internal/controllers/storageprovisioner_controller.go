@@ -25,6 +25,7 @@ import (
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
@@ -34,24 +35,39 @@ import (
 // StorageProvisionerReconciler reconciles a StorageProvisioner object
 type StorageProvisionerReconciler struct {
 	client.Client
-	Log          logr.Logger
-	Scheme       *runtime.Scheme
-	Provisioners *ProvisionerRegistry
-	Namespace    string
+	Log           logr.Logger
+	Scheme        *runtime.Scheme
+	Provisioners  *ProvisionerRegistry
+	Namespace     string
+	jobReconciler *utils.JobReconciler
+	recorder      record.EventRecorder
 }
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *StorageProvisionerReconciler) SetupWithManager(mgr ctrl.Manager) error {
-	return ctrl.NewControllerManagedBy(mgr).
+	r.recorder = mgr.GetEventRecorderFor("StorageProvisioner")
+	r.jobReconciler = &utils.JobReconciler{
+		Client:                   r.Client,
+		Recorder:                 r.recorder,
+		AnnotationOwnerName:      annStorageProvisionerName,
+		AnnotationOwnerNamespace: annStorageProvisionerNamespace,
+	}
+	b := ctrl.NewControllerManagedBy(mgr).
 		For(&storageapi.StorageProvisioner{}, builder.WithPredicates(predicate.NewPredicateFuncs(func(o client.Object) bool {
 			return r.Namespace == "" || o.GetNamespace() == r.Namespace
-		}))).
-		Complete(r)
+		})))
+	return r.jobReconciler.Watch(b, r.Namespace).Complete(r)
 }
 
 // +kubebuilder:rbac:groups=k8storagex.mgoltzsche.github.com,resources=storageprovisioners,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=k8storagex.mgoltzsche.github.com,resources=storageprovisioners/status,verbs=get;update;patch
 // +kubebuilder:rbac:groups=k8storagex.mgoltzsche.github.com,resources=storageprovisioners/finalizers,verbs=update
+// +kubebuilder:rbac:groups=core,resources=nodes,verbs=get;list;watch
+// +kubebuilder:rbac:groups=core,resources=persistentvolumes,verbs=get;list;watch
+// +kubebuilder:rbac:groups=core,resources=persistentvolumeclaims,verbs=get;list;watch
+// +kubebuilder:rbac:groups=core,resources=pods,verbs=get;list;create;delete;patch;watch
+// +kubebuilder:rbac:groups=batch,resources=jobs,verbs=get;list;create;delete;watch
+// +kubebuilder:rbac:groups="",resources=events,verbs=create;patch
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
@@ -105,5 +121,5 @@ func (r *StorageProvisionerReconciler) Reconcile(ctx context.Context, req ctrl.R
 		return ctrl.Result{}, r.Client.Status().Update(ctx, config)
 	}
 
-	return ctrl.Result{}, nil
+	return r.audit(ctx, config, log)
 }
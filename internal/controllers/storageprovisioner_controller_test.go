@@ -0,0 +1,97 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	storageapi "github.com/mgoltzsche/k8storagex/api/v1alpha1"
+	"github.com/mgoltzsche/k8storagex/internal/utils"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+var _ = Describe("StorageProvisionerController", func() {
+	Describe("auditor", func() {
+		It("should delete orphans that exceeded the grace period but no known volumes", func() {
+			p := fakeProvisioner("audit")
+			p.Namespace = testNamespace
+			p.Spec.Nodes = []storageapi.NodePath{{Name: "audit-node", Path: "/fake/audit/path"}}
+			p.Spec.Containers.Auditor = &storageapi.ProvisionerContainer{Command: []string{"audit"}}
+			p.Spec.Audit = &storageapi.AuditSpec{
+				Interval:           &metav1.Duration{Duration: time.Second},
+				DeleteOrphansAfter: &metav1.Duration{Duration: time.Second},
+			}
+			createReadyNode("audit-node")
+			known := &corev1.PersistentVolume{Spec: p.Spec.PersistentVolumeTemplate}
+			known.Name = "pvc-audit-known"
+			known.Annotations = map[string]string{annStorageProvisioner: p.Spec.Name}
+			known.Spec.Capacity = corev1.ResourceList{corev1.ResourceStorage: resource.MustParse("1G")}
+			known.Spec.HostPath = &corev1.HostPathVolumeSource{Path: "/fake/audit/path/pvc-audit-known"}
+			known.Spec.NodeAffinity = nodeAffinity([]string{"audit-node"})
+			Expect(k8sClient.Create(context.TODO(), known)).To(Succeed())
+			Expect(k8sClient.Create(context.TODO(), p)).To(Succeed())
+
+			pod := &corev1.Pod{}
+			pod.Name = utils.ResourceName("audit-audit-node", auditor)
+			pod.Namespace = testNamespace
+			verify(pod, func(err error) error {
+				if err != nil {
+					return err
+				}
+				if !hasEnv(pod, envVolumes, known.Name) {
+					return fmt.Errorf("auditor Pod does not specify the known volume")
+				}
+				if !hasEnv(pod, envDeleteOrphans, "") {
+					return fmt.Errorf("auditor Pod deletes orphans during the first audit")
+				}
+				return nil
+			})
+			completeAuditor(pod, "pvc-audit-orphan\npvc-audit-known\n../escaped")
+			verify(p, func(err error) error {
+				if err != nil {
+					return err
+				}
+				if len(p.Status.Nodes) != 1 || len(p.Status.Nodes[0].Orphans) != 1 || p.Status.Nodes[0].Orphans[0].Name != "pvc-audit-orphan" {
+					return fmt.Errorf("unexpected audit status %#v", p.Status.Nodes)
+				}
+				return nil
+			})
+
+			By("running the next audit")
+			verify(pod, func(err error) error {
+				if err != nil {
+					return err
+				}
+				if !hasEnv(pod, envDeleteOrphans, "pvc-audit-orphan") {
+					return fmt.Errorf("auditor Pod does not delete the orphan")
+				}
+				if !hasEnv(pod, envVolumes, known.Name) {
+					return fmt.Errorf("auditor Pod does not specify the known volume")
+				}
+				return nil
+			})
+		})
+	})
+})
+
+// completeAuditor terminates the auditor Pod successfully with the given termination message
+func completeAuditor(pod *corev1.Pod, message string) {
+	key := types.NamespacedName{Name: pod.Name, Namespace: pod.Namespace}
+	Eventually(func() error {
+		if err := k8sClient.Get(context.TODO(), key, pod); err != nil {
+			return err
+		}
+		pod.Status.Phase = corev1.PodSucceeded
+		pod.Status.ContainerStatuses = []corev1.ContainerStatus{{
+			Name:  "main",
+			Image: pod.Spec.Containers[0].Image,
+			State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{Message: message}},
+		}}
+		return k8sClient.Status().Update(context.TODO(), pod)
+	}, "10s", "1s").ShouldNot(HaveOccurred())
+}
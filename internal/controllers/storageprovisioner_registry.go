@@ -118,6 +118,30 @@ func validateProvisioner(p *storageapi.StorageProvisioner) error {
 	if err != nil {
 		return err
 	}
+	optional := map[string]*storageapi.ProvisionerContainer{
+		"expander":        p.Spec.Containers.Expander,
+		"snapshotter":     p.Spec.Containers.Snapshotter,
+		"snapshotDeleter": p.Spec.Containers.SnapshotDeleter,
+		"auditor":         p.Spec.Containers.Auditor,
+		"releaser":        p.Spec.Containers.Releaser,
+	}
+	for name, c := range optional {
+		if c == nil {
+			continue
+		}
+		_, err = utils.NewProvisionerPod(utils.PodSource{
+			ContainerName: name,
+			PodName: types.NamespacedName{
+				Name:      "test-pod",
+				Namespace: "test-namespace",
+			},
+			SubstitutedProvisioner: p,
+			Container:              c,
+		})
+		if err != nil {
+			return errors.Wrapf(err, "spec.containers.%s", name)
+		}
+	}
 	if p.Spec.PersistentVolumeTemplate.VolumeMode == nil {
 		return fmt.Errorf("spec.persistentVolumeTemplate.VolumeMode is empty")
 	}
@@ -144,6 +168,17 @@ func validateProvisioner(p *storageapi.StorageProvisioner) error {
 			return fmt.Errorf("spec.nodes[%d].path must be an absolute sub directory but is %q", i, path)
 		}
 	}
+	if a := p.Spec.Agent; a != nil {
+		if len(a.PodSelector) == 0 {
+			return fmt.Errorf("spec.agent.podSelector is empty")
+		}
+		if a.Port <= 0 {
+			return fmt.Errorf("spec.agent.port is not positive")
+		}
+		if p.Spec.PersistentVolumeTemplate.HostPath == nil {
+			return fmt.Errorf("spec.agent requires spec.persistentVolumeTemplate.hostPath to be specified")
+		}
+	}
 	// TODO: validate other containers, missing fields etc
 	return nil
 }
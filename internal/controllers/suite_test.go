@@ -32,6 +32,7 @@ import (
 	"time"
 
 	storageapi "github.com/mgoltzsche/k8storagex/api/v1alpha1"
+	"github.com/mgoltzsche/k8storagex/internal/agent"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	corev1 "k8s.io/api/core/v1"
@@ -60,6 +61,11 @@ var (
 	testNamespace         string
 	testNamespaceResource = &corev1.Namespace{}
 	testProvisioners      = newProvisioners()
+	testRegistry          = &fakeRegistry{}
+	// testPodProvisioners are known to the PodReconciler only so that the other reconcilers ignore its fixtures
+	testPodProvisioners = newProvisioners()
+	// testLostNodeGracePeriod is the duration a node may be NotReady before its volumes are finalized
+	testLostNodeGracePeriod = 5 * time.Second
 )
 
 func TestAPIs(t *testing.T) {
@@ -122,7 +128,56 @@ var _ = BeforeSuite(func() {
 		Client:       mgr.GetClient(),
 		Log:          ctrl.Log.WithName("controllers").WithName("Pod"),
 		Scheme:       mgr.GetScheme(),
+		Provisioners: testPodProvisioners,
+	}).SetupWithManager(mgr)
+	Expect(err).ToNot(HaveOccurred())
+	err = (&PersistentVolumeClaimReconciler{
+		Client:           mgr.GetClient(),
+		Log:              ctrl.Log.WithName("controllers").WithName("PersistentVolumeClaim"),
+		Scheme:           mgr.GetScheme(),
+		ManagerNamespace: testNamespace,
+		Provisioners:     testProvisioners,
+		AgentTokens:      agent.StaticToken(testAgentToken),
+	}).SetupWithManager(mgr)
+	Expect(err).ToNot(HaveOccurred())
+	err = (&PersistentVolumeReconciler{
+		Client:           mgr.GetClient(),
+		Log:              ctrl.Log.WithName("controllers").WithName("PersistentVolume"),
+		Scheme:           mgr.GetScheme(),
+		ManagerNamespace: testNamespace,
+		Provisioners:     testProvisioners,
+		AgentTokens:      agent.StaticToken(testAgentToken),
+	}).SetupWithManager(mgr)
+	Expect(err).ToNot(HaveOccurred())
+	err = (&NodeReconciler{
+		Client:              mgr.GetClient(),
+		Log:                 ctrl.Log.WithName("controllers").WithName("Node"),
+		Scheme:              mgr.GetScheme(),
+		ManagerNamespace:    testNamespace,
+		LostNodeGracePeriod: testLostNodeGracePeriod,
+	}).SetupWithManager(mgr)
+	Expect(err).ToNot(HaveOccurred())
+	err = (&StorageProvisionerReconciler{
+		Client:       mgr.GetClient(),
+		Log:          ctrl.Log.WithName("controllers").WithName("StorageProvisioner"),
+		Scheme:       mgr.GetScheme(),
 		Provisioners: testProvisioners,
+		Namespace:    testNamespace,
+	}).SetupWithManager(mgr)
+	Expect(err).ToNot(HaveOccurred())
+	err = (&CacheSnapshotReconciler{
+		Client:           mgr.GetClient(),
+		Log:              ctrl.Log.WithName("controllers").WithName("CacheSnapshot"),
+		Scheme:           mgr.GetScheme(),
+		ManagerNamespace: testNamespace,
+		Provisioners:     testProvisioners,
+	}).SetupWithManager(mgr)
+	Expect(err).ToNot(HaveOccurred())
+	err = (&CacheReconciler{
+		Client:   mgr.GetClient(),
+		Log:      ctrl.Log.WithName("controllers").WithName("Cache"),
+		Scheme:   mgr.GetScheme(),
+		Registry: testRegistry,
 	}).SetupWithManager(mgr)
 	Expect(err).ToNot(HaveOccurred())
 
@@ -245,7 +300,7 @@ func hasBeenDeleted(pvc *corev1.PersistentVolumeClaim) func(error) error {
 			}
 			return err
 		}
-		if pvc.Annotations[storageapi.AnnotationPersistentVolumeClaimNoProtection] != storageapi.Enabled {
+		if pvc.Annotations[annPVCUsed] != storageapi.Enabled {
 			err = fmt.Errorf("PVC has not been annotated. %s", err)
 		}
 		if pvc.GetDeletionTimestamp() == nil {
@@ -256,6 +311,13 @@ func hasBeenDeleted(pvc *corev1.PersistentVolumeClaim) func(error) error {
 }
 
 func createPVC(name string, provisionerName string) *corev1.PersistentVolumeClaim {
+	pvc := newPVC(name, provisionerName)
+	err := k8sClient.Create(context.TODO(), pvc)
+	Expect(err).ShouldNot(HaveOccurred())
+	return pvc
+}
+
+func newPVC(name string, provisionerName string) *corev1.PersistentVolumeClaim {
 	pvc := &corev1.PersistentVolumeClaim{}
 	pvc.Name = name
 	pvc.Namespace = testNamespace
@@ -263,7 +325,5 @@ func createPVC(name string, provisionerName string) *corev1.PersistentVolumeClai
 	pvc.Spec.Resources.Requests = map[corev1.ResourceName]resource.Quantity{corev1.ResourceStorage: resource.MustParse("1G")}
 	pvc.Finalizers = []string{finalizerPVCProtection}
 	pvc.Annotations = map[string]string{"volume.beta.kubernetes.io/storage-provisioner": provisionerName}
-	err := k8sClient.Create(context.TODO(), pvc)
-	Expect(err).ShouldNot(HaveOccurred())
 	return pvc
 }
@@ -0,0 +1,177 @@
+package csi
+
+import (
+	"context"
+	"os"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/containers/storage"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// controllerServer creates volumes that are pinned to a node.
+// The volume contents are created on the node when the volume is published.
+// Since volumes are deleted on their node the controller service runs on every node.
+type controllerServer struct {
+	*Driver
+}
+
+func (s *controllerServer) CreateVolume(_ context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+	if req.Name == "" {
+		return nil, status.Error(codes.InvalidArgument, "no volume name provided")
+	}
+	if err := validateCapabilities(req.VolumeCapabilities); err != nil {
+		return nil, err
+	}
+	params := req.Parameters
+	volumeCtx := map[string]string{}
+	for k, v := range params {
+		if !strings.HasPrefix(k, paramPrefixK8sMetadata) {
+			volumeCtx[k] = v
+		}
+	}
+	if volumeCtx[paramCacheNamespace] == "" && params[paramPVCNamespace] != "" {
+		volumeCtx[paramCacheNamespace] = params[paramPVCNamespace]
+	}
+	if volumeCtx[paramCacheName] == "" && volumeCtx[paramImage] == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "neither parameter %s nor %s specified", paramCacheName, paramImage)
+	}
+	vol := &csi.Volume{
+		VolumeId:      req.Name,
+		VolumeContext: volumeCtx,
+	}
+	if r := req.CapacityRange; r != nil {
+		vol.CapacityBytes = r.RequiredBytes
+	}
+	if topology := selectTopology(req.AccessibilityRequirements); topology != nil {
+		vol.AccessibleTopology = []*csi.Topology{topology}
+	}
+	return &csi.CreateVolumeResponse{Volume: vol}, nil
+}
+
+// selectTopology pins the volume to the node preferred by the scheduler
+func selectTopology(req *csi.TopologyRequirement) *csi.Topology {
+	if req == nil {
+		return nil
+	}
+	for _, t := range append(req.Preferred, req.Requisite...) {
+		if t.Segments[TopologyKeyNode] != "" {
+			return &csi.Topology{Segments: map[string]string{TopologyKeyNode: t.Segments[TopologyKeyNode]}}
+		}
+	}
+	return nil
+}
+
+// DeleteVolume removes a volume from the node.
+// A volume that has been unpublished has been committed and removed already.
+// The contents of a volume that is still recorded as published are discarded.
+func (s *controllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
+	if req.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "no volume id provided")
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	vol, err := s.loadState(req.VolumeId)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if vol == nil {
+		return &csi.DeleteVolumeResponse{}, nil
+	}
+	opts := s.mountOptions(ctx, req.VolumeId, vol)
+	store, err := s.NewStore()
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	defer store.Free()
+	s.Log.WithField("volume", req.VolumeId).WithField("targetPath", vol.TargetPath).Warn("Discarding volume that has not been unpublished")
+	if _, _, err = store.Unmount(opts); err != nil && !errors.Is(err, storage.ErrContainerUnknown) {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if err = os.Remove(s.stateFile(req.VolumeId)); err != nil && !os.IsNotExist(err) {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &csi.DeleteVolumeResponse{}, nil
+}
+
+func (s *controllerServer) ValidateVolumeCapabilities(_ context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
+	if req.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "no volume id provided")
+	}
+	if err := validateCapabilities(req.VolumeCapabilities); err != nil {
+		return &csi.ValidateVolumeCapabilitiesResponse{Message: err.Error()}, nil
+	}
+	return &csi.ValidateVolumeCapabilitiesResponse{
+		Confirmed: &csi.ValidateVolumeCapabilitiesResponse_Confirmed{
+			VolumeContext:      req.VolumeContext,
+			VolumeCapabilities: req.VolumeCapabilities,
+			Parameters:         req.Parameters,
+		},
+	}, nil
+}
+
+func (s *controllerServer) ControllerGetCapabilities(context.Context, *csi.ControllerGetCapabilitiesRequest) (*csi.ControllerGetCapabilitiesResponse, error) {
+	return &csi.ControllerGetCapabilitiesResponse{
+		Capabilities: []*csi.ControllerServiceCapability{{
+			Type: &csi.ControllerServiceCapability_Rpc{
+				Rpc: &csi.ControllerServiceCapability_RPC{Type: csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME},
+			},
+		}},
+	}, nil
+}
+
+func (s *controllerServer) ControllerPublishVolume(context.Context, *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "ControllerPublishVolume is not supported")
+}
+
+func (s *controllerServer) ControllerUnpublishVolume(context.Context, *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "ControllerUnpublishVolume is not supported")
+}
+
+func (s *controllerServer) ListVolumes(context.Context, *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "ListVolumes is not supported")
+}
+
+func (s *controllerServer) GetCapacity(context.Context, *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "GetCapacity is not supported")
+}
+
+func (s *controllerServer) CreateSnapshot(context.Context, *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "CreateSnapshot is not supported")
+}
+
+func (s *controllerServer) DeleteSnapshot(context.Context, *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "DeleteSnapshot is not supported")
+}
+
+func (s *controllerServer) ListSnapshots(context.Context, *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "ListSnapshots is not supported")
+}
+
+func (s *controllerServer) ControllerExpandVolume(context.Context, *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "ControllerExpandVolume is not supported")
+}
+
+func (s *controllerServer) ControllerGetVolume(context.Context, *csi.ControllerGetVolumeRequest) (*csi.ControllerGetVolumeResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "ControllerGetVolume is not supported")
+}
+
+func validateCapabilities(caps []*csi.VolumeCapability) error {
+	if len(caps) == 0 {
+		return status.Error(codes.InvalidArgument, "no volume capabilities provided")
+	}
+	for _, c := range caps {
+		if c.GetBlock() != nil {
+			return status.Error(codes.InvalidArgument, "block volumes are not supported")
+		}
+		if m := c.GetAccessMode().GetMode(); m != csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER {
+			return status.Errorf(codes.InvalidArgument, "unsupported access mode %s", m)
+		}
+	}
+	return nil
+}
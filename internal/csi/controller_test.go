@@ -0,0 +1,76 @@
+package csi
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/containers/storage"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCreateVolume(t *testing.T) {
+	testee := &controllerServer{&Driver{Name: "testdriver"}}
+	req := &csi.CreateVolumeRequest{
+		Name: "pvc-123",
+		VolumeCapabilities: []*csi.VolumeCapability{{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		}},
+		Parameters: map[string]string{
+			paramCacheName:    "mycache",
+			paramPVCNamespace: "myns",
+		},
+		AccessibilityRequirements: &csi.TopologyRequirement{
+			Preferred: []*csi.Topology{{Segments: map[string]string{TopologyKeyNode: "node-b"}}},
+			Requisite: []*csi.Topology{{Segments: map[string]string{TopologyKeyNode: "node-a"}}},
+		},
+	}
+	resp, err := testee.CreateVolume(context.Background(), req)
+	require.NoError(t, err)
+	require.Equal(t, "pvc-123", resp.Volume.VolumeId)
+	require.Equal(t, map[string]string{paramCacheName: "mycache", paramCacheNamespace: "myns"}, resp.Volume.VolumeContext)
+	require.Equal(t, []*csi.Topology{{Segments: map[string]string{TopologyKeyNode: "node-b"}}}, resp.Volume.AccessibleTopology)
+
+	req.Parameters = map[string]string{}
+	_, err = testee.CreateVolume(context.Background(), req)
+	require.Error(t, err, "missing cache name")
+
+	req.Parameters = map[string]string{paramCacheName: "mycache"}
+	req.VolumeCapabilities[0].AccessMode.Mode = csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER
+	_, err = testee.CreateVolume(context.Background(), req)
+	require.Error(t, err, "unsupported access mode")
+}
+
+func TestDeleteVolume(t *testing.T) {
+	store := &fakeStore{}
+	d := newTestDriver(t, store)
+	testee := &controllerServer{d}
+	targetPath := filepath.Join(t.TempDir(), "target")
+	require.NoError(t, d.saveState("pvc-123", &publishedVolume{TargetPath: targetPath, CacheName: "mycache", CacheNamespace: "myns"}))
+
+	_, err := testee.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: "pvc-123"})
+	require.NoError(t, err)
+	require.Len(t, store.unmounted, 1, "unmounted")
+	opts := store.unmounted[0]
+	require.Equal(t, "pvc-123", opts.ContainerName, "container name")
+	require.Equal(t, targetPath, opts.ExtMountDir, "mount dir")
+	require.False(t, opts.Commit, "should discard the volume's contents")
+	vol, err := d.loadState("pvc-123")
+	require.NoError(t, err)
+	require.Nil(t, vol, "volume state should be removed")
+
+	_, err = testee.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: "pvc-123"})
+	require.NoError(t, err, "delete unpublished volume")
+	require.Len(t, store.unmounted, 1, "should not unmount unpublished volume")
+
+	store.unmountErr = errors.Wrap(storage.ErrContainerUnknown, "find cache container")
+	require.NoError(t, d.saveState("pvc-456", &publishedVolume{TargetPath: targetPath, CacheName: "mycache"}))
+	_, err = testee.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: "pvc-456"})
+	require.NoError(t, err, "delete volume whose container does not exist")
+
+	_, err = testee.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{})
+	require.Error(t, err, "missing volume id")
+}
@@ -0,0 +1,97 @@
+// Package csi provides a CSI driver that mounts layerfs cache volumes.
+// It uses the layerfs store directly and does not render StorageProvisioner templates.
+package csi
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"os"
+	"sync"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/mgoltzsche/k8storagex/internal/layerfs"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+)
+
+const (
+	// TopologyKeyNode is the topology key that pins a volume to the node it has been created for
+	TopologyKeyNode = "k8storagex.mgoltzsche.github.com/node"
+
+	paramCacheName         = "cacheName"
+	paramCacheNamespace    = "cacheNamespace"
+	paramImage             = "image"
+	paramPVCNamespace      = "csi.storage.k8s.io/pvc/namespace"
+	paramPodNamespace      = "csi.storage.k8s.io/pod.namespace"
+	paramEphemeral         = "csi.storage.k8s.io/ephemeral"
+	paramPrefixK8sMetadata = "csi.storage.k8s.io/"
+)
+
+// Driver implements the CSI identity, controller and node services.
+// Since volumes are node-local the controller service must be run on every node
+// using the external-provisioner's --node-deployment mode.
+type Driver struct {
+	// Name is the CSI driver name
+	Name string
+	// Version is the driver version
+	Version string
+	// NodeID identifies the node the driver is running on
+	NodeID string
+	// StateDir is the node-local directory in which published volumes are recorded
+	StateDir string
+	// Mode specifies the access permissions of published volume directories
+	Mode os.FileMode
+	// NewStore creates a new cache store
+	NewStore func() (layerfs.Store, error)
+	// ApplyDefaults completes the mount options derived from a volume's context
+	ApplyDefaults func(*layerfs.MountOptions)
+	Log           *logrus.Entry
+	// mutex synchronizes the access to the node's published volumes
+	mutex sync.Mutex
+}
+
+// Serve serves the CSI API at the given endpoint, e.g. unix:///csi/csi.sock
+func (d *Driver) Serve(ctx context.Context, endpoint string) error {
+	if d.Name == "" {
+		return errors.New("no csi driver name specified")
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return errors.Wrap(err, "invalid csi endpoint")
+	}
+	if u.Scheme != "unix" {
+		return errors.Errorf("unsupported csi endpoint scheme %q, expected unix", u.Scheme)
+	}
+	addr := u.Path
+	if u.Host != "" {
+		addr = u.Host + addr
+	}
+	if err = os.Remove(addr); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "remove previous csi socket")
+	}
+	l, err := net.Listen("unix", addr)
+	if err != nil {
+		return errors.Wrap(err, "csi")
+	}
+	srv := grpc.NewServer(grpc.UnaryInterceptor(d.logErrors))
+	csi.RegisterIdentityServer(srv, &identityServer{d})
+	csi.RegisterControllerServer(srv, &controllerServer{d})
+	csi.RegisterNodeServer(srv, newNodeServer(d))
+	go func() {
+		<-ctx.Done()
+		srv.GracefulStop()
+	}()
+	d.Log.Infof("Serving CSI driver %s at %s", d.Name, endpoint)
+	return srv.Serve(l)
+}
+
+func (d *Driver) logErrors(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	d.Log.Debugf("%s: %+v", info.FullMethod, req)
+	resp, err := handler(ctx, req)
+	if err != nil {
+		d.Log.WithError(err).Errorf("%s failed", info.FullMethod)
+	}
+	return resp, err
+}
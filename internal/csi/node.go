@@ -0,0 +1,217 @@
+package csi
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/mgoltzsche/k8storagex/internal/layerfs"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// nodeServer un/mounts cache volumes using the layerfs store.
+// Since NodeUnpublishVolume requests don't contain the volume context
+// the mount options are recorded within the state dir when a volume is published.
+type nodeServer struct {
+	*Driver
+}
+
+// publishedVolume is the node-local state of a published volume
+type publishedVolume struct {
+	TargetPath     string `json:"targetPath"`
+	CacheName      string `json:"cacheName,omitempty"`
+	CacheNamespace string `json:"cacheNamespace,omitempty"`
+	Image          string `json:"image,omitempty"`
+}
+
+func newNodeServer(d *Driver) *nodeServer {
+	return &nodeServer{Driver: d}
+}
+
+func (s *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+	if req.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "no volume id provided")
+	}
+	if req.TargetPath == "" {
+		return nil, status.Error(codes.InvalidArgument, "no target path provided")
+	}
+	if err := validateCapabilities([]*csi.VolumeCapability{req.VolumeCapability}); err != nil {
+		return nil, err
+	}
+	if req.Readonly {
+		return nil, status.Error(codes.InvalidArgument, "read-only volumes are not supported")
+	}
+	volumeCtx := req.VolumeContext
+	if volumeCtx[paramEphemeral] == "true" {
+		// The attributes of inline volumes are specified by the Pod's author and could refer to any cache
+		return nil, status.Error(codes.InvalidArgument, "inline ephemeral volumes are not supported, use a generic ephemeral volume instead")
+	}
+	vol := publishedVolume{
+		TargetPath:     req.TargetPath,
+		CacheName:      volumeCtx[paramCacheName],
+		CacheNamespace: volumeCtx[paramCacheNamespace],
+		Image:          volumeCtx[paramImage],
+	}
+	if vol.CacheNamespace == "" {
+		vol.CacheNamespace = volumeCtx[paramPodNamespace]
+	}
+	if vol.CacheName == "" && vol.Image == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "neither volume attribute %s nor %s specified", paramCacheName, paramImage)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	published, err := s.loadState(req.VolumeId)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if published != nil {
+		if published.TargetPath != req.TargetPath {
+			return nil, status.Errorf(codes.FailedPrecondition, "volume %s is already published at %s", req.VolumeId, published.TargetPath)
+		}
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
+	// Remove the target dir if the kubelet created it since the store creates it
+	if err = os.Remove(req.TargetPath); err != nil && !os.IsNotExist(err) {
+		return nil, status.Errorf(codes.Internal, "remove target path: %s", err)
+	}
+	opts := s.mountOptions(ctx, req.VolumeId, &vol)
+	store, err := s.NewStore()
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	defer store.Free()
+	s.Log.WithField("volume", req.VolumeId).WithField("targetPath", req.TargetPath).Info("Publishing volume")
+	dir, err := store.Mount(opts)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if err = os.Chmod(dir, s.Mode); err == nil {
+		err = s.saveState(req.VolumeId, &vol)
+	}
+	if err != nil {
+		opts.Context = context.Background()
+		_, _, _ = store.Unmount(opts)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &csi.NodePublishVolumeResponse{}, nil
+}
+
+func (s *nodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
+	if req.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "no volume id provided")
+	}
+	if req.TargetPath == "" {
+		return nil, status.Error(codes.InvalidArgument, "no target path provided")
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	vol, err := s.loadState(req.VolumeId)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if vol == nil {
+		return &csi.NodeUnpublishVolumeResponse{}, nil // not published
+	}
+	opts := s.mountOptions(ctx, req.VolumeId, vol)
+	opts.Commit = true
+	opts.AsyncPush = true
+	store, err := s.NewStore()
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	defer store.Free()
+	s.Log.WithField("volume", req.VolumeId).WithField("targetPath", vol.TargetPath).Info("Unpublishing volume")
+	if _, _, err = store.Unmount(opts); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if err = os.Remove(s.stateFile(req.VolumeId)); err != nil && !os.IsNotExist(err) {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &csi.NodeUnpublishVolumeResponse{}, nil
+}
+
+func (s *nodeServer) NodeGetInfo(context.Context, *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
+	return &csi.NodeGetInfoResponse{
+		NodeId: s.NodeID,
+		AccessibleTopology: &csi.Topology{
+			Segments: map[string]string{TopologyKeyNode: s.NodeID},
+		},
+	}, nil
+}
+
+func (s *nodeServer) NodeGetCapabilities(context.Context, *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
+	return &csi.NodeGetCapabilitiesResponse{}, nil
+}
+
+func (s *nodeServer) NodeStageVolume(context.Context, *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "NodeStageVolume is not supported")
+}
+
+func (s *nodeServer) NodeUnstageVolume(context.Context, *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "NodeUnstageVolume is not supported")
+}
+
+func (s *nodeServer) NodeGetVolumeStats(context.Context, *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "NodeGetVolumeStats is not supported")
+}
+
+func (s *nodeServer) NodeExpandVolume(context.Context, *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "NodeExpandVolume is not supported")
+}
+
+func (s *Driver) mountOptions(ctx context.Context, volumeID string, vol *publishedVolume) layerfs.MountOptions {
+	opts := layerfs.MountOptions{
+		Context:        ctx,
+		ContainerName:  volumeID,
+		ExtMountDir:    vol.TargetPath,
+		CacheName:      vol.CacheName,
+		CacheNamespace: vol.CacheNamespace,
+		Image:          vol.Image,
+	}
+	if s.ApplyDefaults != nil {
+		s.ApplyDefaults(&opts)
+	}
+	return opts
+}
+
+func (s *Driver) stateFile(volumeID string) string {
+	return filepath.Join(s.StateDir, volumeID+".json")
+}
+
+func (s *Driver) loadState(volumeID string) (*publishedVolume, error) {
+	b, err := ioutil.ReadFile(s.stateFile(volumeID))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "load volume state")
+	}
+	vol := &publishedVolume{}
+	err = json.Unmarshal(b, vol)
+	return vol, errors.Wrapf(err, "load volume state %s", volumeID)
+}
+
+func (s *Driver) saveState(volumeID string, vol *publishedVolume) error {
+	if err := os.MkdirAll(s.StateDir, 0700); err != nil {
+		return errors.Wrap(err, "save volume state")
+	}
+	b, err := json.Marshal(vol)
+	if err != nil {
+		return errors.Wrap(err, "save volume state")
+	}
+	file := s.stateFile(volumeID)
+	tmpFile := file + ".tmp"
+	if err = ioutil.WriteFile(tmpFile, b, 0600); err == nil {
+		err = os.Rename(tmpFile, file)
+	}
+	return errors.Wrap(err, "save volume state")
+}
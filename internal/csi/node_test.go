@@ -0,0 +1,133 @@
+package csi
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/mgoltzsche/k8storagex/internal/layerfs"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type fakeStore struct {
+	layerfs.Store
+	mounted    []layerfs.MountOptions
+	unmounted  []layerfs.MountOptions
+	unmountErr error
+}
+
+func (s *fakeStore) Free() {}
+
+func (s *fakeStore) Mount(opts layerfs.MountOptions) (string, error) {
+	s.mounted = append(s.mounted, opts)
+	return opts.ExtMountDir, os.Mkdir(opts.ExtMountDir, 0700)
+}
+
+func (s *fakeStore) Unmount(opts layerfs.MountOptions) (string, bool, error) {
+	s.unmounted = append(s.unmounted, opts)
+	if s.unmountErr != nil {
+		return "", false, s.unmountErr
+	}
+	return "", false, os.RemoveAll(opts.ExtMountDir)
+}
+
+func newTestDriver(t *testing.T, store layerfs.Store) *Driver {
+	return &Driver{
+		Name:     "testdriver",
+		NodeID:   "node-a",
+		StateDir: filepath.Join(t.TempDir(), "state"),
+		Mode:     0750,
+		NewStore: func() (layerfs.Store, error) { return store, nil },
+		Log:      logrus.NewEntry(logrus.StandardLogger()),
+	}
+}
+
+func newPublishRequest(targetPath string) *csi.NodePublishVolumeRequest {
+	return &csi.NodePublishVolumeRequest{
+		VolumeId:   "pvc-123",
+		TargetPath: targetPath,
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		},
+		VolumeContext: map[string]string{
+			paramCacheName:    "mycache",
+			paramPodNamespace: "myns",
+		},
+	}
+}
+
+func TestNodePublishVolume(t *testing.T) {
+	store := &fakeStore{}
+	testee := newNodeServer(newTestDriver(t, store))
+	targetPath := filepath.Join(t.TempDir(), "target")
+	req := newPublishRequest(targetPath)
+	require.NoError(t, os.Mkdir(targetPath, 0700), "target path created by the kubelet")
+
+	_, err := testee.NodePublishVolume(context.Background(), req)
+	require.NoError(t, err)
+	require.Len(t, store.mounted, 1, "mounted")
+	opts := store.mounted[0]
+	require.Equal(t, "pvc-123", opts.ContainerName, "container name")
+	require.Equal(t, targetPath, opts.ExtMountDir, "mount dir")
+	require.Equal(t, "mycache", opts.CacheName, "cache name")
+	require.Equal(t, "myns", opts.CacheNamespace, "cache namespace should default to the Pod's namespace")
+	fi, err := os.Stat(targetPath)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0750), fi.Mode().Perm(), "target dir mode")
+
+	_, err = testee.NodePublishVolume(context.Background(), req)
+	require.NoError(t, err, "publish volume again")
+	require.Len(t, store.mounted, 1, "should not mount published volume again")
+
+	req.TargetPath = filepath.Join(t.TempDir(), "other")
+	_, err = testee.NodePublishVolume(context.Background(), req)
+	require.Error(t, err, "publish volume at another path")
+	require.Equal(t, codes.FailedPrecondition, status.Code(err), "status code")
+
+	_, err = testee.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{VolumeId: "pvc-123", TargetPath: targetPath})
+	require.NoError(t, err)
+	require.Len(t, store.unmounted, 1, "unmounted")
+	opts = store.unmounted[0]
+	require.Equal(t, "mycache", opts.CacheName, "unmount cache name")
+	require.Equal(t, "myns", opts.CacheNamespace, "unmount cache namespace")
+	require.True(t, opts.Commit, "should commit")
+	require.True(t, opts.AsyncPush, "should push asynchronously")
+	vol, err := testee.loadState("pvc-123")
+	require.NoError(t, err)
+	require.Nil(t, vol, "volume state should be removed")
+
+	_, err = testee.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{VolumeId: "pvc-123", TargetPath: targetPath})
+	require.NoError(t, err, "unpublish volume again")
+	require.Len(t, store.unmounted, 1, "should not unmount unpublished volume again")
+}
+
+func TestNodePublishVolumeRejectsInvalidRequests(t *testing.T) {
+	store := &fakeStore{}
+	testee := newNodeServer(newTestDriver(t, store))
+	for name, modify := range map[string]func(*csi.NodePublishVolumeRequest){
+		"no volume id":   func(r *csi.NodePublishVolumeRequest) { r.VolumeId = "" },
+		"no target path": func(r *csi.NodePublishVolumeRequest) { r.TargetPath = "" },
+		"read-only":      func(r *csi.NodePublishVolumeRequest) { r.Readonly = true },
+		"no cache name":  func(r *csi.NodePublishVolumeRequest) { delete(r.VolumeContext, paramCacheName) },
+		"inline ephemeral volume": func(r *csi.NodePublishVolumeRequest) {
+			r.VolumeContext[paramEphemeral] = "true"
+			r.VolumeContext[paramCacheNamespace] = "otherns"
+		},
+		"unsupported access mode": func(r *csi.NodePublishVolumeRequest) {
+			r.VolumeCapability.AccessMode.Mode = csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER
+		},
+	} {
+		req := newPublishRequest(filepath.Join(t.TempDir(), "target"))
+		modify(req)
+		_, err := testee.NodePublishVolume(context.Background(), req)
+		require.Error(t, err, name)
+		require.Equal(t, codes.InvalidArgument, status.Code(err), "%s: status code", name)
+	}
+	require.Len(t, store.mounted, 0, "mounted")
+}
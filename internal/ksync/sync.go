@@ -41,10 +41,13 @@ func (u *Updater) RegisterCacheVolume(ctx context.Context, cacheName types.Names
 	return image, errors.Wrap(err, "register volume in cluster")
 }
 
-func (u *Updater) PrepareCommit(ctx context.Context, cacheName types.NamespacedName, nodeName, volumeName string) (commit bool, err error) {
+// PrepareCommit acquires the commit lock for a volume.
+// reject is true when the cache does not accept the volume's contents since it is read-only or was reset after the volume has been mounted.
+func (u *Updater) PrepareCommit(ctx context.Context, cacheName types.NamespacedName, nodeName, volumeName string) (commit, reject bool, generation int64, err error) {
 	err = u.updateCache(ctx, cacheName, false, func(c *cacheapi.Cache) {
 		if c.Spec.ReadOnly || c.Status.Phase == cacheapi.CachePhaseReject {
 			commit = false
+			reject = true
 		} else {
 			vol, err := findVolume(c, nodeName, volumeName)
 			if err != nil {
@@ -56,6 +59,8 @@ func (u *Updater) PrepareCommit(ctx context.Context, cacheName types.NamespacedN
 				return
 			}
 			commit = vol.Committable && !commitInProgress(c)
+			reject = !vol.Committable || resetSince(c, vol.Created.Time)
+			generation = vol.CacheGeneration
 			if commit {
 				vol.CommitStartTime = &metav1.Time{Time: time.Now()}
 			}
@@ -66,7 +71,7 @@ func (u *Updater) PrepareCommit(ctx context.Context, cacheName types.NamespacedN
 		commit = false
 		err = nil
 	}
-	return commit, errors.Wrap(err, "prepare cache commit")
+	return commit, reject, generation, errors.Wrap(err, "prepare cache commit")
 }
 
 func (u *Updater) UnregisterCacheVolume(ctx context.Context, cacheName types.NamespacedName, nodeName, volumeName string, commitErr error) error {
@@ -93,6 +98,96 @@ func (u *Updater) UnregisterCacheVolume(ctx context.Context, cacheName types.Nam
 	return errors.Wrapf(err, "unregister volume %q from cluster", volumeName)
 }
 
+// ImagePushed records the cache's latest registry image and, unless 0, its generation.
+func (u *Updater) ImagePushed(ctx context.Context, cacheName types.NamespacedName, nodeName, volumeName, imageID string, generation int64, pushErr error) error {
+	err := u.updateCache(ctx, cacheName, false, func(c *cacheapi.Cache) {
+		node := upsertNode(&c.Status, nodeName)
+		if pushErr != nil {
+			node.LastError = &cacheapi.VolumeError{
+				VolumeName: volumeName,
+				Error:      fmt.Sprintf("push: %s", pushErr),
+				Happened:   metav1.Time{Time: time.Now()},
+			}
+			return
+		}
+		node.LastImageID = imageID
+		c.Status.LastImageID = &imageID
+		if generation > c.Status.ImageGeneration {
+			c.Status.ImageGeneration = generation
+		}
+		c.Status.LastWritten = &metav1.Time{Time: time.Now()}
+	})
+	if kerr.IsNotFound(err) {
+		logrus.WithField("cache", cacheName.String()).
+			WithField("node", nodeName).
+			Warn("update pushed image: cache not found")
+		err = nil
+	}
+	return errors.Wrap(err, "update pushed image in cluster")
+}
+
+// ImageRolledBack records the image and generation the cache's latest image has been rolled back to.
+func (u *Updater) ImageRolledBack(ctx context.Context, cacheName types.NamespacedName, nodeName, imageID string, generation int64) error {
+	err := u.updateCache(ctx, cacheName, false, func(c *cacheapi.Cache) {
+		upsertNode(&c.Status, nodeName).LastImageID = imageID
+		c.Status.LastImageID = &imageID
+		c.Status.ImageGeneration = generation
+		c.Status.LastWritten = &metav1.Time{Time: time.Now()}
+	})
+	if kerr.IsNotFound(err) {
+		logrus.WithField("cache", cacheName.String()).
+			WithField("node", nodeName).
+			Warn("update rolled back image: cache not found")
+		err = nil
+	}
+	return errors.Wrap(err, "update rolled back image in cluster")
+}
+
+// CacheReset describes the last reset of a cache from a node's point of view
+type CacheReset struct {
+	Generation int64
+	Time       time.Time
+	// Applied is true when the node's local images have already been dropped
+	Applied bool
+}
+
+// LastReset returns the cache's last reset or nil if it has never been reset.
+func (u *Updater) LastReset(ctx context.Context, cacheName types.NamespacedName, nodeName string) (*CacheReset, error) {
+	var c cacheapi.Cache
+	if err := u.client.Get(ctx, cacheName, &c); err != nil {
+		if kerr.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "get cache reset")
+	}
+	r := c.Status.LastReset
+	if r == nil {
+		return nil, nil
+	}
+	reset := &CacheReset{
+		Generation: r.ResetGeneration,
+		Time:       r.ResetTime.Time,
+	}
+	for _, n := range c.Status.Nodes {
+		if n.Name == nodeName {
+			reset.Applied = n.ResetGeneration == r.ResetGeneration
+			break
+		}
+	}
+	return reset, nil
+}
+
+// ResetApplied records that the node's local images have been dropped for the given reset generation.
+func (u *Updater) ResetApplied(ctx context.Context, cacheName types.NamespacedName, nodeName string, generation int64) error {
+	err := u.updateCache(ctx, cacheName, false, func(c *cacheapi.Cache) {
+		upsertNode(&c.Status, nodeName).ResetGeneration = generation
+	})
+	if kerr.IsNotFound(err) {
+		err = nil
+	}
+	return errors.Wrap(err, "record node reset")
+}
+
 func (u *Updater) updateCache(ctx context.Context, name types.NamespacedName, create bool, modify func(*cacheapi.Cache)) error {
 	return retry.RetryOnConflict(backoff, func() error {
 		var cache cacheapi.Cache
@@ -124,7 +219,7 @@ func addVolume(c *cacheapi.Cache, nodeName, volName string, commit bool) error {
 			return errors.Errorf("volume %q on node %q already exists", volName, nodeName)
 		}
 	}
-	commit = commit && !c.Spec.ReadOnly
+	commit = commit && !c.Spec.ReadOnly && c.Status.Phase != cacheapi.CachePhaseReject
 	if commit {
 		c.Status.CacheGeneration++
 	}
@@ -179,6 +274,11 @@ func findVolume(c *cacheapi.Cache, nodeName, volumeName string) (*cacheapi.Volum
 	return nil, errors.Errorf("node %q not found in %T %s/%s", nodeName, *c, c.Namespace, c.Name)
 }
 
+// resetSince returns true if the cache has been reset after the given time
+func resetSince(c *cacheapi.Cache, t time.Time) bool {
+	return c.Status.LastReset != nil && c.Status.LastReset.ResetTime.After(t)
+}
+
 var commitTimeout = 15 * time.Minute
 
 func commitInProgress(c *cacheapi.Cache) bool {
@@ -1,9 +1,11 @@
 package ksync
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/mgoltzsche/k8storagex/internal/layerfs"
+	"github.com/pkg/errors"
 	"k8s.io/apimachinery/pkg/types"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
@@ -28,7 +30,7 @@ func (s *synchronizedStore) Mount(opts layerfs.MountOptions) (dir string, err er
 		return "", fmt.Errorf("no cache name or namespace provided")
 	}
 	cacheName := types.NamespacedName{Name: opts.CacheName, Namespace: opts.CacheNamespace}
-	opts.Image, err = s.cluster.RegisterCacheVolume(opts.Context, cacheName, s.nodeName, opts.ContainerName, opts.Image, true)
+	opts.Image, err = s.cluster.RegisterCacheVolume(opts.Context, cacheName, s.nodeName, opts.ContainerName, opts.Image, !opts.ReadOnly)
 	if err != nil {
 		return "", err
 	}
@@ -37,15 +39,39 @@ func (s *synchronizedStore) Mount(opts layerfs.MountOptions) (dir string, err er
 			s.cluster.UnregisterCacheVolume(opts.Context, cacheName, s.nodeName, opts.ContainerName, err)
 		}
 	}()
+	if err = s.applyReset(opts, cacheName); err != nil {
+		return "", err
+	}
 	return s.Store.Mount(opts)
 }
 
+// applyReset drops the node's local images of a cache that has been reset since the node used it last.
+// The registry images have been deleted by the manager already.
+func (s *synchronizedStore) applyReset(opts layerfs.MountOptions, cacheName types.NamespacedName) error {
+	reset, err := s.cluster.LastReset(opts.Context, cacheName, s.nodeName)
+	if err != nil || reset == nil || reset.Applied {
+		return err
+	}
+	opts.Image = ""
+	if err = s.Store.Reset(opts); err != nil {
+		return err
+	}
+	return s.cluster.ResetApplied(opts.Context, cacheName, s.nodeName, reset.Generation)
+}
+
 func (s *synchronizedStore) Unmount(opts layerfs.MountOptions) (imageID string, newImage bool, err error) {
 	if opts.CacheName == "" || opts.CacheNamespace == "" {
 		return "", false, fmt.Errorf("no cache name or namespace provided")
 	}
 	cacheName := types.NamespacedName{Name: opts.CacheName, Namespace: opts.CacheNamespace}
-	_, syncErr := s.cluster.PrepareCommit(opts.Context, cacheName, s.nodeName, opts.ContainerName)
+	_, reject, generation, syncErr := s.cluster.PrepareCommit(opts.Context, cacheName, s.nodeName, opts.ContainerName)
+	if reject {
+		opts.Commit = false
+	}
+	if opts.Generation == 0 {
+		// tag the image with the cluster-wide cache generation
+		opts.Generation = generation
+	}
 	defer func() {
 		if err != nil {
 			err = fmt.Errorf("unmount: %w", err)
@@ -54,8 +80,57 @@ func (s *synchronizedStore) Unmount(opts layerfs.MountOptions) (imageID string,
 	}()
 	//opts.Commit = commit
 	imageID, newImage, err = s.Store.Unmount(opts)
+	if err == nil && newImage && opts.Image != "" && !opts.AsyncPush {
+		// the image has been pushed already
+		err = s.cluster.ImagePushed(opts.Context, cacheName, s.nodeName, opts.ContainerName, imageID, imageGeneration(opts), nil)
+	}
 	if err == nil {
 		err = syncErr
 	}
 	return
 }
+
+func (s *synchronizedStore) Push(ctx context.Context, req layerfs.PushRequest) error {
+	if req.CacheName == "" || req.CacheNamespace == "" {
+		return s.Store.Push(ctx, req)
+	}
+	cacheName := types.NamespacedName{Name: req.CacheName, Namespace: req.CacheNamespace}
+	reset, err := s.cluster.LastReset(ctx, cacheName, s.nodeName)
+	if err != nil {
+		return err
+	}
+	if reset != nil && reset.Time.After(req.Created) {
+		// Don't push an image that was committed before the cache has been reset
+		return s.Store.DiscardPush(req)
+	}
+	err = s.Store.Push(ctx, req)
+	if errors.Is(err, layerfs.ErrPushDiscarded) {
+		return err // nothing has been pushed
+	}
+	if e := s.cluster.ImagePushed(ctx, cacheName, s.nodeName, req.ContainerName, req.ImageID, req.Generation, err); e != nil && err == nil {
+		err = e
+	}
+	return err
+}
+
+// Rollback rolls the cache back to the given generation and records it within the Cache's status
+func (s *synchronizedStore) Rollback(opts layerfs.MountOptions) (imageID string, err error) {
+	if opts.CacheName == "" || opts.CacheNamespace == "" {
+		return "", fmt.Errorf("no cache name or namespace provided")
+	}
+	imageID, err = s.Store.Rollback(opts)
+	if err != nil {
+		return "", err
+	}
+	cacheName := types.NamespacedName{Name: opts.CacheName, Namespace: opts.CacheNamespace}
+	err = s.cluster.ImageRolledBack(opts.Context, cacheName, s.nodeName, imageID, opts.Generation)
+	return imageID, err
+}
+
+// imageGeneration returns the generation a committed image has been tagged with or 0 if generations are not tagged
+func imageGeneration(opts layerfs.MountOptions) int64 {
+	if opts.KeepGenerations <= 0 {
+		return 0
+	}
+	return opts.Generation
+}
@@ -0,0 +1,47 @@
+package ksync
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	cacheapi "github.com/mgoltzsche/k8storagex/api/v1alpha1"
+	"github.com/mgoltzsche/k8storagex/internal/layerfs"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// discardingStore behaves like a layerfs.Store whose queued image has been deleted
+type discardingStore struct {
+	layerfs.Store
+}
+
+func (s *discardingStore) Push(context.Context, layerfs.PushRequest) error {
+	return layerfs.ErrPushDiscarded
+}
+
+func TestPushDiscardedDoesNotRecordImage(t *testing.T) {
+	scheme := runtime.NewScheme()
+	require.NoError(t, cacheapi.AddToScheme(scheme))
+	cache := &cacheapi.Cache{ObjectMeta: metav1.ObjectMeta{Name: "mycache", Namespace: "myns"}}
+	c := fake.NewFakeClientWithScheme(scheme, cache)
+	s := Synchronized(&discardingStore{}, c, "mynode")
+
+	err := s.Push(context.Background(), layerfs.PushRequest{
+		CacheName:      "mycache",
+		CacheNamespace: "myns",
+		ImageID:        "deleted-image-id",
+		Generation:     3,
+		Created:        time.Now(),
+	})
+	require.True(t, errors.Is(err, layerfs.ErrPushDiscarded), "Push() should return ErrPushDiscarded but returned %v", err)
+	actual := &cacheapi.Cache{}
+	require.NoError(t, c.Get(context.Background(), types.NamespacedName{Name: "mycache", Namespace: "myns"}, actual))
+	require.Nil(t, actual.Status.LastImageID, "status.lastImageID")
+	require.Nil(t, actual.Status.LastWritten, "status.lastWritten")
+	require.Equal(t, int64(0), actual.Status.ImageGeneration, "status.imageGeneration")
+}
@@ -0,0 +1,252 @@
+package layerfs
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/transports/alltransports"
+	"github.com/containers/image/v5/types"
+	"github.com/containers/storage"
+	"github.com/pkg/errors"
+)
+
+const generationTagPrefix = "gen-"
+
+// tagGeneration tags a committed cache image with its generation and removes the local tags of generations that should not be kept anymore.
+// Untagged images are deleted by Prune.
+func (s *store) tagGeneration(opts *MountOptions, imageID string) (generation int64, err error) {
+	repo := localImageRepo(opts)
+	generations, err := s.localGenerations(repo)
+	if err != nil {
+		return 0, err
+	}
+	generation = opts.Generation
+	if generation == 0 {
+		generation = 1
+		if len(generations) > 0 {
+			generation = generations[len(generations)-1] + 1
+		}
+	}
+	img, err := s.store.Image(imageID)
+	if err != nil {
+		return 0, errors.Wrap(err, "tag generation")
+	}
+	if err = s.store.SetNames(imageID, append(img.Names, localGenerationImageName(repo, generation))); err != nil {
+		return 0, errors.Wrap(err, "tag generation")
+	}
+	generations = append(generations, generation)
+	sort.Slice(generations, func(i, j int) bool { return generations[i] < generations[j] })
+	for len(generations) > opts.KeepGenerations {
+		if err = s.untag(localGenerationImageName(repo, generations[0])); err != nil {
+			return 0, errors.Wrap(err, "remove old generation tag")
+		}
+		generations = generations[1:]
+	}
+	return generation, nil
+}
+
+// Rollback points the cache's latest image to the given generation's image and returns the image's ID.
+// When a registry image is configured the generation is pulled from the registry unless it exists locally
+// and the registry's latest image is replaced with the generation's one.
+func (s *store) Rollback(opts MountOptions) (imageID string, err error) {
+	if opts.Generation <= 0 {
+		return "", errors.New("rollback: no generation specified")
+	}
+	repo := localImageRepo(&opts)
+	genImgName := localGenerationImageName(repo, opts.Generation)
+	img, err := s.store.Image(genImgName)
+	if err != nil {
+		if opts.Image == "" || !errors.Is(err, storage.ErrImageUnknown) {
+			return "", errors.Wrapf(err, "rollback to generation %d", opts.Generation)
+		}
+		// generation does not exist locally
+		if img, err = s.pullGeneration(&opts); err != nil {
+			return "", errors.Wrapf(err, "rollback to generation %d", opts.Generation)
+		}
+	}
+	if opts.Image != "" {
+		srcRef, err := alltransports.ParseImageName(generationImage(opts.Image, opts.Generation))
+		if err != nil {
+			return "", errors.Wrap(err, "rollback")
+		}
+		destRef, err := s.imageRef(&opts)
+		if err != nil {
+			return "", errors.Wrap(err, "rollback")
+		}
+		log := s.log.WithField("image", opts.Image).WithField("generation", opts.Generation)
+		log.Info("rolling back cache image within registry")
+		err = s.copyImage(opts.Context, destRef, srcRef, &s.systemContext, &s.systemContext, log)
+		if err != nil {
+			return "", errors.Wrap(err, "rollback")
+		}
+	}
+	latest := localImageName(&opts)
+	if err = s.store.SetNames(img.ID, append(img.Names, latest)); err != nil {
+		return "", errors.Wrap(err, "rollback")
+	}
+	s.log.WithField("image", latest).WithField("imageID", img.ID).WithField("generation", opts.Generation).Info("rolled back cache image")
+	return img.ID, nil
+}
+
+// pullGeneration pulls the given generation's registry image and tags it locally with its generation.
+func (s *store) pullGeneration(opts *MountOptions) (*storage.Image, error) {
+	genImage := generationImage(opts.Image, opts.Generation)
+	srcRef, err := alltransports.ParseImageName(genImage)
+	if err != nil {
+		return nil, err
+	}
+	if err = s.pullImage(opts.Context, srcRef); err != nil {
+		return nil, err
+	}
+	img, err := s.store.Image(srcRef.DockerReference().String())
+	if err != nil {
+		return nil, err
+	}
+	names := append(img.Names, localGenerationImageName(localImageRepo(opts), opts.Generation))
+	if err = s.store.SetNames(img.ID, names); err != nil {
+		return nil, err
+	}
+	img.Names = names
+	return img, nil
+}
+
+// pruneRegistryGenerations deletes the registry's generation tags of the cache image that should not be kept anymore.
+// Since a registry deletes a manifest including all of its tags a generation is kept
+// when it refers to the same manifest as the latest image or a kept generation.
+func (s *store) pruneRegistryGenerations(ctx context.Context, image string, keep int) error {
+	if keep <= 0 {
+		return nil
+	}
+	ref, err := alltransports.ParseImageName(image)
+	if err != nil {
+		return errors.Wrap(err, "prune registry generations")
+	}
+	if ref.Transport().Name() != docker.Transport.Name() {
+		return nil
+	}
+	generations, err := s.registryGenerations(ctx, ref)
+	if err != nil || len(generations) <= keep {
+		return errors.Wrap(err, "prune registry generations")
+	}
+	keepDigests := map[string]bool{}
+	if dgst, err := docker.GetDigest(ctx, &s.systemContext, ref); err == nil {
+		keepDigests[dgst.String()] = true
+	} else if !isImageNotFound(err) {
+		return errors.Wrap(err, "prune registry generations")
+	}
+	refs := make([]types.ImageReference, len(generations))
+	digests := make([]string, len(generations))
+	for i, gen := range generations {
+		if refs[i], err = alltransports.ParseImageName(generationImage(image, gen)); err != nil {
+			return errors.Wrap(err, "prune registry generations")
+		}
+		dgst, err := docker.GetDigest(ctx, &s.systemContext, refs[i])
+		if err != nil {
+			return errors.Wrap(err, "prune registry generations")
+		}
+		digests[i] = dgst.String()
+	}
+	for _, dgst := range digests[len(digests)-keep:] {
+		keepDigests[dgst] = true
+	}
+	for i, gen := range generations[:len(generations)-keep] {
+		log := s.log.WithField("image", image).WithField("generation", gen)
+		if keepDigests[digests[i]] {
+			log.Debug("keeping registry generation since its manifest is still referenced")
+			continue
+		}
+		log.Info("deleting registry generation")
+		if err = refs[i].DeleteImage(ctx, &s.systemContext); err != nil && !isImageNotFound(err) {
+			return errors.Wrapf(err, "delete registry generation %d", gen)
+		}
+	}
+	return nil
+}
+
+// registryGenerations lists the generations the cache image is tagged with within the registry in ascending order
+func (s *store) registryGenerations(ctx context.Context, ref types.ImageReference) ([]int64, error) {
+	prefix := generationTagPrefix
+	if tagged, ok := ref.DockerReference().(reference.NamedTagged); ok {
+		prefix = fmt.Sprintf("%s-%s", tagged.Tag(), generationTagPrefix)
+	}
+	tags, err := docker.GetRepositoryTags(ctx, &s.systemContext, ref)
+	if err != nil {
+		return nil, err
+	}
+	generations := []int64{}
+	for _, tag := range tags {
+		if strings.HasPrefix(tag, prefix) {
+			if gen, err := strconv.ParseInt(tag[len(prefix):], 10, 64); err == nil {
+				generations = append(generations, gen)
+			}
+		}
+	}
+	sort.Slice(generations, func(i, j int) bool { return generations[i] < generations[j] })
+	return generations, nil
+}
+
+func (s *store) localGenerations(repo string) ([]int64, error) {
+	images, err := s.store.Images()
+	if err != nil {
+		return nil, errors.Wrap(err, "list generations")
+	}
+	prefix := fmt.Sprintf("%s:%s", repo, generationTagPrefix)
+	generations := []int64{}
+	for _, img := range images {
+		for _, name := range img.Names {
+			if strings.HasPrefix(name, prefix) {
+				if gen, err := strconv.ParseInt(name[len(prefix):], 10, 64); err == nil {
+					generations = append(generations, gen)
+				}
+			}
+		}
+	}
+	sort.Slice(generations, func(i, j int) bool { return generations[i] < generations[j] })
+	return generations, nil
+}
+
+func (s *store) untag(name string) error {
+	img, err := s.store.Image(name)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(img.Names))
+	for _, n := range img.Names {
+		if n != name {
+			names = append(names, n)
+		}
+	}
+	return s.store.SetNames(img.ID, names)
+}
+
+// generationImage derives the image name of a generation from the cache's image name.
+// Since the cache name is the registry image's tag the generation is appended to the tag.
+func generationImage(image string, generation int64) string {
+	ref, err := alltransports.ParseImageName(image)
+	if err != nil || ref.DockerReference() == nil {
+		return fmt.Sprintf("%s-%s%d", image, generationTagPrefix, generation)
+	}
+	named := ref.DockerReference()
+	tag := fmt.Sprintf("%s%d", generationTagPrefix, generation)
+	if tagged, ok := named.(reference.NamedTagged); ok {
+		tag = fmt.Sprintf("%s-%s", tagged.Tag(), tag)
+	}
+	genRef, err := reference.WithTag(reference.TrimNamed(named), tag)
+	if err != nil {
+		return fmt.Sprintf("%s-%s%d", image, generationTagPrefix, generation)
+	}
+	return fmt.Sprintf("%s://%s", ref.Transport().Name(), genRef.String())
+}
+
+func localImageRepo(o *MountOptions) string {
+	return fmt.Sprintf("localhost/cache/%s/%s", o.CacheNamespace, o.CacheName)
+}
+
+func localGenerationImageName(repo string, generation int64) string {
+	return fmt.Sprintf("%s:%s%d", repo, generationTagPrefix, generation)
+}
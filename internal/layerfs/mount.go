@@ -1,6 +1,7 @@
 package layerfs
 
 import (
+	mountinfo "github.com/containers/storage/pkg/mount"
 	"github.com/pkg/errors"
 	"golang.org/x/sys/unix"
 )
@@ -17,3 +18,14 @@ func unmount(destDir string) error {
 	err := unix.Unmount(destDir, unix.MNT_DETACH|unix.MNT_FORCE)
 	return errors.Wrapf(err, "unmount %s", destDir)
 }
+
+func remountReadOnly(destDir string) error {
+	err := unix.Mount("", destDir, "", unix.MS_BIND|unix.MS_REMOUNT|unix.MS_RDONLY, "")
+	return errors.Wrapf(err, "remount %s read-only", destDir)
+}
+
+// Mounted returns true if the given directory is a mount point
+func Mounted(dir string) (bool, error) {
+	mounted, err := mountinfo.Mounted(dir)
+	return mounted, errors.Wrapf(err, "check if %s is mounted", dir)
+}
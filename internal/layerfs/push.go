@@ -3,38 +3,54 @@ package layerfs
 import (
 	"context"
 	"fmt"
-	"os"
-	"time"
 
-	"github.com/containers/common/pkg/retry"
-	"github.com/containers/image/v5/copy"
 	"github.com/containers/image/v5/docker/reference"
-	"github.com/containers/image/v5/signature"
 	"github.com/containers/image/v5/storage"
+	"github.com/containers/image/v5/transports/alltransports"
 	"github.com/containers/image/v5/types"
 	"github.com/pkg/errors"
 )
 
 func (s *store) pushImage(ctx context.Context, srcImageRef reference.Named, srcImageID string, destRef types.ImageReference) error {
-	policy := &signature.Policy{Default: []signature.PolicyRequirement{signature.NewPRInsecureAcceptAnything()}}
-	policyCtx, err := signature.NewPolicyContext(policy)
-	if err != nil {
-		panic(err)
-	}
 	srcRef, err := storage.Transport.NewStoreReference(s.store, srcImageRef, srcImageID)
 	if err != nil {
 		return errors.Wrap(err, "push source")
 	}
-	s.log.WithField("src", srcRef.StringWithinTransport()).
-		WithField("dst", fmt.Sprintf("%s://%s", destRef.Transport().Name(), destRef.StringWithinTransport())).
-		Info("pushing cache image to registry")
-	return retry.RetryIfNecessary(ctx, func() error {
-		_, err := copy.Image(ctx, policyCtx, destRef, srcRef, &copy.Options{
-			SourceCtx:          &types.SystemContext{},
-			DestinationCtx:     &s.systemContext,
-			ImageListSelection: copy.CopySystemImage,
-			ReportWriter:       os.Stdout,
-		})
+	log := s.log.WithField("src", srcRef.StringWithinTransport()).
+		WithField("dst", fmt.Sprintf("%s://%s", destRef.Transport().Name(), destRef.StringWithinTransport()))
+	log.Info("pushing cache image to registry")
+	err = s.copyImage(ctx, destRef, srcRef, &s.systemContext, &types.SystemContext{}, log)
+	return errors.Wrap(err, "push")
+}
+
+func (s *store) pullImage(ctx context.Context, srcRef types.ImageReference) error {
+	destRef, err := s.storeImageRef(srcRef.DockerReference().String())
+	if err != nil {
+		return errors.Wrap(err, "pull destination")
+	}
+	log := s.log.WithField("src", fmt.Sprintf("%s://%s", srcRef.Transport().Name(), srcRef.StringWithinTransport())).
+		WithField("dst", destRef.StringWithinTransport())
+	log.Info("pulling cache image from registry")
+	err = s.copyImage(ctx, destRef, srcRef, &types.SystemContext{}, &s.systemContext, log)
+	return errors.Wrap(err, "pull")
+}
+
+// pushGeneration pushes the image additionally as the given generation image if specified
+// and deletes the registry's generations that exceed the number of generations to keep.
+func (s *store) pushGeneration(ctx context.Context, srcImageRef reference.Named, srcImageID, image, genImage string, keep int) error {
+	if genImage == "" {
+		return nil
+	}
+	destRef, err := alltransports.ParseImageName(genImage)
+	if err != nil {
+		return errors.Wrap(err, "push generation")
+	}
+	if err = s.pushImage(ctx, srcImageRef, srcImageID, destRef); err != nil {
 		return err
-	}, &retry.RetryOptions{MaxRetry: 10, Delay: time.Second})
+	}
+	if err = s.pruneRegistryGenerations(ctx, image, keep); err != nil {
+		// the image has been pushed successfully - old generations are deleted with the next push
+		s.log.WithField("image", image).Warn(err)
+	}
+	return nil
 }
@@ -0,0 +1,200 @@
+package layerfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/containers/storage/pkg/lockfile"
+	"github.com/pkg/errors"
+)
+
+// PushRequest describes a committed cache image that needs to be pushed to the registry
+type PushRequest struct {
+	CacheName      string `json:"cacheName,omitempty"`
+	CacheNamespace string `json:"cacheNamespace,omitempty"`
+	ContainerName  string `json:"containerName,omitempty"`
+	Image          string `json:"image"`
+	LocalImage     string `json:"localImage"`
+	ImageID        string `json:"imageID"`
+	// GenerationImage is the registry image the image is pushed to additionally to tag its generation
+	GenerationImage string `json:"generationImage,omitempty"`
+	// Generation is the generation the image has been tagged with or 0 if it has not been tagged
+	Generation int64 `json:"generation,omitempty"`
+	// KeepGenerations is the number of generations that are kept within the registry
+	KeepGenerations int       `json:"keepGenerations,omitempty"`
+	Created         time.Time `json:"created"`
+	// Attempts is the number of failed push attempts
+	Attempts int `json:"attempts,omitempty"`
+	// NextAttempt is the time before which a failed push is not retried
+	NextAttempt *time.Time `json:"nextAttempt,omitempty"`
+}
+
+const (
+	// maxPushAttempts is the number of times a queued push is attempted before it is discarded
+	maxPushAttempts = 10
+	pushRetryDelay  = 30 * time.Second
+	maxPushDelay    = 30 * time.Minute
+)
+
+// Due returns true if the push should be attempted (again) at the given time
+func (r *PushRequest) Due(now time.Time) bool {
+	return r.NextAttempt == nil || !now.Before(*r.NextAttempt)
+}
+
+func (r *PushRequest) key() string {
+	return strings.NewReplacer("/", "_", ":", "_").Replace(r.LocalImage)
+}
+
+// pushQueue is a node-local queue of images that need to be pushed.
+// Only the latest request per image is kept since older commits don't need to be pushed anymore.
+type pushQueue struct {
+	dir string
+}
+
+func (q *pushQueue) Enqueue(req PushRequest) error {
+	unlock, err := q.lock()
+	if err != nil {
+		return errors.Wrap(err, "enqueue push")
+	}
+	defer unlock()
+	return errors.Wrap(q.write(&req), "enqueue push")
+}
+
+// Failed records a failed attempt to push the given request and delays its next attempt exponentially.
+// The request is removed from the queue after maxPushAttempts.
+// Returns the push error, annotated when the request has been discarded.
+func (q *pushQueue) Failed(req PushRequest, pushErr error) error {
+	unlock, err := q.lock()
+	if err != nil {
+		return errors.Wrap(err, "record failed push")
+	}
+	defer unlock()
+	queued, err := q.read(q.file(&req))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return pushErr
+		}
+		return errors.Wrap(err, "record failed push")
+	}
+	if queued.ImageID != req.ImageID {
+		return pushErr // a newer image has been queued meanwhile
+	}
+	queued.Attempts++
+	if queued.Attempts >= maxPushAttempts {
+		if err = os.Remove(q.file(&req)); err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "discard failed push")
+		}
+		return errors.Wrapf(pushErr, "discarded queued push after %d attempts", queued.Attempts)
+	}
+	delay := pushRetryDelay << uint(queued.Attempts-1)
+	if delay > maxPushDelay || delay <= 0 {
+		delay = maxPushDelay
+	}
+	next := time.Now().Add(delay)
+	queued.NextAttempt = &next
+	if err = q.write(&queued); err != nil {
+		return errors.Wrap(err, "record failed push")
+	}
+	return errors.Wrapf(pushErr, "attempt %d/%d, retrying in %s", queued.Attempts, maxPushAttempts, delay)
+}
+
+func (q *pushQueue) write(req *PushRequest) error {
+	b, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	tmpFile, err := ioutil.TempFile(q.dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	_, err = tmpFile.Write(b)
+	if e := tmpFile.Close(); e != nil && err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(tmpFile.Name(), q.file(req))
+	}
+	return err
+}
+
+func (q *pushQueue) read(file string) (req PushRequest, err error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return req, err
+	}
+	err = json.Unmarshal(b, &req)
+	return req, err
+}
+
+func (q *pushQueue) List() ([]PushRequest, error) {
+	files, err := ioutil.ReadDir(q.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "list queued pushes")
+	}
+	reqs := make([]PushRequest, 0, len(files))
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		req, err := q.read(filepath.Join(q.dir, f.Name()))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue // removed concurrently
+			}
+			return nil, errors.Wrapf(err, "read queued push %s", f.Name())
+		}
+		reqs = append(reqs, req)
+	}
+	sort.Slice(reqs, func(i, j int) bool {
+		return reqs[i].Created.Before(reqs[j].Created)
+	})
+	return reqs, nil
+}
+
+// Remove removes the given request from the queue unless it has been replaced by a newer one meanwhile.
+func (q *pushQueue) Remove(req PushRequest) error {
+	unlock, err := q.lock()
+	if err != nil {
+		return errors.Wrap(err, "dequeue push")
+	}
+	defer unlock()
+	file := q.file(&req)
+	queued, err := q.read(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err == nil && queued.ImageID != req.ImageID {
+		return nil // a newer image has been queued meanwhile
+	}
+	err = os.Remove(file)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "dequeue push")
+	}
+	return nil
+}
+
+func (q *pushQueue) lock() (unlock func(), err error) {
+	if err = os.MkdirAll(q.dir, 0700); err != nil {
+		return nil, err
+	}
+	l, err := lockfile.GetLockfile(filepath.Join(q.dir, ".lock"))
+	if err != nil {
+		return nil, err
+	}
+	l.Lock()
+	return l.Unlock, nil
+}
+
+func (q *pushQueue) file(req *PushRequest) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%s.json", req.key()))
+}
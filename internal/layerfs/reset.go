@@ -0,0 +1,45 @@
+package layerfs
+
+import (
+	"github.com/containers/storage"
+	"github.com/pkg/errors"
+)
+
+// Reset removes the names of the cache's local images including its generations.
+// The untagged images are deleted by Prune.
+// When a registry image is specified it is deleted from the registry as well.
+func (s *store) Reset(opts MountOptions) error {
+	repo := localImageRepo(&opts)
+	generations, err := s.localGenerations(repo)
+	if err != nil {
+		return errors.Wrap(err, "reset")
+	}
+	names := []string{localImageName(&opts)}
+	for _, gen := range generations {
+		names = append(names, localGenerationImageName(repo, gen))
+	}
+	for _, name := range names {
+		if err = s.untag(name); err != nil && !errors.Is(err, storage.ErrImageUnknown) {
+			return errors.Wrap(err, "reset")
+		}
+	}
+	log := s.log.WithField("image", localImageName(&opts))
+	if opts.Image != "" {
+		imgRef, err := s.imageRef(&opts)
+		if err != nil {
+			return errors.Wrap(err, "reset")
+		}
+		log = log.WithField("image", opts.Image)
+		if err = imgRef.DeleteImage(opts.Context, &s.systemContext); err != nil && !isImageNotFound(err) {
+			return errors.Wrap(err, "reset: delete registry image")
+		}
+	}
+	log.Info("reset cache")
+	return nil
+}
+
+// DiscardPush removes a queued push without pushing the image
+func (s *store) DiscardPush(req PushRequest) error {
+	s.log.WithField("image", req.Image).WithField("imageID", req.ImageID).Info("discarding queued push")
+	return s.queue.Remove(req)
+}
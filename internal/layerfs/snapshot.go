@@ -0,0 +1,106 @@
+package layerfs
+
+import (
+	"fmt"
+
+	"github.com/containers/buildah"
+	"github.com/containers/image/v5/transports/alltransports"
+	"github.com/containers/image/v5/types"
+	"github.com/containers/storage"
+	"github.com/pkg/errors"
+)
+
+// Snapshot commits the mounted cache container to an immutable snapshot image without unmounting it.
+// When the container did not change its source image is tagged as snapshot.
+// When a snapshot image is specified the snapshot is pushed to the registry.
+func (s *store) Snapshot(opts MountOptions) (imageID string, err error) {
+	if opts.Snapshot == "" {
+		return "", errors.New("no snapshot name provided")
+	}
+	if opts.ContainerName == "" && opts.ExtMountDir == "" {
+		return "", errors.New("neither container name nor mount path provided")
+	}
+	name, err := opts.containerName()
+	if err != nil {
+		return "", err
+	}
+	builder, err := buildah.OpenBuilder(s.store, name)
+	if err != nil {
+		if opts.ContainerName != "" {
+			return "", errors.Wrapf(err, "find cache container %q", name)
+		}
+		builder, err = buildah.OpenBuilderByPath(s.store, opts.ExtMountDir)
+		if err != nil {
+			return "", errors.Wrapf(err, "find cache container by path %s", opts.ExtMountDir)
+		}
+	}
+	imgRef, err := s.storeImageRef(localSnapshotImageName(&opts))
+	if err != nil {
+		return "", err
+	}
+	imageID, _, newImage, err := s.commit(opts.Context, builder, imgRef)
+	if err != nil {
+		return "", errors.Wrap(err, "snapshot")
+	}
+	imgName := imgRef.DockerReference().String()
+	if !newImage {
+		img, err := s.store.Image(imageID)
+		if err != nil {
+			return "", errors.Wrap(err, "tag snapshot")
+		}
+		if err = s.store.SetNames(imageID, append(img.Names, imgName)); err != nil {
+			return "", errors.Wrap(err, "tag snapshot")
+		}
+	}
+	s.log.WithField("image", imgName).WithField("imageID", imageID).Info("created snapshot")
+	if opts.SnapshotImage != "" {
+		destRef, err := alltransports.ParseImageName(opts.SnapshotImage)
+		if err != nil {
+			return "", errors.Wrap(err, "invalid snapshot image name provided")
+		}
+		if err = s.pushImage(opts.Context, imgRef.DockerReference(), imageID, destRef); err != nil {
+			return "", errors.Wrap(err, "snapshot")
+		}
+	}
+	return imageID, nil
+}
+
+// DeleteSnapshot removes the snapshot image's name and deletes the snapshot from the registry if specified.
+// The image's layers are deleted when no other name or container refers to them anymore.
+// Since every snapshot is pushed to its own repository deleting its manifest does not affect other images.
+func (s *store) DeleteSnapshot(opts MountOptions) error {
+	if opts.Snapshot == "" {
+		return errors.New("no snapshot name provided")
+	}
+	if opts.SnapshotImage != "" {
+		destRef, err := alltransports.ParseImageName(opts.SnapshotImage)
+		if err != nil {
+			return errors.Wrap(err, "invalid snapshot image name provided")
+		}
+		if err = destRef.DeleteImage(opts.Context, &s.systemContext); err != nil && !isImageNotFound(err) {
+			return errors.Wrap(err, "delete registry snapshot")
+		}
+		s.log.WithField("image", opts.SnapshotImage).Info("deleted registry snapshot")
+	}
+	imgRef, err := s.storeImageRef(localSnapshotImageName(&opts))
+	if err != nil {
+		return err
+	}
+	imgName := imgRef.DockerReference().String()
+	if _, err = s.store.Image(imgName); err != nil {
+		if errors.Is(err, storage.ErrImageUnknown) {
+			return nil
+		}
+		return errors.Wrap(err, "delete snapshot")
+	}
+	err = deleteImages(opts.Context, &types.SystemContext{}, s.store, []string{imgName}, false, false, false)
+	if err != nil {
+		return errors.Wrap(err, "delete snapshot")
+	}
+	s.log.WithField("image", imgName).Info("deleted snapshot")
+	return nil
+}
+
+func localSnapshotImageName(o *MountOptions) string {
+	return fmt.Sprintf("localhost/snapshot/%s/%s:latest", o.CacheNamespace, o.Snapshot)
+}
@@ -5,7 +5,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
-	"strings"
+	"time"
 
 	"github.com/containers/buildah"
 	//"github.com/containers/buildah/util"
@@ -28,19 +28,44 @@ type Store interface {
 	Free()
 	Mount(MountOptions) (dir string, err error)
 	Unmount(MountOptions) (imageID string, newImage bool, err error)
+	Snapshot(MountOptions) (imageID string, err error)
+	Rollback(MountOptions) (imageID string, err error)
+	Reset(MountOptions) error
+	DeleteSnapshot(MountOptions) error
 	Prune(context.Context) error
+	QueuedPushes() ([]PushRequest, error)
+	Push(context.Context, PushRequest) error
+	DiscardPush(PushRequest) error
 }
 
 var _ Store = &store{}
 
+// ErrPushDiscarded is returned by Push when the queued image does not exist anymore
+var ErrPushDiscarded = errors.New("queued push discarded since the image does not exist anymore")
+
 type MountOptions struct {
 	Context        context.Context
 	Image          string
 	ContainerName  string
 	ExtMountDir    string
 	Commit         bool
+	AsyncPush      bool
 	CacheName      string
 	CacheNamespace string
+	// Snapshot is the name of the snapshot to mount instead of the cache's latest image
+	Snapshot string
+	// SnapshotImage is the registry image the snapshot is pushed to and restored from.
+	// When empty the snapshot is stored on the node only.
+	SnapshotImage string
+	// Generation is the generation a committed image is tagged with (as gen-<n>) or rolled back to.
+	// When 0 the generation following the latest local one is used.
+	Generation int64
+	// KeepGenerations is the number of generation tags that are kept locally and within the registry (0 disables generation tags)
+	KeepGenerations int
+	// Keep lets Unmount commit the container without unmounting and deleting it
+	Keep bool
+	// ReadOnly mounts the cache read-only and registers the volume as not committable
+	ReadOnly bool
 }
 
 func (o *MountOptions) validate() error {
@@ -72,14 +97,22 @@ func (o *MountOptions) containerName() (string, error) {
 // Store represents the cache store.
 // Un/Mount must be run as root and requires storage.conf to configure kernel space overlayfs (and mount option "nodev").
 type store struct {
-	store         storage.Store
-	log           *logrus.Entry
-	systemContext types.SystemContext
+	store           storage.Store
+	log             *logrus.Entry
+	systemContext   types.SystemContext
+	transferOptions TransferOptions
+	queue           *pushQueue
 }
 
 // New creates a new cache store
-func New(s storage.Store, systemContext types.SystemContext, log *logrus.Entry) Store {
-	return &store{store: s, systemContext: systemContext, log: log}
+func New(s storage.Store, systemContext types.SystemContext, transferOptions TransferOptions, log *logrus.Entry) Store {
+	return &store{
+		store:           s,
+		systemContext:   systemContext,
+		transferOptions: transferOptions,
+		queue:           &pushQueue{dir: filepath.Join(s.GraphRoot(), "push-queue")},
+		log:             log,
+	}
 }
 
 func (s *store) Free() {
@@ -99,12 +132,27 @@ func (s *store) Mount(opts MountOptions) (dir string, err error) {
 	var imageRef types.ImageReference
 	imageName := localImageName(&opts)
 	imgLog := s.log
-	pullPolicy := buildah.PullNever
-	if opts.Image == "" {
+	if opts.Snapshot != "" && opts.SnapshotImage != "" {
+		imgLog = s.log.WithField("image", opts.SnapshotImage)
+		imageRef, err = alltransports.ParseImageName(opts.SnapshotImage)
+		err = errors.Wrap(err, "invalid snapshot image name provided")
+	} else if opts.Snapshot != "" {
+		imageName = localSnapshotImageName(&opts)
+		imgLog = s.log.WithField("image", imageName)
+		imageRef, err = s.storeImageRef(imageName)
+	} else if opts.Generation > 0 && opts.Image == "" {
+		imageName = localGenerationImageName(localImageRepo(&opts), opts.Generation)
+		imgLog = s.log.WithField("image", imageName)
+		imageRef, err = s.storeImageRef(imageName)
+	} else if opts.Generation > 0 {
+		genOpts := opts
+		genOpts.Image = generationImage(opts.Image, opts.Generation)
+		imgLog = s.log.WithField("image", genOpts.Image)
+		imageRef, err = s.imageRef(&genOpts)
+	} else if opts.Image == "" {
 		imgLog = s.log.WithField("image", imageName)
 		imageRef, err = s.storeImageRef(imageName)
 	} else {
-		pullPolicy = buildah.PullAlways
 		imgLog = s.log.WithField("image", opts.Image)
 		imageRef, err = s.imageRef(&opts)
 	}
@@ -125,19 +173,30 @@ func (s *store) Mount(opts MountOptions) (dir string, err error) {
 		}()
 	}
 
+	// Pull the latest image or snapshot from the registry (skipping already present layers).
+	// When the image does not exist continue with an empty file system
+	// unless a particular generation or snapshot has been requested.
+	if (opts.Image != "" && opts.Snapshot == "") || opts.SnapshotImage != "" {
+		if err = s.pullImage(opts.Context, imageRef); err != nil {
+			if !isImageNotFound(err) || opts.Generation > 0 || opts.Snapshot != "" {
+				return "", err
+			}
+			imgLog.Warn(err)
+			imgLog.Infof("creating empty cache since image %s does not exist", imageName)
+			imageName = "scratch"
+		}
+	}
+
 	// Create a new cache container.
-	// When the image does not exist continue with an empty file system.
-	builder, err := s.newBuilder(opts, name, imageName, pullPolicy)
+	builder, err := s.newBuilder(opts, name, imageName)
 	if err != nil {
-		notFound := strings.HasSuffix(err.Error(), ": manifest unknown") || strings.HasSuffix(err.Error(), " could not be found locally")
-		if !notFound || imageName == "scratch" {
+		if !isImageNotFound(err) || imageName == "scratch" || opts.Snapshot != "" || opts.Generation > 0 {
 			return "", err
 		}
 		imgLog.Warn(err)
 		imgLog.Infof("creating empty cache since image %s does not exist", imageName)
 		imageName = "scratch"
-		pullPolicy = buildah.PullNever
-		builder, err = s.newBuilder(opts, name, imageName, pullPolicy)
+		builder, err = s.newBuilder(opts, name, imageName)
 		if err != nil {
 			return "", err
 		}
@@ -165,16 +224,19 @@ func (s *store) Mount(opts MountOptions) (dir string, err error) {
 		}
 		s.log.Debugf("mounting container dir %s at %s", dir, opts.ExtMountDir)
 		err = mount(dir, opts.ExtMountDir)
+		if err == nil && opts.ReadOnly {
+			err = remountReadOnly(opts.ExtMountDir)
+		}
 		dir = opts.ExtMountDir
 	}
 	return dir, err
 }
 
-func (s *store) newBuilder(opts MountOptions, name, imageName string, pullPolicy buildah.PullPolicy) (*buildah.Builder, error) {
+func (s *store) newBuilder(opts MountOptions, name, imageName string) (*buildah.Builder, error) {
 	builderOpts := buildah.BuilderOptions{
 		Container:        name,
 		FromImage:        imageName,
-		PullPolicy:       pullPolicy,
+		PullPolicy:       buildah.PullNever,
 		Isolation:        buildah.IsolationChroot,
 		CommonBuildOpts:  &buildah.CommonBuildOptions{},
 		ConfigureNetwork: buildah.NetworkDisabled,
@@ -195,7 +257,7 @@ func (s *store) Unmount(opts MountOptions) (imageID string, newImage bool, err e
 		return "", false, err
 	}
 	dir := opts.ExtMountDir
-	if dir != "" {
+	if dir != "" && !opts.Keep {
 		if e := unmountAndDelete(dir); e != nil && err == nil {
 			err = e
 		}
@@ -213,22 +275,24 @@ func (s *store) Unmount(opts MountOptions) (imageID string, newImage bool, err e
 			return "", false, errors.Wrapf(err, "find cache container %q", name)
 		}
 	}
-	if builder.Args != nil {
+	if builder.Args != nil && !opts.Keep {
 		dir = builder.Args["MOUNT_DIR"]
 		if dir != "" && dir != opts.ExtMountDir {
 			err = unmountAndDelete(dir)
 		}
 	}
 	defer func() {
-		if opts.Context.Err() == nil {
+		if opts.Context.Err() == nil && !opts.Keep {
 			logrus.WithField("container", builder.ContainerID).Debug("deleting container")
 			if e := builder.Delete(); e != nil && err == nil {
 				err = e
 			}
 		}
 	}()
-	if e := builder.Unmount(); e != nil && err == nil {
-		err = e
+	if !opts.Keep {
+		if e := builder.Unmount(); e != nil && err == nil {
+			err = e
+		}
 	}
 	if err != nil || !opts.Commit {
 		return "", false, err
@@ -248,16 +312,86 @@ func (s *store) Unmount(opts MountOptions) (imageID string, newImage bool, err e
 	if err != nil {
 		return "", false, err
 	}
+	var genImage string
+	var generation int64
+	if newImage && opts.KeepGenerations > 0 {
+		generation, err = s.tagGeneration(&opts, imageID)
+		if err != nil {
+			return "", false, err
+		}
+		if opts.Image != "" {
+			genImage = generationImage(opts.Image, generation)
+		}
+	}
 	if newImage && opts.Image != "" {
+		if opts.AsyncPush {
+			// let the agent push the image to the registry
+			err = s.queue.Enqueue(PushRequest{
+				CacheName:       opts.CacheName,
+				CacheNamespace:  opts.CacheNamespace,
+				ContainerName:   name,
+				Image:           opts.Image,
+				LocalImage:      localImgRef.DockerReference().String(),
+				ImageID:         imageID,
+				GenerationImage: genImage,
+				Generation:      generation,
+				KeepGenerations: opts.KeepGenerations,
+				Created:         time.Now(),
+			})
+			if err != nil {
+				return "", false, err
+			}
+			s.log.WithField("image", opts.Image).WithField("imageID", imageID).Info("queued cache image push")
+			return imageID, newImage, nil
+		}
 		// push image to registry
 		err = s.pushImage(opts.Context, ref, imageID, imageRef)
 		if err != nil {
 			return "", false, err
 		}
+		if err = s.pushGeneration(opts.Context, ref, imageID, opts.Image, genImage, opts.KeepGenerations); err != nil {
+			return "", false, err
+		}
 	}
 	return imageID, newImage, nil
 }
 
+func (s *store) QueuedPushes() ([]PushRequest, error) {
+	return s.queue.List()
+}
+
+// Push pushes a queued image to the registry and removes it from the queue on success.
+// A failed push is delayed exponentially and discarded after too many attempts.
+// ErrPushDiscarded is returned when the image does not exist anymore and has not been pushed.
+func (s *store) Push(ctx context.Context, req PushRequest) error {
+	ref, err := reference.ParseNormalizedNamed(req.LocalImage)
+	if err != nil {
+		return errors.Wrap(err, "queued push")
+	}
+	destRef, err := alltransports.ParseImageName(req.Image)
+	if err != nil {
+		return errors.Wrap(err, "queued push")
+	}
+	if _, err = s.store.Image(req.ImageID); err != nil {
+		s.log.WithField("imageID", req.ImageID).Warn("discarding queued push since the image does not exist anymore")
+		if err = s.queue.Remove(req); err != nil {
+			return err
+		}
+		return ErrPushDiscarded
+	}
+	err = s.pushImage(ctx, ref, req.ImageID, destRef)
+	if err == nil {
+		err = s.pushGeneration(ctx, ref, req.ImageID, req.Image, req.GenerationImage, req.KeepGenerations)
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return err
+		}
+		return s.queue.Failed(req, err)
+	}
+	return s.queue.Remove(req)
+}
+
 func unmountAndDelete(dir string) error {
 	mountLog := logrus.WithField("dir", dir)
 	mountLog.Debug("unmounting cache")
@@ -328,5 +462,5 @@ func (s *store) storeImageRef(name string) (types.ImageReference, error) {
 }
 
 func localImageName(o *MountOptions) string {
-	return fmt.Sprintf("localhost/cache/%s/%s:latest", o.CacheNamespace, o.CacheName)
+	return fmt.Sprintf("%s:latest", localImageRepo(o))
 }
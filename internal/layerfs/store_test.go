@@ -0,0 +1,54 @@
+package layerfs
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/containers/image/v5/types"
+	"github.com/containers/storage"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestStore(t *testing.T) (*store, storage.Store) {
+	dir, err := ioutil.TempDir("", "layerfs-test-")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	s, err := storage.GetStore(storage.StoreOptions{
+		GraphRoot:       filepath.Join(dir, "graph"),
+		RunRoot:         filepath.Join(dir, "run"),
+		GraphDriverName: "vfs",
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Shutdown(true) })
+	return New(s, types.SystemContext{}, TransferOptions{}, logrus.NewEntry(logrus.New())).(*store), s
+}
+
+func TestPushDiscardsDeletedImage(t *testing.T) {
+	s, storageStore := newTestStore(t)
+	layer, err := storageStore.CreateLayer("", "", nil, "", false, nil)
+	require.NoError(t, err)
+	img, err := storageStore.CreateImage("", []string{"localhost/cache/ns/mycache"}, layer.ID, "", &storage.ImageOptions{})
+	require.NoError(t, err)
+	req := PushRequest{
+		Image:      "docker://registry.example.org/cache/ns:mycache",
+		LocalImage: "localhost/cache/ns/mycache",
+		ImageID:    img.ID,
+		Generation: 1,
+		Created:    time.Now(),
+	}
+	require.NoError(t, s.queue.Enqueue(req))
+	_, err = storageStore.DeleteImage(img.ID, true)
+	require.NoError(t, err)
+
+	err = s.Push(context.Background(), req)
+	require.True(t, errors.Is(err, ErrPushDiscarded), "Push() should return ErrPushDiscarded but returned %v", err)
+	queued, err := s.QueuedPushes()
+	require.NoError(t, err)
+	require.Empty(t, queued, "queued pushes")
+}
@@ -0,0 +1,193 @@
+package layerfs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/containers/image/v5/copy"
+	"github.com/containers/image/v5/signature"
+	"github.com/containers/image/v5/types"
+	"github.com/docker/distribution/registry/api/errcode"
+	errcodev2 "github.com/docker/distribution/registry/api/v2"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+)
+
+// TransferOptions configure how images are copied between the local storage and a registry
+type TransferOptions struct {
+	// MaxRetries is the number of times a failed copy is retried
+	MaxRetries int
+	// RetryDelay is the initial delay between retries which is doubled with every attempt
+	RetryDelay time.Duration
+	// MaxRetryDelay limits the delay between retries
+	MaxRetryDelay time.Duration
+	// BandwidthLimit limits the transfer rate in bytes per second (0 means unlimited)
+	BandwidthLimit int64
+	// Timeout limits the duration of a copy operation including its retries (0 means no timeout)
+	Timeout time.Duration
+}
+
+// DefaultTransferOptions returns the TransferOptions used when none are specified
+func DefaultTransferOptions() TransferOptions {
+	return TransferOptions{
+		MaxRetries:    10,
+		RetryDelay:    time.Second,
+		MaxRetryDelay: time.Minute,
+	}
+}
+
+type transferStats struct {
+	transferred int64
+	skipped     int64
+}
+
+func (s *store) copyImage(ctx context.Context, destRef, srcRef types.ImageReference, destCtx, srcCtx *types.SystemContext, log *logrus.Entry) error {
+	policy := &signature.Policy{Default: []signature.PolicyRequirement{signature.NewPRInsecureAcceptAnything()}}
+	policyCtx, err := signature.NewPolicyContext(policy)
+	if err != nil {
+		panic(err)
+	}
+	defer policyCtx.Destroy()
+	o := s.transferOptions
+	if o.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, o.Timeout)
+		defer cancel()
+	}
+	var limiter *rate.Limiter
+	if o.BandwidthLimit > 0 {
+		limiter = rate.NewLimiter(rate.Limit(o.BandwidthLimit), int(o.BandwidthLimit))
+	}
+	stats := &transferStats{}
+	dest := &transferReference{ImageReference: destRef, limiter: limiter, stats: stats}
+	startTime := time.Now()
+	delay := o.RetryDelay
+	err = withRetries(ctx, o, func() error {
+		_, err := copy.Image(ctx, policyCtx, dest, srcRef, &copy.Options{
+			SourceCtx:          srcCtx,
+			DestinationCtx:     destCtx,
+			ImageListSelection: copy.CopySystemImage,
+		})
+		return err
+	}, func(attempt int, err error) time.Duration {
+		d := delay
+		if delay *= 2; o.MaxRetryDelay > 0 && delay > o.MaxRetryDelay {
+			delay = o.MaxRetryDelay
+		}
+		log.WithError(err).Warnf("image transfer failed, retrying in %s (%d/%d)", d, attempt, o.MaxRetries)
+		return d
+	})
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return errors.Wrapf(err, "image transfer timed out after %s", o.Timeout)
+		}
+		return err
+	}
+	log.WithField("blobsTransferred", atomic.LoadInt64(&stats.transferred)).
+		WithField("blobsSkipped", atomic.LoadInt64(&stats.skipped)).
+		WithField("duration", time.Since(startTime).Round(time.Millisecond).String()).
+		Info("image transfer completed")
+	return nil
+}
+
+// withRetries retries the operation using the delay returned by the backoff func
+func withRetries(ctx context.Context, o TransferOptions, operation func() error, backoff func(attempt int, err error) time.Duration) error {
+	err := operation()
+	for attempt := 1; err != nil && attempt <= o.MaxRetries && isRetryable(err); attempt++ {
+		select {
+		case <-time.After(backoff(attempt, err)):
+		case <-ctx.Done():
+			return err
+		}
+		err = operation()
+	}
+	return err
+}
+
+func isRetryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || isImageNotFound(err) {
+		return false
+	}
+	var e errcode.Error
+	if errors.As(err, &e) {
+		switch e.Code {
+		case errcode.ErrorCodeUnauthorized, errcode.ErrorCodeDenied, errcodev2.ErrorCodeNameUnknown, errcodev2.ErrorCodeManifestUnknown:
+			return false
+		}
+	}
+	return true
+}
+
+func isImageNotFound(err error) bool {
+	msg := err.Error()
+	return strings.HasSuffix(msg, ": manifest unknown") || strings.HasSuffix(msg, " could not be found locally") ||
+		strings.HasSuffix(msg, "Image may not exist or is not stored with a v2 Schema in a v2 registry")
+}
+
+// transferReference wraps an ImageReference in order to
+// count the transferred blobs and limit the bandwidth.
+type transferReference struct {
+	types.ImageReference
+	limiter *rate.Limiter
+	stats   *transferStats
+}
+
+func (r *transferReference) NewImageDestination(ctx context.Context, sys *types.SystemContext) (types.ImageDestination, error) {
+	d, err := r.ImageReference.NewImageDestination(ctx, sys)
+	if err != nil {
+		return nil, err
+	}
+	return &transferDestination{ImageDestination: d, ref: r}, nil
+}
+
+type transferDestination struct {
+	types.ImageDestination
+	ref *transferReference
+}
+
+func (d *transferDestination) Reference() types.ImageReference {
+	return d.ref
+}
+
+func (d *transferDestination) PutBlob(ctx context.Context, stream io.Reader, inputInfo types.BlobInfo, cache types.BlobInfoCache, isConfig bool) (types.BlobInfo, error) {
+	if d.ref.limiter != nil {
+		stream = &rateLimitedReader{ctx: ctx, reader: stream, limiter: d.ref.limiter}
+	}
+	info, err := d.ImageDestination.PutBlob(ctx, stream, inputInfo, cache, isConfig)
+	if err == nil && !isConfig {
+		atomic.AddInt64(&d.ref.stats.transferred, 1)
+	}
+	return info, err
+}
+
+func (d *transferDestination) TryReusingBlob(ctx context.Context, info types.BlobInfo, cache types.BlobInfoCache, canSubstitute bool) (bool, types.BlobInfo, error) {
+	reused, info, err := d.ImageDestination.TryReusingBlob(ctx, info, cache, canSubstitute)
+	if reused && err == nil {
+		atomic.AddInt64(&d.ref.stats.skipped, 1)
+	}
+	return reused, info, err
+}
+
+type rateLimitedReader struct {
+	ctx     context.Context
+	reader  io.Reader
+	limiter *rate.Limiter
+}
+
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	if burst := r.limiter.Burst(); len(p) > burst {
+		p = p[:burst]
+	}
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		if e := r.limiter.WaitN(r.ctx, n); e != nil {
+			return n, fmt.Errorf("rate limit: %w", e)
+		}
+	}
+	return n, err
+}
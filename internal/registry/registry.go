@@ -0,0 +1,100 @@
+// Package registry deletes cache images from a docker registry on behalf of the manager.
+package registry
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/types"
+	"github.com/pkg/errors"
+)
+
+// generationTagPrefix must match the prefix layerfs tags the cache generations with
+const generationTagPrefix = "gen-"
+
+// Registry deletes cache images from a docker registry
+type Registry struct {
+	systemContext types.SystemContext
+}
+
+// New creates a Registry that connects using the given SystemContext
+func New(systemContext types.SystemContext) *Registry {
+	return &Registry{systemContext: systemContext}
+}
+
+// DeleteImage deletes the given cache image as well as its generation tags from the registry.
+// Since a registry deletes a manifest including all of its tags other tags of the same manifests are deleted as well.
+// Images that are not stored within a docker registry are ignored.
+func (r *Registry) DeleteImage(ctx context.Context, image string) error {
+	ref, err := parseImageName(image)
+	if err != nil || ref == nil {
+		return errors.Wrap(err, "delete registry image")
+	}
+	tags, err := r.generationTags(ctx, ref)
+	if err != nil {
+		return errors.Wrap(err, "delete registry image")
+	}
+	for _, tag := range tags {
+		genRef, err := reference.WithTag(reference.TrimNamed(ref.DockerReference()), tag)
+		if err != nil {
+			return errors.Wrap(err, "delete registry image")
+		}
+		if err = r.deleteImage(ctx, genRef); err != nil {
+			return errors.Wrapf(err, "delete registry image tag %s", tag)
+		}
+	}
+	return errors.Wrap(r.deleteImage(ctx, ref.DockerReference()), "delete registry image")
+}
+
+func (r *Registry) deleteImage(ctx context.Context, named reference.Named) error {
+	ref, err := docker.NewReference(named)
+	if err != nil {
+		return err
+	}
+	err = ref.DeleteImage(ctx, &r.systemContext)
+	if err != nil && isImageNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// generationTags lists the cache image's generation tags
+func (r *Registry) generationTags(ctx context.Context, ref types.ImageReference) ([]string, error) {
+	prefix := generationTagPrefix
+	if tagged, ok := ref.DockerReference().(reference.NamedTagged); ok {
+		prefix = fmt.Sprintf("%s-%s", tagged.Tag(), generationTagPrefix)
+	}
+	tags, err := docker.GetRepositoryTags(ctx, &r.systemContext, ref)
+	if err != nil {
+		if isImageNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	generations := []string{}
+	for _, tag := range tags {
+		if strings.HasPrefix(tag, prefix) {
+			generations = append(generations, tag)
+		}
+	}
+	return generations, nil
+}
+
+// parseImageName parses a layerfs image name (docker://<image>).
+// It returns nil if the image is not stored within a docker registry.
+func parseImageName(image string) (types.ImageReference, error) {
+	transport := docker.Transport.Name() + ":"
+	if !strings.HasPrefix(image, transport) {
+		return nil, nil
+	}
+	return docker.ParseReference(image[len(transport):])
+}
+
+func isImageNotFound(err error) bool {
+	msg := err.Error()
+	return strings.HasSuffix(msg, ": manifest unknown") || strings.HasSuffix(msg, "invalid status code from registry 404 (Not Found)") ||
+		strings.HasSuffix(msg, "Image may not exist or is not stored with a v2 Schema in a v2 registry")
+}
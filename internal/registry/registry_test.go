@@ -0,0 +1,90 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/containers/image/v5/types"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeRegistry serves the manifests of the repository cache/ns
+type fakeRegistry struct {
+	tags    map[string]string
+	deleted []string
+	mutex   sync.Mutex
+}
+
+func (r *fakeRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	const repo = "/v2/cache/ns"
+	switch {
+	case req.URL.Path == "/v2/":
+		w.WriteHeader(http.StatusOK)
+	case req.URL.Path == repo+"/tags/list":
+		tags := []string{}
+		for tag := range r.tags {
+			tags = append(tags, fmt.Sprintf("%q", tag))
+		}
+		sort.Strings(tags)
+		fmt.Fprintf(w, `{"name":"cache/ns","tags":[%s]}`, strings.Join(tags, ","))
+	case strings.HasPrefix(req.URL.Path, repo+"/manifests/") && req.Method == http.MethodGet:
+		dgst, ok := r.tags[strings.TrimPrefix(req.URL.Path, repo+"/manifests/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Docker-Content-Digest", dgst)
+		fmt.Fprint(w, `{"schemaVersion":2}`)
+	case strings.HasPrefix(req.URL.Path, repo+"/manifests/") && req.Method == http.MethodDelete:
+		dgst := strings.TrimPrefix(req.URL.Path, repo+"/manifests/")
+		for tag, d := range r.tags {
+			if d == dgst {
+				delete(r.tags, tag)
+				r.deleted = append(r.deleted, tag)
+			}
+		}
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestDeleteImage(t *testing.T) {
+	fake := &fakeRegistry{tags: map[string]string{
+		"mycache":       "sha256:1111111111111111111111111111111111111111111111111111111111111111",
+		"mycache-gen-1": "sha256:2222222222222222222222222222222222222222222222222222222222222222",
+		"mycache-gen-2": "sha256:1111111111111111111111111111111111111111111111111111111111111111",
+		"othercache":    "sha256:3333333333333333333333333333333333333333333333333333333333333333",
+	}}
+	srv := httptest.NewTLSServer(fake)
+	defer srv.Close()
+	tmpDir := t.TempDir()
+	require.NoError(t, ioutil.WriteFile(filepath.Join(tmpDir, "registries.conf"), nil, 0600))
+	r := New(types.SystemContext{
+		AuthFilePath:                filepath.Join(tmpDir, "auth.json"),
+		SystemRegistriesConfPath:    filepath.Join(tmpDir, "registries.conf"),
+		DockerInsecureSkipTLSVerify: types.OptionalBoolTrue,
+	})
+	host := strings.TrimPrefix(srv.URL, "https://")
+
+	err := r.DeleteImage(context.Background(), fmt.Sprintf("docker://%s/cache/ns:mycache", host))
+	require.NoError(t, err)
+	sort.Strings(fake.deleted)
+	require.Equal(t, []string{"mycache", "mycache-gen-1", "mycache-gen-2"}, fake.deleted, "deleted tags")
+
+	err = r.DeleteImage(context.Background(), fmt.Sprintf("docker://%s/cache/ns:mycache", host))
+	require.NoError(t, err, "delete missing image")
+	err = r.DeleteImage(context.Background(), "docker-archive:/tmp/image.tar")
+	require.NoError(t, err, "delete image without registry")
+	require.Len(t, fake.tags, 1, "remaining tags")
+}
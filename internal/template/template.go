@@ -1,13 +1,29 @@
 package template
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"strconv"
+	"strings"
+	"text/template"
+	tplparse "text/template/parse"
 
 	"github.com/a8m/envsubst/parse"
 )
 
+// itemsMarker prefixes a rendered list of items that replaces the list element it is rendered into
+const itemsMarker = "\x00items:"
+
+// errOmit signals that the enclosing list element should be omitted
+var errOmit = errors.New("omit")
+
 type Substitution struct {
-	parser *parse.Parser
+	name       string
+	parser     *parse.Parser
+	values     map[string]string
+	goTemplate bool
 }
 
 func NewSubstitution(name string, values map[string]string) *Substitution {
@@ -16,15 +32,187 @@ func NewSubstitution(name string, values map[string]string) *Substitution {
 	for k, v := range values {
 		env = append(env, fmt.Sprintf("%s=%s", k, v))
 	}
-	return &Substitution{parser: &parse.Parser{Name: name, Env: env, Restrict: restrictions, Mode: parse.AllErrors}}
+	return &Substitution{name: name, values: values, parser: &parse.Parser{Name: name, Env: env, Restrict: restrictions, Mode: parse.AllErrors}}
+}
+
+// NewGoTemplateSubstitution creates a Substitution that renders each string as Go text/template
+// and substitutes the ${VAR} expressions within the template's text and string constants like NewSubstitution
+// when they are evaluated. The values the template renders are not substituted again.
+// The values are accessible as map (e.g. {{.VAR}}) with missing values evaluating to an empty string.
+// In addition to the text/template builtins the functions default, required, split, join,
+// lower, upper, trim, contains, hasPrefix, omit and items are supported:
+// omit removes the enclosing list element while items replaces it with the provided items.
+func NewGoTemplateSubstitution(name string, values map[string]string) *Substitution {
+	s := NewSubstitution(name, values)
+	s.goTemplate = true
+	return s
 }
 
 func (s Substitution) SubstituteString(tpl string) (string, error) {
+	if s.goTemplate && strings.Contains(tpl, "{{") {
+		return s.executeGoTemplate(tpl)
+	}
 	return s.parser.Parse(tpl)
 }
 
+func (s Substitution) executeGoTemplate(tpl string) (string, error) {
+	t, err := template.New(s.name).Option("missingkey=zero").Funcs(templateFuncs).
+		Funcs(template.FuncMap{envsubstFunc: s.parser.Parse}).Parse(tpl)
+	if err != nil {
+		return "", err
+	}
+	for _, t := range t.Templates() {
+		if err = s.substituteNode(t.Tree.Root); err != nil {
+			return "", err
+		}
+	}
+	var buf bytes.Buffer
+	if err = t.Execute(&buf, s.values); err != nil {
+		var execErr template.ExecError
+		if errors.As(err, &execErr) && errors.Is(execErr.Err, errOmit) {
+			return "", errOmit
+		}
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// envsubstFunc is the name of the template function that substitutes the ${VAR} expressions within a string
+const envsubstFunc = "envsubst"
+
+// substituteNode lets the template substitute the ${VAR} expressions within its text and string constants
+// when they are evaluated by replacing them with envsubst calls.
+func (s Substitution) substituteNode(node tplparse.Node) error {
+	switch n := node.(type) {
+	case *tplparse.ListNode:
+		if n == nil {
+			return nil
+		}
+		for i, c := range n.Nodes {
+			if txt, ok := c.(*tplparse.TextNode); ok {
+				if bytes.ContainsRune(txt.Text, '$') {
+					action, err := envsubstAction(string(txt.Text))
+					if err != nil {
+						return err
+					}
+					n.Nodes[i] = action
+				}
+				continue
+			}
+			if err := s.substituteNode(c); err != nil {
+				return err
+			}
+		}
+	case *tplparse.ActionNode:
+		return s.substituteNode(n.Pipe)
+	case *tplparse.TemplateNode:
+		return s.substituteNode(n.Pipe)
+	case *tplparse.PipeNode:
+		if n == nil {
+			return nil
+		}
+		for _, c := range n.Cmds {
+			if err := s.substituteNode(c); err != nil {
+				return err
+			}
+		}
+	case *tplparse.CommandNode:
+		for i, arg := range n.Args {
+			if str, ok := arg.(*tplparse.StringNode); ok {
+				if strings.Contains(str.Text, "$") {
+					action, err := envsubstAction(str.Text)
+					if err != nil {
+						return err
+					}
+					n.Args[i] = action.Pipe
+				}
+				continue
+			}
+			if err := s.substituteNode(arg); err != nil {
+				return err
+			}
+		}
+	case *tplparse.IfNode:
+		return s.substituteBranch(&n.BranchNode)
+	case *tplparse.RangeNode:
+		return s.substituteBranch(&n.BranchNode)
+	case *tplparse.WithNode:
+		return s.substituteBranch(&n.BranchNode)
+	}
+	return nil
+}
+
+func (s Substitution) substituteBranch(n *tplparse.BranchNode) error {
+	if err := s.substituteNode(n.Pipe); err != nil {
+		return err
+	}
+	if err := s.substituteNode(n.List); err != nil {
+		return err
+	}
+	return s.substituteNode(n.ElseList)
+}
+
+// envsubstAction returns an action that substitutes the ${VAR} expressions within the given text
+func envsubstAction(text string) (*tplparse.ActionNode, error) {
+	src := fmt.Sprintf("{{%s %s}}", envsubstFunc, strconv.Quote(text))
+	// the function is declared here for the parser only, the template provides the Substitution's implementation
+	trees, err := tplparse.Parse(envsubstFunc, src, "{{", "}}", map[string]interface{}{envsubstFunc: fmt.Sprint})
+	if err != nil {
+		return nil, err
+	}
+	return trees[envsubstFunc].Root.Nodes[0].(*tplparse.ActionNode), nil
+}
+
+var templateFuncs = template.FuncMap{
+	"default": func(def, v string) string {
+		if v == "" {
+			return def
+		}
+		return v
+	},
+	"required": func(msg, v string) (string, error) {
+		if v == "" {
+			return "", errors.New(msg)
+		}
+		return v, nil
+	},
+	"omit": func() (string, error) {
+		return "", errOmit
+	},
+	"items": func(items ...interface{}) (string, error) {
+		flat := make([]interface{}, 0, len(items))
+		for _, item := range items {
+			if l, ok := item.([]string); ok {
+				for _, v := range l {
+					flat = append(flat, v)
+				}
+				continue
+			}
+			flat = append(flat, item)
+		}
+		b, err := json.Marshal(flat)
+		return itemsMarker + string(b), err
+	},
+	"split": func(sep, s string) []string {
+		if s == "" {
+			return nil
+		}
+		return strings.Split(s, sep)
+	},
+	"join":      func(sep string, l []string) string { return strings.Join(l, sep) },
+	"lower":     strings.ToLower,
+	"upper":     strings.ToUpper,
+	"trim":      strings.TrimSpace,
+	"contains":  func(substr, s string) bool { return strings.Contains(s, substr) },
+	"hasPrefix": func(prefix, s string) bool { return strings.HasPrefix(s, prefix) },
+}
+
 func (s Substitution) SubstituteMap(tpl map[string]interface{}) (map[string]interface{}, error) {
-	return s.substituteMap(tpl, "")
+	r, err := s.substituteMap(tpl, "")
+	if errors.Is(err, errOmit) {
+		return nil, fmt.Errorf("%w: not within a list", err)
+	}
+	return r, err
 }
 
 func (s Substitution) substitute(tpl interface{}, path string) (interface{}, error) {
@@ -41,13 +229,25 @@ func (s Substitution) substitute(tpl interface{}, path string) (interface{}, err
 }
 
 func (s Substitution) substituteSlice(tpl []interface{}, parentPath string) (r []interface{}, err error) {
-	r = make([]interface{}, len(tpl))
+	r = make([]interface{}, 0, len(tpl))
 	for i, v := range tpl {
 		path := fmt.Sprintf("%s[%d]", parentPath, i)
-		r[i], err = s.substitute(v, path)
+		v, err = s.substitute(v, path)
 		if err != nil {
+			if errors.Is(err, errOmit) {
+				continue
+			}
 			return nil, fmt.Errorf("%s: %w", path, err)
 		}
+		if str, ok := v.(string); ok && strings.HasPrefix(str, itemsMarker) {
+			items := []interface{}{}
+			if err = json.Unmarshal([]byte(str[len(itemsMarker):]), &items); err != nil {
+				return nil, fmt.Errorf("%s: items: %w", path, err)
+			}
+			r = append(r, items...)
+			continue
+		}
+		r = append(r, v)
 	}
 	return r, nil
 }
@@ -58,8 +258,14 @@ func (s Substitution) substituteMap(tpl map[string]interface{}, parentPath strin
 		path := fmt.Sprintf("%s.%s", parentPath, k)
 		r[k], err = s.substitute(v, path)
 		if err != nil {
+			if errors.Is(err, errOmit) {
+				return nil, err
+			}
 			return nil, fmt.Errorf("%s: %w", path, err)
 		}
+		if str, ok := r[k].(string); ok && strings.HasPrefix(str, itemsMarker) {
+			return nil, fmt.Errorf("%s: items can only be used as list element", path)
+		}
 	}
 	return r, nil
 }
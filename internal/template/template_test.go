@@ -24,3 +24,54 @@ func TestSubstitutionFailOnUndefinedVariable(t *testing.T) {
 	require.Error(t, err)
 	require.Nil(t, actual)
 }
+
+func TestGoTemplateSubstitution(t *testing.T) {
+	values := map[string]string{"var_a": "val_a", "list": "x,y", "flag": "true", "user": "${var_a}"}
+	tpl := map[string]interface{}{
+		"a":       "{{ .var_a | upper }} ${var_a}",
+		"default": `{{ .missing | default "def-${var_a}" }}`,
+		"plain":   "${var_a}",
+		"once":    "{{ .user }}",
+		"ifelse":  "{{ if .missing }}${missing}{{ else }}${var_a}{{ end }}",
+		"list": []interface{}{
+			"first",
+			`{{ if .flag }}flag{{ else }}{{ omit }}{{ end }}`,
+			map[string]interface{}{"name": `{{ if not .missing }}{{ omit }}{{ end }}`},
+			`{{ items (split "," .list) }}`,
+			`{{ items "${var_a}" .user }}`,
+			"last",
+		},
+	}
+	expected := map[string]interface{}{
+		"a":       "VAL_A val_a",
+		"default": "def-val_a",
+		"plain":   "val_a",
+		"once":    "${var_a}",
+		"ifelse":  "val_a",
+		"list":    []interface{}{"first", "flag", "x", "y", "val_a", "${var_a}", "last"},
+	}
+	actual, err := NewGoTemplateSubstitution("testsubst", values).SubstituteMap(tpl)
+	require.NoError(t, err)
+	require.Equal(t, expected, actual)
+}
+
+func TestGoTemplateSubstitutionErrors(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		tpl  map[string]interface{}
+		path string
+	}{
+		{"required", map[string]interface{}{"a": map[string]interface{}{"b": `{{ required "b required" .missing }}`}}, ".a.b: "},
+		{"syntax", map[string]interface{}{"a": []interface{}{"{{ .var_a "}}, ".a[0]: "},
+		{"omit outside list", map[string]interface{}{"a": "{{ omit }}"}, "omit"},
+		{"items outside list", map[string]interface{}{"a": `{{ items "x" }}`}, ".a: items"},
+		{"undefined envsubst var", map[string]interface{}{"a": "{{ .var_a }}${missing}"}, ".a: "},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			actual, err := NewGoTemplateSubstitution("testsubst", map[string]string{"var_a": "val_a"}).SubstituteMap(c.tpl)
+			require.Error(t, err)
+			require.Contains(t, err.Error(), c.path)
+			require.Nil(t, actual)
+		})
+	}
+}
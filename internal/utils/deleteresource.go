@@ -10,8 +10,8 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
-func DeleteResource(ctx context.Context, client client.Client, o client.Object, log logr.Logger) (done bool, err error) {
-	err = client.Delete(ctx, o)
+func DeleteResource(ctx context.Context, client client.Client, o client.Object, log logr.Logger, opts ...client.DeleteOption) (done bool, err error) {
+	err = client.Delete(ctx, o, opts...)
 	if apierrors.IsNotFound(err) {
 		return true, nil
 	}
@@ -0,0 +1,140 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+// reconcileBatchJob runs the requested Pod as batch/v1 Job that retries failed Pods itself.
+func (r *JobReconciler) reconcileBatchJob(req JobRequest) (bool, error) {
+	jobLog := req.Log.WithValues("job", req.PodName.String())
+	job := &batchv1.Job{}
+	err := r.Client.Get(req.Context, req.PodName, job)
+	if err != nil {
+		if !apierrors.IsNotFound(err) {
+			return false, errors.Wrap(err, "reconcile job")
+		}
+		pod, err := r.newPod(req, jobLog)
+		if err != nil {
+			return false, errors.Wrap(err, req.Name)
+		}
+		job = r.newBatchJob(req, pod)
+		err = r.Client.Create(req.Context, job)
+		if err != nil && !apierrors.IsAlreadyExists(err) {
+			return false, errors.Wrap(err, "reconcile job")
+		}
+		return false, nil // Job created, watch will invoke another reconcile run
+	}
+	if job.DeletionTimestamp != nil {
+		return false, nil
+	}
+	for _, c := range job.Status.Conditions {
+		if c.Status != corev1.ConditionTrue {
+			continue
+		}
+		switch c.Type {
+		case batchv1.JobComplete:
+			pod, err := r.jobPod(req.Context, job, corev1.PodSucceeded)
+			if err != nil {
+				return false, err
+			}
+			if pod == nil {
+				return false, errors.Errorf("%s: cannot find succeeded pod of job %s", req.Name, job.Name)
+			}
+			return r.completed(req, jobLog, pod, job)
+		case batchv1.JobFailed:
+			pod, err := r.jobPod(req.Context, job, corev1.PodFailed)
+			if err != nil {
+				return false, err
+			}
+			reason := joinReason(c.Reason, c.Message)
+			if pod != nil {
+				reason = fmt.Sprintf("%s; %s", reason, podFailureReason(pod))
+			}
+			err = errors.Errorf("job %s failed: %s", job.Name, reason)
+			r.failed(req, jobLog, pod, err)
+			return true, errors.Wrap(err, req.Name)
+		}
+	}
+	// Report a Pod that cannot start
+	pod, err := r.jobPod(req.Context, job, corev1.PodPending)
+	if err != nil || pod == nil {
+		return false, err
+	}
+	return false, r.reportPending(req, pod, upperFirst(req.Name), podPendingReason(pod))
+}
+
+// newBatchJob wraps the Pod into a Job that is owned by the request's owner if possible.
+func (r *JobReconciler) newBatchJob(req JobRequest, pod *corev1.Pod) *batchv1.Job {
+	backoffLimit := int32(defaultBackoffLimit)
+	if req.Policy.BackoffLimit != nil {
+		backoffLimit = *req.Policy.BackoffLimit
+	}
+	job := &batchv1.Job{}
+	job.Name = req.PodName.Name
+	job.Namespace = req.PodName.Namespace
+	job.Annotations = map[string]string{}
+	for k, v := range pod.Annotations {
+		job.Annotations[k] = v
+	}
+	job.Spec.BackoffLimit = &backoffLimit
+	job.Spec.ActiveDeadlineSeconds = req.Policy.ActiveDeadlineSeconds
+	job.Spec.TTLSecondsAfterFinished = req.Policy.TTLSecondsAfterFinished
+	job.Spec.Template.Annotations = pod.Annotations
+	job.Spec.Template.Labels = pod.Labels
+	job.Spec.Template.Spec = pod.Spec
+	// Owner references must not point to an object within another namespace
+	if ns := req.Owner.GetNamespace(); ns == "" || ns == job.Namespace {
+		if err := controllerutil.SetOwnerReference(req.Owner, job, r.Client.Scheme()); err != nil {
+			req.Log.Error(err, "Cannot set Job owner reference")
+		}
+	}
+	return job
+}
+
+// jobPod returns the Job's latest Pod that is in the given phase or nil if there is none.
+func (r *JobReconciler) jobPod(ctx context.Context, job *batchv1.Job, phase corev1.PodPhase) (*corev1.Pod, error) {
+	pods := &corev1.PodList{}
+	err := r.Client.List(ctx, pods, client.InNamespace(job.Namespace), client.MatchingLabels{"controller-uid": string(job.UID)})
+	if err != nil {
+		return nil, errors.Wrapf(err, "list pods of job %s", job.Name)
+	}
+	var pod *corev1.Pod
+	for i, p := range pods.Items {
+		if p.Status.Phase == phase && (pod == nil || pod.CreationTimestamp.Before(&p.CreationTimestamp)) {
+			pod = &pods.Items[i]
+		}
+	}
+	return pod, nil
+}
+
+// DeleteJob deletes the Pod or Job a JobReconciler created with the given name.
+func DeleteJob(ctx context.Context, c client.Client, name types.NamespacedName, log logr.Logger) (done bool, err error) {
+	done, err = DeletePod(ctx, c, name, log)
+	if err != nil || !done {
+		return done, err
+	}
+	return deleteBatchJob(ctx, c, name, log)
+}
+
+func deleteBatchJob(ctx context.Context, c client.Client, name types.NamespacedName, log logr.Logger) (done bool, err error) {
+	job := &batchv1.Job{}
+	err = c.Get(ctx, name, job)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return true, nil
+		}
+		return false, err
+	}
+	return DeleteResource(ctx, c, job, log, client.PropagationPolicy(metav1.DeletePropagationBackground))
+}
@@ -3,24 +3,33 @@ package utils
 import (
 	"context"
 	"fmt"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/go-logr/logr"
+	storageapi "github.com/mgoltzsche/k8storagex/api/v1alpha1"
 	"github.com/pkg/errors"
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
-	kerr "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 )
 
-// ReconcilePod reconciles a Pod
-func ReconcilePod(ctx context.Context, client client.Client, name types.NamespacedName, create func() (*corev1.Pod, error)) (done bool, pod *corev1.Pod, err error) {
+// reconcilePod creates the Pod if it does not exist and returns done=true when it terminated
+func reconcilePod(ctx context.Context, client client.Client, name types.NamespacedName, create func() (*corev1.Pod, error)) (done bool, pod *corev1.Pod, err error) {
 	pod = &corev1.Pod{}
 	err = client.Get(ctx, name, pod)
 	if err != nil {
-		if kerr.IsNotFound(err) {
+		if apierrors.IsNotFound(err) {
 			// Create Pod if it doesn't exist
 			if pod, err = create(); err != nil {
 				return false, pod, err
@@ -44,78 +53,315 @@ func ReconcilePod(ctx context.Context, client client.Client, name types.Namespac
 		return true, pod, nil
 	}
 	if pod.Status.Phase == corev1.PodFailed {
-		return true, pod, errors.Errorf("pod %s failed", pod.Name)
+		return true, pod, errors.Errorf("pod %s failed: %s", pod.Name, podFailureReason(pod))
 	}
 	return false, pod, nil
 }
 
-// TODO: use this in all controllers to run de/provisioner Pods
+const (
+	annJobRetries       = "k8storagex.mgoltzsche.github.com/job-retries"
+	annPendingReason    = "k8storagex.mgoltzsche.github.com/pending-reason"
+	defaultBackoffLimit = 3
+	defaultRetryBackoff = 10 * time.Second
+	maxRetryBackoff     = 15 * time.Minute
+	failureMessageLines = 10
+)
+
+// JobReconciler runs a provisioner container on behalf of an owner object as bare Pod or as batch/v1 Job.
 type JobReconciler struct {
 	Client                   client.Client
 	Recorder                 record.EventRecorder
 	AnnotationOwnerName      string
 	AnnotationOwnerNamespace string
+	requeue                  chan event.GenericEvent
+	requeueOnce              sync.Once
+	// retries holds the retry count of a Pod that is being recreated.
+	// Once recreated the count is recorded as the Pod's annotation.
+	retries sync.Map
 }
 
 type JobRequest struct {
-	Context     context.Context
-	Name        string
+	Context context.Context
+	Name    string
+	// PodName is the name of the Pod or Job
 	PodName     types.NamespacedName
 	Owner       client.Object
 	ShouldRun   bool
 	Create      func() (*corev1.Pod, error)
 	OnCompleted func(*corev1.Pod) (done bool, err error)
+	Policy      storageapi.JobPolicy
 	Log         logr.Logger
 }
 
+// Watch adds the watches to the controller that trigger the reconciliation of the owners of the Pods and Jobs
+// as well as the delayed requests that are scheduled to retry failed Pods and to check pending ones.
+func (r *JobReconciler) Watch(b *builder.Builder, namespace string) *builder.Builder {
+	mapper := PodToRequestMapper(namespace, r.AnnotationOwnerName, r.AnnotationOwnerNamespace)
+	return b.Watches(&source.Kind{Type: &corev1.Pod{}}, mapper).
+		Watches(&source.Kind{Type: &batchv1.Job{}}, mapper).
+		Watches(&source.Channel{Source: r.requeueChannel()}, &handler.EnqueueRequestForObject{})
+}
+
+func (r *JobReconciler) requeueChannel() chan event.GenericEvent {
+	r.requeueOnce.Do(func() {
+		r.requeue = make(chan event.GenericEvent, 1024)
+	})
+	return r.requeue
+}
+
+func (r *JobReconciler) requeueAfter(owner client.Object, d time.Duration) {
+	ch := r.requeueChannel()
+	o := owner.DeepCopyObject().(client.Object)
+	time.AfterFunc(d, func() {
+		select {
+		case ch <- event.GenericEvent{Object: o}:
+		default:
+		}
+	})
+}
+
+// ReconcileJob runs the requested Pod or Job, calls OnCompleted when it succeeded and deletes it afterwards.
+// It returns done=true with an error when the Pod or Job failed finally.
 func (r *JobReconciler) ReconcileJob(req JobRequest) (bool, error) {
-	podLog := req.Log.WithValues("pod", req.PodName.String())
 	if !req.ShouldRun {
-		return DeletePod(req.Context, r.Client, req.PodName, req.Log)
+		r.retries.Delete(req.PodName)
+		return DeleteJob(req.Context, r.Client, req.PodName, req.Log)
 	}
-	done, pod, err := ReconcilePod(req.Context, r.Client, req.PodName, func() (*corev1.Pod, error) {
-		pod, err := req.Create()
-		if err != nil {
-			return nil, err
-		}
-		if pod.Annotations == nil {
-			pod.Annotations = map[string]string{}
-		}
-		pod.Annotations[r.AnnotationOwnerName] = req.Owner.GetName()
-		if r.AnnotationOwnerNamespace != "" {
-			pod.Annotations[r.AnnotationOwnerNamespace] = req.Owner.GetNamespace()
-		}
-		pod.Spec.RestartPolicy = corev1.RestartPolicyNever
-
-		logWithNode(podLog, pod).Info(fmt.Sprintf("Creating %s Pod", req.Name))
-
-		return pod, nil
+	if req.Policy.Workload == storageapi.WorkloadJob {
+		return r.reconcileBatchJob(req)
+	}
+	podLog := req.Log.WithValues("pod", req.PodName.String())
+	done, pod, err := reconcilePod(req.Context, r.Client, req.PodName, func() (*corev1.Pod, error) {
+		return r.newPod(req, podLog)
 	})
-	nameUpper := fmt.Sprintf("%s%s", strings.ToUpper(req.Name[0:1]), req.Name[1:])
-	err = errors.Wrap(err, req.Name)
+	nameUpper := upperFirst(req.Name)
+	failedAt := time.Time{}
+	if err == nil && !done {
+		failedAt, err = r.checkPending(req, pod, nameUpper)
+		done = err != nil
+	} else if err != nil && done {
+		failedAt = podFinishedAt(pod)
+	}
 	if err != nil || !done {
 		if err != nil && done {
-			reason := fmt.Sprintf("%sFailed", nameUpper)
-			msg := fmt.Sprintf("%s Pod failed", nameUpper)
-			logWithNode(podLog, pod).Error(err, msg)
-			r.Recorder.Event(req.Owner, corev1.EventTypeWarning, reason, msg)
+			if pod.DeletionTimestamp != nil {
+				return false, nil // wait for the failed Pod to be removed
+			}
+			retrying, e := r.retry(req, pod, failedAt, nameUpper, err)
+			if retrying || e != nil {
+				return false, e
+			}
+			r.failed(req, podLog, pod, err)
 		}
-		return done, err
+		return done, errors.Wrap(err, req.Name)
+	}
+	return r.completed(req, podLog, pod, pod)
+}
+
+// newPod creates the Pod using the request's Create function and marks it with the owner annotations.
+func (r *JobReconciler) newPod(req JobRequest, log logr.Logger) (*corev1.Pod, error) {
+	pod, err := req.Create()
+	if err != nil {
+		return nil, err
+	}
+	if pod.Annotations == nil {
+		pod.Annotations = map[string]string{}
+	}
+	pod.Annotations[r.AnnotationOwnerName] = req.Owner.GetName()
+	if n, ok := r.retries.Load(req.PodName); ok {
+		pod.Annotations[annJobRetries] = strconv.Itoa(int(n.(int32)))
+	}
+	if r.AnnotationOwnerNamespace != "" {
+		pod.Annotations[r.AnnotationOwnerNamespace] = req.Owner.GetNamespace()
+	}
+	pod.Spec.RestartPolicy = corev1.RestartPolicyNever
+	if pod.Spec.ActiveDeadlineSeconds == nil {
+		pod.Spec.ActiveDeadlineSeconds = req.Policy.ActiveDeadlineSeconds
 	}
 
+	logWithNode(log, pod).Info(fmt.Sprintf("Creating %s Pod", req.Name))
+
+	return pod, nil
+}
+
+// completed runs the request's OnCompleted callback with the succeeded Pod and deletes the Pod or Job afterwards.
+func (r *JobReconciler) completed(req JobRequest, log logr.Logger, pod *corev1.Pod, o client.Object) (bool, error) {
+	nameUpper := upperFirst(req.Name)
 	reason := fmt.Sprintf("%sCompleted", nameUpper)
 	msg := fmt.Sprintf("%s Pod completed", nameUpper)
-	logWithNode(podLog, pod).Info(msg)
+	logWithNode(log, pod).Info(msg)
 	r.Recorder.Event(req.Owner, corev1.EventTypeNormal, reason, msg)
+	r.retries.Delete(req.PodName)
 
 	// Run success callback (before Pod deletion in order to prevent the pod from being recreated again during the reconciliation)
-	done, err = req.OnCompleted(pod)
+	done, err := req.OnCompleted(pod)
 	if err != nil || !done {
 		return done, err
 	}
 
 	// Delete pod
-	return DeleteResource(req.Context, r.Client, pod, req.Log)
+	return DeleteResource(req.Context, r.Client, o, req.Log, client.PropagationPolicy(metav1.DeletePropagationBackground))
+}
+
+// failed reports the final failure of a Pod or Job.
+func (r *JobReconciler) failed(req JobRequest, log logr.Logger, pod *corev1.Pod, err error) {
+	nameUpper := upperFirst(req.Name)
+	reason := fmt.Sprintf("%sFailed", nameUpper)
+	msg := fmt.Sprintf("%s Pod failed: %s", nameUpper, err)
+	if pod != nil {
+		log = logWithNode(log, pod)
+	}
+	log.Error(err, msg)
+	r.Recorder.Event(req.Owner, corev1.EventTypeWarning, reason, msg)
+	r.retries.Delete(req.PodName)
+}
+
+func upperFirst(s string) string {
+	return fmt.Sprintf("%s%s", strings.ToUpper(s[0:1]), s[1:])
+}
+
+// checkPending reports a Pod that cannot start and fails it when it exceeded its active deadline while pending.
+func (r *JobReconciler) checkPending(req JobRequest, pod *corev1.Pod, nameUpper string) (failedAt time.Time, err error) {
+	if pod == nil || pod.Status.Phase != corev1.PodPending && pod.Status.Phase != "" {
+		return failedAt, nil
+	}
+	reason := podPendingReason(pod)
+	if err = r.reportPending(req, pod, nameUpper, reason); err != nil {
+		return failedAt, err
+	}
+	deadline := pod.Spec.ActiveDeadlineSeconds
+	if deadline == nil || pod.CreationTimestamp.IsZero() {
+		return failedAt, nil
+	}
+	failedAt = pod.CreationTimestamp.Add(time.Duration(*deadline) * time.Second)
+	if d := time.Until(failedAt); d > 0 {
+		r.requeueAfter(req.Owner, d)
+		return failedAt, nil
+	}
+	if reason == "" {
+		reason = "not started"
+	}
+	return failedAt, errors.Errorf("pod %s exceeded its active deadline while pending: %s", pod.Name, reason)
+}
+
+// reportPending emits an event when the reason a Pod cannot start changed.
+// The reported reason is recorded on the Pod in order to emit the event only once.
+func (r *JobReconciler) reportPending(req JobRequest, pod *corev1.Pod, nameUpper, reason string) error {
+	if pod.Annotations[annPendingReason] == reason {
+		return nil
+	}
+	patch := client.MergeFrom(pod.DeepCopy())
+	if pod.Annotations == nil {
+		pod.Annotations = map[string]string{}
+	}
+	pod.Annotations[annPendingReason] = reason
+	err := r.Client.Patch(req.Context, pod, patch)
+	if err != nil {
+		return errors.Wrap(err, "record pending reason")
+	}
+	if reason != "" {
+		msg := fmt.Sprintf("%s Pod cannot start: %s", nameUpper, reason)
+		r.Recorder.Event(req.Owner, corev1.EventTypeWarning, fmt.Sprintf("%sPending", nameUpper), msg)
+	}
+	return nil
+}
+
+// retry deletes the failed Pod after the backoff in order to recreate it as long as the backoff limit is not exceeded.
+// The retry count is recorded on the recreated Pod.
+func (r *JobReconciler) retry(req JobRequest, pod *corev1.Pod, failedAt time.Time, nameUpper string, cause error) (retrying bool, err error) {
+	limit := int32(defaultBackoffLimit)
+	if req.Policy.BackoffLimit != nil {
+		limit = *req.Policy.BackoffLimit
+	}
+	n := podRetries(pod)
+	if n >= limit {
+		return false, nil
+	}
+	backoff := defaultRetryBackoff
+	if req.Policy.RetryBackoff != nil {
+		backoff = req.Policy.RetryBackoff.Duration
+	}
+	for i := int32(0); i < n && backoff < maxRetryBackoff; i++ {
+		backoff *= 2
+	}
+	if d := time.Until(failedAt.Add(backoff)); d > 0 {
+		r.requeueAfter(req.Owner, d)
+		return true, nil
+	}
+	r.retries.Store(req.PodName, n+1)
+	msg := fmt.Sprintf("%s Pod failed, retrying (%d/%d): %s", nameUpper, n+1, limit, cause)
+	logWithNode(req.Log.WithValues("pod", req.PodName.String()), pod).Info(msg)
+	r.Recorder.Event(req.Owner, corev1.EventTypeWarning, fmt.Sprintf("%sRetrying", nameUpper), msg)
+	_, err = DeleteResource(req.Context, r.Client, pod, req.Log)
+	return true, err
+}
+
+// podRetries returns the retry count that is recorded on the Pod.
+func podRetries(pod *corev1.Pod) int32 {
+	n, _ := strconv.Atoi(pod.Annotations[annJobRetries])
+	return int32(n)
+}
+
+// podFinishedAt returns the time the Pod's last container terminated.
+func podFinishedAt(pod *corev1.Pod) time.Time {
+	t := pod.CreationTimestamp.Time
+	for _, s := range pod.Status.ContainerStatuses {
+		if s.State.Terminated != nil && s.State.Terminated.FinishedAt.After(t) {
+			t = s.State.Terminated.FinishedAt.Time
+		}
+	}
+	return t
+}
+
+// podFailureReason returns the reason the Pod or its containers failed with.
+func podFailureReason(pod *corev1.Pod) string {
+	reasons := []string{}
+	if pod.Status.Reason != "" || pod.Status.Message != "" {
+		reasons = append(reasons, joinReason(pod.Status.Reason, pod.Status.Message))
+	}
+	for _, s := range append(pod.Status.InitContainerStatuses, pod.Status.ContainerStatuses...) {
+		if t := s.State.Terminated; t != nil && t.ExitCode != 0 {
+			reasons = append(reasons, fmt.Sprintf("container %s: %s (exit code %d)", s.Name, joinReason(t.Reason, lastLines(t.Message, failureMessageLines)), t.ExitCode))
+		}
+	}
+	if len(reasons) == 0 {
+		return "unknown reason"
+	}
+	return strings.Join(reasons, "; ")
+}
+
+// podPendingReason returns the reason a pending Pod cannot start or an empty string.
+func podPendingReason(pod *corev1.Pod) string {
+	for _, c := range pod.Status.Conditions {
+		if c.Type == corev1.PodScheduled && c.Status == corev1.ConditionFalse && c.Reason != "" {
+			return joinReason(c.Reason, c.Message)
+		}
+	}
+	for _, s := range append(pod.Status.InitContainerStatuses, pod.Status.ContainerStatuses...) {
+		if w := s.State.Waiting; w != nil && w.Reason != "" && w.Reason != "ContainerCreating" && w.Reason != "PodInitializing" {
+			return fmt.Sprintf("container %s: %s", s.Name, joinReason(w.Reason, w.Message))
+		}
+	}
+	return ""
+}
+
+// lastLines returns the last n lines of the given text.
+func lastLines(text string, n int) string {
+	lines := strings.Split(strings.TrimSpace(text), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n")
+}
+
+func joinReason(reason, message string) string {
+	if reason == "" {
+		return message
+	}
+	if message == "" {
+		return reason
+	}
+	return fmt.Sprintf("%s: %s", reason, message)
 }
 
 func logWithNode(log logr.Logger, pod *corev1.Pod) logr.Logger {
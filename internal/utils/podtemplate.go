@@ -1,14 +1,18 @@
 package utils
 
 import (
+	"context"
 	"fmt"
 	"sort"
+	"strings"
 
 	storageapi "github.com/mgoltzsche/k8storagex/api/v1alpha1"
 	"github.com/mgoltzsche/k8storagex/internal/template"
 	"github.com/pkg/errors"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
 type PodSource struct {
@@ -24,20 +28,101 @@ type ProvisionerParams struct {
 	NodePath              string
 	PersistentVolumeName  string
 	PersistentVolumeClaim types.NamespacedName
+	// Capacity is the requested storage capacity
+	Capacity string
+	// AccessModes are the requested access modes
+	AccessModes []corev1.PersistentVolumeAccessMode
+	// Parameters are the StorageClass parameters
+	Parameters map[string]string
+	// Labels are the PersistentVolumeClaim's labels
+	Labels map[string]string
+	// Annotations are the PersistentVolumeClaim's annotations
+	Annotations map[string]string
 }
 
+// SubstituteProvisionerPlaceholders replaces the STORAGE_* placeholders within the provisioner template.
+// StorageClass parameters and the PVC labels/annotations listed within the provisioner's claimPlaceholders are provided as
+// STORAGE_PARAM_<KEY>, STORAGE_PVC_LABEL_<KEY> and STORAGE_PVC_ANNOTATION_<KEY>
+// with the key upper-cased and non-alphanumeric characters replaced with '_'.
+// Keys that map to the same placeholder are rejected.
+// Since missing values are errors optional ones must be referenced with a default, e.g. ${STORAGE_PARAM_SIZE:-1Gi}.
 func SubstituteProvisionerPlaceholders(tpl *storageapi.StorageProvisioner, p ProvisionerParams) error {
-	values := template.NewSubstitution("provisioner template", map[string]string{
+	values := map[string]string{
 		"STORAGE_NODE_NAME":     p.NodeName,
 		"STORAGE_NODE_PATH":     p.NodePath,
 		"STORAGE_PV_NAME":       p.PersistentVolumeName,
 		"STORAGE_PVC_NAME":      p.PersistentVolumeClaim.Name,
 		"STORAGE_PVC_NAMESPACE": p.PersistentVolumeClaim.Namespace,
-	})
-	err := Substitute(tpl, values)
+	}
+	if p.Capacity != "" {
+		values["STORAGE_CAPACITY"] = p.Capacity
+	}
+	if len(p.AccessModes) > 0 {
+		modes := make([]string, len(p.AccessModes))
+		for i, m := range p.AccessModes {
+			modes[i] = string(m)
+		}
+		values["STORAGE_ACCESS_MODES"] = strings.Join(modes, ",")
+	}
+	var labelKeys, annotationKeys []string
+	if c := tpl.Spec.ClaimPlaceholders; c != nil {
+		labelKeys, annotationKeys = c.Labels, c.Annotations
+	}
+	paramKeys := make([]string, 0, len(p.Parameters))
+	for k := range p.Parameters {
+		paramKeys = append(paramKeys, k)
+	}
+	sort.Strings(paramKeys)
+	err := addPrefixedValues(values, "STORAGE_PARAM_", p.Parameters, paramKeys)
+	if err == nil {
+		err = addPrefixedValues(values, "STORAGE_PVC_LABEL_", p.Labels, labelKeys)
+	}
+	if err == nil {
+		err = addPrefixedValues(values, "STORAGE_PVC_ANNOTATION_", p.Annotations, annotationKeys)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "provisioner template %s", tpl.Name)
+	}
+	subst := template.NewSubstitution("provisioner template", values)
+	if tpl.Spec.TemplateMode == storageapi.TemplateModeGoTemplate {
+		subst = template.NewGoTemplateSubstitution("provisioner template", values)
+	}
+	err = Substitute(tpl, subst)
 	return errors.Wrapf(err, "invalid provisioner template %s", tpl.Name)
 }
 
+// addPrefixedValues adds the values of the given keys.
+// Returns an error if keys map to the same placeholder.
+func addPrefixedValues(values map[string]string, prefix string, m map[string]string, keys []string) error {
+	origKeys := map[string]string{}
+	for _, k := range keys {
+		v, ok := m[k]
+		if !ok {
+			continue
+		}
+		placeholder := prefix + PlaceholderKey(k)
+		if other, ok := origKeys[placeholder]; ok && other != k {
+			return errors.Errorf("keys %q and %q map to the same placeholder %s", other, k, placeholder)
+		}
+		origKeys[placeholder] = k
+		values[placeholder] = v
+	}
+	return nil
+}
+
+// PlaceholderKey converts a key into a valid placeholder name suffix
+func PlaceholderKey(key string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' {
+			return r - 'a' + 'A'
+		}
+		if r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '_'
+	}, key)
+}
+
 func NewProvisionerPod(src PodSource) (*corev1.Pod, error) {
 	/*parentHostDir := filepath.Clean(filepath.Dir(src.VolumeHostPath))
 	if parentHostDir == "" || parentHostDir == "." || parentHostDir == "/" {
@@ -60,6 +145,10 @@ func NewProvisionerPod(src PodSource) (*corev1.Pod, error) {
 	if container.Command != nil {
 		c.Command = container.Command
 	}
+	if c.TerminationMessagePolicy == "" {
+		// Expose the log tail of a failed Pod
+		c.TerminationMessagePolicy = corev1.TerminationMessageFallbackToLogsOnError
+	}
 	if c.Image == "" {
 		return nil, fmt.Errorf("provisioner %s pod template does not specify an image for the %s container", src.SubstitutedProvisioner.Name, containerName)
 	}
@@ -72,6 +161,79 @@ func NewProvisionerPod(src PodSource) (*corev1.Pod, error) {
 	return p, nil
 }
 
+// ProvisionerEnv returns the env vars the provisioner Pod's main container would be run with.
+// References to Secrets, ConfigMaps and the Pod's fields are resolved within the Pod's namespace.
+func ProvisionerEnv(ctx context.Context, c client.Reader, src PodSource) (map[string]string, error) {
+	pod, err := NewProvisionerPod(src)
+	if err != nil {
+		return nil, err
+	}
+	main := findContainer(pod.Spec.Containers, "main")
+	env := make(map[string]string, len(main.Env))
+	for _, e := range main.Env {
+		if e.ValueFrom == nil {
+			env[e.Name] = e.Value
+			continue
+		}
+		v, found, err := resolveEnvVarSource(ctx, c, pod, e.ValueFrom)
+		if err != nil {
+			return nil, errors.Wrapf(err, "resolve env var %s", e.Name)
+		}
+		if found {
+			env[e.Name] = v
+		}
+	}
+	return env, nil
+}
+
+func resolveEnvVarSource(ctx context.Context, c client.Reader, pod *corev1.Pod, src *corev1.EnvVarSource) (value string, found bool, err error) {
+	switch {
+	case src.FieldRef != nil:
+		switch src.FieldRef.FieldPath {
+		case "metadata.name":
+			return pod.Name, true, nil
+		case "metadata.namespace":
+			return pod.Namespace, true, nil
+		case "spec.nodeName":
+			return pod.Spec.NodeName, true, nil
+		case "spec.serviceAccountName":
+			return pod.Spec.ServiceAccountName, true, nil
+		}
+		return "", false, errors.Errorf("unsupported fieldRef %s", src.FieldRef.FieldPath)
+	case src.SecretKeyRef != nil:
+		ref := src.SecretKeyRef
+		secret := &corev1.Secret{}
+		err = c.Get(ctx, types.NamespacedName{Name: ref.Name, Namespace: pod.Namespace}, secret)
+		if err != nil {
+			if apierrors.IsNotFound(err) && ref.Optional != nil && *ref.Optional {
+				return "", false, nil
+			}
+			return "", false, errors.Wrap(err, "get secret")
+		}
+		v, ok := secret.Data[ref.Key]
+		if !ok && (ref.Optional == nil || !*ref.Optional) {
+			return "", false, errors.Errorf("secret %s does not contain key %s", ref.Name, ref.Key)
+		}
+		return string(v), ok, nil
+	case src.ConfigMapKeyRef != nil:
+		ref := src.ConfigMapKeyRef
+		cm := &corev1.ConfigMap{}
+		err = c.Get(ctx, types.NamespacedName{Name: ref.Name, Namespace: pod.Namespace}, cm)
+		if err != nil {
+			if apierrors.IsNotFound(err) && ref.Optional != nil && *ref.Optional {
+				return "", false, nil
+			}
+			return "", false, errors.Wrap(err, "get configmap")
+		}
+		v, ok := cm.Data[ref.Key]
+		if !ok && (ref.Optional == nil || !*ref.Optional) {
+			return "", false, errors.Errorf("configmap %s does not contain key %s", ref.Name, ref.Key)
+		}
+		return v, ok, nil
+	}
+	return "", false, errors.New("unsupported valueFrom")
+}
+
 type ContainerParams struct {
 	Command []string
 	Env     []corev1.EnvVar
@@ -0,0 +1,60 @@
+package utils
+
+import (
+	"testing"
+
+	storageapi "github.com/mgoltzsche/k8storagex/api/v1alpha1"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func newTestProvisioner(cmd ...string) *storageapi.StorageProvisioner {
+	p := &storageapi.StorageProvisioner{}
+	p.Name = "test-provisioner"
+	p.Spec.Containers.Provisioner = storageapi.ProvisionerContainer{Command: cmd}
+	return p
+}
+
+func TestSubstituteProvisionerPlaceholders(t *testing.T) {
+	p := newTestProvisioner("${STORAGE_PARAM_MODE}", "${STORAGE_PVC_LABEL_APP}", "${STORAGE_PVC_ANNOTATION_EXAMPLE_ORG_SIZE}", "${STORAGE_CAPACITY}", "${STORAGE_ACCESS_MODES}")
+	p.Spec.ClaimPlaceholders = &storageapi.ClaimPlaceholders{
+		Labels:      []string{"app"},
+		Annotations: []string{"example.org/size"},
+	}
+	err := SubstituteProvisionerPlaceholders(p, ProvisionerParams{
+		Capacity:    "1Gi",
+		AccessModes: []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+		Parameters:  map[string]string{"mode": "0755"},
+		Labels:      map[string]string{"app": "myapp", "other": "x"},
+		Annotations: map[string]string{"example.org/size": "${STORAGE_PVC_LABEL_OTHER}"},
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"0755", "myapp", "${STORAGE_PVC_LABEL_OTHER}", "1Gi", "ReadWriteOnce"}, p.Spec.Containers.Provisioner.Command)
+}
+
+func TestSubstituteProvisionerPlaceholdersOmitsUnlistedClaimMetadata(t *testing.T) {
+	for _, placeholder := range []string{"${STORAGE_PVC_LABEL_APP}", "${STORAGE_PVC_ANNOTATION_APP}"} {
+		p := newTestProvisioner(placeholder)
+		err := SubstituteProvisionerPlaceholders(p, ProvisionerParams{
+			Labels:      map[string]string{"app": "myapp"},
+			Annotations: map[string]string{"app": "myapp"},
+		})
+		require.Error(t, err, placeholder)
+	}
+}
+
+func TestSubstituteProvisionerPlaceholdersRejectsCollidingKeys(t *testing.T) {
+	p := newTestProvisioner("${STORAGE_PARAM_A_B:-}")
+	err := SubstituteProvisionerPlaceholders(p, ProvisionerParams{
+		Parameters: map[string]string{"a-b": "x", "a.b": "y"},
+	})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "STORAGE_PARAM_A_B")
+
+	p = newTestProvisioner("${STORAGE_PVC_ANNOTATION_A_B:-}")
+	p.Spec.ClaimPlaceholders = &storageapi.ClaimPlaceholders{Annotations: []string{"a/b", "a.b"}}
+	err = SubstituteProvisionerPlaceholders(p, ProvisionerParams{
+		Annotations: map[string]string{"a/b": "x", "a.b": "y"},
+	})
+	require.Error(t, err, "colliding annotations")
+}